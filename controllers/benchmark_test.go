@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	authz "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// benchmarkFlow is the OAuth service set up with the canary service provider, so that the whole flow can be run in
+// the benchmarks without any external dependencies.
+type benchmarkFlow struct {
+	router  http.Handler
+	state   string
+	baseUrl string
+}
+
+func newBenchmarkFlow(b *testing.B) *benchmarkFlow {
+	b.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := api.AddToScheme(scheme); err != nil {
+		b.Fatal(err)
+	}
+	if err := authz.AddToScheme(scheme); err != nil {
+		b.Fatal(err)
+	}
+	cl := allowingClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "canary", Namespace: "default"},
+	}).Build()}
+
+	flow := &benchmarkFlow{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flow.router.ServeHTTP(w, r)
+	}))
+	b.Cleanup(server.Close)
+
+	storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+		return nil
+	}}
+
+	sessionManager := scs.New()
+	cfg := OAuthServiceConfiguration{SharedConfiguration: config.SharedConfiguration{BaseUrl: server.URL, SharedSecret: []byte("secret")}}
+	controller, err := FromConfiguration(cfg, CanaryServiceProviderConfiguration(server.URL, "client-secret"),
+		auth.NewAuthenticator(sessionManager, cl), NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits), nil, nil, cl, storage, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	RegisterRoutes(r, []Route{
+		{Path: CanaryProviderPath + "/token", Handler: http.HandlerFunc(CanaryTokenHandler("client-secret"))},
+		{Path: "/canary/authenticate", Handler: http.HandlerFunc(controller.Authenticate), Middleware: []Middleware{sessionManager.LoadAndSave}},
+		{Path: "/canary/callback", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			controller.Callback(r.Context(), w, r)
+		}), Middleware: []Middleware{sessionManager.LoadAndSave}},
+	})
+	flow.router = r
+	flow.baseUrl = server.URL
+
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	flow.state, err = codec.Encode(&oauthstate.AnonymousOAuthState{
+		TokenName:           "canary",
+		TokenNamespace:      "default",
+		IssuedAt:            time.Now().Unix(),
+		ServiceProviderType: CanaryServiceProviderType,
+		ServiceProviderUrl:  server.URL + CanaryProviderPath,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return flow
+}
+
+// authenticate runs the authenticate endpoint and returns the session cookies and the veiled state the flow continues
+// with.
+func (f *benchmarkFlow) authenticate(b *testing.B) ([]*http.Cookie, string) {
+	query := url.Values{}
+	query.Set("state", f.state)
+	query.Set("k8s_token", "k8s-token")
+	req := httptest.NewRequest("GET", "/canary/authenticate?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+	f.router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		b.Fatalf("authenticate responded with %d", rr.Code)
+	}
+
+	body := rr.Body.String()
+	start := strings.Index(body, "state=")
+	if start < 0 {
+		b.Fatal("no state in the authenticate response")
+	}
+	start += len("state=")
+	end := strings.IndexAny(body[start:], "&\"'<> ")
+	veil, err := url.QueryUnescape(html.UnescapeString(body[start : start+end]))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return rr.Result().Cookies(), veil
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	flow := newBenchmarkFlow(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		flow.authenticate(b)
+	}
+}
+
+func BenchmarkCallback(b *testing.B) {
+	flow := newBenchmarkFlow(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cookies, veil := flow.authenticate(b)
+		req := httptest.NewRequest("GET", flow.baseUrl+"/canary/callback?code="+canaryCodePrefix+"code&state="+url.QueryEscape(veil), nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		b.StartTimer()
+
+		flow.router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusFound {
+			b.Fatalf("callback responded with %d", rr.Code)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// CachingTokenStorage is a wrapper around TokenStorage that caches the tokens read from the wrapped storage for a short
+// time so that the endpoints polled by the dashboards don't hammer Vault. The cached token is invalidated when it is
+// stored or deleted through this storage. The changes made by other replicas of the service are only visible once
+// the cached token expires, so the TTL should be kept short.
+type CachingTokenStorage struct {
+	// TokenStorage is the token storage to delegate the actual storage operations to.
+	TokenStorage tokenstorage.TokenStorage
+
+	// TTL is how long the tokens are cached.
+	TTL time.Duration
+
+	lock    sync.Mutex
+	entries map[cacheKey]cachedToken
+	// invalidations counts the invalidations of the cached tokens so that Get doesn't cache a token that was stored or
+	// deleted while it was being read from the wrapped storage.
+	invalidations uint64
+}
+
+// cacheKey identifies the cached token. The UID makes sure that a token of a re-created SPIAccessToken is not served
+// from the cache. The cluster is the KCP workspace of the token, if any.
+type cacheKey struct {
+	types.NamespacedName
+	uid     types.UID
+	cluster logicalcluster.Name
+}
+
+type cachedToken struct {
+	token   *api.Token
+	expires time.Time
+}
+
+var _ tokenstorage.TokenStorage = (*CachingTokenStorage)(nil)
+
+// NewCachingTokenStorage returns a new caching token storage caching the tokens of the provided storage for the given
+// time.
+func NewCachingTokenStorage(storage tokenstorage.TokenStorage, ttl time.Duration) *CachingTokenStorage {
+	return &CachingTokenStorage{
+		TokenStorage: storage,
+		TTL:          ttl,
+		entries:      map[cacheKey]cachedToken{},
+	}
+}
+
+func keyOf(ctx context.Context, owner *api.SPIAccessToken) cacheKey {
+	cluster, _ := logicalcluster.ClusterFromContext(ctx)
+	return cacheKey{NamespacedName: types.NamespacedName{Namespace: owner.Namespace, Name: owner.Name}, uid: owner.UID, cluster: cluster}
+}
+
+func (c *CachingTokenStorage) Store(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	// invalidate even if the storage fails because we don't know what state it ended up in
+	defer c.invalidate(ctx, owner)
+	if err := c.TokenStorage.Store(ctx, owner, token); err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return nil
+}
+
+func (c *CachingTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	key := keyOf(ctx, owner)
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	invalidations := c.invalidations
+	c.lock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		tokenStorageCacheLookupsCounter.WithLabelValues("hit").Inc()
+		return entry.token.DeepCopy(), nil
+	}
+	tokenStorageCacheLookupsCounter.WithLabelValues("miss").Inc()
+
+	token, err := c.TokenStorage.Get(ctx, owner)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped storage error: %w", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.purgeExpired()
+	if invalidations == c.invalidations {
+		c.entries[key] = cachedToken{token: token.DeepCopy(), expires: time.Now().Add(c.TTL)}
+	}
+	return token, nil
+}
+
+func (c *CachingTokenStorage) Delete(ctx context.Context, owner *api.SPIAccessToken) error {
+	defer c.invalidate(ctx, owner)
+	if err := c.TokenStorage.Delete(ctx, owner); err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return nil
+}
+
+// invalidate removes the token of the owner from the cache.
+func (c *CachingTokenStorage) invalidate(ctx context.Context, owner *api.SPIAccessToken) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.invalidations++
+	delete(c.entries, keyOf(ctx, owner))
+}
+
+// purgeExpired removes the expired tokens from the cache so that it doesn't grow indefinitely. It needs to be called
+// with the lock held.
+func (c *CachingTokenStorage) purgeExpired() {
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCachingTokenStorage(t *testing.T) {
+	gets := 0
+	stored := &api.Token{AccessToken: "first"}
+	storage := tokenstorage.TestTokenStorage{
+		GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+			gets++
+			return stored.DeepCopy(), nil
+		},
+		StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			stored = token
+			return nil
+		},
+	}
+	owner := &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default", UID: "1"}}
+
+	t.Run("caches reads", func(t *testing.T) {
+		gets = 0
+		cache := NewCachingTokenStorage(storage, time.Minute)
+
+		token, err := cache.Get(context.TODO(), owner)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", token.AccessToken)
+
+		// modifying the returned token doesn't affect the cache
+		token.AccessToken = "modified"
+		token, err = cache.Get(context.TODO(), owner)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", token.AccessToken)
+		assert.Equal(t, 1, gets)
+
+		// re-created SPIAccessToken is not served from the cache
+		_, err = cache.Get(context.TODO(), &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default", UID: "2"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, gets)
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		gets = 0
+		cache := NewCachingTokenStorage(storage, time.Millisecond)
+
+		_, _ = cache.Get(context.TODO(), owner)
+		time.Sleep(5 * time.Millisecond)
+		_, _ = cache.Get(context.TODO(), owner)
+		assert.Equal(t, 2, gets)
+	})
+
+	t.Run("invalidates on store and delete", func(t *testing.T) {
+		gets = 0
+		cache := NewCachingTokenStorage(storage, time.Minute)
+
+		_, _ = cache.Get(context.TODO(), owner)
+		assert.NoError(t, cache.Store(context.TODO(), owner, &api.Token{AccessToken: "second"}))
+		token, err := cache.Get(context.TODO(), owner)
+		assert.NoError(t, err)
+		assert.Equal(t, "second", token.AccessToken)
+		assert.Equal(t, 2, gets)
+
+		assert.NoError(t, cache.Delete(context.TODO(), owner))
+		_, _ = cache.Get(context.TODO(), owner)
+		assert.Equal(t, 3, gets)
+	})
+
+	t.Run("doesn't cache token changed during the read", func(t *testing.T) {
+		var cache *CachingTokenStorage
+		cache = NewCachingTokenStorage(tokenstorage.TestTokenStorage{
+			GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+				read := stored.DeepCopy()
+				// another request stores a new token before this read finishes
+				assert.NoError(t, cache.Store(ctx, owner, &api.Token{AccessToken: "concurrent"}))
+				return read, nil
+			},
+			StoreImpl: storage.StoreImpl,
+		}, time.Minute)
+
+		stored = &api.Token{AccessToken: "first"}
+		_, err := cache.Get(context.TODO(), owner)
+		assert.NoError(t, err)
+		assert.Empty(t, cache.entries)
+	})
+
+	t.Run("doesn't cache errors", func(t *testing.T) {
+		failures := 0
+		cache := NewCachingTokenStorage(tokenstorage.TestTokenStorage{
+			GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+				failures++
+				return nil, errors.New("vault down")
+			},
+		}, time.Minute)
+
+		_, err := cache.Get(context.TODO(), owner)
+		assert.Error(t, err)
+		_, err = cache.Get(context.TODO(), owner)
+		assert.Error(t, err)
+		assert.Equal(t, 2, failures)
+	})
+}
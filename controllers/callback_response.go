@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// callbackFormatQueryParameter is the query parameter using which the API clients can explicitly ask for the JSON
+	// responses from the callback when they cannot set the Accept header.
+	callbackFormatQueryParameter = "format"
+	callbackFormatJson           = "json"
+
+	callbackResultSuccess = "success"
+	callbackResultError   = "error"
+)
+
+// callbackResult is the response of the callback in the JSON mode. Some automation treats the redirects as failures
+// so, in the JSON mode, the callback responds with the redirect target in the body instead.
+type callbackResult struct {
+	Result      string `json:"result"`
+	RedirectUrl string `json:"redirectUrl,omitempty"`
+	Message     string `json:"message,omitempty"`
+	// ErrorKind is the stable name of the kind of the failure, see spierrors.Kind. The details of the failure are only
+	// logged.
+	ErrorKind string `json:"errorKind,omitempty"`
+}
+
+// isJsonMode tells whether the client negotiated the JSON responses from the callback either by accepting
+// the application/json media type or by the explicit format query parameter.
+func isJsonMode(r *http.Request) bool {
+	if r.URL.Query().Get(callbackFormatQueryParameter) == callbackFormatJson {
+		return true
+	}
+
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeCallbackResult writes the result of the callback as JSON with the provided status code.
+func writeCallbackResult(ctx context.Context, w http.ResponseWriter, status int, result callbackResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.FromContext(ctx).Error(err, "error recording the callback result")
+	}
+}
+
+// redirectAfterCallback redirects the client to the location, or, in the JSON mode, responds with 200 and
+// the location in the body.
+func redirectAfterCallback(w http.ResponseWriter, r *http.Request, location string) {
+	if isJsonMode(r) {
+		writeCallbackResult(r.Context(), w, http.StatusOK, callbackResult{Result: callbackResultSuccess, RedirectUrl: location})
+		return
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// logErrorAndWriteCallbackResponse is the logging.LogErrorAndWriteResponse for the callback that responds with JSON in the JSON
+// mode. The JSON only contains the message and the kind of the error, the error itself may contain internal details.
+func logErrorAndWriteCallbackResponse(w http.ResponseWriter, r *http.Request, status int, msg string, err error) {
+	if !isJsonMode(r) {
+		logging.LogErrorAndWriteResponse(r.Context(), w, status, msg, err)
+		return
+	}
+	log.FromContext(r.Context()).Error(err, msg)
+	writeCallbackResult(r.Context(), w, status, callbackResult{Result: callbackResultError, Message: msg, ErrorKind: spierrors.Kind(err)})
+}
+
+// renderCallbackErrorPage is the renderErrorPage for the callback that responds with JSON in the JSON mode.
+func renderCallbackErrorPage(w http.ResponseWriter, r *http.Request, status int, data viewData) {
+	if !isJsonMode(r) {
+		renderErrorPage(r.Context(), w, status, data)
+		return
+	}
+	writeCallbackResult(r.Context(), w, status, callbackResult{Result: callbackResultError, Message: fmt.Sprintf("%s: %s", data.Title, data.Message)})
+}
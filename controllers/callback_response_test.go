@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsJsonMode(t *testing.T) {
+	test := func(url string, accept string) bool {
+		req := httptest.NewRequest("GET", url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return isJsonMode(req)
+	}
+
+	assert.False(t, test("/github/callback", ""))
+	assert.False(t, test("/github/callback", "text/html,application/xhtml+xml,*/*;q=0.8"))
+	assert.False(t, test("/github/callback?format=html", ""))
+	assert.True(t, test("/github/callback", "application/json"))
+	assert.True(t, test("/github/callback", "text/plain, application/json; q=0.9"))
+	assert.True(t, test("/github/callback?format=json", ""))
+}
+
+func TestRedirectAfterCallback(t *testing.T) {
+	t.Run("redirects", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		redirectAfterCallback(rr, httptest.NewRequest("GET", "/github/callback", nil), "https://spi/callback_success")
+		assert.Equal(t, http.StatusFound, rr.Code)
+		assert.Equal(t, "https://spi/callback_success", rr.Header().Get("Location"))
+	})
+
+	t.Run("responds with JSON in JSON mode", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		redirectAfterCallback(rr, httptest.NewRequest("GET", "/github/callback?format=json", nil), "https://spi/callback_success")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		assert.Empty(t, rr.Header().Get("Location"))
+
+		result := callbackResult{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		assert.Equal(t, callbackResult{Result: callbackResultSuccess, RedirectUrl: "https://spi/callback_success"}, result)
+	})
+}
+
+func TestLogErrorAndWriteCallbackResponseJsonMode(t *testing.T) {
+	rr := httptest.NewRecorder()
+	err := fmt.Errorf("failed to persist the token to storage: %w", spierrors.WithKind(spierrors.StorageUnavailable, errors.New("vault at 10.0.0.5:8200 is sealed")))
+	logErrorAndWriteCallbackResponse(rr, httptest.NewRequest("GET", "/github/callback?format=json", nil), http.StatusServiceUnavailable, "failed to store token data to cluster", err)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "10.0.0.5")
+	result := callbackResult{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, callbackResult{Result: callbackResultError, Message: "failed to store token data to cluster", ErrorKind: "storage_unavailable"}, result)
+}
+
+func TestCallbackErrorHandlerJsonMode(t *testing.T) {
+	req := httptest.NewRequest("GET", "/github/callback?error=access_denied&error_description=denied", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+
+	sessionManager := scs.New()
+	sessionManager.LoadAndSave(http.HandlerFunc(CallbackErrorHandler(NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits), "https://spi.acme.com", []byte("secret")))).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	result := callbackResult{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, callbackResult{Result: callbackResultError, Message: "access_denied: denied"}, result)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// callbackHostsExtraKey is the key in the extra configuration of the service provider specifying the comma-separated
+// hosts, other than the host of the base URL of the service, on which the callback from the service provider can be
+// received. A host without a port matches any port.
+const callbackHostsExtraKey = "callbackHosts"
+
+var (
+	invalidBaseUrlError         = errors.New("invalid base URL")
+	invalidCallbackHostError    = errors.New("invalid callback host")
+	unexpectedCallbackHostError = errors.New("the callback was received on an unexpected host")
+)
+
+// CallbackHosts returns the hosts on which the callback of the service provider can be received, i.e. the host of
+// the base URL of the service and the hosts configured for the service provider. The callbacks with the other
+// Host headers are rejected so that the spoofed Host header can't influence the flow. No restriction is applied if
+// the returned list is empty, i.e. when neither the base URL nor the callback hosts are configured.
+func CallbackHosts(baseUrl string, spConfig config.ServiceProviderConfiguration) ([]string, error) {
+	var hosts []string
+	if baseUrl != "" {
+		u, err := url.Parse(baseUrl)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%w '%s': it must be an absolute URL", invalidBaseUrlError, baseUrl)
+		}
+		hosts = append(hosts, strings.ToLower(u.Host))
+	}
+
+	if extra := spConfig.Extra[callbackHostsExtraKey]; extra != "" {
+		for _, host := range strings.Split(extra, ",") {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if u, err := url.Parse("//" + host); err != nil || host == "" || u.Host != host {
+				return nil, fmt.Errorf("%w '%s' configured for service provider %s", invalidCallbackHostError, host, spConfig.ServiceProviderType)
+			}
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts, nil
+}
+
+// isAllowedHost checks that the host, as found in the Host header of the request, is one of the allowed hosts. All
+// the hosts are allowed if the allowed list is empty.
+func isAllowedHost(allowed []string, host string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	for _, a := range allowed {
+		if a == host {
+			return true
+		}
+		// the allowed host without the port matches any port
+		if _, _, err := net.SplitHostPort(a); err != nil && a == hostname {
+			return true
+		}
+	}
+	return false
+}
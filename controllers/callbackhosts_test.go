@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbackHosts(t *testing.T) {
+	spConfig := func(callbackHosts string) config.ServiceProviderConfiguration {
+		cfg := config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub}
+		if callbackHosts != "" {
+			cfg.Extra = map[string]string{callbackHostsExtraKey: callbackHosts}
+		}
+		return cfg
+	}
+
+	t.Run("host of the base URL", func(t *testing.T) {
+		hosts, err := CallbackHosts("https://SPI.example.com/oauth", spConfig(""))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"spi.example.com"}, hosts)
+	})
+
+	t.Run("configured hosts", func(t *testing.T) {
+		hosts, err := CallbackHosts("https://spi.example.com", spConfig("spi-internal:8000, spi.other.com"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"spi.example.com", "spi-internal:8000", "spi.other.com"}, hosts)
+	})
+
+	t.Run("no restriction without base URL", func(t *testing.T) {
+		hosts, err := CallbackHosts("", spConfig(""))
+		assert.NoError(t, err)
+		assert.Empty(t, hosts)
+	})
+
+	t.Run("invalid base URL", func(t *testing.T) {
+		_, err := CallbackHosts("spi.example.com/oauth", spConfig(""))
+		assert.True(t, errors.Is(err, invalidBaseUrlError))
+	})
+
+	t.Run("invalid configured hosts", func(t *testing.T) {
+		for _, hosts := range []string{"https://spi.example.com", "spi.example.com/callback", "spi.example.com,", "user@spi.example.com"} {
+			_, err := CallbackHosts("https://spi.example.com", spConfig(hosts))
+			assert.True(t, errors.Is(err, invalidCallbackHostError), hosts)
+		}
+	})
+
+	t.Run("validated when creating the controller", func(t *testing.T) {
+		_, err := FromConfiguration(OAuthServiceConfiguration{}, spConfig("spi.example.com/callback"), nil, nil, nil, nil, nil, nil, nil)
+		assert.True(t, errors.Is(err, invalidCallbackHostError))
+	})
+}
+
+func TestIsAllowedHost(t *testing.T) {
+	allowed := []string{"spi.example.com", "spi-internal:8000"}
+
+	assert.True(t, isAllowedHost(allowed, "spi.example.com"))
+	assert.True(t, isAllowedHost(allowed, "SPI.example.com:443"))
+	assert.True(t, isAllowedHost(allowed, "spi-internal:8000"))
+	assert.False(t, isAllowedHost(allowed, "spi-internal:8001"))
+	assert.False(t, isAllowedHost(allowed, "spi-internal"))
+	assert.False(t, isAllowedHost(allowed, "evil.example.com"))
+	assert.False(t, isAllowedHost(allowed, ""))
+	assert.True(t, isAllowedHost(nil, "evil.example.com"))
+}
+
+func TestCallbackRejectsUnexpectedHost(t *testing.T) {
+	controller := &commonController{CallbackHosts: []string{"spi.example.com"}}
+
+	rr := httptest.NewRecorder()
+	controller.Callback(context.TODO(), rr, httptest.NewRequest("GET", "https://evil.example.com/github/callback?code=code&state=state", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), unexpectedCallbackHostError.Error())
+}
+
+func TestWithAllowedHosts(t *testing.T) {
+	handler := WithAllowedHosts([]string{"spi.example.com"})(http.HandlerFunc(OkHandler))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "https://spi.example.com/github/callback?error=denied", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "https://evil.example.com/github/callback?error=denied", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"golang.org/x/oauth2"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// CanaryServiceProviderType is the type of the built-in fake service provider used by the canary probe.
+	CanaryServiceProviderType config.ServiceProviderType = "Canary"
+	// CanaryProviderPath is the path on which the routes of the fake service provider are registered.
+	CanaryProviderPath = "/canary/provider"
+	// CanaryClientId is the client ID of the OAuth application in the fake service provider.
+	CanaryClientId = "spi-canary"
+
+	canaryCodePrefix = "canary-"
+	// canaryProbeTimeout limits the duration of a single request of the canary probe.
+	canaryProbeTimeout = 30 * time.Second
+	// canaryMaxBodySize limits the size of the response bodies read by the canary probe.
+	canaryMaxBodySize = 1024 * 1024
+)
+
+var (
+	canaryUnexpectedResponseError = errors.New("unexpected response in the canary flow")
+	canaryNoAuthUrlError          = errors.New("no URL of the canary provider found in the authenticate response")
+	canaryInvalidClientError      = errors.New("invalid client credentials")
+	canaryInvalidCodeError        = errors.New("invalid authorization code")
+	canaryInvalidRedirectUriError = errors.New("the redirect_uri is not the canary callback of the service")
+)
+
+// canaryEndpoint returns the OAuth endpoints of the fake service provider served at the base URL.
+func canaryEndpoint(baseUrl string) oauth2.Endpoint {
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	return oauth2.Endpoint{
+		AuthURL:   baseUrl + "/authorize",
+		TokenURL:  baseUrl + "/token",
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+}
+
+// CanaryServiceProviderConfiguration returns the configuration of the fake service provider served by this service at
+// the serviceUrl. The provider only accepts the provided client secret.
+func CanaryServiceProviderConfiguration(serviceUrl string, clientSecret string) config.ServiceProviderConfiguration {
+	spConfig := config.ServiceProviderConfiguration{
+		ClientId:               CanaryClientId,
+		ClientSecret:           clientSecret,
+		ServiceProviderType:    CanaryServiceProviderType,
+		ServiceProviderBaseUrl: strings.TrimSuffix(serviceUrl, "/") + CanaryProviderPath,
+	}
+	// the probe finishes the flow on the internal URL of the service
+	if u, err := url.Parse(serviceUrl); err == nil && u.Host != "" {
+		spConfig.Extra = map[string]string{callbackHostsExtraKey: u.Host}
+	}
+	return spConfig
+}
+
+// CanaryAuthorizeHandler returns the authorization endpoint of the fake service provider. It immediately redirects back
+// to the redirect URI with a new authorization code, as if the user authorized the access. Only the canary callbacks
+// of the service at the provided base URLs are accepted as the redirect URI, so that the endpoint cannot be used to
+// redirect the users anywhere else.
+func CanaryAuthorizeHandler(baseUrls ...string) func(http.ResponseWriter, *http.Request) {
+	callbackUrls := make([]string, 0, len(baseUrls))
+	for _, baseUrl := range baseUrls {
+		if baseUrl != "" {
+			callbackUrls = append(callbackUrls, canaryCallbackUrl(baseUrl))
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		redirectUri, err := url.Parse(r.FormValue("redirect_uri"))
+		if err != nil || redirectUri.String() == "" {
+			logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusBadRequest, "invalid redirect_uri")
+			return
+		}
+		if !isCanaryCallbackUrl(callbackUrls, redirectUri) {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "invalid redirect_uri", canaryInvalidRedirectUriError)
+			return
+		}
+
+		code, err := NewVeil(MinVeilEntropyBits)
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to generate the authorization code", err)
+			return
+		}
+
+		query := redirectUri.Query()
+		query.Set("code", canaryCodePrefix+code)
+		query.Set("state", r.FormValue("state"))
+		redirectUri.RawQuery = query.Encode()
+		http.Redirect(w, r, redirectUri.String(), http.StatusFound)
+	}
+}
+
+// canaryCallbackUrl returns the URL of the callback of the canary flow of the service at the base URL.
+func canaryCallbackUrl(baseUrl string) string {
+	return strings.TrimSuffix(baseUrl, "/") + "/" + strings.ToLower(string(CanaryServiceProviderType)) + "/callback"
+}
+
+// isCanaryCallbackUrl checks whether the redirect URI, without its query, is one of the canary callback URLs.
+func isCanaryCallbackUrl(callbackUrls []string, redirectUri *url.URL) bool {
+	if redirectUri.User != nil || redirectUri.Fragment != "" {
+		return false
+	}
+	withoutQuery := *redirectUri
+	withoutQuery.RawQuery = ""
+	withoutQuery.ForceQuery = false
+	for _, callbackUrl := range callbackUrls {
+		if withoutQuery.String() == callbackUrl {
+			return true
+		}
+	}
+	return false
+}
+
+// CanaryTokenHandler returns the token endpoint of the fake service provider. It issues a fake access token for any
+// code issued by the CanaryAuthorizeHandler to the client authenticated with the provided client secret.
+func CanaryTokenHandler(clientSecret string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != CanaryClientId || subtle.ConstantTimeCompare([]byte(r.FormValue("client_secret")), []byte(clientSecret)) != 1 {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed to authenticate the client", canaryInvalidClientError)
+			return
+		}
+		if !strings.HasPrefix(r.FormValue("code"), canaryCodePrefix) {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to exchange the code", canaryInvalidCodeError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "canary-token",
+			"token_type":   "bearer",
+			"expires_in":   3600,
+		}); err != nil {
+			log.FromContext(r.Context()).Error(err, "error writing the canary token to the response")
+		}
+	}
+}
+
+// CanaryProbe runs the whole OAuth flow against the fake service provider through the HTTP endpoints of the service,
+// storing the obtained token in the configured SPIAccessToken. This verifies that the OAuth flow works end to end.
+type CanaryProbe struct {
+	// ServiceUrl is the URL on which the probe can reach the service, e.g. http://localhost:8000.
+	ServiceUrl string
+	// TokenNamespace and TokenName identify the SPIAccessToken the probe stores the token into.
+	TokenNamespace string
+	TokenName      string
+	// K8sTokenFilePath is the path to the Kubernetes token the probe authenticates with. It is read for each run so
+	// that the rotated tokens are picked up.
+	K8sTokenFilePath string
+	// JwtSigningSecret is the secret used to sign the OAuth state of the probe.
+	JwtSigningSecret []byte
+}
+
+// Start runs the probe with the given interval until the context is cancelled. The results are exposed in the metrics.
+func (p *CanaryProbe) Start(ctx context.Context, interval time.Duration) {
+	lg := log.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Run(ctx); err != nil {
+				lg.Error(err, "the canary OAuth flow failed")
+				canarySuccessGauge.Set(0)
+			} else {
+				lg.V(logs.DebugLevel).Info("the canary OAuth flow succeeded")
+				canarySuccessGauge.Set(1)
+			}
+			canaryLastRunGauge.SetToCurrentTime()
+		}
+	}
+}
+
+// Run runs the OAuth flow once.
+func (p *CanaryProbe) Run(ctx context.Context) error {
+	k8sToken, err := ioutil.ReadFile(p.K8sTokenFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read the Kubernetes token of the canary: %w", err)
+	}
+
+	codec, err := oauthstate.NewCodec(p.JwtSigningSecret)
+	if err != nil {
+		return fmt.Errorf("failed to create JWT codec: %w", err)
+	}
+	state, err := codec.Encode(&exchangeState{
+		AnonymousOAuthState: oauthstate.AnonymousOAuthState{
+			TokenName:           p.TokenName,
+			TokenNamespace:      p.TokenNamespace,
+			IssuedAt:            time.Now().Unix(),
+			ServiceProviderType: CanaryServiceProviderType,
+			ServiceProviderUrl:  strings.TrimSuffix(p.ServiceUrl, "/") + CanaryProviderPath,
+		},
+		Initiator: CanaryInitiator,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode the canary OAuth state: %w", err)
+	}
+
+	flow := canaryFlow{
+		client: &http.Client{
+			Timeout: canaryProbeTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	serviceUrl := strings.TrimSuffix(p.ServiceUrl, "/")
+	authUrlPrefix := canaryEndpoint(serviceUrl + CanaryProviderPath).AuthURL
+
+	query := url.Values{}
+	query.Set("state", state)
+	query.Set("k8s_token", strings.TrimSpace(string(k8sToken)))
+	_, body, err := flow.get(ctx, serviceUrl+"/canary/authenticate?"+query.Encode(), http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	// the authenticate endpoint renders a page with the URL of the service provider
+	start := strings.Index(body, authUrlPrefix)
+	if start < 0 {
+		return canaryNoAuthUrlError
+	}
+	end := strings.IndexAny(body[start:], "\"'<> ")
+	if end < 0 {
+		return canaryNoAuthUrlError
+	}
+	authUrl := html.UnescapeString(body[start : start+end])
+
+	callback, _, err := flow.get(ctx, authUrl, http.StatusFound)
+	if err != nil {
+		return err
+	}
+
+	// the service provider redirects to the public URL of the service, let's stay on the internal one
+	if _, _, err = flow.get(ctx, serviceUrl+"/canary/callback?"+callback.RawQuery, http.StatusFound); err != nil {
+		return err
+	}
+	return nil
+}
+
+// canaryFlow makes the requests of a single run of the canary probe. It carries the cookies between the requests
+// itself because the session cookie is marked secure while the probe may talk to the service over plain HTTP.
+type canaryFlow struct {
+	client  *http.Client
+	cookies []*http.Cookie
+}
+
+// get makes the GET request expecting the given status. Returns the location the response redirects to, if any, and
+// the body of the response.
+func (f *canaryFlow) get(ctx context.Context, requestUrl string, expectedStatus int) (*url.URL, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create the canary request: %w", err)
+	}
+	for _, c := range f.cookies {
+		req.AddCookie(c)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to perform the canary request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, canaryMaxBodySize))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read the canary response: %w", err)
+	}
+
+	if resp.StatusCode != expectedStatus {
+		return nil, "", fmt.Errorf("%w: %s responded with %d instead of %d", canaryUnexpectedResponseError, req.URL.Path, resp.StatusCode, expectedStatus)
+	}
+
+	f.keepCookies(resp.Cookies())
+
+	location, err := resp.Location()
+	if err != nil && !errors.Is(err, http.ErrNoLocation) {
+		return nil, "", fmt.Errorf("failed to read the location of the canary response: %w", err)
+	}
+	return location, string(body), nil
+}
+
+// keepCookies remembers the cookies for the subsequent requests, replacing the previous ones with the same name.
+func (f *canaryFlow) keepCookies(cookies []*http.Cookie) {
+	for _, c := range cookies {
+		replaced := false
+		for i := range f.cookies {
+			if f.cookies[i].Name == c.Name {
+				f.cookies[i] = c
+				replaced = true
+			}
+		}
+		if !replaced {
+			f.cookies = append(f.cookies, c)
+		}
+	}
+}
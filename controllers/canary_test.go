@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// allowingClient is a fake client that allows all the access reviews.
+type allowingClient struct {
+	client.Client
+}
+
+func (c allowingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authz.SelfSubjectAccessReview); ok {
+		review.Status.Allowed = true
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestCanaryProbe(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	assert.NoError(t, authz.AddToScheme(scheme))
+	cl := allowingClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "canary", Namespace: "default"},
+	}).Build()}
+
+	var router http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	var storedToken *api.Token
+	storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+		storedToken = token
+		return nil
+	}}
+
+	sessionManager := scs.New()
+	journalStore := memstore.New()
+	history := NewFlowHistory(10, reviewClient{Client: cl, users: map[string]string{"k8s-token": "canary-user"}})
+	cfg := OAuthServiceConfiguration{SharedConfiguration: config.SharedConfiguration{BaseUrl: server.URL, SharedSecret: []byte("secret")}}
+	controller, err := FromConfiguration(cfg, CanaryServiceProviderConfiguration(server.URL, "client-secret"),
+		auth.NewAuthenticator(sessionManager, cl), NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits), NewFlowJournal(journalStore), history, cl, storage, nil)
+	assert.NoError(t, err)
+
+	r := mux.NewRouter()
+	RegisterRoutes(r, []Route{
+		{Path: CanaryProviderPath + "/authorize", Handler: http.HandlerFunc(CanaryAuthorizeHandler(server.URL))},
+		{Path: CanaryProviderPath + "/token", Handler: http.HandlerFunc(CanaryTokenHandler("client-secret"))},
+		{Path: "/canary/authenticate", Handler: http.HandlerFunc(controller.Authenticate), Middleware: []Middleware{sessionManager.LoadAndSave}},
+		{Path: "/canary/callback", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			controller.Callback(r.Context(), w, r)
+		}), Middleware: []Middleware{sessionManager.LoadAndSave}},
+	})
+	router = r
+
+	k8sTokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(k8sTokenFile, []byte("k8s-token\n"), 0600))
+
+	probe := &CanaryProbe{
+		ServiceUrl:       server.URL,
+		TokenNamespace:   "default",
+		TokenName:        "canary",
+		K8sTokenFilePath: k8sTokenFile,
+		JwtSigningSecret: []byte("secret"),
+	}
+
+	t.Run("succeeds", func(t *testing.T) {
+		assert.NoError(t, probe.Run(context.TODO()))
+		if assert.NotNil(t, storedToken) {
+			assert.Equal(t, "canary-token", storedToken.AccessToken)
+		}
+		journal, err := journalStore.All()
+		assert.NoError(t, err)
+		assert.Empty(t, journal)
+		flows := queryAll(t, history, "canary-user")
+		if assert.Len(t, flows, 1) {
+			assert.Equal(t, flowSucceeded, flows[0].Result)
+			assert.Equal(t, "canary", flows[0].TokenName)
+		}
+	})
+
+	t.Run("fails when the flow fails", func(t *testing.T) {
+		failingProbe := *probe
+		failingProbe.TokenName = "non-existent"
+
+		err := failingProbe.Run(context.TODO())
+		assert.True(t, errors.Is(err, canaryUnexpectedResponseError))
+		flows := queryAll(t, history, "canary-user")
+		if assert.Len(t, flows, 2) {
+			assert.Equal(t, flowFailed, flows[0].Result)
+			assert.Equal(t, "non-existent", flows[0].TokenName)
+		}
+	})
+}
+
+func TestCanaryTokenHandler(t *testing.T) {
+	handler := CanaryTokenHandler("client-secret")
+
+	req := httptest.NewRequest("POST", "/token?client_id=spi-canary&client_secret=wrong&code=canary-code", nil)
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req = httptest.NewRequest("POST", "/token?client_id=spi-canary&client_secret=client-secret&code=other-code", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	req = httptest.NewRequest("POST", "/token?client_id=spi-canary&client_secret=client-secret&code=canary-code", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"access_token":"canary-token"`)
+}
+
+func TestCanaryAuthorizeHandler(t *testing.T) {
+	handler := CanaryAuthorizeHandler("https://spi", "http://localhost:8000/")
+
+	for _, redirectUri := range []string{"https://spi/canary/callback", "http://localhost:8000/canary/callback"} {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", "/authorize?state=abc&redirect_uri="+url.QueryEscape(redirectUri), nil))
+		assert.Equal(t, http.StatusFound, rr.Code, redirectUri)
+		assert.True(t, strings.HasPrefix(rr.Header().Get("Location"), redirectUri+"?"), rr.Header().Get("Location"))
+	}
+
+	for _, redirectUri := range []string{"", "https://evil.example.com/canary/callback", "https://spi/github/callback", "https://spi.evil.example.com/canary/callback", "https://user@spi/canary/callback", "https://spi/canary/callback#fragment"} {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", "/authorize?state=abc&redirect_uri="+url.QueryEscape(redirectUri), nil))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, redirectUri)
+		assert.Empty(t, rr.Header().Get("Location"))
+	}
+}
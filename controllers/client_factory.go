@@ -17,10 +17,13 @@ import (
 	"fmt"
 	"net/http"
 	"path"
+	goruntime "runtime"
 
 	"github.com/kcp-dev/logicalcluster/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
 
 	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	authn "k8s.io/api/authentication/v1"
 	authz "k8s.io/api/authorization/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -28,13 +31,22 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// AuthenticatingClient is just a typedef that advertises that it is safe to use the WithAuthIntoContext or
-// WithAuthFromRequestIntoContext functions with clients having this type.
-type AuthenticatingClient client.Client
+// UserAgent returns the User-Agent the service identifies itself with to the Kubernetes API server.
+func UserAgent(version string) string {
+	return fmt.Sprintf("spi-oauth/%s (%s/%s)", version, goruntime.GOOS, goruntime.GOARCH)
+}
 
 // CreateClient creates a new client based on the provided configuration. Note that configuration is potentially
 // modified during the call.
-func CreateClient(cfg *rest.Config, options client.Options) (AuthenticatingClient, error) {
+func CreateClient(cfg *rest.Config, options client.Options) (auth.AuthenticatingClient, error) {
+	auth.AugmentConfiguration(cfg)
+	return CreateServiceClient(cfg, options)
+}
+
+// CreateServiceClient creates a new client acting with the credentials in the provided configuration, i.e. with
+// the credentials of the service itself, unlike CreateClient. Note that configuration is potentially modified during
+// the call.
+func CreateServiceClient(cfg *rest.Config, options client.Options) (client.Client, error) {
 	var err error
 	scheme := options.Scheme
 	if scheme == nil {
@@ -54,7 +66,9 @@ func CreateClient(cfg *rest.Config, options client.Options) (AuthenticatingClien
 		return nil, fmt.Errorf("failed to add authz to the scheme: %w", err)
 	}
 
-	AugmentConfiguration(cfg)
+	if err = authn.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to add authn to the scheme: %w", err)
+	}
 
 	cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
 		return kcpWorkspaceRoundTripper{next: rt}
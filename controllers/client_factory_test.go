@@ -32,3 +32,7 @@ func TestCreateClient(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEmpty(t, cl.Scheme().AllKnownTypes())
 }
+
+func TestUserAgent(t *testing.T) {
+	assert.Regexp(t, `^spi-oauth/v1\.2\.3 \([a-z0-9]+/[a-z0-9]+\)$`, UserAgent("v1.2.3"))
+}
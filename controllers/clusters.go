@@ -0,0 +1,193 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	authz "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/rest"
+	certutil "k8s.io/client-go/util/cert"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+var invalidClusterConfigurationError = errors.New("invalid cluster configuration")
+
+// ClustersConfiguration is the configuration of the member clusters the service works with in addition to the default
+// one.
+type ClustersConfiguration struct {
+	Clusters []ClusterConfiguration `json:"clusters"`
+}
+
+// ClusterConfiguration describes a member cluster and the namespaces that live in it.
+type ClusterConfiguration struct {
+	// Name identifies the cluster in the logs.
+	Name string `json:"name"`
+	// ApiServer is the URL of the API server of the cluster.
+	ApiServer string `json:"apiServer"`
+	// CAPath is the path to the CA certificate to use when connecting to the API server.
+	CAPath string `json:"caPath,omitempty"`
+	// Namespaces are the patterns of the namespaces in the cluster as understood by path.Match. The first cluster
+	// with a matching pattern is used for the namespace. The default cluster is used if no cluster matches.
+	Namespaces []string `json:"namespaces"`
+}
+
+// LoadClustersConfiguration reads the configuration of the member clusters from the YAML file.
+func LoadClustersConfiguration(file string) (ClustersConfiguration, error) {
+	cfg := ClustersConfiguration{}
+
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read the clusters configuration from %s: %w", file, err)
+	}
+	if err = yaml.UnmarshalStrict(bytes, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse the clusters configuration from %s: %w", file, err)
+	}
+
+	for _, c := range cfg.Clusters {
+		if c.Name == "" || c.ApiServer == "" {
+			return cfg, fmt.Errorf("%w: the name and the API server of the cluster must not be empty", invalidClusterConfigurationError)
+		}
+		for _, ns := range c.Namespaces {
+			if _, err := path.Match(ns, ""); err != nil {
+				return cfg, fmt.Errorf("%w: invalid namespace pattern '%s' of the cluster %s", invalidClusterConfigurationError, ns, c.Name)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// ApiServerConfig returns the configuration for connecting to the API server, optionally verified with the CA
+// certificate at the caPath. Note that we're NOT adding the Token or the TokenFile to the configuration here. This is
+// supposed to be handled on per-request basis.
+func ApiServerConfig(apiServer string, caPath string) (*rest.Config, error) {
+	// here we're essentially replicating what is done in rest.InClusterConfig() but we're using our own
+	// configuration - this is to support going through an alternative API server to the one we're running with...
+	cfg := rest.Config{}
+
+	apiServerUrl, err := url.Parse(apiServer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the API server URL: %w", err)
+	}
+
+	cfg.Host = "https://" + net.JoinHostPort(apiServerUrl.Hostname(), apiServerUrl.Port())
+
+	tlsConfig := rest.TLSClientConfig{}
+
+	if caPath != "" {
+		// rest.InClusterConfig is doing this most possibly only for early error handling so let's do the same
+		if _, err := certutil.NewPool(caPath); err != nil {
+			return nil, fmt.Errorf("expected to load root CA config from %s, but got err: %w", caPath, err)
+		} else {
+			tlsConfig.CAFile = caPath
+		}
+	}
+
+	cfg.TLSClientConfig = tlsConfig
+
+	return &cfg, nil
+}
+
+// MemberCluster is a member cluster with the client to use for the namespaces in it.
+type MemberCluster struct {
+	Name       string
+	Namespaces []string
+	Client     auth.AuthenticatingClient
+}
+
+// clusterRoutingClient is a client that sends the requests to the cluster the namespace of the request lives in. The
+// requests for cluster-scoped objects and for the namespaces not found in any of the member clusters are sent to
+// the default cluster. Notice that the self subject access reviews are routed using the namespace of the reviewed
+// resource. The status writer always goes to the default cluster.
+type clusterRoutingClient struct {
+	client.Client
+	members []MemberCluster
+}
+
+var _ client.Client = (*clusterRoutingClient)(nil)
+
+// NewClusterRoutingClient returns a client routing the requests to the member clusters based on their namespaces.
+// The default client is used for the requests not matching any of the member clusters.
+func NewClusterRoutingClient(defaultClient auth.AuthenticatingClient, members []MemberCluster) auth.AuthenticatingClient {
+	if len(members) == 0 {
+		return defaultClient
+	}
+	return &clusterRoutingClient{Client: defaultClient, members: members}
+}
+
+// forNamespace returns the client of the cluster the namespace lives in.
+func (c *clusterRoutingClient) forNamespace(ctx context.Context, namespace string) client.Client {
+	if namespace != "" {
+		for _, m := range c.members {
+			for _, pattern := range m.Namespaces {
+				if matches, _ := path.Match(pattern, namespace); matches {
+					log.FromContext(ctx).V(logs.DebugLevel).Info("routing the request to the member cluster", "cluster", m.Name, "namespace", namespace)
+					return m.Client
+				}
+			}
+		}
+	}
+	return c.Client
+}
+
+// namespaceOf returns the namespace that determines the cluster of the object.
+func namespaceOf(obj client.Object) string {
+	if review, ok := obj.(*authz.SelfSubjectAccessReview); ok && review.Spec.ResourceAttributes != nil {
+		return review.Spec.ResourceAttributes.Namespace
+	}
+	return obj.GetNamespace()
+}
+
+func (c *clusterRoutingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.forNamespace(ctx, key.Namespace).Get(ctx, key, obj) //nolint:wrapcheck // the routing is transparent
+}
+
+func (c *clusterRoutingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	return c.forNamespace(ctx, listOpts.Namespace).List(ctx, list, opts...) //nolint:wrapcheck // the routing is transparent
+}
+
+func (c *clusterRoutingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.forNamespace(ctx, namespaceOf(obj)).Create(ctx, obj, opts...) //nolint:wrapcheck // the routing is transparent
+}
+
+func (c *clusterRoutingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return c.forNamespace(ctx, namespaceOf(obj)).Delete(ctx, obj, opts...) //nolint:wrapcheck // the routing is transparent
+}
+
+func (c *clusterRoutingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.forNamespace(ctx, namespaceOf(obj)).Update(ctx, obj, opts...) //nolint:wrapcheck // the routing is transparent
+}
+
+func (c *clusterRoutingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.forNamespace(ctx, namespaceOf(obj)).Patch(ctx, obj, patch, opts...) //nolint:wrapcheck // the routing is transparent
+}
+
+func (c *clusterRoutingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	deleteOpts := client.DeleteAllOfOptions{}
+	deleteOpts.ApplyOptions(opts)
+	return c.forNamespace(ctx, deleteOpts.Namespace).DeleteAllOf(ctx, obj, opts...) //nolint:wrapcheck // the routing is transparent
+}
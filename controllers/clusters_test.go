@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLoadClustersConfiguration(t *testing.T) {
+	write := func(content string) string {
+		file := filepath.Join(t.TempDir(), "clusters.yaml")
+		assert.NoError(t, os.WriteFile(file, []byte(content), 0600))
+		return file
+	}
+
+	cfg, err := LoadClustersConfiguration(write(`
+clusters:
+- name: member-1
+  apiServer: https://member-1:6443
+  namespaces: ["team-a-*", "team-b"]
+`))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Clusters, 1)
+	assert.Equal(t, "member-1", cfg.Clusters[0].Name)
+	assert.Equal(t, []string{"team-a-*", "team-b"}, cfg.Clusters[0].Namespaces)
+
+	_, err = LoadClustersConfiguration(write(`
+clusters:
+- name: member-1
+  namespaces: ["team-a-*"]
+`))
+	assert.True(t, errors.Is(err, invalidClusterConfigurationError))
+
+	_, err = LoadClustersConfiguration(write(`
+clusters:
+- name: member-1
+  apiServer: https://member-1:6443
+  namespaces: ["team-[a"]
+`))
+	assert.True(t, errors.Is(err, invalidClusterConfigurationError))
+}
+
+func TestClusterRoutingClient(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	assert.NoError(t, authz.AddToScheme(scheme))
+
+	token := func(namespace string) *api.SPIAccessToken {
+		return &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: namespace}}
+	}
+	defaultClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(token("default")).Build()
+	memberClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(token("team-a-dev")).Build()
+
+	cl := NewClusterRoutingClient(defaultClient, []MemberCluster{{Name: "member", Namespaces: []string{"team-a-*"}, Client: memberClient}})
+
+	t.Run("routes by namespace", func(t *testing.T) {
+		assert.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Name: "token", Namespace: "team-a-dev"}, &api.SPIAccessToken{}))
+		assert.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Name: "token", Namespace: "default"}, &api.SPIAccessToken{}))
+		assert.Error(t, cl.Get(context.TODO(), client.ObjectKey{Name: "token", Namespace: "team-b"}, &api.SPIAccessToken{}))
+	})
+
+	t.Run("routes creation", func(t *testing.T) {
+		update := &api.SPIAccessTokenDataUpdate{ObjectMeta: metav1.ObjectMeta{Name: "update", Namespace: "team-a-dev"}}
+		assert.NoError(t, cl.Create(context.TODO(), update))
+		assert.NoError(t, memberClient.Get(context.TODO(), client.ObjectKeyFromObject(update), &api.SPIAccessTokenDataUpdate{}))
+		assert.Error(t, defaultClient.Get(context.TODO(), client.ObjectKeyFromObject(update), &api.SPIAccessTokenDataUpdate{}))
+	})
+
+	t.Run("routes lists", func(t *testing.T) {
+		list := &api.SPIAccessTokenList{}
+		assert.NoError(t, cl.List(context.TODO(), list, client.InNamespace("team-a-dev")))
+		assert.Len(t, list.Items, 1)
+		assert.Equal(t, "team-a-dev", list.Items[0].Namespace)
+	})
+
+	t.Run("routes access reviews by the reviewed namespace", func(t *testing.T) {
+		review := &authz.SelfSubjectAccessReview{Spec: authz.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authz.ResourceAttributes{Namespace: "team-a-dev"},
+		}}
+		assert.Equal(t, "team-a-dev", namespaceOf(review))
+	})
+
+	t.Run("no members means the default client", func(t *testing.T) {
+		assert.Equal(t, auth.AuthenticatingClient(defaultClient), NewClusterRoutingClient(defaultClient, nil))
+	})
+}
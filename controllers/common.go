@@ -19,9 +19,13 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
 
 	v1 "k8s.io/api/authorization/v1"
@@ -36,26 +40,39 @@ import (
 )
 
 var (
-	noActiveSessionError = errors.New("no active oauth session found")
+	noActiveSessionError = spierrors.WithKind(spierrors.NotAuthenticated, errors.New("no active oauth session found"))
 )
 
 // commonController is the implementation of the Controller interface that assumes typical OAuth flow.
 type commonController struct {
-	Config           config.ServiceProviderConfiguration
-	JwtSigningSecret []byte
-	K8sClient        AuthenticatingClient
-	TokenStorage     tokenstorage.TokenStorage
-	Endpoint         oauth2.Endpoint
-	BaseUrl          string
-	RedirectTemplate *template.Template
-	Authenticator    *Authenticator
-	StateStorage     *StateStorage
+	Config                   config.ServiceProviderConfiguration
+	JwtSigningSecret         []byte
+	Codec                    *oauthstate.Codec
+	K8sClient                auth.AuthenticatingClient
+	TokenStorage             tokenstorage.TokenStorage
+	Endpoint                 oauth2.Endpoint
+	AuthStyle                oauth2.AuthStyle
+	IncrementalAuthz         bool
+	Reauthentication         reauthenticationPolicy
+	TokenTransformers        tokenTransformerChain
+	Initiators               InitiatorPolicy
+	CallbackHosts            []string
+	BaseUrl                  string
+	RedirectTemplate         *template.Template
+	ProviderRedirectTemplate *template.Template
+	Authenticator            *auth.Authenticator
+	StateStorage             *StateStorage
+	FlowJournal              *FlowJournal
+	FlowHistory              *FlowHistory
 }
 
 // exchangeState is the state that we're sending out to the SP after checking the anonymous oauth state produced by
 // the operator as the initial OAuth URL. Notice that the state doesn't contain any sensitive information.
 type exchangeState struct {
 	oauthstate.AnonymousOAuthState
+	// Initiator identifies the client application that started the flow. It is either a claim of the OAuth state or
+	// it is provided by the client when starting the flow.
+	Initiator string `json:"initiator,omitempty"`
 }
 
 // exchangeResult this the result of the OAuth exchange with all the data necessary to store the token into the storage
@@ -66,16 +83,29 @@ type exchangeResult struct {
 	authorizationHeader string
 }
 
-// newOAuth2Config returns a new instance of the oauth2.Config struct with the clientId, clientSecret and redirect URL
-// specific to this controller.
-func (c *commonController) newOAuth2Config() oauth2.Config {
+// newOAuth2Config returns a new instance of the oauth2.Config struct with the clientId, clientSecret, redirect URL and
+// the endpoint specific to this controller. The auth style of the endpoint is overridden by the configured one unless
+// it is set to auto-detection.
+func (c *commonController) newOAuth2Config(endpoint oauth2.Endpoint) oauth2.Config {
+	if c.AuthStyle != oauth2.AuthStyleAutoDetect {
+		endpoint.AuthStyle = c.AuthStyle
+	}
 	return oauth2.Config{
 		ClientID:     c.Config.ClientId,
 		ClientSecret: c.Config.ClientSecret,
 		RedirectURL:  c.redirectUrl(),
+		Endpoint:     endpoint,
 	}
 }
 
+// redirectTemplate returns the template of the redirect notice page for this controller.
+func (c *commonController) redirectTemplate() *template.Template {
+	if c.ProviderRedirectTemplate != nil {
+		return c.ProviderRedirectTemplate
+	}
+	return c.RedirectTemplate
+}
+
 // redirectUrl constructs the URL to the callback endpoint so that it can be handled by this controller.
 func (c *commonController) redirectUrl() string {
 	return strings.TrimSuffix(c.BaseUrl, "/") + "/" + strings.ToLower(string(c.Config.ServiceProviderType)) + "/callback"
@@ -86,130 +116,269 @@ func (c commonController) Authenticate(w http.ResponseWriter, r *http.Request) {
 
 	defer logs.TimeTrack(log, time.Now(), "/authenticate")
 
-	stateString := r.FormValue("state")
-	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
-	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to instantiate OAuth stateString codec", err)
+	authorizationUrl, ok := c.AuthorizationUrl(w, r, r.FormValue("state"))
+	if !ok {
 		return
 	}
 
-	state, err := codec.ParseAnonymous(stateString)
+	templateData := struct {
+		Url string
+	}{
+		Url: authorizationUrl,
+	}
+	log.V(logs.DebugLevel).Info("Redirecting ", "url", templateData.Url)
+	renderTemplate(r.Context(), w, http.StatusOK, c.redirectTemplate(), redirectNoticeTemplateName, templateData, fallbackViewData{
+		Title:   "Redirecting to the service provider",
+		Message: "You are being redirected to the service provider to authorize the access.",
+		Url:     templateData.Url,
+	})
+}
+
+func (c commonController) AuthorizationUrl(w http.ResponseWriter, r *http.Request, stateString string) (string, bool) {
+	log := log.FromContext(r.Context())
+
+	state, err := c.Codec.ParseAnonymous(stateString)
 	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode the OAuth state", err)
-		return
+		logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode the OAuth state", err)
+		return "", false
 	}
-	token, err := c.Authenticator.GetToken(r)
+	r = r.WithContext(logging.WithTokenLogFields(r.Context(), state.TokenNamespace, state.TokenName))
+	record := newFlowRecord(c.Config.ServiceProviderType)
+
+	initiator := c.flowInitiator(r, stateString)
+	if err = c.Initiators.Check(initiator); err != nil {
+		logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "the client application cannot start the OAuth flow", err)
+		return "", false
+	}
+	r = r.WithContext(withInitiator(r.Context(), initiator))
+
+	stopAuthn := record.track(phaseAuthn)
+	token, err := c.requestToken(r)
+	stopAuthn()
 	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "No active session was found. Please use `/login` method to authorize your request and try again. Or provide the token as a `k8s_token` query parameter.", err)
-		return
+		logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "No active session was found. Please use `/login` method to authorize your request and try again. Or provide the token as a `k8s_token` query parameter.", err)
+		return "", false
 	}
+	stopSar := record.track(phaseSar)
 	hasAccess, err := c.checkIdentityHasAccess(token, r, state)
+	stopSar()
 	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to determine if the authenticated user has access", err)
+		logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to determine if the authenticated user has access", err)
 		log.Error(err, "The token is incorrect or the SPI OAuth service is not configured properly "+
 			"and the API_SERVER environment variable points it to the incorrect Kubernetes API server. "+
 			"If SPI is running with Devsandbox Proxy or KCP, make sure this env var points to the Kubernetes API proxy,"+
 			" otherwise unset this variable. See more https://github.com/redhat-appstudio/infra-deployments/pull/264")
-		return
+		return "", false
 	}
 
 	if !hasAccess {
-		LogDebugAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
-		return
+		logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
+		return "", false
+	}
+	// the initiator is declared by the client, so only the authorized requests may use up its limit, otherwise anyone
+	// could exhaust the limit of the other client applications
+	if !c.Initiators.Allow(initiator) {
+		logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusTooManyRequests, "too many requests, please try again later")
+		return "", false
 	}
-	AuditLogWithTokenInfo(r.Context(), "OAuth authentication flow started", state.TokenNamespace, state.TokenName, "provider", string(state.ServiceProviderType), "scopes", state.Scopes)
-	newStateString, err := c.StateStorage.VeilRealState(r)
+	stopVeil := record.track(phaseVeil)
+	newStateString, err := c.StateStorage.VeilState(r.Context(), stateString)
+	stopVeil()
 	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, err.Error(), err)
-		return
+		logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, err.Error(), err)
+		return "", false
 	}
+	logging.AuditLogWithTokenInfo(r.Context(), "OAuth authentication flow started", state.TokenNamespace, state.TokenName, "provider", string(state.ServiceProviderType), "scopes", state.Scopes, "initiator", initiator, "phaseDurationSeconds", record.durations())
 	keyedState := exchangeState{
 		AnonymousOAuthState: state,
+		Initiator:           initiator,
+	}
+
+	// the user might not be allowed to read the SPIAccessToken, in which case we just ask for the requested scopes
+	granted, err := c.grantedScopes(r.Context(), token, state)
+	if err != nil {
+		log.V(logs.DebugLevel).Info("failed to find the scopes granted to the existing token", "error", err.Error())
 	}
+	scopes, authCodeOptions := authorizationScopes(granted, keyedState.Scopes, c.IncrementalAuthz)
+	authCodeOptions = append(authCodeOptions, c.Reauthentication.options(keyedState.Scopes)...)
 
-	oauthCfg := c.newOAuth2Config()
-	oauthCfg.Endpoint = c.Endpoint
-	oauthCfg.Scopes = keyedState.Scopes
+	oauthCfg := c.newOAuth2Config(c.Endpoint)
+	oauthCfg.Scopes = scopes
 
-	templateData := struct {
-		Url string
-	}{
-		Url: oauthCfg.AuthCodeURL(newStateString),
+	return oauthCfg.AuthCodeURL(newStateString, authCodeOptions...), true
+}
+
+// requestToken returns the Kubernetes token authenticating the request starting the flow. The requests of the flows API
+// carry the bearer token in the context, the others are authenticated by the session or the `k8s_token` parameter.
+func (c commonController) requestToken(r *http.Request) (string, error) {
+	if token := auth.BearerTokenFromContext(r.Context()); token != "" {
+		return token, nil
 	}
-	log.V(logs.DebugLevel).Info("Redirecting ", "url", templateData.Url)
-	err = c.RedirectTemplate.Execute(w, templateData)
+	token, err := c.Authenticator.GetToken(r)
 	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to return redirect notice HTML page", err)
-		return
+		return "", fmt.Errorf("failed to authenticate the request: %w", err)
 	}
+	return token, nil
+}
+
+// flowInitiator returns the initiator of the flow with the state. The initiator claim of the state, which cannot be
+// forged, takes precedence over the one the client identified itself with in the request.
+func (c commonController) flowInitiator(r *http.Request, stateString string) string {
+	claims := exchangeState{}
+	if err := c.Codec.ParseInto(stateString, &claims); err == nil && claims.Initiator != "" {
+		return claims.Initiator
+	}
+	return requestInitiator(r)
 }
 
 func (c commonController) Callback(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	lg := log.FromContext(r.Context())
 	defer logs.TimeTrack(lg, time.Now(), "/callback")
 
-	exchange, err := c.finishOAuthExchange(ctx, r, c.Endpoint)
+	if !isAllowedHost(c.CallbackHosts, r.Host) {
+		lg.V(logs.DebugLevel).Info("rejecting the callback received on an unexpected host", "host", r.Host, "allowedHosts", c.CallbackHosts)
+		logErrorAndWriteCallbackResponse(w, r, http.StatusBadRequest, "failed to finish the OAuth flow", unexpectedCallbackHostError)
+		return
+	}
+
+	record := newFlowRecord(c.Config.ServiceProviderType)
+	exchange, err := c.finishOAuthExchange(ctx, r, c.Endpoint, record)
+	if errors.Is(err, stateNotFoundError) {
+		logging.AuditLog(ctx).Info("OAuth authentication flow failed because the authorization session expired", "provider", string(c.Config.ServiceProviderType))
+		expiredSessionsCounter.WithLabelValues(string(c.Config.ServiceProviderType)).Inc()
+		flowsCounter.WithLabelValues(string(c.Config.ServiceProviderType), flowExpired).Inc()
+		// we don't know the token of the flow anymore but the user might still be logged in
+		if k8sToken, err := c.Authenticator.GetToken(r); err == nil { //nolint:contextCheck // same as in finishOAuthExchange
+			c.recordFlowHistory(ctx, k8sToken, flowHistoryEntry{Provider: c.Config.ServiceProviderType, Result: flowExpired})
+		}
+		renderCallbackErrorPage(w, r, spierrors.HttpStatus(err), viewData{
+			Title:   "authorization session expired",
+			Message: "Your authorization session expired or was not found. Please restart the flow.",
+		})
+		return
+	}
+	// the user can authenticate and retry the callback, otherwise the code is used up and the state is of no use anymore
+	if exchange.result != oauthFinishK8sAuthRequired {
+		defer c.StateStorage.FinishState(ctx, r.FormValue("state"))
+	}
 	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "error in Service Provider token exchange", err)
+		c.recordFlow(ctx, &exchange, flowFailed)
+		logErrorAndWriteCallbackResponse(w, r, spierrors.HttpStatus(err), "error in Service Provider token exchange", err)
 		return
 	}
 
 	if exchange.result == oauthFinishK8sAuthRequired {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "could not authenticate to Kubernetes", err)
+		logErrorAndWriteCallbackResponse(w, r, http.StatusUnauthorized, "could not authenticate to Kubernetes", err)
 		return
 	}
-
+	ctx = logging.WithTokenLogFields(ctx, exchange.TokenNamespace, exchange.TokenName)
+	r = r.WithContext(logging.WithTokenLogFields(r.Context(), exchange.TokenNamespace, exchange.TokenName))
+
+	// the journal is there to detect the tokens lost by crashing before they're stored. Once we're back from
+	// the storage, the user gets to know the outcome.
+	state := r.FormValue("state")
+	c.FlowJournal.RecordExchanged(ctx, state, &exchange)
+	stopStorage := record.track(phaseStorage)
 	err = c.syncTokenData(ctx, &exchange)
+	stopStorage()
+	c.FlowJournal.Finish(ctx, state)
 	if err != nil {
-		LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to store token data to cluster", err)
+		c.recordFlow(ctx, &exchange, flowFailed)
+		logErrorAndWriteCallbackResponse(w, r, spierrors.HttpStatus(err), "failed to store token data to cluster", err)
 		return
 	}
-	AuditLogWithTokenInfo(ctx, "OAuth authentication completed successfully", exchange.TokenNamespace, exchange.TokenName, "provider", string(exchange.ServiceProviderType), "scopes", exchange.Scopes)
+	c.recordFlow(ctx, &exchange, flowSucceeded)
+	logging.AuditLogWithTokenInfo(ctx, "OAuth authentication completed successfully", exchange.TokenNamespace, exchange.TokenName, "provider", string(exchange.ServiceProviderType), "scopes", exchange.Scopes, "initiator", exchange.Initiator, "phaseDurationSeconds", record.durations())
 	redirectLocation := r.FormValue("redirect_after_login")
 	if redirectLocation == "" {
-		redirectLocation = strings.TrimSuffix(c.BaseUrl, "/") + "/" + "callback_success"
+		query := successPageQuery(&exchange)
+		signPageQuery(c.JwtSigningSecret, callbackSuccessPage, query)
+		redirectLocation = strings.TrimSuffix(c.BaseUrl, "/") + "/" + callbackSuccessPage + "?" + query.Encode()
+	}
+	redirectAfterCallback(w, r, redirectLocation)
+}
+
+// recordFlow records the outcome of the flow in the metrics and in the flow history of the user that started it.
+// Nothing is recorded in the history if the flow didn't get far enough for the user to be known.
+func (c commonController) recordFlow(ctx context.Context, exchange *exchangeResult, result string) {
+	flowsCounter.WithLabelValues(string(c.Config.ServiceProviderType), result).Inc()
+	c.recordFlowHistory(ctx, exchange.authorizationHeader, flowHistoryEntry{
+		Provider:       c.Config.ServiceProviderType,
+		TokenNamespace: exchange.TokenNamespace,
+		TokenName:      exchange.TokenName,
+		Result:         result,
+	})
+}
+
+// recordFlowHistory records the flow in the history of the user authenticated by the Kubernetes token. The history is
+// only informative, so the flow is not recorded if the token cannot be reviewed.
+func (c commonController) recordFlowHistory(ctx context.Context, k8sToken string, entry flowHistoryEntry) {
+	if k8sToken == "" {
+		return
+	}
+	caller, err := c.FlowHistory.CallerOf(ctx, k8sToken)
+	if err != nil {
+		log.FromContext(ctx).V(logs.DebugLevel).Info("failed to review the user of the flow, not recording it in the flow history", "error", err.Error())
+		return
+	}
+	c.FlowHistory.Record(caller, entry)
+}
+
+// successPageQuery returns the query parameters identifying the SPIAccessToken for the callback success page so that
+// it can link to the next step in the flow.
+func successPageQuery(exchange *exchangeResult) url.Values {
+	query := url.Values{}
+	query.Set("namespace", exchange.TokenNamespace)
+	query.Set("name", exchange.TokenName)
+	if exchange.TokenKcpWorkspace != "" {
+		query.Set("workspace", exchange.TokenKcpWorkspace)
 	}
-	http.Redirect(w, r, redirectLocation, http.StatusFound)
+	return query
 }
 
 // finishOAuthExchange implements the bulk of the Callback function. It returns the token, if obtained, the decoded
-// state from the oauth flow, if available, and the result of the authentication.
-func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Request, endpoint oauth2.Endpoint) (exchangeResult, error) {
+// state from the oauth flow, if available, and the result of the authentication. The durations of the phases of
+// the exchange are recorded in the provided flow record.
+func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Request, endpoint oauth2.Endpoint, record *flowRecord) (exchangeResult, error) {
 	// TODO support the implicit flow here, too?
 
 	// check that the state is correct
+	stopUnveil := record.track(phaseUnveil)
 	stateString, err := c.StateStorage.UnveilState(ctx, r)
+	stopUnveil()
 	if err != nil {
 		return exchangeResult{result: oauthFinishError}, fmt.Errorf("failed to unveil token state: %w", err)
 	}
-	codec, err := oauthstate.NewCodec(c.JwtSigningSecret)
-	if err != nil {
-		return exchangeResult{result: oauthFinishError}, fmt.Errorf("failed to create JWT codec: %w", err)
-	}
-
 	state := &exchangeState{}
-	err = codec.ParseInto(stateString, state)
+	err = c.Codec.ParseInto(stateString, state)
 	if err != nil {
-		return exchangeResult{result: oauthFinishError}, fmt.Errorf("failed to parse JWT state string: %w", err)
+		return exchangeResult{result: oauthFinishError}, fmt.Errorf("failed to parse JWT state string: %w", spierrors.WithKind(spierrors.InvalidRequest, err))
+	}
+	if state.Initiator == "" {
+		state.Initiator = c.StateStorage.Initiator(r.Context(), r.FormValue("state"))
 	}
 
+	stopAuthn := record.track(phaseAuthn)
 	k8sToken, err := c.Authenticator.GetToken(r) //nolint:contextCheck // no idea why contextCheck is complaining here - we're not doing any HTTP requests with this call
+	stopAuthn()
 	if err != nil {
 		return exchangeResult{result: oauthFinishK8sAuthRequired}, noActiveSessionError
 	}
 
 	// the state is ok, let's retrieve the token from the service provider
-	oauthCfg := c.newOAuth2Config()
-	oauthCfg.Endpoint = endpoint
+	oauthCfg := c.newOAuth2Config(endpoint)
 
 	code := r.FormValue("code")
 
 	// adding scopes to code exchange request is little out of spec, but quay wants them,
 	// while other providers will just ignore this parameter
 	scopeOption := oauth2.SetAuthURLParam("scope", r.FormValue("scope"))
+	stopExchange := record.track(phaseExchange)
 	token, err := oauthCfg.Exchange(ctx, code, scopeOption)
+	stopExchange()
 	if err != nil {
-		return exchangeResult{result: oauthFinishError}, fmt.Errorf("failed to finish the OAuth exchange: %w", err)
+		// the state and the user are known at this point so that the failure can be attributed to them
+		return exchangeResult{exchangeState: *state, result: oauthFinishError, authorizationHeader: k8sToken}, fmt.Errorf("failed to finish the OAuth exchange: %w", providerError(err))
 	}
 	return exchangeResult{
 		exchangeState:       *state,
@@ -219,9 +388,20 @@ func (c commonController) finishOAuthExchange(ctx context.Context, r *http.Reque
 	}, nil
 }
 
+// providerError returns the failed token exchange as the spierrors.ProviderError with the status code of the response
+// of the service provider, if there was any.
+func providerError(err error) error {
+	providerErr := &spierrors.ProviderError{Err: err}
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		providerErr.Code = retrieveErr.Response.StatusCode
+	}
+	return providerErr
+}
+
 // syncTokenData stores the data of the token to the configured TokenStorage.
 func (c commonController) syncTokenData(ctx context.Context, exchange *exchangeResult) error {
-	ctx = WithAuthIntoContext(exchange.authorizationHeader, ctx)
+	ctx = auth.WithAuthIntoContext(exchange.authorizationHeader, ctx)
 
 	accessToken := &v1beta1.SPIAccessToken{}
 	if err := c.K8sClient.Get(ctx, client.ObjectKey{Name: exchange.TokenName, Namespace: exchange.TokenNamespace}, accessToken); err != nil {
@@ -232,22 +412,60 @@ func (c commonController) syncTokenData(ctx context.Context, exchange *exchangeR
 		AccessToken:  exchange.token.AccessToken,
 		TokenType:    exchange.token.TokenType,
 		RefreshToken: exchange.token.RefreshToken,
-		Expiry:       uint64(exchange.token.Expiry.Unix()),
+	}
+	// zero means that the token doesn't expire
+	if !exchange.token.Expiry.IsZero() {
+		apiToken.Expiry = uint64(exchange.token.Expiry.Unix())
+	}
+
+	if err := c.TokenTransformers.Transform(ctx, &apiToken); err != nil {
+		return err
 	}
 
 	if err := c.TokenStorage.Store(ctx, accessToken, &apiToken); err != nil {
-		return fmt.Errorf("failed to persist the token to storage: %w", err)
+		return fmt.Errorf("failed to persist the token to storage: %w", spierrors.WithKind(spierrors.StorageUnavailable, err))
+	}
+
+	// the new token has both the previously granted scopes and the requested ones, because we either asked for all of
+	// them or the service provider included the granted scopes
+	if accessToken.Status.TokenMetadata != nil {
+		exchange.Scopes = scopeUnion(accessToken.Status.TokenMetadata.Scopes, exchange.Scopes)
 	}
 
 	return nil
 }
 
+// grantedScopes returns the scopes of the token already stored for the SPIAccessToken targeted by the state. The scopes
+// are empty if there is no token yet.
+func (c *commonController) grantedScopes(ctx context.Context, token string, state oauthstate.AnonymousOAuthState) ([]string, error) {
+	accessToken := &v1beta1.SPIAccessToken{}
+	if err := c.K8sClient.Get(auth.WithAuthIntoContext(token, ctx), client.ObjectKey{Name: state.TokenName, Namespace: state.TokenNamespace}, accessToken); err != nil {
+		return nil, fmt.Errorf("failed to get the SPIAccessToken object %s/%s: %w", state.TokenNamespace, state.TokenName, err)
+	}
+	if accessToken.Status.TokenMetadata == nil {
+		return nil, nil
+	}
+	return accessToken.Status.TokenMetadata.Scopes, nil
+}
+
 func (c *commonController) checkIdentityHasAccess(token string, req *http.Request, state oauthstate.AnonymousOAuthState) (bool, error) {
+	return hasTokenDataUpdateAccess(auth.WithAuthIntoContext(token, req.Context()), c.K8sClient, state.TokenNamespace)
+}
+
+// hasTokenDataUpdateAccess checks whether the identity authenticated in the context is allowed to update the token
+// data in the namespace, i.e. whether it can create the SPIAccessTokenDataUpdate objects there.
+func hasTokenDataUpdateAccess(ctx context.Context, cl client.Client, namespace string) (bool, error) {
+	return hasTokenDataUpdateVerbAccess(ctx, cl, namespace, "create")
+}
+
+// hasTokenDataUpdateVerbAccess checks whether the identity authenticated in the context is allowed to perform the verb
+// on the SPIAccessTokenDataUpdate objects in the namespace.
+func hasTokenDataUpdateVerbAccess(ctx context.Context, cl client.Client, namespace string, verb string) (bool, error) {
 	review := v1.SelfSubjectAccessReview{
 		Spec: v1.SelfSubjectAccessReviewSpec{
 			ResourceAttributes: &v1.ResourceAttributes{
-				Namespace: state.TokenNamespace,
-				Verb:      "create",
+				Namespace: namespace,
+				Verb:      verb,
 				Group:     v1beta1.GroupVersion.Group,
 				Version:   v1beta1.GroupVersion.Version,
 				Resource:  "spiaccesstokendataupdates",
@@ -255,12 +473,10 @@ func (c *commonController) checkIdentityHasAccess(token string, req *http.Reques
 		},
 	}
 
-	ctx := WithAuthIntoContext(token, req.Context())
-
-	if err := c.K8sClient.Create(ctx, &review); err != nil {
+	if err := cl.Create(ctx, &review); err != nil {
 		return false, fmt.Errorf("failed to create SelfSubjectAccessReview: %w", err)
 	}
 
-	log.FromContext(req.Context()).V(logs.DebugLevel).Info("self subject review result", "review", &review)
+	log.FromContext(ctx).V(logs.DebugLevel).Info("self subject review result", "review", &review)
 	return review.Status.Allowed, nil
 }
@@ -27,6 +27,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
 	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -81,12 +82,14 @@ var _ = Describe("Controller", func() {
 		return result
 	}
 
-	prepareAuthenticator := func(g Gomega) *Authenticator {
-		return NewAuthenticator(IT.SessionManager, IT.Client)
+	prepareAuthenticator := func(g Gomega) *auth.Authenticator {
+		return auth.NewAuthenticator(IT.SessionManager, IT.Client)
 	}
 	prepareController := func(g Gomega) *commonController {
 		tmpl, err := template.ParseFiles("../static/redirect_notice.html")
 		g.Expect(err).NotTo(HaveOccurred())
+		codec, err := oauthstate.NewCodec([]byte("secret"))
+		g.Expect(err).NotTo(HaveOccurred())
 		return &commonController{
 			Config: config.ServiceProviderConfiguration{
 				ClientId:            "clientId",
@@ -94,6 +97,7 @@ var _ = Describe("Controller", func() {
 				ServiceProviderType: config.ServiceProviderTypeGitHub,
 			},
 			JwtSigningSecret: []byte("secret"),
+			Codec:            &codec,
 			K8sClient:        IT.Client,
 			TokenStorage:     IT.TokenStorage,
 			Endpoint: oauth2.Endpoint{
@@ -104,11 +108,11 @@ var _ = Describe("Controller", func() {
 			BaseUrl:          "https://spi.on.my.machine",
 			Authenticator:    prepareAuthenticator(g),
 			RedirectTemplate: tmpl,
-			StateStorage:     NewStateStorage(IT.SessionManager),
+			StateStorage:     NewStateStorage(IT.SessionManager, nil, DefaultVeilEntropyBits),
 		}
 	}
 
-	loginFlow := func(g Gomega) (*Authenticator, *httptest.ResponseRecorder) {
+	loginFlow := func(g Gomega) (*auth.Authenticator, *httptest.ResponseRecorder) {
 		token := grabK8sToken(g)
 
 		// This is the setup for the HTTP call to /github/authenticate
@@ -228,6 +232,20 @@ var _ = Describe("Controller", func() {
 		Expect(cookie.Name).To(Equal("appstudio_spi_session"))
 	})
 
+	It("shows the session expired page for unknown state", func() {
+		req := httptest.NewRequest("GET", "/?state=unknown-veil&code=123", nil)
+		res := httptest.NewRecorder()
+
+		c := prepareController(Default)
+
+		IT.SessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.Callback(r.Context(), w, r)
+		})).ServeHTTP(res, req)
+
+		Expect(res.Code).To(Equal(http.StatusUnauthorized))
+		Expect(res.Body.String()).To(ContainSubstring("authorization session expired"))
+	})
+
 	When("OAuth initiated", func() {
 		BeforeEach(func() {
 			Expect(IT.Client.Create(IT.Context, &v1beta1.SPIAccessToken{
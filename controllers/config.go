@@ -14,26 +14,124 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
+	"text/template"
+	"time"
 
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
 )
 
+var (
+	canaryTokenNamespaceMissingError  = errors.New("the canary token namespace must be configured when the canary is enabled")
+	invalidSigningSecretRotateByError = errors.New("invalid JWT signing secret rotation time")
+)
+
 type OAuthServiceCliArgs struct {
 	config.CommonCliArgs
 	config.LoggingCliArgs
 	tokenstorage.VaultCliArgs
-	ServiceAddr     string `arg:"--service-addr, env" default:"0.0.0.0:8000" help:"Service address to listen on"`
+	ServiceAddr     string `arg:"--service-addr, env" default:":8000" help:"Comma-separated list of the service addresses to listen on. The addresses with a literal IP listen only on its IP stack (e.g. 0.0.0.0:8000 or [::]:8000), the ones with an empty host on both."`
 	AllowedOrigins  string `arg:"--allowed-origins, env" default:"https://console.dev.redhat.com,https://prod.foo.redhat.com:1337" help:"Comma-separated list of domains allowed for cross-domain requests"`
 	KubeConfig      string `arg:"--kubeconfig, env" default:"" help:""`
 	KubeInsecureTLS bool   `arg:"--kube-insecure-tls, env" default:"false" help:"Whether is allowed or not insecure kubernetes tls connection."`
 	ApiServer       string `arg:"--api-server, env:API_SERVER" default:"" help:"host:port of the Kubernetes API server to use when handling HTTP requests"`
 	ApiServerCAPath string `arg:"--ca-path, env:API_SERVER_CA_PATH" default:"" help:"the path to the CA certificate to use when connecting to the Kubernetes API server"`
+
+	KubeClientQPS   float32 `arg:"--kube-client-qps, env" default:"5" help:"The maximum number of queries per second to the Kubernetes API server"`
+	KubeClientBurst int     `arg:"--kube-client-burst, env" default:"10" help:"The maximum burst of queries to the Kubernetes API server"`
+
+	LogCaller bool `arg:"--log-caller, env" default:"true" help:"Whether to include the location of the log call in the logs. Use --log-caller=false to disable."`
+
+	TokenStorageCacheTTL time.Duration `arg:"--token-storage-cache-ttl, env" default:"0s" help:"How long the tokens read from the token storage are cached. The cache is disabled when zero."`
+	TokenMaxAge          time.Duration `arg:"--token-max-age, env" default:"0s" help:"The expiry given to the stored tokens for which the service provider reports none, counted from the time they are stored, so that they are rotated on schedule. Can be overridden per service provider using the tokenMaxAge extra key. Disabled when zero."`
+
+	UserInfoEnrichment bool `arg:"--user-info-enrichment, env" default:"false" help:"Whether to look up the username of the stored tokens that don't have one at the user info endpoint of their service provider. The endpoint is configured per service provider using the userInfoUrl, userInfoAuthStyle, userInfoUsernameField and userInfoIdField extra keys, GitHub and Quay have it by default."`
+
+	ClustersConfigFile string `arg:"--clusters-config-file, env" default:"" help:"The path to the YAML file with the member clusters and their namespaces. The requests for the namespaces of a member cluster are sent to its API server instead of the default one."`
+
+	SuccessNextStepUrl  string `arg:"--success-next-step-url, env" default:"" help:"Template of the URL offered to the user on the page shown after a successful OAuth flow. It can refer to {{.Namespace}}, {{.TokenName}} and {{.KcpWorkspace}} of the SPIAccessToken. No link is shown when empty."`
+	SuccessNextStepText string `arg:"--success-next-step-text, env" default:"Continue to AppStudio" help:"The text of the link offered on the page shown after a successful OAuth flow"`
+
+	SessionStoreMaxEntries int `arg:"--session-store-max-entries, env" default:"100000" help:"The maximum number of sessions kept in memory. The least recently used sessions are evicted when the limit is reached so that a flood of requests cannot exhaust the memory of the service. Unlimited when zero."`
+
+	SharedStateStore            bool   `arg:"--shared-state-store, env" default:"false" help:"Whether to also keep the OAuth states and the sessions in Vault so that the OAuth flow can be finished by another replica of the service when the sticky session breaks"`
+	SharedStateStoreVaultPath   string `arg:"--shared-state-store-vault-path, env" default:"spi/data/oauth/states" help:"The Vault path under which the shared OAuth states are kept"`
+	SharedSessionStoreVaultPath string `arg:"--shared-session-store-vault-path, env" default:"spi/data/oauth/sessions" help:"The Vault path under which the sessions are kept with the shared state store"`
+
+	FlowJournalVaultPath        string        `arg:"--flow-journal-vault-path, env" default:"spi/data/oauth/journal" help:"The Vault path under which the journal of the OAuth flows that are storing the obtained token is kept. The journal is only kept with the shared state store."`
+	FlowJournalRecoveryInterval time.Duration `arg:"--flow-journal-recovery-interval, env" default:"5m" help:"How often to look for the OAuth flows in the journal that were interrupted after obtaining the token from the service provider"`
+	CoordinationVaultPath       string        `arg:"--coordination-vault-path, env" default:"spi/data/oauth/coordination" help:"The Vault path under which the replicas of the service register their configuration to detect incompatible replicas. Only used with the shared state store."`
+	CoordinationTakeover        bool          `arg:"--coordination-takeover, env" default:"false" help:"Whether this replica replaces the configuration registered by the other replicas instead of refusing to start when they differ, e.g. to rotate the JWT signing secret with a rolling update. The replicas with the replaced configuration become unready."`
+	CoordinationTTL             time.Duration `arg:"--coordination-ttl, env" default:"2m" help:"How long the configuration registered by the replicas of the service is kept after the last of them stops"`
+
+	FlowHistorySize int `arg:"--flow-history-size, env" default:"0" help:"The number of the most recent OAuth flows kept in memory for the users to review on the flow history page. The history is disabled when zero. The service account of the service needs to be able to create the TokenReviews when enabled."`
+
+	WarmUp        bool          `arg:"--warm-up, env" default:"false" help:"Whether to establish the connections to Vault and the token endpoints of the service providers before starting to serve the requests, so that the first OAuth flows don't wait for them"`
+	WarmUpTimeout time.Duration `arg:"--warm-up-timeout, env" default:"30s" help:"How long the start of the service can be delayed by the warm-up"`
+
+	UploadSecrets                bool   `arg:"--upload-secrets, env" default:"false" help:"Whether to watch the Secrets labeled with spi.appstudio.redhat.com/upload-secret=token and upload their data as the token data of the SPIAccessTokens. The service uses its own credentials to watch and delete the Secrets, so only the Secrets in the namespaces labeled with spi.appstudio.redhat.com/upload-secrets=true are uploaded."`
+	UploadSecretNamespaces       string `arg:"--upload-secret-namespaces, env" default:"" help:"Comma-separated list of the namespaces in which the upload Secrets are watched. All namespaces are watched when empty."`
+	UploadSecretLeaderElectionID string `arg:"--upload-secret-leader-election-id, env" default:"spi-oauth-upload-secret" help:"The name of the Lease held by the replica of the service watching the upload Secrets"`
+	UploadOnBehalf               bool   `arg:"--upload-on-behalf, env" default:"false" help:"Whether the identities granted the impersonate verb on spiaccesstokendataupdates in a namespace can upload the token data there even though they cannot create the SPIAccessTokenDataUpdates themselves. The service uses its own credentials for such uploads."`
+
+	LeaderElection          bool   `arg:"--leader-election, env" default:"true" help:"Whether only one replica of the service at a time runs the watchers of the cluster, i.e. the upload Secret watcher and the token cleanup. The replicas need to be able to manage the Leases."`
+	LeaderElectionNamespace string `arg:"--leader-election-namespace, env" default:"" help:"The namespace of the Leases held by the replicas of the service running the watchers. The namespace the service runs in is used when empty, which requires running in the cluster."`
+
+	TokenCleanup                 bool   `arg:"--token-cleanup, env" default:"false" help:"Whether to put a finalizer on the SPIAccessTokens and, once they are deleted, revoke their tokens at the service providers configured with the revocationUrl and remove the token data from the token storage. The service uses its own credentials to watch and update the SPIAccessTokens."`
+	TokenCleanupLeaderElectionID string `arg:"--token-cleanup-leader-election-id, env" default:"spi-oauth-token-cleanup" help:"The name of the Lease held by the replica of the service cleaning up the tokens of the deleted SPIAccessTokens"`
+	TokenCleanupNamespaces       string `arg:"--token-cleanup-namespaces, env" default:"" help:"Comma-separated list of the namespaces in which the SPIAccessTokens are cleaned up after deletion. All namespaces are watched when empty."`
+
+	MaxConcurrentRequests int `arg:"--max-concurrent-requests, env" default:"0" help:"The maximum number of the requests handled concurrently. The requests over the limit wait and the interactive ones, like the OAuth callbacks, are served before the background ones, like the token uploads. Unlimited when zero."`
+
+	GrpcAddr         string `arg:"--grpc-addr, env" default:"" help:"Comma-separated list of the addresses the gRPC API for the token upload, metadata and deletion listens on. The gRPC API is disabled when empty."`
+	GrpcCertFile     string `arg:"--grpc-cert-file, env" default:"" help:"The path to the PEM-encoded certificate of the gRPC server"`
+	GrpcKeyFile      string `arg:"--grpc-key-file, env" default:"" help:"The path to the PEM-encoded private key of the gRPC server"`
+	GrpcClientCAFile string `arg:"--grpc-client-ca-file, env" default:"" help:"The path to the PEM-encoded CA certificates the client certificates of the gRPC clients must be signed by"`
+
+	JwtSigningSecretRotateBy string `arg:"--jwt-signing-secret-rotate-by, env" default:"" help:"The time by which the JWT signing secret should be rotated in the RFC 3339 format, e.g. 2023-01-31T00:00:00Z. If set, the days left are exposed in the metrics."`
+
+	ThemeProductName    string `arg:"--theme-product-name, env" default:"" help:"The product name shown in the titles of the pages rendered by the service"`
+	ThemeLogoUrl        string `arg:"--theme-logo-url, env" default:"" help:"The URL of the logo shown in the header of the pages rendered by the service instead of the default one"`
+	ThemePrimaryColor   string `arg:"--theme-primary-color, env" default:"" help:"The hexadecimal CSS color of the links and headings of the pages rendered by the service, e.g. #0066cc"`
+	ThemeSecondaryColor string `arg:"--theme-secondary-color, env" default:"" help:"The hexadecimal CSS color of the header background of the pages rendered by the service, replacing the default header image"`
+
+	AllowedInitiators  string  `arg:"--allowed-initiators, env" default:"" help:"Comma-separated list of the client applications, e.g. appstudio-ui,spi-cli, allowed to start the OAuth flows. The clients identify themselves using the initiator claim of the OAuth state, the X-SPI-Initiator header or the initiator query parameter. Any initiator is allowed when empty."`
+	RequireInitiator   bool    `arg:"--require-initiator, env" default:"false" help:"Whether to reject the OAuth flows started without identifying the client application"`
+	InitiatorRateLimit float64 `arg:"--initiator-rate-limit, env" default:"0" help:"The maximum number of the OAuth flows started per second by each of the allowed initiators. The flows of the other clients share a single limit. Unlimited when zero."`
+	InitiatorRateBurst int     `arg:"--initiator-rate-burst, env" default:"20" help:"The burst of the OAuth flows started by each of the allowed initiators over the initiator rate limit"`
+
+	StateEntropyBits int `arg:"--state-entropy-bits, env" default:"256" help:"The number of random bits in the OAuth states sent to the service providers. Must be a multiple of 8 and at least 128."`
+
+	CanaryInterval         time.Duration `arg:"--canary-interval, env" default:"0s" help:"How often to run the canary OAuth flow against the built-in fake service provider. The canary is disabled when zero."`
+	CanaryServiceUrl       string        `arg:"--canary-service-url, env" default:"http://localhost:8000" help:"The URL on which the canary can reach this service"`
+	CanaryTokenNamespace   string        `arg:"--canary-token-namespace, env" default:"" help:"The namespace of the SPIAccessToken the canary stores the fake token into"`
+	CanaryTokenName        string        `arg:"--canary-token-name, env" default:"spi-oauth-canary" help:"The name of the SPIAccessToken the canary stores the fake token into"`
+	CanaryK8sTokenFilePath string        `arg:"--canary-k8s-token-filepath, env" default:"/var/run/secrets/kubernetes.io/serviceaccount/token" help:"Filepath to the Kubernetes token the canary authenticates with. It needs to be able to create SPIAccessTokenDataUpdates in the canary namespace."`
 }
 
 type OAuthServiceConfiguration struct {
 	config.SharedConfiguration
+
+	// SuccessNextStepUrl is the template of the URL that the user can continue to after successfully finishing
+	// the OAuth flow. It is nil if no such link should be offered.
+	SuccessNextStepUrl *template.Template
+
+	// SuccessNextStepText is the text of the link to SuccessNextStepUrl.
+	SuccessNextStepText string
+
+	// StateEntropyBits is the number of random bits in the OAuth states sent to the service providers.
+	StateEntropyBits int
+
+	// SigningSecretRotateBy is the time by which the JWT signing secret should be rotated. It is zero if not known.
+	SigningSecretRotateBy time.Time
+
+	// Theme is the branding of the pages rendered by the service.
+	Theme Theme
+
+	// Initiators decides which client applications can start the OAuth flows.
+	Initiators InitiatorPolicy
 }
 
 func LoadOAuthServiceConfiguration(args OAuthServiceCliArgs) (OAuthServiceConfiguration, error) {
@@ -42,5 +140,44 @@ func LoadOAuthServiceConfiguration(args OAuthServiceCliArgs) (OAuthServiceConfig
 		return OAuthServiceConfiguration{}, fmt.Errorf("failed to load the configuration from file %s: %w", args.ConfigFile, err)
 	}
 
-	return OAuthServiceConfiguration{SharedConfiguration: baseCfg}, nil
+	cfg := OAuthServiceConfiguration{
+		SharedConfiguration: baseCfg,
+		SuccessNextStepText: args.SuccessNextStepText,
+		StateEntropyBits:    args.StateEntropyBits,
+	}
+
+	if args.CanaryInterval > 0 && args.CanaryTokenNamespace == "" {
+		return OAuthServiceConfiguration{}, canaryTokenNamespaceMissingError
+	}
+
+	if err = ValidateVeilEntropy(cfg.StateEntropyBits); err != nil {
+		return OAuthServiceConfiguration{}, fmt.Errorf("invalid state entropy configuration: %w", err)
+	}
+
+	if cfg.Theme, err = NewTheme(args.ThemeProductName, args.ThemeLogoUrl, args.ThemePrimaryColor, args.ThemeSecondaryColor); err != nil {
+		return OAuthServiceConfiguration{}, fmt.Errorf("invalid theme configuration: %w", err)
+	}
+
+	if cfg.Initiators, err = NewInitiatorPolicy(args.AllowedInitiators, args.RequireInitiator); err != nil {
+		return OAuthServiceConfiguration{}, fmt.Errorf("invalid initiator configuration: %w", err)
+	}
+	if args.InitiatorRateLimit > 0 {
+		cfg.Initiators = cfg.Initiators.WithRateLimit(args.InitiatorRateLimit, args.InitiatorRateBurst)
+	}
+
+	if args.JwtSigningSecretRotateBy != "" {
+		cfg.SigningSecretRotateBy, err = time.Parse(time.RFC3339, args.JwtSigningSecretRotateBy)
+		if err != nil {
+			return OAuthServiceConfiguration{}, fmt.Errorf("%w '%s': %s", invalidSigningSecretRotateByError, args.JwtSigningSecretRotateBy, err.Error())
+		}
+	}
+
+	if args.SuccessNextStepUrl != "" {
+		cfg.SuccessNextStepUrl, err = template.New("successNextStepUrl").Option("missingkey=error").Parse(args.SuccessNextStepUrl)
+		if err != nil {
+			return OAuthServiceConfiguration{}, fmt.Errorf("failed to parse the success next step URL template: %w", err)
+		}
+	}
+
+	return cfg, nil
 }
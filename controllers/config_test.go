@@ -14,10 +14,12 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/alexflint/go-arg"
 )
@@ -41,6 +43,17 @@ func TestK8sConfigParse(t *testing.T) {
 	}
 }
 
+func TestKubeClientConfigParse(t *testing.T) {
+	args := OAuthServiceCliArgs{}
+	_, err := parseWithEnv("--kube-client-qps 50 --kube-client-burst 100", nil, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.KubeClientQPS != 50 || args.KubeClientBurst != 100 {
+		t.Fatal("Unable to parse the kubernetes client QPS and burst")
+	}
+}
+
 func TestCorsConfigParse(t *testing.T) {
 	//given
 	cmd := ""
@@ -57,6 +70,89 @@ func TestCorsConfigParse(t *testing.T) {
 	}
 }
 
+func TestSuccessNextStepUrlConfig(t *testing.T) {
+	cfgFile, err := os.CreateTemp(t.TempDir(), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfgFile.WriteString("sharedSecret: secret\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	args := OAuthServiceCliArgs{}
+	args.ConfigFile = cfgFile.Name()
+	args.StateEntropyBits = DefaultVeilEntropyBits
+	args.SuccessNextStepUrl = "https://acme.com/{{.Namespace}}/{{.TokenName}}"
+
+	cfg, err := LoadOAuthServiceConfiguration(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SuccessNextStepUrl == nil {
+		t.Fatal("The success next step URL template not parsed")
+	}
+
+	args.SuccessNextStepUrl = "https://acme.com/{{.Namespace"
+	if _, err = LoadOAuthServiceConfiguration(args); err == nil {
+		t.Fatal("Invalid success next step URL template should fail the configuration loading")
+	}
+}
+
+func TestStateEntropyConfig(t *testing.T) {
+	cfgFile, err := os.CreateTemp(t.TempDir(), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfgFile.WriteString("sharedSecret: secret\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	args := OAuthServiceCliArgs{}
+	args.ConfigFile = cfgFile.Name()
+	args.StateEntropyBits = 512
+
+	cfg, err := LoadOAuthServiceConfiguration(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.StateEntropyBits != 512 {
+		t.Fatal("Unable to configure the state entropy")
+	}
+
+	args.StateEntropyBits = 64
+	if _, err = LoadOAuthServiceConfiguration(args); err == nil {
+		t.Fatal("Too low state entropy should fail the configuration loading")
+	}
+}
+
+func TestSigningSecretRotateByConfig(t *testing.T) {
+	cfgFile, err := os.CreateTemp(t.TempDir(), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cfgFile.WriteString("sharedSecret: secret\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	args := OAuthServiceCliArgs{}
+	args.ConfigFile = cfgFile.Name()
+	args.StateEntropyBits = DefaultVeilEntropyBits
+	args.JwtSigningSecretRotateBy = "2023-01-31T00:00:00Z"
+
+	cfg, err := LoadOAuthServiceConfiguration(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.SigningSecretRotateBy.Equal(time.Date(2023, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Fatal("Unable to configure the JWT signing secret rotation time")
+	}
+
+	args.JwtSigningSecretRotateBy = "next month"
+	if _, err = LoadOAuthServiceConfiguration(args); !errors.Is(err, invalidSigningSecretRotateByError) {
+		t.Fatal("Invalid rotation time should fail the configuration loading")
+	}
+}
+
 func parseWithEnv(cmdline string, env []string, dest interface{}) (*arg.Parser, error) {
 	p, err := arg.NewParser(arg.Config{}, dest)
 	if err != nil {
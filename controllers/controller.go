@@ -16,19 +16,42 @@ package controllers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
 
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 )
 
 var (
-	notImplementedError = errors.New("not implemented yet")
+	notImplementedError   = errors.New("not implemented yet")
+	unknownAuthStyleError = errors.New("unknown auth style")
+
+	invalidIncrementalAuthorizationError = errors.New("invalid incremental authorization setting")
 )
 
+// authStyleExtraKey is the key in the extra configuration of the service provider specifying how the client
+// credentials are sent to the token endpoint of the service provider. The possible values are "header" for the HTTP
+// Basic authentication, "params" for the form parameters and "auto" (the default) for trying both.
+const authStyleExtraKey = "authStyle"
+
+// incrementalAuthorizationExtraKey is the key in the extra configuration of the service provider specifying whether
+// the service provider supports the incremental authorization using the `include_granted_scopes` parameter. If it does,
+// only the scopes that are not granted yet are requested from the users when a token already exists.
+const incrementalAuthorizationExtraKey = "incrementalAuthorization"
+
+// redirectTemplateExtraKey is the key in the extra configuration of the service provider specifying the path to
+// the template of the redirect notice page shown before the users are redirected to the service provider. This can be
+// used to give the users instructions specific to the service provider. If not specified, the global redirect notice
+// template is used.
+const redirectTemplateExtraKey = "redirectTemplate"
+
 // Controller implements the OAuth flow. There are specific implementations for each service provider type. These
 // are usually instances of the commonController with service-provider-specific configuration.
 type Controller interface {
@@ -36,6 +59,11 @@ type Controller interface {
 	// compose the authenticated OAuth state and return a redirect to the service-provider OAuth endpoint with the state.
 	Authenticate(w http.ResponseWriter, r *http.Request)
 
+	// AuthorizationUrl starts the OAuth flow with the provided state the same way as Authenticate but returns the URL
+	// of the service provider the user needs to visit instead of responding with the redirect notice. If the flow
+	// cannot be started, the error is written to the response and false is returned.
+	AuthorizationUrl(w http.ResponseWriter, r *http.Request, state string) (string, bool)
+
 	// Callback finishes the OAuth flow. It handles the final redirect from the OAuth flow of the service provider.
 	Callback(ctx context.Context, w http.ResponseWriter, r *http.Request)
 }
@@ -52,33 +80,130 @@ const (
 
 // FromConfiguration is a factory function to create instances of the Controller based on the service provider
 // configuration.
-func FromConfiguration(fullConfig OAuthServiceConfiguration, spConfig config.ServiceProviderConfiguration, authenticator *Authenticator, stateStorage *StateStorage, cl AuthenticatingClient, storage tokenstorage.TokenStorage, redirectTemplate *template.Template) (Controller, error) {
+func FromConfiguration(fullConfig OAuthServiceConfiguration, spConfig config.ServiceProviderConfiguration, authenticator *auth.Authenticator, stateStorage *StateStorage, journal *FlowJournal, history *FlowHistory, cl auth.AuthenticatingClient, storage tokenstorage.TokenStorage, redirectTemplate *template.Template) (Controller, error) {
 	// use the notifying token storage to automatically inform the cluster about changes in the token storage
 	ts := &tokenstorage.NotifyingTokenStorage{
 		Client:       cl,
 		TokenStorage: storage,
 	}
 
-	var endpoint oauth2.Endpoint
+	endpoint, err := endpointFromConfiguration(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	authStyle, err := authStyleFromConfiguration(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	incrementalAuthorization, err := incrementalAuthorizationFromConfiguration(spConfig)
+	if err != nil {
+		return nil, err
+	}
 
+	reauthentication, err := reauthenticationPolicyFromConfiguration(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenTransformers, err := tokenTransformersFromConfiguration(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	providerRedirectTemplate, err := redirectTemplateFromConfiguration(spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	callbackHosts, err := CallbackHosts(fullConfig.BaseUrl, spConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// the codec is shared by all the requests of the controller, the signer it uses is safe for concurrent use
+	codec, err := oauthstate.NewCodec(fullConfig.SharedSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWT codec: %w", err)
+	}
+
+	return &commonController{
+		Config:                   spConfig,
+		JwtSigningSecret:         fullConfig.SharedSecret,
+		Codec:                    &codec,
+		K8sClient:                cl,
+		TokenStorage:             ts,
+		Endpoint:                 endpoint,
+		AuthStyle:                authStyle,
+		IncrementalAuthz:         incrementalAuthorization,
+		Reauthentication:         reauthentication,
+		TokenTransformers:        tokenTransformers,
+		Initiators:               fullConfig.Initiators,
+		CallbackHosts:            callbackHosts,
+		BaseUrl:                  fullConfig.BaseUrl,
+		Authenticator:            authenticator,
+		StateStorage:             stateStorage,
+		FlowJournal:              journal,
+		FlowHistory:              history,
+		RedirectTemplate:         redirectTemplate,
+		ProviderRedirectTemplate: providerRedirectTemplate,
+	}, nil
+}
+
+// endpointFromConfiguration returns the OAuth endpoints of the service provider.
+func endpointFromConfiguration(spConfig config.ServiceProviderConfiguration) (oauth2.Endpoint, error) {
 	switch spConfig.ServiceProviderType {
 	case config.ServiceProviderTypeGitHub:
-		endpoint = github.Endpoint
+		return github.Endpoint, nil
 	case config.ServiceProviderTypeQuay:
-		endpoint = quayEndpoint
+		return quayEndpoint, nil
+	case CanaryServiceProviderType:
+		return canaryEndpoint(spConfig.ServiceProviderBaseUrl), nil
 	default:
-		return nil, notImplementedError
+		return oauth2.Endpoint{}, notImplementedError
 	}
+}
 
-	return &commonController{
-		Config:           spConfig,
-		JwtSigningSecret: fullConfig.SharedSecret,
-		K8sClient:        cl,
-		TokenStorage:     ts,
-		Endpoint:         endpoint,
-		BaseUrl:          fullConfig.BaseUrl,
-		Authenticator:    authenticator,
-		StateStorage:     stateStorage,
-		RedirectTemplate: redirectTemplate,
-	}, nil
+// authStyleFromConfiguration reads the auth style of the token endpoint from the extra configuration of the service
+// provider.
+func authStyleFromConfiguration(spConfig config.ServiceProviderConfiguration) (oauth2.AuthStyle, error) {
+	switch style := spConfig.Extra[authStyleExtraKey]; style {
+	case "", "auto":
+		return oauth2.AuthStyleAutoDetect, nil
+	case "header":
+		return oauth2.AuthStyleInHeader, nil
+	case "params":
+		return oauth2.AuthStyleInParams, nil
+	default:
+		return oauth2.AuthStyleAutoDetect, fmt.Errorf("%w '%s' configured for service provider %s", unknownAuthStyleError, style, spConfig.ServiceProviderType)
+	}
+}
+
+// incrementalAuthorizationFromConfiguration reads whether the service provider supports the incremental authorization
+// from the extra configuration of the service provider.
+func incrementalAuthorizationFromConfiguration(spConfig config.ServiceProviderConfiguration) (bool, error) {
+	value := spConfig.Extra[incrementalAuthorizationExtraKey]
+	if value == "" {
+		return false, nil
+	}
+	incremental, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%w '%s' configured for service provider %s", invalidIncrementalAuthorizationError, value, spConfig.ServiceProviderType)
+	}
+	return incremental, nil
+}
+
+// redirectTemplateFromConfiguration parses the redirect notice template configured for the service provider in its
+// extra configuration. Returns nil if the service provider doesn't have its own template.
+func redirectTemplateFromConfiguration(spConfig config.ServiceProviderConfiguration) (*template.Template, error) {
+	path := spConfig.Extra[redirectTemplateExtraKey]
+	if path == "" {
+		return nil, nil
+	}
+	tmpl, err := ParsePageTemplate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the redirect notice template configured for service provider %s: %w", spConfig.ServiceProviderType, err)
+	}
+	return tmpl, nil
 }
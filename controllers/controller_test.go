@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestFromConfigurationAuthStyle(t *testing.T) {
+	newController := func(authStyle string) (Controller, error) {
+		spConfig := config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeQuay}
+		if authStyle != "" {
+			spConfig.Extra = map[string]string{authStyleExtraKey: authStyle}
+		}
+		return FromConfiguration(OAuthServiceConfiguration{}, spConfig, nil, nil, nil, nil, nil, nil, nil)
+	}
+
+	for authStyle, expected := range map[string]oauth2.AuthStyle{
+		"":       oauth2.AuthStyleAutoDetect,
+		"auto":   oauth2.AuthStyleAutoDetect,
+		"header": oauth2.AuthStyleInHeader,
+		"params": oauth2.AuthStyleInParams,
+	} {
+		controller, err := newController(authStyle)
+		assert.NoError(t, err)
+		oauthCfg := controller.(*commonController).newOAuth2Config(quayEndpoint)
+		assert.Equal(t, expected, oauthCfg.Endpoint.AuthStyle, "auth style: '%s'", authStyle)
+		assert.Equal(t, quayEndpoint.TokenURL, oauthCfg.Endpoint.TokenURL)
+	}
+
+	_, err := newController("basic")
+	assert.True(t, errors.Is(err, unknownAuthStyleError))
+}
+
+func TestFromConfigurationIncrementalAuthorization(t *testing.T) {
+	newController := func(incremental string) (Controller, error) {
+		spConfig := config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeQuay}
+		if incremental != "" {
+			spConfig.Extra = map[string]string{incrementalAuthorizationExtraKey: incremental}
+		}
+		return FromConfiguration(OAuthServiceConfiguration{}, spConfig, nil, nil, nil, nil, nil, nil, nil)
+	}
+
+	for incremental, expected := range map[string]bool{"": false, "false": false, "true": true} {
+		controller, err := newController(incremental)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, controller.(*commonController).IncrementalAuthz, "incremental authorization: '%s'", incremental)
+	}
+
+	_, err := newController("sometimes")
+	assert.True(t, errors.Is(err, invalidIncrementalAuthorizationError))
+}
+
+func TestFromConfigurationRedirectTemplate(t *testing.T) {
+	globalTemplate := template.Must(template.New("global").Parse("global {{.Url}}"))
+	newController := func(redirectTemplate string) (Controller, error) {
+		spConfig := config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeQuay}
+		if redirectTemplate != "" {
+			spConfig.Extra = map[string]string{redirectTemplateExtraKey: redirectTemplate}
+		}
+		return FromConfiguration(OAuthServiceConfiguration{}, spConfig, nil, nil, nil, nil, nil, nil, globalTemplate)
+	}
+
+	t.Run("uses the global template by default", func(t *testing.T) {
+		controller, err := newController("")
+		assert.NoError(t, err)
+		assert.Same(t, globalTemplate, controller.(*commonController).redirectTemplate())
+	})
+
+	t.Run("uses the template of the provider", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "quay.html")
+		assert.NoError(t, os.WriteFile(path, []byte("quay {{.Url}}"), 0600))
+
+		controller, err := newController(path)
+		assert.NoError(t, err)
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, controller.(*commonController).redirectTemplate().Execute(buf, struct{ Url string }{Url: "https://quay.io"}))
+		assert.Equal(t, "quay https://quay.io", buf.String())
+	})
+
+	t.Run("fails on invalid template", func(t *testing.T) {
+		_, err := newController(filepath.Join(t.TempDir(), "non-existent.html"))
+		assert.Error(t, err)
+	})
+}
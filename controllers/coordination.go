@@ -0,0 +1,289 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// coordinationKey is the key of the configuration of the deployment in the coordination store.
+const coordinationKey = "configuration"
+
+// leaseKeyPrefix is the prefix of the keys of the leases in the coordination store.
+const leaseKeyPrefix = "lease-"
+
+var (
+	incompatibleInstanceError  = errors.New("the configuration of this instance is incompatible with the other instances of the deployment")
+	corruptedCoordinationError = errors.New("corrupted coordination record")
+)
+
+// InstanceIdentity identifies the running instance of the service among the other replicas of the deployment.
+type InstanceIdentity struct {
+	// Id is the name of the pod of the instance, or a random string when the host name is not known.
+	Id string
+	// StartedAt is the time the instance started.
+	StartedAt time.Time
+}
+
+// NewInstanceIdentity returns the identity of this instance of the service.
+func NewInstanceIdentity() (InstanceIdentity, error) {
+	id, err := os.Hostname()
+	if err != nil || id == "" {
+		if id, err = NewVeil(MinVeilEntropyBits); err != nil {
+			return InstanceIdentity{}, fmt.Errorf("failed to generate the instance id: %w", err)
+		}
+	}
+	return InstanceIdentity{Id: id, StartedAt: time.Now()}, nil
+}
+
+// Lease is the lease making sure that a job runs on a single instance of the deployment at a time. It is implemented
+// by the Coordinator.
+type Lease interface {
+	// AcquireLease acquires or renews the named lease for the ttl. Returns false if another instance holds it.
+	AcquireLease(ctx context.Context, name string, ttl time.Duration) (bool, error)
+}
+
+// leaseRecord is the record of a lease in the coordination store. The lease expires together with the record.
+type leaseRecord struct {
+	// InstanceId is the id of the instance holding the lease.
+	InstanceId string `json:"instanceId"`
+}
+
+// coordinationRecord is the configuration the instances of the deployment need to agree on, as registered by
+// the instances in the coordination store.
+type coordinationRecord struct {
+	// BaseUrl is the base URL of the service, the callbacks of the OAuth flows started by one instance can be handled
+	// by another one only if they agree on it.
+	BaseUrl string `json:"baseUrl"`
+	// SigningSecretDigest identifies the secret signing the OAuth states and the page markers without revealing it.
+	SigningSecretDigest string `json:"signingSecretDigest"`
+	// InstanceId is the id of the instance that last refreshed the record.
+	InstanceId string `json:"instanceId"`
+	// RefreshedAt is the time the record was last refreshed.
+	RefreshedAt time.Time `json:"refreshedAt"`
+}
+
+// differences returns the names of the configuration settings in which the records differ.
+func (r coordinationRecord) differences(other coordinationRecord) []string {
+	var diffs []string
+	if r.BaseUrl != other.BaseUrl {
+		diffs = append(diffs, "the base URL")
+	}
+	if !hmac.Equal([]byte(r.SigningSecretDigest), []byte(other.SigningSecretDigest)) {
+		diffs = append(diffs, "the JWT signing secret")
+	}
+	return diffs
+}
+
+// Coordinator makes sure that all the instances of the deployment sharing the OAuth states have compatible
+// configurations. The first instance registers its configuration in the coordination store, the others compare
+// theirs with it. The record is refreshed by the running instances and expires after the TTL once all of them are
+// gone, so that the deployment can be reconfigured by stopping all its instances.
+type Coordinator struct {
+	// Takeover makes this instance replace the registered configuration instead of refusing to join when they differ.
+	// This lets a rolling update change the configuration, e.g. rotate the JWT signing secret. The instances with
+	// the replaced configuration become unready once they notice. The configuration is only taken over when joining,
+	// so that the instances left with the flag after the rollout don't keep replacing each other's configurations.
+	Takeover bool
+
+	store    scs.Store
+	identity InstanceIdentity
+	record   coordinationRecord
+	ttl      time.Duration
+
+	lock sync.Mutex
+	// conflict is the incompatibility with the registered configuration found by the last check, if any
+	conflict error
+}
+
+// NewCoordinator creates the coordinator of the instance with the given configuration keeping the record in the store.
+func NewCoordinator(store scs.Store, identity InstanceIdentity, baseUrl string, jwtSigningSecret []byte, ttl time.Duration) *Coordinator {
+	// the digest is keyed so that it is not a plain hash of the secret
+	mac := hmac.New(sha256.New, jwtSigningSecret)
+	mac.Write([]byte(coordinationKey))
+	return &Coordinator{
+		store:    store,
+		identity: identity,
+		record: coordinationRecord{
+			BaseUrl:             strings.TrimSuffix(baseUrl, "/"),
+			SigningSecretDigest: hex.EncodeToString(mac.Sum(nil)),
+			InstanceId:          identity.Id,
+		},
+		ttl: ttl,
+	}
+}
+
+// Join registers the configuration of this instance in the coordination store or checks that it is compatible with
+// the configuration already registered by the other instances. Returns incompatibleInstanceError if it isn't.
+func (c *Coordinator) Join(ctx context.Context) error {
+	if err := c.refresh(ctx, c.Takeover); err != nil {
+		return err
+	}
+	// two instances may have registered at the same time, only one of them won
+	return c.check(ctx)
+}
+
+// Start periodically refreshes the record of the configuration so that it doesn't expire while this instance runs.
+// The conflicts with the other instances detected in the meantime are logged. Returns when the context is done.
+func (c *Coordinator) Start(ctx context.Context) {
+	lg := log.FromContext(ctx)
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.refresh(ctx, false); err != nil {
+			// the incompatibility is reported by the readiness, so that the instance stops receiving requests
+			lg.Error(err, "failed to refresh the coordination record", "instanceId", c.identity.Id)
+		} else {
+			lg.V(logs.DebugLevel).Info("coordination record refreshed", "instanceId", c.identity.Id)
+		}
+	}
+}
+
+// Ready returns incompatibleInstanceError if the configuration registered by the other instances was found to differ
+// from the configuration of this instance, e.g. because it was replaced by a newer instance taking over.
+func (c *Coordinator) Ready() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conflict
+}
+
+// refresh writes the record of this instance into the store unless there is a record of an incompatible
+// configuration and this instance doesn't take it over.
+func (c *Coordinator) refresh(ctx context.Context, takeover bool) error {
+	if err := c.check(ctx); err != nil {
+		if !takeover || !errors.Is(err, incompatibleInstanceError) {
+			return err
+		}
+		log.FromContext(ctx).Info("replacing the configuration registered by the other instances", "instanceId", c.identity.Id)
+	}
+	record := c.record
+	record.RefreshedAt = time.Now()
+	b, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the coordination record: %w", err)
+	}
+	if err = c.store.Commit(coordinationKey, b, record.RefreshedAt.Add(c.ttl)); err != nil {
+		return fmt.Errorf("failed to write the coordination record: %w", err)
+	}
+	return nil
+}
+
+// check compares the configuration of this instance with the registered one, if any. The incompatibility found is
+// remembered for the readiness.
+func (c *Coordinator) check(ctx context.Context) error {
+	b, found, err := c.store.Find(coordinationKey)
+	if err != nil {
+		return fmt.Errorf("failed to read the coordination record: %w", err)
+	}
+	registered := coordinationRecord{}
+	if found {
+		if err = json.Unmarshal(b, &registered); err != nil {
+			return fmt.Errorf("%w: %s", corruptedCoordinationError, err.Error())
+		}
+	}
+
+	var conflict error
+	if diffs := registered.differences(c.record); found && len(diffs) > 0 {
+		log.FromContext(ctx).Error(incompatibleInstanceError, "the configuration differs from the registered one", "instanceId", c.identity.Id, "registeredBy", registered.InstanceId, "differences", diffs)
+		conflict = fmt.Errorf("%w: %s differ from the configuration registered by instance %s at %s", incompatibleInstanceError, strings.Join(diffs, " and "), registered.InstanceId, registered.RefreshedAt.Format(time.RFC3339))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conflict = conflict
+	return conflict
+}
+
+// AcquireLease acquires the named lease for this instance, or renews it if this instance already holds it, for the ttl.
+// Returns false if another instance holds the lease. This is used to run the background jobs, e.g. the recovery of
+// the flow journal, on a single instance of the deployment. The store cannot compare and swap, so the lease is read
+// back after it is written and the instance that wrote it last holds it.
+func (c *Coordinator) AcquireLease(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	key := leaseKeyPrefix + name
+	holder, err := c.leaseHolder(key)
+	if err != nil {
+		return false, err
+	}
+	if holder != "" && holder != c.identity.Id {
+		log.FromContext(ctx).V(logs.DebugLevel).Info("lease held by another instance", "lease", name, "instanceId", c.identity.Id, "holder", holder)
+		return false, nil
+	}
+
+	b, err := json.Marshal(leaseRecord{InstanceId: c.identity.Id})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal the lease record: %w", err)
+	}
+	if err = c.store.Commit(key, b, time.Now().Add(ttl)); err != nil {
+		return false, fmt.Errorf("failed to write the lease record: %w", err)
+	}
+
+	if holder, err = c.leaseHolder(key); err != nil {
+		return false, err
+	}
+	return holder == c.identity.Id, nil
+}
+
+// leaseHolder returns the id of the instance holding the lease with the key, or an empty string if it's not held.
+func (c *Coordinator) leaseHolder(key string) (string, error) {
+	b, found, err := c.store.Find(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the lease record: %w", err)
+	}
+	if !found {
+		return "", nil
+	}
+	lease := leaseRecord{}
+	if err = json.Unmarshal(b, &lease); err != nil {
+		return "", fmt.Errorf("%w: %s", corruptedCoordinationError, err.Error())
+	}
+	return lease.InstanceId, nil
+}
+
+// holdsLease acquires the named lease and returns whether this instance holds it. A nil lease is always held, the job
+// then runs on every instance. The failures to acquire the lease are logged and the lease is not held.
+func holdsLease(ctx context.Context, lease Lease, name string, ttl time.Duration) bool {
+	if lease == nil {
+		return true
+	}
+	lg := log.FromContext(ctx)
+	held, err := lease.AcquireLease(ctx, name, ttl)
+	if err != nil {
+		lg.Error(err, "failed to acquire the lease", "lease", name)
+		return false
+	}
+	if !held {
+		lg.V(logs.DebugLevel).Info("the leased job runs on another instance", "lease", name)
+	}
+	return held
+}
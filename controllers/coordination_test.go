@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoordinatorJoin(t *testing.T) {
+	store := memstore.NewWithCleanupInterval(0)
+	ctx := context.TODO()
+
+	first := NewCoordinator(store, InstanceIdentity{Id: "first"}, "https://spi.example.com", []byte("secret"), time.Minute)
+	assert.NoError(t, first.Join(ctx))
+
+	t.Run("compatible", func(t *testing.T) {
+		// the trailing slash doesn't make a difference
+		second := NewCoordinator(store, InstanceIdentity{Id: "second"}, "https://spi.example.com/", []byte("secret"), time.Minute)
+		assert.NoError(t, second.Join(ctx))
+	})
+
+	t.Run("different base url", func(t *testing.T) {
+		second := NewCoordinator(store, InstanceIdentity{Id: "second"}, "https://other.example.com", []byte("secret"), time.Minute)
+		err := second.Join(ctx)
+		assert.True(t, errors.Is(err, incompatibleInstanceError))
+		assert.Contains(t, err.Error(), "base URL")
+	})
+
+	t.Run("different secret", func(t *testing.T) {
+		second := NewCoordinator(store, InstanceIdentity{Id: "second"}, "https://spi.example.com", []byte("s3cr3t"), time.Minute)
+		err := second.Join(ctx)
+		assert.True(t, errors.Is(err, incompatibleInstanceError))
+		assert.Contains(t, err.Error(), "JWT signing secret")
+		assert.NotContains(t, err.Error(), "s3cr3t")
+	})
+}
+
+func TestCoordinatorRecordExpires(t *testing.T) {
+	store := memstore.NewWithCleanupInterval(0)
+	ctx := context.TODO()
+
+	first := NewCoordinator(store, InstanceIdentity{Id: "first"}, "https://spi.example.com", []byte("secret"), 10*time.Millisecond)
+	assert.NoError(t, first.Join(ctx))
+
+	time.Sleep(20 * time.Millisecond)
+
+	// all the old replicas are gone, so the new configuration can be registered
+	second := NewCoordinator(store, InstanceIdentity{Id: "second"}, "https://other.example.com", []byte("other"), time.Minute)
+	assert.NoError(t, second.Join(ctx))
+	assert.Error(t, first.Join(ctx))
+}
+
+func TestCoordinatorTakeover(t *testing.T) {
+	store := memstore.NewWithCleanupInterval(0)
+	ctx := context.TODO()
+
+	old := NewCoordinator(store, InstanceIdentity{Id: "old"}, "https://spi.example.com", []byte("secret"), time.Minute)
+	assert.NoError(t, old.Join(ctx))
+	assert.NoError(t, old.Ready())
+
+	// the rolling update rotating the secret starts a new replica while the old one still runs
+	rotated := NewCoordinator(store, InstanceIdentity{Id: "rotated"}, "https://spi.example.com", []byte("rotated"), time.Minute)
+	assert.True(t, errors.Is(rotated.Join(ctx), incompatibleInstanceError))
+	assert.True(t, errors.Is(rotated.Ready(), incompatibleInstanceError))
+
+	rotated.Takeover = true
+	assert.NoError(t, rotated.Join(ctx))
+	assert.NoError(t, rotated.Ready())
+
+	// the old replica notices on the next refresh and becomes unready instead of taking the record back
+	assert.True(t, errors.Is(old.refresh(ctx, false), incompatibleInstanceError))
+	assert.True(t, errors.Is(old.Ready(), incompatibleInstanceError))
+	assert.NoError(t, rotated.check(ctx))
+
+	// the replicas with the rotated secret don't need to take over anymore
+	another := NewCoordinator(store, InstanceIdentity{Id: "another"}, "https://spi.example.com", []byte("rotated"), time.Minute)
+	assert.NoError(t, another.Join(ctx))
+
+	// the instance left with the flag doesn't take the configuration over again once it's running
+	misconfigured := NewCoordinator(store, InstanceIdentity{Id: "misconfigured"}, "https://spi.example.com", []byte("other"), time.Minute)
+	misconfigured.Takeover = true
+	assert.NoError(t, misconfigured.Join(ctx))
+	rotated.Takeover = true
+	runCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	rotated.ttl = 30 * time.Millisecond
+	rotated.Start(runCtx)
+	assert.True(t, errors.Is(rotated.Ready(), incompatibleInstanceError))
+	assert.NoError(t, misconfigured.check(ctx))
+}
+
+func TestCoordinatorCorruptedRecord(t *testing.T) {
+	store := memstore.NewWithCleanupInterval(0)
+	assert.NoError(t, store.Commit(coordinationKey, []byte("not json"), time.Now().Add(time.Minute)))
+
+	c := NewCoordinator(store, InstanceIdentity{Id: "first"}, "https://spi.example.com", []byte("secret"), time.Minute)
+	assert.True(t, errors.Is(c.Join(context.TODO()), corruptedCoordinationError))
+}
+
+func TestCoordinatorLease(t *testing.T) {
+	store := memstore.NewWithCleanupInterval(0)
+	ctx := context.TODO()
+
+	first := NewCoordinator(store, InstanceIdentity{Id: "first"}, "https://spi.example.com", []byte("secret"), time.Minute)
+	second := NewCoordinator(store, InstanceIdentity{Id: "second"}, "https://spi.example.com", []byte("secret"), time.Minute)
+
+	held, err := first.AcquireLease(ctx, "job", 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, held)
+
+	// the holder renews the lease, the others don't get it
+	held, err = first.AcquireLease(ctx, "job", 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, held)
+	held, err = second.AcquireLease(ctx, "job", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, held)
+
+	// the other leases are independent
+	held, err = second.AcquireLease(ctx, "other-job", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, held)
+
+	// the lease expires once the holder stops renewing it
+	time.Sleep(20 * time.Millisecond)
+	held, err = second.AcquireLease(ctx, "job", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, held)
+	held, err = first.AcquireLease(ctx, "job", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, held)
+}
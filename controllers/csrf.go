@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/middleware"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// CsrfCookieName is the name of the cookie with the anti-CSRF token of the browser.
+	CsrfCookieName = "appstudio_spi_csrf"
+	// csrfFormField is the form field in which the HTML forms send the anti-CSRF token back.
+	csrfFormField = "csrf_token"
+	// csrfTokenEntropyBits is the entropy of the anti-CSRF tokens.
+	csrfTokenEntropyBits = 256
+)
+
+var csrfCheckFailedError = spierrors.WithKind(spierrors.Forbidden, errors.New("the request is not authenticated by a bearer token and has neither a valid anti-CSRF token nor a trusted origin"))
+
+// WithCsrfProtection returns a middleware protecting the state-mutating requests from cross-site request forgery.
+// The requests carrying a bearer token in the Authorization header are let through, because browsers never attach
+// that on their own. The other requests with unsafe methods need either the anti-CSRF token from the CsrfCookieName
+// cookie in the middleware.CsrfHeaderName header or in the `csrf_token` form field (the double-submit cookie), or
+// an Origin (or Referer) header of the service itself or of one of the trusted origins. The others are rejected with
+// http.StatusForbidden. The safe requests get the anti-CSRF token issued if they don't have one yet.
+func WithCsrfProtection(trustedOrigins []string) Middleware {
+	trusted := map[string]bool{}
+	for _, o := range trustedOrigins {
+		trusted[strings.TrimSuffix(strings.TrimSpace(o), "/")] = true
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isSafeMethod(r.Method) {
+				issueCsrfToken(w, r)
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			switch {
+			case auth.ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization")) != "":
+			case hasValidCsrfToken(r):
+			case isTrustedOrigin(r, trusted):
+			default:
+				log.FromContext(r.Context()).V(logs.DebugLevel).Info("rejecting the possibly forged cross-site request", "origin", r.Header.Get("Origin"), "referer", r.Header.Get("Referer"))
+				logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(csrfCheckFailedError), "failed to process the request", csrfCheckFailedError)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isSafeMethod tells whether the requests with the HTTP method are not supposed to change any state.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// issueCsrfToken sets the anti-CSRF token cookie if the request doesn't have it yet and exposes the token in
+// the response header.
+func issueCsrfToken(w http.ResponseWriter, r *http.Request) {
+	token := ""
+	if cookie, err := r.Cookie(CsrfCookieName); err == nil && cookie.Value != "" {
+		token = cookie.Value
+	} else {
+		var err error
+		if token, err = NewVeil(csrfTokenEntropyBits); err != nil {
+			log.FromContext(r.Context()).Error(err, "failed to generate the anti-CSRF token")
+			return
+		}
+		// the cookie needs to reach the service from the pages of the allowed origins, same as the session cookie
+		http.SetCookie(w, &http.Cookie{
+			Name:     CsrfCookieName,
+			Value:    token,
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+	// the UIs on the allowed origins can't read the cookie of the service, so they learn the token from the header
+	w.Header().Set(middleware.CsrfHeaderName, token)
+}
+
+// hasValidCsrfToken tells whether the request sends back the anti-CSRF token from its cookie.
+func hasValidCsrfToken(r *http.Request) bool {
+	cookie, err := r.Cookie(CsrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	sent := r.Header.Get(middleware.CsrfHeaderName)
+	if sent == "" && hasFormBody(r) {
+		sent = r.PostFormValue(csrfFormField)
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) == 1
+}
+
+// hasFormBody tells whether the body of the request is an HTML form.
+func hasFormBody(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data")
+}
+
+// isTrustedOrigin tells whether the request comes from a page of the service itself or of one of the trusted origins.
+// The Referer is only consulted if there is no Origin header.
+func isTrustedOrigin(r *http.Request, trusted map[string]bool) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		referer, err := url.Parse(r.Header.Get("Referer"))
+		if err != nil || referer.Host == "" {
+			return false
+		}
+		origin = referer.Scheme + "://" + referer.Host
+	}
+	if trusted[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
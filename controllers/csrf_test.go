@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithCsrfProtection(t *testing.T) {
+	handler := WithCsrfProtection([]string{"https://console.dev.redhat.com"})(http.HandlerFunc(OkHandler))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+	post := func(headers map[string]string) *http.Request {
+		r := httptest.NewRequest("POST", "https://spi-oauth.example.com/flow/state/cancel", nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+
+	t.Run("issues token on safe requests", func(t *testing.T) {
+		rr := serve(httptest.NewRequest("GET", "https://spi-oauth.example.com/flow/history", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		cookies := rr.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, CsrfCookieName, cookies[0].Name)
+		assert.NotEmpty(t, cookies[0].Value)
+		assert.True(t, cookies[0].Secure)
+		assert.Equal(t, cookies[0].Value, rr.Header().Get(middleware.CsrfHeaderName))
+
+		t.Run("keeps existing token", func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://spi-oauth.example.com/flow/history", nil)
+			r.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: "existing"})
+			rr := serve(r)
+			assert.Empty(t, rr.Result().Cookies())
+			assert.Equal(t, "existing", rr.Header().Get(middleware.CsrfHeaderName))
+		})
+	})
+
+	t.Run("rejects cross-site requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, serve(post(nil)).Code)
+		assert.Equal(t, http.StatusForbidden, serve(post(map[string]string{"Origin": "https://evil.example.com"})).Code)
+		assert.Equal(t, http.StatusForbidden, serve(post(map[string]string{"Referer": "https://evil.example.com/page"})).Code)
+	})
+
+	t.Run("accepts bearer token", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(post(map[string]string{"Authorization": "Bearer token", "Origin": "https://evil.example.com"})).Code)
+	})
+
+	t.Run("accepts trusted origins", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(post(map[string]string{"Origin": "https://console.dev.redhat.com"})).Code)
+		assert.Equal(t, http.StatusOK, serve(post(map[string]string{"Origin": "https://spi-oauth.example.com"})).Code)
+		assert.Equal(t, http.StatusOK, serve(post(map[string]string{"Referer": "https://console.dev.redhat.com/app"})).Code)
+	})
+
+	t.Run("double-submit cookie", func(t *testing.T) {
+		r := post(map[string]string{middleware.CsrfHeaderName: "token"})
+		r.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: "token"})
+		assert.Equal(t, http.StatusOK, serve(r).Code)
+
+		r = post(map[string]string{middleware.CsrfHeaderName: "forged"})
+		r.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: "token"})
+		assert.Equal(t, http.StatusForbidden, serve(r).Code)
+
+		r = post(map[string]string{middleware.CsrfHeaderName: ""})
+		r.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: ""})
+		assert.Equal(t, http.StatusForbidden, serve(r).Code)
+	})
+
+	t.Run("form field", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "https://spi-oauth.example.com/login", strings.NewReader(url.Values{"csrf_token": {"token"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: CsrfCookieName, Value: "token"})
+		assert.Equal(t, http.StatusOK, serve(r).Code)
+	})
+}
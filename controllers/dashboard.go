@@ -0,0 +1,319 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// GrafanaDashboardUid is the UID of the Grafana dashboard of the service so that importing a newer version of it
+// replaces the older one.
+const GrafanaDashboardUid = "spi-oauth"
+
+// the dashboard is laid out on the 24 columns wide grid of Grafana
+const (
+	dashboardPanelWidth  = 8
+	dashboardPanelHeight = 8
+	dashboardRowHeight   = 1
+	dashboardGridWidth   = 24
+)
+
+type grafanaDashboard struct {
+	Uid           string             `json:"uid"`
+	Title         string             `json:"title"`
+	Tags          []string           `json:"tags"`
+	SchemaVersion int                `json:"schemaVersion"`
+	Refresh       string             `json:"refresh"`
+	Time          grafanaTimeRange   `json:"time"`
+	Templating    grafanaTemplating  `json:"templating"`
+	Panels        []grafanaPanel     `json:"panels"`
+	Annotations   grafanaAnnotations `json:"annotations"`
+}
+
+type grafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaTemplating struct {
+	List []grafanaVariable `json:"list"`
+}
+
+type grafanaVariable struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+type grafanaAnnotations struct {
+	List []map[string]string `json:"list"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	Uid  string `json:"uid"`
+}
+
+type grafanaGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type grafanaPanel struct {
+	Id          int                 `json:"id"`
+	Type        string              `json:"type"`
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	GridPos     grafanaGridPos      `json:"gridPos"`
+	Datasource  *grafanaDatasource  `json:"datasource,omitempty"`
+	FieldConfig *grafanaFieldConfig `json:"fieldConfig,omitempty"`
+	Targets     []grafanaTarget     `json:"targets,omitempty"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults grafanaFieldDefaults `json:"defaults"`
+}
+
+type grafanaFieldDefaults struct {
+	Unit string `json:"unit,omitempty"`
+}
+
+type grafanaTarget struct {
+	RefId        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// dashboardPanel is a time series panel of the dashboard. The expressions may use the %[1]s placeholder for the common
+// prefix of the metrics of the service.
+type dashboardPanel struct {
+	title       string
+	description string
+	unit        string
+	// targets are pairs of the expression and its legend
+	targets [][2]string
+}
+
+// dashboardRow is a titled row of the panels of the dashboard.
+type dashboardRow struct {
+	title  string
+	panels []dashboardPanel
+}
+
+// dashboardRows define the contents of the Grafana dashboard of the service. They refer to the metrics registered by
+// RegisterMetrics.
+var dashboardRows = []dashboardRow{
+	{
+		title: "OAuth flows",
+		panels: []dashboardPanel{
+			{
+				title:       "Flow success rate",
+				description: "The ratio of the OAuth flows that succeeded, per service provider.",
+				unit:        "percentunit",
+				targets: [][2]string{
+					{`sum by (sp) (rate(%[1]s_flows_total{result="succeeded"}[5m])) / sum by (sp) (rate(%[1]s_flows_total[5m]))`, "{{sp}}"},
+				},
+			},
+			{
+				title:       "Flows",
+				description: "The rate of the finished OAuth flows, per result.",
+				unit:        "ops",
+				targets: [][2]string{
+					{`sum by (result) (rate(%[1]s_flows_total[5m]))`, "{{result}}"},
+				},
+			},
+			{
+				title:       "Callback latency",
+				description: "The duration of the OAuth callbacks.",
+				unit:        "s",
+				targets: [][2]string{
+					{`histogram_quantile(0.95, sum by (le) (rate(%[1]s_http_request_duration_seconds_bucket{route=~"/[^/]+/callback"}[5m])))`, "p95"},
+					{`histogram_quantile(0.5, sum by (le) (rate(%[1]s_http_request_duration_seconds_bucket{route=~"/[^/]+/callback"}[5m])))`, "p50"},
+				},
+			},
+			{
+				title:       "Flow phase latency (p95)",
+				description: "The duration of the phases of the OAuth flows performed by the service.",
+				unit:        "s",
+				targets: [][2]string{
+					{`histogram_quantile(0.95, sum by (le, phase) (rate(%[1]s_flow_phase_duration_seconds_bucket[5m])))`, "{{phase}}"},
+				},
+			},
+			{
+				title:       "Server errors",
+				description: "The ratio of the requests that failed with a server error, per route.",
+				unit:        "percentunit",
+				targets: [][2]string{
+					{`sum by (route) (rate(%[1]s_http_requests_total{code=~"5.."}[5m])) / sum by (route) (rate(%[1]s_http_requests_total[5m]))`, "{{route}}"},
+				},
+			},
+			{
+				title:       "Queued requests",
+				description: "The requests waiting to be handled because the service is busy, per priority.",
+				unit:        "short",
+				targets: [][2]string{
+					{`sum by (priority) (%[1]s_queued_requests)`, "{{priority}}"},
+				},
+			},
+		},
+	},
+	{
+		title: "Token storage",
+		panels: []dashboardPanel{
+			{
+				title:       "Storage errors",
+				description: "The ratio of the requests to the token storage that failed, per operation.",
+				unit:        "percentunit",
+				targets: [][2]string{
+					{`sum by (operation) (rate(%[1]s_token_storage_requests_total{result="error"}[5m])) / sum by (operation) (rate(%[1]s_token_storage_requests_total[5m]))`, "{{operation}}"},
+				},
+			},
+			{
+				title:       "Storage latency (p95)",
+				description: "The duration of the requests to the token storage, per operation.",
+				unit:        "s",
+				targets: [][2]string{
+					{`histogram_quantile(0.95, sum by (le, operation) (rate(%[1]s_token_storage_request_duration_seconds_bucket[5m])))`, "{{operation}}"},
+				},
+			},
+			{
+				title:       "Storage cache hit ratio",
+				description: "The ratio of the token lookups served from the cache in front of the token storage.",
+				unit:        "percentunit",
+				targets: [][2]string{
+					{`sum(rate(%[1]s_token_storage_cache_lookups_total{result="hit"}[5m])) / sum(rate(%[1]s_token_storage_cache_lookups_total[5m]))`, "hit ratio"},
+				},
+			},
+			{
+				title:       "Orphaned flows",
+				description: "The OAuth flows that obtained the token but failed to store it, per service provider.",
+				unit:        "short",
+				targets: [][2]string{
+					{`sum by (sp) (increase(%[1]s_orphaned_flows_total[1h]))`, "{{sp}}"},
+				},
+			},
+		},
+	},
+	{
+		title: "Service providers",
+		panels: []dashboardPanel{
+			{
+				title:       "Provider API requests",
+				description: "The rate of the requests to the APIs of the service providers, per host and response code.",
+				unit:        "ops",
+				targets: [][2]string{
+					{`sum by (host, code) (rate(%[1]s_provider_requests_total[5m]))`, "{{host}} {{code}}"},
+				},
+			},
+			{
+				title:       "Provider rate limit remaining",
+				description: "The number of requests remaining in the rate limit of the service providers.",
+				unit:        "short",
+				targets: [][2]string{
+					{`min by (host) (%[1]s_provider_rate_limit_remaining)`, "{{host}}"},
+				},
+			},
+			{
+				title:       "Canary",
+				description: "Whether the last run of the canary OAuth flow succeeded.",
+				unit:        "bool",
+				targets: [][2]string{
+					{`min(%[1]s_canary_success)`, "success"},
+				},
+			},
+		},
+	},
+}
+
+// GrafanaDashboardJson returns the JSON model of the Grafana dashboard of the service built from dashboardRows.
+func GrafanaDashboardJson() ([]byte, error) {
+	dashboard := grafanaDashboard{
+		Uid:           GrafanaDashboardUid,
+		Title:         "SPI OAuth service",
+		Tags:          []string{"appstudio", "spi"},
+		SchemaVersion: 36,
+		Refresh:       "1m",
+		Time:          grafanaTimeRange{From: "now-6h", To: "now"},
+		Templating: grafanaTemplating{List: []grafanaVariable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		}},
+		Panels:      []grafanaPanel{},
+		Annotations: grafanaAnnotations{List: []map[string]string{}},
+	}
+
+	prefix := MetricsNamespace + "_" + MetricsSubsystem
+	datasource := &grafanaDatasource{Type: "prometheus", Uid: "${datasource}"}
+	id, y := 1, 0
+	for _, row := range dashboardRows {
+		dashboard.Panels = append(dashboard.Panels, grafanaPanel{
+			Id:      id,
+			Type:    "row",
+			Title:   row.title,
+			GridPos: grafanaGridPos{X: 0, Y: y, W: dashboardGridWidth, H: dashboardRowHeight},
+		})
+		id++
+		y += dashboardRowHeight
+
+		for i, p := range row.panels {
+			panel := grafanaPanel{
+				Id:          id,
+				Type:        "timeseries",
+				Title:       p.title,
+				Description: p.description,
+				GridPos:     grafanaGridPos{X: (i * dashboardPanelWidth) % dashboardGridWidth, Y: y + (i*dashboardPanelWidth)/dashboardGridWidth*dashboardPanelHeight, W: dashboardPanelWidth, H: dashboardPanelHeight},
+				Datasource:  datasource,
+				FieldConfig: &grafanaFieldConfig{Defaults: grafanaFieldDefaults{Unit: p.unit}},
+			}
+			for j, t := range p.targets {
+				panel.Targets = append(panel.Targets, grafanaTarget{
+					RefId:        string(rune('A' + j)),
+					Expr:         fmt.Sprintf(t[0], prefix),
+					LegendFormat: t[1],
+				})
+			}
+			dashboard.Panels = append(dashboard.Panels, panel)
+			id++
+		}
+		y += (len(row.panels) + dashboardGridWidth/dashboardPanelWidth - 1) / (dashboardGridWidth / dashboardPanelWidth) * dashboardPanelHeight
+	}
+
+	bytes, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the Grafana dashboard: %w", err)
+	}
+	return append(bytes, '\n'), nil
+}
+
+// GrafanaDashboardHandler is a Handler implementation that responds with the JSON model of the Grafana dashboard of
+// the service so that it can be imported into Grafana as-is, e.g. using the dashboard provisioning.
+func GrafanaDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	dashboard, err := GrafanaDashboardJson()
+	if err != nil {
+		logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to generate the Grafana dashboard", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(dashboard); err != nil {
+		log.FromContext(r.Context()).Error(err, "error writing the Grafana dashboard to the response")
+	}
+}
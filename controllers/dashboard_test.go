@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// collectingRegisterer is the prometheus.Registerer that only remembers the registered collectors.
+type collectingRegisterer struct {
+	collectors []prometheus.Collector
+}
+
+func (r *collectingRegisterer) Register(c prometheus.Collector) error {
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+func (r *collectingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	r.collectors = append(r.collectors, cs...)
+}
+
+func (r *collectingRegisterer) Unregister(prometheus.Collector) bool {
+	return false
+}
+
+func TestGrafanaDashboardHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	GrafanaDashboardHandler(rr, httptest.NewRequest("GET", "/grafana-dashboard", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	dashboard := grafanaDashboard{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &dashboard))
+	assert.Equal(t, GrafanaDashboardUid, dashboard.Uid)
+	assert.NotEmpty(t, dashboard.Panels)
+
+	t.Run("shipped dashboard is up to date", func(t *testing.T) {
+		shipped, err := os.ReadFile("../dashboards/spi-oauth.json")
+		assert.NoError(t, err)
+		assert.Equal(t, string(shipped), rr.Body.String(), "run `make grafana_dashboard` to regenerate the dashboard")
+	})
+
+	t.Run("panels refer to the registered metrics", func(t *testing.T) {
+		registerer := &collectingRegisterer{}
+		assert.NoError(t, RegisterMetrics(registerer))
+		registered := map[string]bool{}
+		fqName := regexp.MustCompile(`fqName: "([^"]+)"`)
+		for _, c := range registerer.collectors {
+			descs := make(chan *prometheus.Desc, 1)
+			go func() {
+				c.Describe(descs)
+				close(descs)
+			}()
+			for d := range descs {
+				registered[fqName.FindStringSubmatch(d.String())[1]] = true
+			}
+		}
+
+		metric := regexp.MustCompile(MetricsNamespace + "_" + MetricsSubsystem + `_[a-z_]+`)
+		for _, panel := range dashboard.Panels {
+			if panel.Type == "row" {
+				continue
+			}
+			assert.NotEmpty(t, panel.Targets, "panel %s has no targets", panel.Title)
+			for _, target := range panel.Targets {
+				names := metric.FindAllString(target.Expr, -1)
+				assert.NotEmpty(t, names, "unexpected expression: %s", target.Expr)
+				for _, name := range names {
+					assert.True(t, registered[strings.TrimSuffix(name, "_bucket")], "unknown metric %s in panel %s", name, panel.Title)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	authz "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const fakeProviderClientSecret = "fake-provider-secret"
+
+// fakeProviderScenario scripts the response of the fake service provider to a single token request.
+type fakeProviderScenario struct {
+	// GrantedScopes are the scopes the provider grants. All the requested scopes are granted if nil.
+	GrantedScopes []string
+	// Delay postpones the response of the token endpoint, simulating a slow service provider.
+	Delay time.Duration
+	// RotateRefreshToken makes the refresh issue a new refresh token and invalidate the used one.
+	RotateRefreshToken bool
+	// MalformedJson makes the token endpoint respond with a body that cannot be parsed.
+	MalformedJson bool
+	// Status is the status code of the token response, http.StatusOK if not set.
+	Status int
+}
+
+// fakeProviderRequest is a token request received by the fake service provider.
+type fakeProviderRequest struct {
+	GrantType       string
+	RequestedScopes []string
+	RefreshToken    string
+}
+
+// fakeProvider is a service provider with the OAuth endpoints of the canary provider whose token endpoint responds
+// according to the scripted scenarios. The scenarios are used one per token request in the order given, the last one
+// is repeated for the rest of the requests.
+type fakeProvider struct {
+	*httptest.Server
+
+	lock          sync.Mutex
+	scenarios     []fakeProviderScenario
+	requests      []fakeProviderRequest
+	refreshTokens map[string]struct{}
+	issued        int
+}
+
+// newFakeProvider starts the fake service provider with the scenarios. The provider is closed when the test ends.
+func newFakeProvider(t *testing.T, scenarios ...fakeProviderScenario) *fakeProvider {
+	p := &fakeProvider{scenarios: scenarios, refreshTokens: map[string]struct{}{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(CanaryProviderPath+"/authorize", CanaryAuthorizeHandler("https://spi"))
+	mux.HandleFunc(CanaryProviderPath+"/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// configuration returns the configuration of the service provider pointing to the fake provider.
+func (p *fakeProvider) configuration() config.ServiceProviderConfiguration {
+	return CanaryServiceProviderConfiguration(p.URL, fakeProviderClientSecret)
+}
+
+// receivedRequests returns the token requests received so far.
+func (p *fakeProvider) receivedRequests() []fakeProviderRequest {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]fakeProviderRequest{}, p.requests...)
+}
+
+// nextScenario records the request and returns the scenario to respond to it with.
+func (p *fakeProvider) nextScenario(request fakeProviderRequest) fakeProviderScenario {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requests = append(p.requests, request)
+	if len(p.scenarios) == 0 {
+		return fakeProviderScenario{}
+	}
+	scenario := p.scenarios[0]
+	if len(p.scenarios) > 1 {
+		p.scenarios = p.scenarios[1:]
+	}
+	return scenario
+}
+
+// issueTokens issues a new access token and, unless refreshToken is kept, a new refresh token which replaces it.
+func (p *fakeProvider) issueTokens(refreshToken string, keepRefreshToken bool) (string, string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if refreshToken != "" {
+		if _, ok := p.refreshTokens[refreshToken]; !ok {
+			return "", "", false
+		}
+		if keepRefreshToken {
+			p.issued++
+			return fmt.Sprintf("fake-access-token-%d", p.issued), "", true
+		}
+		delete(p.refreshTokens, refreshToken)
+	}
+	p.issued++
+	newRefreshToken := fmt.Sprintf("fake-refresh-token-%d", p.issued)
+	p.refreshTokens[newRefreshToken] = struct{}{}
+	return fmt.Sprintf("fake-access-token-%d", p.issued), newRefreshToken, true
+}
+
+func (p *fakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	request := fakeProviderRequest{
+		GrantType:       r.FormValue("grant_type"),
+		RequestedScopes: strings.Fields(r.FormValue("scope")),
+		RefreshToken:    r.FormValue("refresh_token"),
+	}
+	scenario := p.nextScenario(request)
+
+	select {
+	case <-time.After(scenario.Delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	if r.FormValue("client_id") != CanaryClientId || r.FormValue("client_secret") != fakeProviderClientSecret {
+		writeFakeProviderError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if scenario.Status != 0 && scenario.Status != http.StatusOK {
+		writeFakeProviderError(w, scenario.Status, "server_error")
+		return
+	}
+	if scenario.MalformedJson {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "fake-access-token", "token_type": `))
+		return
+	}
+
+	var accessToken, refreshToken string
+	switch request.GrantType {
+	case "authorization_code":
+		if !strings.HasPrefix(r.FormValue("code"), canaryCodePrefix) {
+			writeFakeProviderError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		accessToken, refreshToken, _ = p.issueTokens("", false)
+	case "refresh_token":
+		var ok bool
+		if accessToken, refreshToken, ok = p.issueTokens(request.RefreshToken, !scenario.RotateRefreshToken); !ok {
+			writeFakeProviderError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		writeFakeProviderError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	granted := scenario.GrantedScopes
+	if granted == nil {
+		granted = request.RequestedScopes
+	}
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "bearer",
+		"expires_in":   3600,
+		"scope":        strings.Join(granted, " "),
+	}
+	// the refresh token is omitted when it doesn't change
+	if refreshToken != "" {
+		response["refresh_token"] = refreshToken
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func writeFakeProviderError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(`{"error": "` + code + `"}`))
+}
+
+func TestFakeProviderCallback(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	assert.NoError(t, authz.AddToScheme(scheme))
+
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		scenarios       []fakeProviderScenario
+		timeout         time.Duration
+		expectedStatus  int
+		expectedGranted string
+		expectStored    bool
+	}{
+		{
+			name:            "grants all the requested scopes",
+			scenarios:       []fakeProviderScenario{{}},
+			expectedStatus:  http.StatusFound,
+			expectedGranted: "repo user",
+			expectStored:    true,
+		},
+		{
+			name:            "grants part of the requested scopes",
+			scenarios:       []fakeProviderScenario{{GrantedScopes: []string{"repo"}}},
+			expectedStatus:  http.StatusFound,
+			expectedGranted: "repo",
+			expectStored:    true,
+		},
+		{
+			name:           "times out on slow token endpoint",
+			scenarios:      []fakeProviderScenario{{Delay: time.Minute}},
+			timeout:        100 * time.Millisecond,
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "fails on malformed token response",
+			scenarios:      []fakeProviderScenario{{MalformedJson: true}},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "fails on provider error",
+			scenarios:      []fakeProviderScenario{{Status: http.StatusServiceUnavailable}},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "fails on rejected code",
+			scenarios:      []fakeProviderScenario{{Status: http.StatusBadRequest}},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider(t, test.scenarios...)
+			cl := allowingClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+				ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+			}).Build()}
+
+			var storedToken *api.Token
+			storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+				storedToken = token
+				return nil
+			}}
+			sessionManager := scs.New()
+			stateStorage := NewStateStorage(sessionManager, memstore.New(), DefaultVeilEntropyBits)
+			cfg := OAuthServiceConfiguration{SharedConfiguration: config.SharedConfiguration{BaseUrl: "https://spi", SharedSecret: []byte("secret")}}
+			controller, err := FromConfiguration(cfg, provider.configuration(), auth.NewAuthenticator(sessionManager, cl), stateStorage, nil, nil, cl, storage, nil)
+			assert.NoError(t, err)
+
+			state, err := codec.Encode(&oauthstate.AnonymousOAuthState{
+				TokenName:           "token",
+				TokenNamespace:      "default",
+				IssuedAt:            time.Now().Unix(),
+				ServiceProviderType: CanaryServiceProviderType,
+				Scopes:              []string{"repo", "user"},
+			})
+			assert.NoError(t, err)
+			// the state is found in the shared store so that the callback doesn't need the session of the flow
+			sessionCtx, err := sessionManager.Load(context.Background(), "")
+			assert.NoError(t, err)
+			veil, err := stateStorage.VeilState(sessionCtx, state)
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest("GET", "https://spi/canary/callback?code="+canaryCodePrefix+"code&scope="+url.QueryEscape("repo user")+"&k8s_token=k8s-token&state="+url.QueryEscape(veil), nil)
+			res := httptest.NewRecorder()
+			sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				if test.timeout != 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, test.timeout)
+					defer cancel()
+				}
+				controller.Callback(ctx, w, r)
+			})).ServeHTTP(res, req)
+
+			assert.Equal(t, test.expectedStatus, res.Code)
+			requests := provider.receivedRequests()
+			if assert.Len(t, requests, 1) {
+				assert.Equal(t, "authorization_code", requests[0].GrantType)
+				assert.Equal(t, []string{"repo", "user"}, requests[0].RequestedScopes)
+			}
+			if test.expectStored {
+				if assert.NotNil(t, storedToken) {
+					assert.Equal(t, "fake-access-token-1", storedToken.AccessToken)
+					assert.Equal(t, "fake-refresh-token-1", storedToken.RefreshToken)
+				}
+			} else {
+				assert.Nil(t, storedToken)
+			}
+		})
+	}
+}
+
+func TestFakeProviderRefresh(t *testing.T) {
+	tests := []struct {
+		name                 string
+		scenarios            []fakeProviderScenario
+		expectedRefreshToken string
+		expectOldRejected    bool
+	}{
+		{
+			name:                 "keeps the refresh token",
+			scenarios:            []fakeProviderScenario{{}, {}},
+			expectedRefreshToken: "fake-refresh-token-1",
+		},
+		{
+			name:                 "rotates the refresh token",
+			scenarios:            []fakeProviderScenario{{}, {RotateRefreshToken: true}},
+			expectedRefreshToken: "fake-refresh-token-2",
+			expectOldRejected:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newFakeProvider(t, test.scenarios...)
+			controller, err := FromConfiguration(OAuthServiceConfiguration{SharedConfiguration: config.SharedConfiguration{BaseUrl: "https://spi"}}, provider.configuration(), nil, nil, nil, nil, nil, nil, nil)
+			assert.NoError(t, err)
+			c := controller.(*commonController)
+			oauthCfg := c.newOAuth2Config(c.Endpoint)
+
+			token, err := oauthCfg.Exchange(context.Background(), canaryCodePrefix+"code")
+			assert.NoError(t, err)
+			assert.Equal(t, "fake-refresh-token-1", token.RefreshToken)
+
+			// an expired token makes the token source refresh it
+			token.Expiry = time.Now().Add(-time.Minute)
+			refreshed, err := oauthCfg.TokenSource(context.Background(), token).Token()
+			assert.NoError(t, err)
+			assert.Equal(t, "fake-access-token-2", refreshed.AccessToken)
+			assert.Equal(t, test.expectedRefreshToken, refreshed.RefreshToken)
+
+			_, err = oauthCfg.TokenSource(context.Background(), &oauth2.Token{RefreshToken: "fake-refresh-token-1"}).Token()
+			if test.expectOldRejected {
+				var retrieveErr *oauth2.RetrieveError
+				if assert.ErrorAs(t, err, &retrieveErr) {
+					assert.Equal(t, http.StatusBadRequest, retrieveErr.Response.StatusCode)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
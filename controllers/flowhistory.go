@@ -0,0 +1,287 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	flowHistoryTemplateName = "flow_history"
+
+	flowSucceeded = "succeeded"
+	flowFailed    = "failed"
+	flowExpired   = "expired"
+
+	// flowHistoryPageSize is the default number of the flows shown on a page of the flow history.
+	flowHistoryPageSize = 50
+	// flowHistoryMaxPageSize is the maximum number of the flows that can be requested on a page of the flow history.
+	flowHistoryMaxPageSize = 500
+)
+
+var invalidFlowHistoryQueryError = errors.New("invalid flow history query")
+
+// flowHistoryPageTemplate is the template of the flow history page.
+var flowHistoryPageTemplate = &fileTemplate{path: "../static/flow_history.html"}
+
+// FlowHistory keeps the outcomes of the recent OAuth flows in a ring buffer of fixed size so that the users can check
+// whether their flows actually went through. The flows are attributed to the users by their usernames as reviewed by
+// the cluster, so that the users see their flows also after their tokens are rotated. The history lives in the memory
+// of the replica that finished the flow. All the methods can be called on a nil history, in which case nothing is
+// recorded.
+type FlowHistory struct {
+	// k8sClient reviews the Kubernetes tokens of the users, so it needs to be able to create the TokenReviews.
+	k8sClient client.Client
+	lock      sync.Mutex
+	entries   []flowHistoryEntry
+	// next is the index in the entries the next flow is recorded at
+	next int
+	// seq is the sequence number of the last recorded flow
+	seq uint64
+	// reviewFailure makes sure the failure to review the tokens is only logged as an error once
+	reviewFailure sync.Once
+}
+
+// flowHistoryEntry is the outcome of a single OAuth flow.
+type flowHistoryEntry struct {
+	// caller is the username of the user that started the flow.
+	caller string
+	// seq orders the flows by the time they were recorded and serves as the cursor of the pages of the history.
+	seq            uint64
+	Provider       config.ServiceProviderType
+	TokenNamespace string
+	TokenName      string
+	Result         string
+	Time           time.Time
+}
+
+// flowHistoryQuery narrows down the flows returned from the history.
+type flowHistoryQuery struct {
+	// Namespace limits the flows to the SPIAccessTokens in the namespace, if not empty.
+	Namespace string
+	// Since and Until limit the flows to the ones finished in [Since, Until), if not zero.
+	Since time.Time
+	Until time.Time
+	// Cursor continues the listing after the last flow of the previous page, if not empty.
+	Cursor string
+	// Limit is the maximum number of the returned flows. Unlimited if not positive.
+	Limit int
+}
+
+// flowHistoryPage is a page of the flows matching the flowHistoryQuery, the most recent first.
+type flowHistoryPage struct {
+	Flows []flowHistoryEntry
+	// NextCursor is the cursor of the next page, empty if this is the last page.
+	NextCursor string
+}
+
+// flowHistoryViewData structure is used to pass parameters during the flow history page processing.
+type flowHistoryViewData struct {
+	Flows []flowHistoryEntry
+	// NextPageUrl is the URL of the page with the older flows, empty if there are none.
+	NextPageUrl string
+}
+
+// NewFlowHistory creates a new flow history keeping at most size flows. The client is used to review the Kubernetes
+// tokens of the users, so it needs to be able to create the TokenReviews. Returns nil, i.e. no history, if the size
+// is not positive.
+func NewFlowHistory(size int, cl client.Client) *FlowHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &FlowHistory{k8sClient: cl, entries: make([]flowHistoryEntry, 0, size)}
+}
+
+// CallerOf returns the username of the user authenticated by the Kubernetes token, which the flows are attributed to.
+// Returns an empty string on a nil history, which records nothing anyway. The first failure to review the token for
+// other reasons than the token not being authenticated is logged as an error, because it usually means that
+// the service is not allowed to create the TokenReviews and the history stays empty.
+func (h *FlowHistory) CallerOf(ctx context.Context, k8sToken string) (string, error) {
+	if h == nil {
+		return "", nil
+	}
+	caller, err := reviewIdentity(ctx, h.k8sClient, k8sToken)
+	if err != nil && !errors.Is(err, unauthenticatedIdentityError) {
+		h.reviewFailure.Do(func() {
+			log.FromContext(ctx).Error(err, "failed to review the token of the user, the flow history cannot be kept, check that the service is allowed to create the TokenReviews")
+		})
+	}
+	return caller, err
+}
+
+// Record records the flow of the user with the username. The oldest flow is forgotten if the history is full.
+func (h *FlowHistory) Record(caller string, entry flowHistoryEntry) {
+	if h == nil || caller == "" {
+		return
+	}
+	entry.caller = caller
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.seq++
+	entry.seq = h.seq
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, entry)
+	} else {
+		h.entries[h.next] = entry
+	}
+	h.next = (h.next + 1) % cap(h.entries)
+}
+
+// Query returns a page of the flows of the user with the username matching the query, the most recent first.
+// The cursor of the next page points after the last returned flow so that the flows recorded in the meantime don't
+// shift the pages.
+func (h *FlowHistory) Query(caller string, query flowHistoryQuery) (flowHistoryPage, error) {
+	page := flowHistoryPage{Flows: []flowHistoryEntry{}}
+
+	var before uint64
+	if query.Cursor != "" {
+		var err error
+		if before, err = strconv.ParseUint(query.Cursor, 10, 64); err != nil {
+			return page, fmt.Errorf("%w: malformed cursor '%s'", invalidFlowHistoryQueryError, query.Cursor)
+		}
+	}
+
+	if h == nil || caller == "" {
+		return page, nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i := 1; i <= len(h.entries); i++ {
+		entry := h.entries[(h.next-i+len(h.entries))%len(h.entries)]
+		if entry.caller != caller || !query.matches(entry) || (before != 0 && entry.seq >= before) {
+			continue
+		}
+		if query.Limit > 0 && len(page.Flows) == query.Limit {
+			page.NextCursor = strconv.FormatUint(page.Flows[len(page.Flows)-1].seq, 10)
+			break
+		}
+		page.Flows = append(page.Flows, entry)
+	}
+	return page, nil
+}
+
+// matches checks whether the flow matches the filters of the query.
+func (q flowHistoryQuery) matches(entry flowHistoryEntry) bool {
+	return (q.Namespace == "" || entry.TokenNamespace == q.Namespace) &&
+		(q.Since.IsZero() || !entry.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.Time.Before(q.Until))
+}
+
+// flowHistoryQueryFromRequest reads the query from the `namespace`, `since`, `until` (both RFC 3339), `cursor` and
+// `limit` query parameters of the request.
+func flowHistoryQueryFromRequest(r *http.Request) (flowHistoryQuery, error) {
+	params := r.URL.Query()
+	query := flowHistoryQuery{
+		Namespace: params.Get("namespace"),
+		Cursor:    params.Get("cursor"),
+		Limit:     flowHistoryPageSize,
+	}
+
+	for _, p := range []struct {
+		name   string
+		target *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		if value := params.Get(p.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, fmt.Errorf("%w: %s must be an RFC 3339 time: %s", invalidFlowHistoryQueryError, p.name, err.Error())
+			}
+			*p.target = t
+		}
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > flowHistoryMaxPageSize {
+			return query, fmt.Errorf("%w: limit must be a number between 1 and %d", invalidFlowHistoryQueryError, flowHistoryMaxPageSize)
+		}
+		query.Limit = limit
+	}
+
+	return query, nil
+}
+
+// FlowHistoryHandler returns a Handler implementation rendering the page with the recent OAuth flows of the user. The user
+// is authenticated the same way as in the authenticate endpoints, i.e. using the session, the `k8s_token` query
+// parameter or the bearer token, whose username is then reviewed by the cluster. The flows are paginated and can be
+// filtered using the query parameters described in flowHistoryQueryFromRequest.
+func FlowHistoryHandler(history *FlowHistory, authenticator *auth.Authenticator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := auth.ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+		if token == "" {
+			var err error
+			if token, err = authenticator.GetToken(r); err != nil {
+				renderErrorPage(r.Context(), w, http.StatusUnauthorized, viewData{
+					Title:   "not authenticated",
+					Message: "Please log in to see the history of your authorizations.",
+				})
+				return
+			}
+		}
+
+		caller, err := history.CallerOf(r.Context(), token)
+		if err != nil {
+			renderErrorPage(r.Context(), w, http.StatusUnauthorized, viewData{
+				Title:   "not authenticated",
+				Message: "Please log in to see the history of your authorizations.",
+			})
+			return
+		}
+
+		query, err := flowHistoryQueryFromRequest(r)
+		var page flowHistoryPage
+		if err == nil {
+			page, err = history.Query(caller, query)
+		}
+		if err != nil {
+			renderErrorPage(r.Context(), w, http.StatusBadRequest, viewData{
+				Title:   "invalid query",
+				Message: err.Error(),
+			})
+			return
+		}
+
+		data := flowHistoryViewData{Flows: page.Flows}
+		if page.NextCursor != "" {
+			next := *r.URL
+			params := next.Query()
+			params.Set("cursor", page.NextCursor)
+			// the token must not end up in the page, the user is authenticated by the session on the next page
+			params.Del("k8s_token")
+			next.RawQuery = params.Encode()
+			data.NextPageUrl = next.RequestURI()
+		}
+
+		renderTemplate(r.Context(), w, http.StatusOK, flowHistoryPageTemplate.get(r.Context()), flowHistoryTemplateName, data, fallbackViewData{
+			Title:   "Authorization history",
+			Message: "The history of your authorizations cannot be shown at the moment.",
+		})
+	}
+}
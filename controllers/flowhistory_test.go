@@ -0,0 +1,242 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-logr/logr/funcr"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestFlowHistory_CallerOf(t *testing.T) {
+	errorLogs := 0
+	ctx := log.IntoContext(context.TODO(), funcr.New(func(prefix, args string) {
+		if strings.Contains(args, "TokenReviews") {
+			errorLogs++
+		}
+	}, funcr.Options{}))
+	// the client cannot create the TokenReviews as if the service wasn't allowed to
+	history := NewFlowHistory(10, fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build())
+
+	for i := 0; i < 3; i++ {
+		_, err := history.CallerOf(ctx, "k8s-token")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, errorLogs)
+}
+
+func TestFlowHistory(t *testing.T) {
+	t.Run("lists the flows of the caller only, most recent first", func(t *testing.T) {
+		history := NewFlowHistory(10, nil)
+		history.Record("alice", flowHistoryEntry{TokenName: "first", Result: flowSucceeded})
+		history.Record("bob", flowHistoryEntry{TokenName: "other", Result: flowSucceeded})
+		history.Record("alice", flowHistoryEntry{TokenName: "second", Result: flowFailed})
+
+		flows := queryAll(t, history, "alice")
+		if assert.Len(t, flows, 2) {
+			assert.Equal(t, "second", flows[0].TokenName)
+			assert.Equal(t, "first", flows[1].TokenName)
+			assert.False(t, flows[0].Time.IsZero())
+		}
+		assert.Len(t, queryAll(t, history, "bob"), 1)
+		assert.Empty(t, queryAll(t, history, "eve"))
+	})
+
+	t.Run("forgets the oldest flows", func(t *testing.T) {
+		history := NewFlowHistory(2, nil)
+		history.Record("alice", flowHistoryEntry{TokenName: "first"})
+		history.Record("alice", flowHistoryEntry{TokenName: "second"})
+		history.Record("alice", flowHistoryEntry{TokenName: "third"})
+
+		flows := queryAll(t, history, "alice")
+		if assert.Len(t, flows, 2) {
+			assert.Equal(t, "third", flows[0].TokenName)
+			assert.Equal(t, "second", flows[1].TokenName)
+		}
+	})
+
+	t.Run("attributes the flows to the reviewed users", func(t *testing.T) {
+		history := NewFlowHistory(1, reviewClient{users: map[string]string{"alice-token": "alice", "rotated-alice-token": "alice"}})
+		caller, err := history.CallerOf(context.TODO(), "alice-token")
+		assert.NoError(t, err)
+		history.Record(caller, flowHistoryEntry{TokenName: "first"})
+
+		// the tokens are rotated, the users aren't
+		caller, err = history.CallerOf(context.TODO(), "rotated-alice-token")
+		assert.NoError(t, err)
+		assert.Len(t, queryAll(t, history, caller), 1)
+
+		_, err = history.CallerOf(context.TODO(), "forged-token")
+		assert.ErrorIs(t, err, unauthenticatedIdentityError)
+	})
+
+	t.Run("disabled history records nothing", func(t *testing.T) {
+		history := NewFlowHistory(0, nil)
+		assert.Nil(t, history)
+		history.Record("alice", flowHistoryEntry{TokenName: "first"})
+		assert.Empty(t, queryAll(t, history, "alice"))
+	})
+}
+
+func TestFlowHistory_Query(t *testing.T) {
+	start := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	history := NewFlowHistory(10, nil)
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		namespace := "team-a"
+		if i%2 == 1 {
+			namespace = "team-b"
+		}
+		history.Record("alice", flowHistoryEntry{TokenNamespace: namespace, TokenName: name, Time: start.Add(time.Duration(i) * time.Hour)})
+	}
+	names := func(page flowHistoryPage) []string {
+		ret := []string{}
+		for _, f := range page.Flows {
+			ret = append(ret, f.TokenName)
+		}
+		return ret
+	}
+
+	t.Run("paginates using the cursor", func(t *testing.T) {
+		page, err := history.Query("alice", flowHistoryQuery{Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"e", "d"}, names(page))
+		assert.NotEmpty(t, page.NextCursor)
+
+		// the flows recorded in the meantime don't shift the pages
+		history.Record("alice", flowHistoryEntry{TokenNamespace: "team-a", TokenName: "f", Time: start.Add(5 * time.Hour)})
+
+		page, err = history.Query("alice", flowHistoryQuery{Limit: 2, Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"c", "b"}, names(page))
+
+		page, err = history.Query("alice", flowHistoryQuery{Limit: 2, Cursor: page.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, names(page))
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("filters by namespace and time", func(t *testing.T) {
+		page, err := history.Query("alice", flowHistoryQuery{Namespace: "team-b"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"d", "b"}, names(page))
+
+		page, err = history.Query("alice", flowHistoryQuery{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"c", "b"}, names(page))
+	})
+
+	t.Run("rejects malformed cursor", func(t *testing.T) {
+		_, err := history.Query("alice", flowHistoryQuery{Cursor: "not-a-cursor"})
+		assert.ErrorIs(t, err, invalidFlowHistoryQueryError)
+	})
+}
+
+func TestFlowHistoryHandler(t *testing.T) {
+	history := NewFlowHistory(10, reviewClient{users: map[string]string{"alice-token": "alice", "bob-token": "bob", "carol-token": "carol", "eve-token": "eve"}})
+	history.Record("alice", flowHistoryEntry{Provider: "GitHub", TokenNamespace: "default", TokenName: "my-token", Result: flowSucceeded})
+	history.Record("bob", flowHistoryEntry{Provider: "Quay", TokenNamespace: "default", TokenName: "bobs-token", Result: flowFailed})
+
+	sessionManager := scs.New()
+	handler := sessionManager.LoadAndSave(http.HandlerFunc(FlowHistoryHandler(history, auth.NewAuthenticator(sessionManager, nil))))
+
+	t.Run("requires authentication", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/flow/history", nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("lists the flows of the bearer", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/flow/history", nil)
+		req.Header.Set("Authorization", "Bearer alice-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "default/my-token")
+		assert.Contains(t, rr.Body.String(), flowSucceeded)
+		assert.NotContains(t, rr.Body.String(), "bobs-token")
+	})
+
+	t.Run("lists the flows of the k8s token", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/flow/history?k8s_token=bob-token", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "default/bobs-token")
+		assert.NotContains(t, rr.Body.String(), "my-token")
+	})
+
+	t.Run("links the next page", func(t *testing.T) {
+		for i := 0; i < flowHistoryPageSize; i++ {
+			history.Record("carol", flowHistoryEntry{TokenNamespace: "default", TokenName: "carols-token"})
+		}
+		req := httptest.NewRequest("GET", "/flow/history?limit=1", nil)
+		req.Header.Set("Authorization", "Bearer carol-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "/flow/history?cursor=")
+	})
+
+	t.Run("doesn't link the next page with the k8s token", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/flow/history?limit=1&k8s_token=carol-token", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "/flow/history?cursor=")
+		assert.NotContains(t, rr.Body.String(), "carol-token")
+	})
+
+	t.Run("rejects tokens not authenticated by the cluster", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/flow/history", nil)
+		req.Header.Set("Authorization", "Bearer forged-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("rejects invalid query", func(t *testing.T) {
+		for _, query := range []string{"since=yesterday", "limit=0", "limit=100000", "cursor=x"} {
+			req := httptest.NewRequest("GET", "/flow/history?"+query, nil)
+			req.Header.Set("Authorization", "Bearer alice-token")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+		}
+	})
+
+	t.Run("shows empty history", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/flow/history", nil)
+		req.Header.Set("Authorization", "Bearer eve-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "No recent authorizations found.")
+	})
+}
+
+// queryAll returns all the flows of the user with the username, the most recent first.
+func queryAll(t *testing.T, history *FlowHistory, caller string) []flowHistoryEntry {
+	page, err := history.Query(caller, flowHistoryQuery{})
+	assert.NoError(t, err)
+	return page.Flows
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// flowJournalPhaseExchanged marks the flows that obtained the token from the service provider and are about to
+	// store it.
+	flowJournalPhaseExchanged = "exchanged"
+
+	// flowJournalRetention is how long the journal entries are kept in the store if they are never finished nor
+	// recovered.
+	flowJournalRetention = 24 * time.Hour
+
+	// FlowJournalGracePeriod is the minimum age of a journal entry to be considered orphaned. Younger entries can
+	// belong to the flows that are still storing the token.
+	FlowJournalGracePeriod = 2 * time.Minute
+)
+
+// flowJournalRecoveryLease is the name of the lease the instance running the recovery holds.
+const flowJournalRecoveryLease = "flow-journal-recovery"
+
+var notIterableJournalStoreError = errors.New("the store of the flow journal doesn't support iteration")
+
+// FlowJournal records the OAuth flows that obtained the token from the service provider but haven't stored it yet.
+// The journal is kept in a store shared by all the replicas of the service so that if a replica crashes between
+// the exchange and the storage of the token, the orphaned flow is detected and surfaced by the recovery instead of
+// the granted token being silently lost. The journal doesn't contain the token itself.
+//
+// A nil journal is valid and records nothing.
+type FlowJournal struct {
+	store scs.Store
+}
+
+// flowJournalEntry is the data recorded for a flow in the journal.
+type flowJournalEntry struct {
+	Phase             string    `json:"phase"`
+	Provider          string    `json:"provider"`
+	TokenName         string    `json:"tokenName"`
+	TokenNamespace    string    `json:"tokenNamespace"`
+	TokenKcpWorkspace string    `json:"tokenKcpWorkspace,omitempty"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// NewFlowJournal creates a new flow journal keeping the entries in the provided store. The store needs to implement
+// scs.IterableStore for the recovery to work.
+func NewFlowJournal(store scs.Store) *FlowJournal {
+	return &FlowJournal{store: store}
+}
+
+// flowJournalId returns the id of the flow in the journal. We don't want to keep the state itself in the store.
+func flowJournalId(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(hash[:])
+}
+
+// RecordExchanged records that the flow with the given state obtained the token from the service provider. Failing to
+// record the flow doesn't fail the flow itself, it is only logged.
+func (j *FlowJournal) RecordExchanged(ctx context.Context, state string, exchange *exchangeResult) {
+	if j == nil {
+		return
+	}
+
+	entry := flowJournalEntry{
+		Phase:             flowJournalPhaseExchanged,
+		Provider:          string(exchange.ServiceProviderType),
+		TokenName:         exchange.TokenName,
+		TokenNamespace:    exchange.TokenNamespace,
+		TokenKcpWorkspace: exchange.TokenKcpWorkspace,
+		Timestamp:         time.Now(),
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "failed to serialize the flow journal entry")
+		return
+	}
+	if err = j.store.Commit(flowJournalId(state), b, entry.Timestamp.Add(flowJournalRetention)); err != nil {
+		log.FromContext(ctx).Error(err, "failed to record the flow in the flow journal")
+	}
+}
+
+// Finish removes the flow with the given state from the journal. This is called once the outcome of storing
+// the token is known to the user.
+func (j *FlowJournal) Finish(ctx context.Context, state string) {
+	if j == nil {
+		return
+	}
+
+	if err := j.store.Delete(flowJournalId(state)); err != nil {
+		log.FromContext(ctx).Error(err, "failed to remove the flow from the flow journal")
+	}
+}
+
+// Recover surfaces the flows that have been in the journal for longer than the grace period. Each such flow is
+// audit-logged, counted in the orphaned flows metric and removed from the journal. The number of the recovered flows
+// is returned.
+func (j *FlowJournal) Recover(ctx context.Context, gracePeriod time.Duration) (int, error) {
+	if j == nil {
+		return 0, nil
+	}
+
+	iterable, ok := j.store.(scs.IterableStore)
+	if !ok {
+		return 0, notIterableJournalStoreError
+	}
+
+	all, err := iterable.All()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the flow journal: %w", err)
+	}
+
+	recovered := 0
+	for id, b := range all {
+		entry := flowJournalEntry{}
+		if err := json.Unmarshal(b, &entry); err != nil {
+			log.FromContext(ctx).Error(err, "failed to parse the flow journal entry, removing it", "id", id)
+			if err := j.store.Delete(id); err != nil {
+				return recovered, fmt.Errorf("failed to remove the corrupted flow journal entry: %w", err)
+			}
+			continue
+		}
+
+		if time.Since(entry.Timestamp) < gracePeriod {
+			continue
+		}
+
+		logging.AuditLogWithTokenInfo(ctx, "OAuth authentication flow orphaned after the token exchange, the token needs to be obtained again", entry.TokenNamespace, entry.TokenName,
+			"provider", entry.Provider, "phase", entry.Phase, "kcpWorkspace", entry.TokenKcpWorkspace, "timestamp", entry.Timestamp)
+		orphanedFlowsCounter.WithLabelValues(entry.Provider).Inc()
+
+		if err := j.store.Delete(id); err != nil {
+			return recovered, fmt.Errorf("failed to remove the orphaned flow from the flow journal: %w", err)
+		}
+		recovered++
+	}
+
+	return recovered, nil
+}
+
+// Start runs the recovery periodically with the given interval until the context is done. The journal is shared by
+// all the instances of the deployment, so if the lease is provided, only the instance holding it runs the recovery so
+// that the orphaned flows are not reported multiple times. A nil lease runs the recovery on this instance.
+func (j *FlowJournal) Start(ctx context.Context, interval time.Duration, lease Lease) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		j.recoverWithLease(ctx, interval, lease)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recoverWithLease runs the recovery once if this instance holds the lease. The lease is held for two intervals so
+// that it doesn't expire between the runs of the instance holding it.
+func (j *FlowJournal) recoverWithLease(ctx context.Context, interval time.Duration, lease Lease) {
+	if !holdsLease(ctx, lease, flowJournalRecoveryLease, 2*interval) {
+		return
+	}
+
+	lg := log.FromContext(ctx)
+	if recovered, err := j.Recover(ctx, FlowJournalGracePeriod); err != nil {
+		lg.Error(err, "failed to recover the orphaned OAuth flows")
+	} else {
+		lg.V(logs.DebugLevel).Info("recovered orphaned OAuth flows", "count", recovered)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+)
+
+type nonIterableStore struct {
+	scs.Store
+}
+
+func TestFlowJournal(t *testing.T) {
+	exchange := &exchangeResult{exchangeState: exchangeState{AnonymousOAuthState: oauthstate.AnonymousOAuthState{
+		TokenName:           "token",
+		TokenNamespace:      "default",
+		ServiceProviderType: "JournalTest",
+	}}}
+
+	t.Run("finished flows are removed", func(t *testing.T) {
+		store := memstore.New()
+		journal := NewFlowJournal(store)
+
+		journal.RecordExchanged(context.TODO(), "state", exchange)
+		all, _ := store.All()
+		assert.Len(t, all, 1)
+		assert.NotContains(t, all, "state")
+
+		journal.Finish(context.TODO(), "state")
+		all, _ = store.All()
+		assert.Empty(t, all)
+	})
+
+	t.Run("orphaned flows are recovered after the grace period", func(t *testing.T) {
+		store := memstore.New()
+		journal := NewFlowJournal(store)
+		journal.RecordExchanged(context.TODO(), "state", exchange)
+
+		recovered, err := journal.Recover(context.TODO(), time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, recovered)
+
+		before := testutil.ToFloat64(orphanedFlowsCounter.WithLabelValues("JournalTest"))
+		recovered, err = journal.Recover(context.TODO(), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, recovered)
+		assert.Equal(t, before+1, testutil.ToFloat64(orphanedFlowsCounter.WithLabelValues("JournalTest")))
+
+		all, _ := store.All()
+		assert.Empty(t, all)
+	})
+
+	t.Run("orphaned flows are recovered by the lease holder only", func(t *testing.T) {
+		store := memstore.New()
+		journal := NewFlowJournal(store)
+		b, err := json.Marshal(flowJournalEntry{Phase: flowJournalPhaseExchanged, Provider: "JournalTest", Timestamp: time.Now().Add(-time.Hour)})
+		assert.NoError(t, err)
+		assert.NoError(t, store.Commit(flowJournalId("state"), b, time.Now().Add(time.Hour)))
+
+		leaseStore := memstore.New()
+		first := NewCoordinator(leaseStore, InstanceIdentity{Id: "first"}, "https://spi", []byte("secret"), time.Minute)
+		second := NewCoordinator(leaseStore, InstanceIdentity{Id: "second"}, "https://spi", []byte("secret"), time.Minute)
+		held, err := first.AcquireLease(context.TODO(), flowJournalRecoveryLease, time.Minute)
+		assert.NoError(t, err)
+		assert.True(t, held)
+
+		journal.recoverWithLease(context.TODO(), time.Minute, second)
+		all, _ := store.All()
+		assert.Len(t, all, 1)
+
+		journal.recoverWithLease(context.TODO(), time.Minute, first)
+		all, _ = store.All()
+		assert.Empty(t, all)
+	})
+
+	t.Run("recovery requires iterable store", func(t *testing.T) {
+		_, err := NewFlowJournal(nonIterableStore{memstore.New()}).Recover(context.TODO(), 0)
+		assert.True(t, errors.Is(err, notIterableJournalStoreError))
+	})
+
+	t.Run("nil journal records nothing", func(t *testing.T) {
+		var journal *FlowJournal
+		journal.RecordExchanged(context.TODO(), "state", exchange)
+		journal.Finish(context.TODO(), "state")
+		recovered, err := journal.Recover(context.TODO(), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, recovered)
+	})
+}
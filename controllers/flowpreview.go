@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// flowPreview is the response of the flow preview endpoint describing the scopes the OAuth flow would ask for compared
+// to the scopes already granted to the token.
+type flowPreview struct {
+	// TokenExists tells whether the SPIAccessToken already has a token with known scopes.
+	TokenExists bool `json:"tokenExists"`
+	// GrantedScopes are the scopes of the existing token.
+	GrantedScopes []string `json:"grantedScopes"`
+	// RequestedScopes are the scopes the OAuth flow asks for.
+	RequestedScopes []string `json:"requestedScopes"`
+	// NewScopes are the requested scopes that are not granted yet.
+	NewScopes []string `json:"newScopes"`
+	// ConsentRequired tells whether the user needs to approve the access at the service provider, i.e. whether there
+	// is no token yet or some of the requested scopes are not granted.
+	ConsentRequired bool `json:"consentRequired"`
+}
+
+// FlowPreviewHandler returns a Handler implementation that decodes the OAuth state in the `state` query parameter and
+// responds with the difference between the scopes already granted to the target SPIAccessToken and the scopes
+// requested by the state. This lets the UIs tell the users whether the re-consent is actually needed. The requests
+// need to carry the bearer token of a user that can read the SPIAccessToken.
+func FlowPreviewHandler(k8sClient auth.AuthenticatingClient, jwtSigningSecret []byte) func(http.ResponseWriter, *http.Request) {
+	codec, codecErr := oauthstate.NewCodec(jwtSigningSecret)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := auth.WithAuthFromRequestIntoContext(r, r.Context())
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed extract authorization information from headers", err)
+			return
+		}
+
+		if codecErr != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to instantiate OAuth stateString codec", codecErr)
+			return
+		}
+
+		state, err := codec.ParseAnonymous(r.URL.Query().Get("state"))
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode the OAuth state", err)
+			return
+		}
+		r = r.WithContext(logging.WithTokenLogFields(r.Context(), state.TokenNamespace, state.TokenName))
+
+		if state.TokenKcpWorkspace != "" {
+			ctx = logicalcluster.WithCluster(ctx, logicalcluster.New(state.TokenKcpWorkspace))
+		}
+
+		token := &api.SPIAccessToken{}
+		if err = k8sClient.Get(ctx, client.ObjectKey{Name: state.TokenName, Namespace: state.TokenNamespace}, token); err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "failed to get the SPIAccessToken object", err)
+			return
+		}
+
+		preview := flowPreview{
+			GrantedScopes:   []string{},
+			RequestedScopes: state.Scopes,
+		}
+		if preview.RequestedScopes == nil {
+			preview.RequestedScopes = []string{}
+		}
+		if token.Status.TokenMetadata != nil {
+			preview.TokenExists = true
+			if token.Status.TokenMetadata.Scopes != nil {
+				preview.GrantedScopes = token.Status.TokenMetadata.Scopes
+			}
+		}
+		preview.NewScopes = scopeDiff(preview.GrantedScopes, preview.RequestedScopes)
+		preview.ConsentRequired = !preview.TokenExists || len(preview.NewScopes) > 0
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(preview); err != nil {
+			log.FromContext(r.Context()).Error(err, "error recording the flow preview")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestFlowPreviewHandler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default"}},
+		&api.SPIAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Name: "existing", Namespace: "default"},
+			Status: api.SPIAccessTokenStatus{
+				TokenMetadata: &api.TokenMetadata{Scopes: []string{"repo", "read:user"}},
+			},
+		},
+	).Build()
+	handler := FlowPreviewHandler(cl, []byte("secret"))
+
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+	preview := func(tokenName string, scopes ...string) (int, flowPreview) {
+		state, err := codec.Encode(&oauthstate.AnonymousOAuthState{TokenName: tokenName, TokenNamespace: "default", Scopes: scopes})
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest("GET", "/flow/preview?state="+state, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		result := flowPreview{}
+		if rr.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		}
+		return rr.Code, result
+	}
+
+	t.Run("no token yet", func(t *testing.T) {
+		code, result := preview("new", "repo")
+		assert.Equal(t, http.StatusOK, code)
+		assert.False(t, result.TokenExists)
+		assert.Equal(t, []string{"repo"}, result.NewScopes)
+		assert.True(t, result.ConsentRequired)
+	})
+
+	t.Run("all scopes granted", func(t *testing.T) {
+		code, result := preview("existing", "repo")
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, result.TokenExists)
+		assert.Equal(t, []string{"repo", "read:user"}, result.GrantedScopes)
+		assert.Empty(t, result.NewScopes)
+		assert.False(t, result.ConsentRequired)
+	})
+
+	t.Run("new scopes requested", func(t *testing.T) {
+		code, result := preview("existing", "repo", "write:packages")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []string{"write:packages"}, result.NewScopes)
+		assert.True(t, result.ConsentRequired)
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		code, _ := preview("unknown", "repo")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("invalid state", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/flow/preview?state=invalid", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("no bearer token", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", "/flow/preview?state=invalid", nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// The phases of the OAuth flow that are timed.
+const (
+	phaseAuthn    = "authn"
+	phaseSar      = "sar"
+	phaseVeil     = "veil"
+	phaseUnveil   = "unveil"
+	phaseExchange = "exchange"
+	phaseStorage  = "storage"
+)
+
+// flowRecord collects the durations of the phases of a single request of the OAuth flow so that they can be reported in
+// the audit event of the request. The durations are also observed in the metrics as they are recorded.
+type flowRecord struct {
+	provider config.ServiceProviderType
+	phases   []phaseDuration
+}
+
+type phaseDuration struct {
+	phase    string
+	duration time.Duration
+}
+
+func newFlowRecord(provider config.ServiceProviderType) *flowRecord {
+	return &flowRecord{provider: provider}
+}
+
+// track starts timing the phase. The returned function needs to be called when the phase finishes.
+func (f *flowRecord) track(phase string) func() {
+	start := time.Now()
+	return func() {
+		f.record(phase, time.Since(start))
+	}
+}
+
+// record records the duration of the phase.
+func (f *flowRecord) record(phase string, duration time.Duration) {
+	f.phases = append(f.phases, phaseDuration{phase: phase, duration: duration})
+	flowPhaseDurationHistogram.WithLabelValues(string(f.provider), phase).Observe(duration.Seconds())
+}
+
+// durations returns the recorded durations of the phases in seconds, keyed by the phase, suitable for logging.
+func (f *flowRecord) durations() map[string]float64 {
+	ret := make(map[string]float64, len(f.phases))
+	for _, p := range f.phases {
+		ret[p.phase] += p.duration.Seconds()
+	}
+	return ret
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowRecord(t *testing.T) {
+	record := newFlowRecord("Test_SP")
+
+	stop := record.track(phaseExchange)
+	stop()
+	record.record(phaseStorage, 2*time.Second)
+	record.record(phaseStorage, time.Second)
+
+	durations := record.durations()
+	assert.Len(t, durations, 2)
+	assert.Contains(t, durations, phaseExchange)
+	assert.Equal(t, float64(3), durations[phaseStorage])
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	noFlowStateError            = errors.New("either the state or the token needs to be specified")
+	noOAuthUrlError             = errors.New("the SPIAccessToken doesn't wait for an OAuth flow")
+	unknownServiceProviderError = errors.New("no service provider is configured for the OAuth state")
+	noSharedStateStoreError     = errors.New("the flows API requires the OAuth states shared among the replicas")
+)
+
+// flowRequest is the body of the request starting the OAuth flow using the flows API. The flow is identified either
+// by the OAuth state generated by the SPI operator or by the SPIAccessToken the state is read from. The initiator
+// identifies the client application starting the flow, the same as the InitiatorHeader.
+type flowRequest struct {
+	State     string              `json:"state,omitempty"`
+	Token     *flowTokenReference `json:"token,omitempty"`
+	Initiator string              `json:"initiator,omitempty"`
+}
+
+// flowTokenReference identifies the SPIAccessToken to start the OAuth flow for.
+type flowTokenReference struct {
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	KcpWorkspace string `json:"kcpWorkspace,omitempty"`
+}
+
+// flowResponse is the response of the flows API.
+type flowResponse struct {
+	// AuthorizationUrl is the URL of the service provider the user needs to visit to authorize the access.
+	AuthorizationUrl string `json:"authorization_url"`
+	// ExpiresAt is the time until which the user needs to finish the flow.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FlowsHandler returns a Handler implementation that starts the OAuth flow the same way as the authenticate endpoints
+// of the service providers but responds with JSON containing the authorization URL instead of the redirect notice.
+// This lets backend services orchestrate the flows and present the URL in their own UIs. The requests need to carry
+// the bearer token of the user the flow is started for. The token is not remembered and the session of the response
+// belongs to the caller, so the user needs to be authenticated in their own session before following the authorization
+// URL, e.g. using the `/login` endpoint, and the callback finds the state in the shared state store. Without the shared
+// state store, the callback couldn't find the state, so the requests are refused. The flow controllers are looked up
+// by the service provider type in the OAuth state.
+func FlowsHandler(flowControllers map[config.ServiceProviderType]Controller, stateStorage *StateStorage, k8sClient auth.AuthenticatingClient, jwtSigningSecret []byte) func(http.ResponseWriter, *http.Request) {
+	codec, codecErr := oauthstate.NewCodec(jwtSigningSecret)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if codecErr != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to instantiate OAuth stateString codec", codecErr)
+			return
+		}
+		if stateStorage == nil || stateStorage.sharedStore == nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusNotImplemented, "failed to start the OAuth flow", noSharedStateStoreError)
+			return
+		}
+
+		ctx, err := auth.WithAuthFromRequestIntoContext(r, r.Context())
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed extract authorization information from headers", err)
+			return
+		}
+
+		request := flowRequest{}
+		if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode request body as flow JSON", err)
+			return
+		}
+
+		if request.Initiator != "" {
+			r.Header.Set(InitiatorHeader, request.Initiator)
+		}
+
+		stateString := request.State
+		if stateString == "" && request.Token != nil {
+			ctx = logging.WithTokenLogFields(ctx, request.Token.Namespace, request.Token.Name)
+			if request.Token.KcpWorkspace != "" {
+				ctx = logicalcluster.WithCluster(ctx, logicalcluster.New(request.Token.KcpWorkspace))
+			}
+
+			token := &api.SPIAccessToken{}
+			if err = k8sClient.Get(ctx, client.ObjectKey{Name: request.Token.Name, Namespace: request.Token.Namespace}, token); err != nil {
+				logging.LogErrorAndWriteResponse(ctx, w, spierrors.HttpStatus(err), "failed to get the SPIAccessToken object", err)
+				return
+			}
+			if stateString, err = stateOfOAuthUrl(token.Status.OAuthUrl); err != nil {
+				logging.LogErrorAndWriteResponse(ctx, w, http.StatusConflict, "failed to find the OAuth state of the SPIAccessToken", err)
+				return
+			}
+		}
+		if stateString == "" {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "no OAuth flow specified", noFlowStateError)
+			return
+		}
+
+		state, err := codec.ParseAnonymous(stateString)
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode the OAuth state", err)
+			return
+		}
+		controller, ok := flowControllers[state.ServiceProviderType]
+		if !ok {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to start the OAuth flow", unknownServiceProviderError)
+			return
+		}
+
+		// the bearer token only authenticates this request, it is not remembered in the session. The user finishes
+		// the flow in the browser and needs to authenticate there for the callback. The context also carries
+		// the workspace of the SPIAccessToken, if any.
+		authorizationUrl, ok := controller.AuthorizationUrl(w, r.WithContext(ctx), stateString)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(flowResponse{
+			AuthorizationUrl: authorizationUrl,
+			ExpiresAt:        time.Now().Add(stateStorage.FlowTimeout()).UTC().Truncate(time.Second),
+		}); err != nil {
+			log.FromContext(r.Context()).Error(err, "error recording the flow response")
+		}
+	}
+}
+
+// stateOfOAuthUrl returns the OAuth state from the OAuth URL the SPI operator puts to the status of the SPIAccessToken.
+func stateOfOAuthUrl(oauthUrl string) (string, error) {
+	if oauthUrl == "" {
+		return "", noOAuthUrlError
+	}
+	parsed, err := url.Parse(oauthUrl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the OAuth URL: %w", err)
+	}
+	state := parsed.Query().Get("state")
+	if state == "" {
+		return "", noOAuthUrlError
+	}
+	return state, nil
+}
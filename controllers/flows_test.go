@@ -0,0 +1,219 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/kcp-dev/logicalcluster/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestFlowsHandler(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(CanaryTokenHandler("client-secret")))
+	defer tokenServer.Close()
+
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+	newState := func(spType config.ServiceProviderType) string {
+		state, err := codec.Encode(&oauthstate.AnonymousOAuthState{
+			TokenName:           "token",
+			TokenNamespace:      "default",
+			IssuedAt:            time.Now().Unix(),
+			ServiceProviderType: spType,
+		})
+		assert.NoError(t, err)
+		return state
+	}
+	state := newState(CanaryServiceProviderType)
+
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	assert.NoError(t, authz.AddToScheme(scheme))
+	cl := allowingClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+		Status:     api.SPIAccessTokenStatus{OAuthUrl: "https://spi/canary/authenticate?state=" + url.QueryEscape(state)},
+	}, &api.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "ready", Namespace: "default"},
+	}).Build()}
+
+	storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+		return nil
+	}}
+	sessionManager := scs.New()
+	authenticator := auth.NewAuthenticator(sessionManager, cl)
+	stateStorage := NewStateStorage(sessionManager, memstore.NewWithCleanupInterval(0), DefaultVeilEntropyBits)
+	cfg := OAuthServiceConfiguration{SharedConfiguration: config.SharedConfiguration{BaseUrl: "https://spi", SharedSecret: []byte("secret")}}
+	controller, err := FromConfiguration(cfg, CanaryServiceProviderConfiguration(tokenServer.URL, "client-secret"), authenticator, stateStorage, nil, nil, cl, storage, nil)
+	assert.NoError(t, err)
+
+	handler := sessionManager.LoadAndSave(http.HandlerFunc(FlowsHandler(map[config.ServiceProviderType]Controller{CanaryServiceProviderType: controller}, stateStorage, cl, []byte("secret"))))
+	startFlow := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/flows", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer k8s-token")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("starts the flow for the state", func(t *testing.T) {
+		rr := startFlow(`{"state": "` + state + `"}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+		response := flowResponse{}
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+		assert.True(t, strings.HasPrefix(response.AuthorizationUrl, tokenServer.URL+CanaryProviderPath+"/authorize?"), response.AuthorizationUrl)
+		assert.True(t, response.ExpiresAt.After(time.Now()))
+
+		// the user finishes the flow in their own session, without the session of the response, and needs to be
+		// authenticated there
+		authorizationUrl, err := url.Parse(response.AuthorizationUrl)
+		assert.NoError(t, err)
+		callback := func(query string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "https://spi/canary/callback?code="+canaryCodePrefix+"code&state="+url.QueryEscape(authorizationUrl.Query().Get("state"))+query, nil)
+			res := httptest.NewRecorder()
+			sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Empty(t, sessionManager.GetString(r.Context(), auth.K8sTokenSessionKey))
+				controller.Callback(r.Context(), w, r)
+			})).ServeHTTP(res, req)
+			return res
+		}
+		assert.Equal(t, http.StatusUnauthorized, callback("").Code)
+		callbackResponse := callback("&k8s_token=k8s-token")
+		assert.Equal(t, http.StatusFound, callbackResponse.Code)
+		assert.Contains(t, callbackResponse.Header().Get("Location"), "/callback_success")
+	})
+
+	t.Run("starts the flow for the token", func(t *testing.T) {
+		rr := startFlow(`{"token": {"namespace": "default", "name": "token"}}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `"authorization_url"`)
+	})
+
+	t.Run("fails for token without flow", func(t *testing.T) {
+		rr := startFlow(`{"token": {"namespace": "default", "name": "ready"}}`)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+	})
+
+	t.Run("fails for unknown token", func(t *testing.T) {
+		rr := startFlow(`{"token": {"namespace": "default", "name": "unknown"}}`)
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("fails without the flow", func(t *testing.T) {
+		rr := startFlow(`{}`)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("fails for unknown service provider", func(t *testing.T) {
+		rr := startFlow(`{"state": "` + newState(config.ServiceProviderTypeGitHub) + `"}`)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("fails for invalid state", func(t *testing.T) {
+		rr := startFlow(`{"state": "invalid"}`)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("rate limits the initiator of the body", func(t *testing.T) {
+		limited := cfg
+		limited.Initiators = InitiatorPolicy{Allowed: []string{"appstudio-ui", "spi-cli"}}.WithRateLimit(0.001, 1)
+		limitedController, err := FromConfiguration(limited, CanaryServiceProviderConfiguration(tokenServer.URL, "client-secret"), authenticator, stateStorage, nil, nil, cl, storage, nil)
+		assert.NoError(t, err)
+		limitedHandler := sessionManager.LoadAndSave(http.HandlerFunc(FlowsHandler(map[config.ServiceProviderType]Controller{CanaryServiceProviderType: limitedController}, stateStorage, cl, []byte("secret"))))
+		start := func(initiator string) int {
+			req := httptest.NewRequest("POST", "/flows", strings.NewReader(`{"state": "`+state+`", "initiator": "`+initiator+`"}`))
+			req.Header.Set("Authorization", "Bearer k8s-token")
+			// the field of the body takes precedence over the header
+			req.Header.Set(InitiatorHeader, "spi-cli")
+			rr := httptest.NewRecorder()
+			limitedHandler.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		assert.Equal(t, http.StatusOK, start("appstudio-ui"))
+		assert.Equal(t, http.StatusTooManyRequests, start("appstudio-ui"))
+		assert.Equal(t, http.StatusOK, start("spi-cli"))
+	})
+
+	t.Run("starts the flow in the workspace of the token", func(t *testing.T) {
+		recording := &recordingController{}
+		recordingHandler := sessionManager.LoadAndSave(http.HandlerFunc(FlowsHandler(map[config.ServiceProviderType]Controller{CanaryServiceProviderType: recording}, stateStorage, cl, []byte("secret"))))
+		req := httptest.NewRequest("POST", "/flows", strings.NewReader(`{"token": {"namespace": "default", "name": "token", "kcpWorkspace": "root:users"}}`))
+		req.Header.Set("Authorization", "Bearer k8s-token")
+		recordingHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+		assert.NotNil(t, recording.ctx)
+		cluster, ok := logicalcluster.ClusterFromContext(recording.ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "root:users", cluster.String())
+		assert.Equal(t, "k8s-token", auth.BearerTokenFromContext(recording.ctx))
+	})
+
+	t.Run("fails without the shared state store", func(t *testing.T) {
+		localHandler := sessionManager.LoadAndSave(http.HandlerFunc(FlowsHandler(map[config.ServiceProviderType]Controller{CanaryServiceProviderType: controller}, NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits), cl, []byte("secret"))))
+		req := httptest.NewRequest("POST", "/flows", strings.NewReader(`{"state": "`+state+`"}`))
+		req.Header.Set("Authorization", "Bearer k8s-token")
+		rr := httptest.NewRecorder()
+		localHandler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotImplemented, rr.Code)
+	})
+
+	t.Run("fails without bearer token", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/flows", strings.NewReader(`{"state": "`+state+`"}`)))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+}
+
+func TestStateOfOAuthUrl(t *testing.T) {
+	state, err := stateOfOAuthUrl("https://spi/github/authenticate?state=abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", state)
+
+	for _, oauthUrl := range []string{"", "https://spi/github/authenticate"} {
+		_, err = stateOfOAuthUrl(oauthUrl)
+		assert.ErrorIs(t, err, noOAuthUrlError)
+	}
+}
+
+// recordingController records the context of the request starting the OAuth flow.
+type recordingController struct {
+	Controller
+	ctx context.Context
+}
+
+func (c *recordingController) AuthorizationUrl(w http.ResponseWriter, r *http.Request, _ string) (string, bool) {
+	c.ctx = r.Context()
+	return "https://provider/authorize", true
+}
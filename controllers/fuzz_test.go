@@ -0,0 +1,183 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/gorilla/mux"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/stretchr/testify/assert"
+)
+
+// The fuzz targets below cover the parsers that process the input of unauthenticated requests. The inputs that made
+// them fail are kept in testdata/fuzz and are run as regression tests by the plain `go test`.
+
+func FuzzParseAnonymousState(f *testing.F) {
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	valid, err := codec.Encode(&oauthstate.AnonymousOAuthState{
+		TokenName:           "token",
+		TokenNamespace:      "default",
+		Scopes:              []string{"repo", "user"},
+		ServiceProviderType: "GitHub",
+		ServiceProviderUrl:  "https://github.com",
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	otherCodec, err := oauthstate.NewCodec([]byte("other"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	forged, err := otherCodec.Encode(&oauthstate.AnonymousOAuthState{TokenName: "token", TokenNamespace: "default"})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(valid)
+	f.Add(forged)
+	f.Add("")
+	f.Add("..")
+	f.Add("a.b.c")
+	f.Add("eyJhbGciOiJub25lIn0.e30.")
+
+	f.Fuzz(func(t *testing.T, stateString string) {
+		state, err := codec.ParseAnonymous(stateString)
+		if err != nil {
+			return
+		}
+
+		// whatever we accept must survive the round-trip through the codec unchanged
+		encoded, err := codec.Encode(&state)
+		if !assert.NoError(t, err) {
+			return
+		}
+		reparsed, err := codec.ParseAnonymous(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, state, reparsed)
+	})
+}
+
+func FuzzVeilRoundTrip(f *testing.F) {
+	f.Add("state")
+	f.Add("eyJhbGciOiJIUzI1NiJ9.e30.sig")
+	f.Add("a&state=b")
+	f.Add("flow:state")
+	f.Add("\x00\xff")
+
+	f.Fuzz(func(t *testing.T, state string) {
+		sessionManager := scs.New()
+		storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
+
+		req := httptest.NewRequest("GET", "/?state="+url.QueryEscape(state), nil)
+		sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			veil, err := storage.VeilRealState(r)
+			if state == "" {
+				assert.True(t, errors.Is(err, noStateError))
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NotEqual(t, state, veil)
+
+			callback := httptest.NewRequest("GET", "/?state="+url.QueryEscape(veil), nil).WithContext(r.Context())
+			unveiled, err := storage.UnveilState(r.Context(), callback)
+			assert.NoError(t, err)
+			assert.Equal(t, state, unveiled)
+
+			assert.NoError(t, storage.CancelState(r.Context(), state))
+			_, err = storage.UnveilState(r.Context(), callback)
+			assert.True(t, errors.Is(err, stateNotFoundError))
+		})).ServeHTTP(httptest.NewRecorder(), req)
+	})
+}
+
+func FuzzUnveilState(f *testing.F) {
+	f.Add("")
+	f.Add("veil")
+	f.Add("state")
+
+	f.Fuzz(func(t *testing.T, veil string) {
+		sessionManager := scs.New()
+		storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
+
+		req := httptest.NewRequest("GET", "/?state=state", nil)
+		sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			realVeil, err := storage.VeilRealState(r)
+			if !assert.NoError(t, err) {
+				return
+			}
+			sessionManager.Put(r.Context(), auth.K8sTokenSessionKey, "k8s-token")
+
+			callback := httptest.NewRequest("GET", "/?state="+url.QueryEscape(veil), nil).WithContext(r.Context())
+			unveiled, err := storage.UnveilState(r.Context(), callback)
+			switch veil {
+			case "":
+				assert.True(t, errors.Is(err, noStateError))
+			case realVeil:
+				assert.Equal(t, "state", unveiled)
+			default:
+				// no other key of the session may be used to unveil the state
+				assert.True(t, errors.Is(err, stateNotFoundError), "veil %q unveiled %q", veil, unveiled)
+			}
+		})).ServeHTTP(httptest.NewRecorder(), req)
+	})
+}
+
+func FuzzUploadTokenDecode(f *testing.F) {
+	f.Add([]byte(`{"access_token": "42"}`))
+	f.Add([]byte(`{"access_token": "42", "username": "jdoe", "token_type": "bearer", "refresh_token": "r", "expiry": 1}`))
+	f.Add([]byte(`{"username": "jdoe"}`))
+	f.Add([]byte(`{"access_token": 42}`))
+	f.Add([]byte(`{"access_token": "42"} trailing`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte(``))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		uploaded := false
+		uploader := UploadFunc(func(ctx context.Context, tokenObjectName string, tokenObjectNamespace string, data *api.Token) error {
+			uploaded = true
+			assert.NotEmpty(t, data.AccessToken)
+			return nil
+		})
+
+		router := mux.NewRouter()
+		router.NewRoute().Path("/token/{namespace}/{name}").HandlerFunc(HandleUpload(uploader)).Methods("POST")
+
+		req := httptest.NewRequest("POST", "/token/jdoe/umbrella", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer kachny")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if uploaded {
+			assert.Equal(t, http.StatusNoContent, rr.Code)
+		} else {
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+		}
+	})
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/grpcapi"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	invalidGrpcTlsConfigurationError = errors.New("invalid TLS configuration of the gRPC server")
+	noTokenDataUpdateAccessError     = spierrors.WithKind(spierrors.Forbidden, errors.New("not allowed to update the token data"))
+)
+
+// TokenServiceServer implements the gRPC TokenService. It offers the operations of the HTTP upload endpoint and
+// authorizes them the same way, using the Kubernetes token of the caller.
+type TokenServiceServer struct {
+	grpcapi.UnimplementedTokenServiceServer
+	// K8sClient is the client authenticating the requests using the token in the context.
+	K8sClient client.Client
+	// Uploader is used to store the uploaded token data.
+	Uploader TokenUploader
+	// Storage is the token storage the token data is deleted from. It should notify the operator about the change
+	// using the client authenticated as the caller.
+	Storage tokenstorage.TokenStorage
+}
+
+var _ grpcapi.TokenServiceServer = (*TokenServiceServer)(nil)
+
+// UploadToken stores the token data of the SPIAccessToken.
+func (s *TokenServiceServer) UploadToken(ctx context.Context, req *grpcapi.UploadTokenRequest) (*grpcapi.UploadTokenResponse, error) {
+	ctx, err := withGrpcAuthIntoContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.upload(ctx, req); err != nil {
+		return nil, err
+	}
+	return &grpcapi.UploadTokenResponse{}, nil
+}
+
+// UploadTokens stores the token data of the streamed requests and streams back the result of each of them.
+func (s *TokenServiceServer) UploadTokens(stream grpcapi.TokenService_UploadTokensServer) error {
+	ctx, err := withGrpcAuthIntoContext(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err //nolint:wrapcheck // the status of the stream is returned to the client as is
+		}
+
+		result := &grpcapi.UploadTokenResult{Token: req.Token}
+		if err := s.upload(ctx, req); err != nil {
+			st := status.Convert(err)
+			result.Code = int32(st.Code())
+			result.Message = st.Message()
+		}
+		if err := stream.Send(result); err != nil {
+			return err //nolint:wrapcheck // the status of the stream is returned to the client as is
+		}
+	}
+}
+
+// GetTokenMetadata returns the metadata of the token from the status of the SPIAccessToken.
+func (s *TokenServiceServer) GetTokenMetadata(ctx context.Context, req *grpcapi.GetTokenMetadataRequest) (*grpcapi.TokenMetadata, error) {
+	ctx, err := withGrpcAuthIntoContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err = withTokenReference(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &api.SPIAccessToken{}
+	if err := s.K8sClient.Get(ctx, client.ObjectKey{Name: req.Token.Name, Namespace: req.Token.Namespace}, token); err != nil {
+		return nil, grpcStatusError(ctx, "failed to get the SPIAccessToken", err)
+	}
+
+	metadata := &grpcapi.TokenMetadata{}
+	if token.Status.TokenMetadata != nil {
+		metadata.Username = token.Status.TokenMetadata.Username
+		metadata.UserId = token.Status.TokenMetadata.UserId
+		metadata.Scopes = token.Status.TokenMetadata.Scopes
+		metadata.LastRefreshTime = token.Status.TokenMetadata.LastRefreshTime
+	}
+	return metadata, nil
+}
+
+// DeleteToken removes the token data of the SPIAccessToken from the token storage. The caller must be allowed to
+// update the token data in the namespace of the SPIAccessToken.
+func (s *TokenServiceServer) DeleteToken(ctx context.Context, req *grpcapi.DeleteTokenRequest) (*grpcapi.DeleteTokenResponse, error) {
+	ctx, err := withGrpcAuthIntoContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err = withTokenReference(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &api.SPIAccessToken{}
+	if err := s.K8sClient.Get(ctx, client.ObjectKey{Name: req.Token.Name, Namespace: req.Token.Namespace}, token); err != nil {
+		return nil, grpcStatusError(ctx, "failed to get the SPIAccessToken", err)
+	}
+
+	allowed, err := hasTokenDataUpdateAccess(ctx, s.K8sClient, req.Token.Namespace)
+	if err != nil {
+		return nil, grpcStatusError(ctx, "failed to check the access to the token data", err)
+	}
+	if !allowed {
+		return nil, grpcStatusError(ctx, "failed to delete the token data", noTokenDataUpdateAccessError)
+	}
+
+	logging.AuditLogWithTokenInfo(ctx, "token data deletion initiated", req.Token.Namespace, req.Token.Name)
+	if err := s.Storage.Delete(ctx, token); err != nil {
+		return nil, grpcStatusError(ctx, "failed to delete the token data", err)
+	}
+	logging.AuditLogWithTokenInfo(ctx, "token data deletion done", req.Token.Namespace, req.Token.Name)
+	return &grpcapi.DeleteTokenResponse{}, nil
+}
+
+// upload validates the request and stores the token data using the uploader.
+func (s *TokenServiceServer) upload(ctx context.Context, req *grpcapi.UploadTokenRequest) error {
+	ctx, err := withTokenReference(ctx, req.Token)
+	if err != nil {
+		return err
+	}
+	if req.Data.GetAccessToken() == "" {
+		return status.Error(codes.InvalidArgument, "access token can't be omitted or empty")
+	}
+
+	data := &api.Token{
+		Username:     req.Data.Username,
+		AccessToken:  req.Data.AccessToken,
+		TokenType:    req.Data.TokenType,
+		RefreshToken: req.Data.RefreshToken,
+		Expiry:       req.Data.Expiry,
+	}
+	if err := s.Uploader.Upload(ctx, req.Token.Name, req.Token.Namespace, data); err != nil {
+		return grpcStatusError(ctx, "failed to upload the token", err)
+	}
+	return nil
+}
+
+// withGrpcAuthIntoContext stores the bearer token from the authorization metadata of the call into the context so that
+// the Kubernetes client authenticates as the caller.
+func withGrpcAuthIntoContext(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		token = auth.ExtractTokenFromAuthorizationHeader(values[0])
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "no bearer token found in the authorization metadata")
+	}
+	return auth.WithAuthIntoContext(token, ctx), nil
+}
+
+// withTokenReference validates the reference to the SPIAccessToken and adds it to the logging fields and,
+// if specified, the KCP workspace of it to the context.
+func withTokenReference(ctx context.Context, ref *grpcapi.TokenReference) (context.Context, error) {
+	if ref.GetName() == "" || ref.GetNamespace() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token name and namespace can't be omitted or empty")
+	}
+	ctx = logging.WithTokenLogFields(ctx, ref.Namespace, ref.Name)
+	if ref.KcpWorkspace != "" {
+		ctx = logicalcluster.WithCluster(ctx, logicalcluster.New(ref.KcpWorkspace))
+	}
+	return ctx, nil
+}
+
+// grpcStatusError logs the error and converts it to the gRPC status error with the code corresponding to the cause.
+func grpcStatusError(ctx context.Context, msg string, err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, spierrors.Forbidden), apierrors.IsForbidden(err):
+		code = codes.PermissionDenied
+	case errors.Is(err, spierrors.NotAuthenticated), apierrors.IsUnauthorized(err):
+		code = codes.Unauthenticated
+	case errors.Is(err, spierrors.StorageUnavailable):
+		code = codes.Unavailable
+	case apierrors.IsNotFound(err):
+		code = codes.NotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	log.FromContext(ctx).Error(err, msg, "code", code.String())
+	return status.Errorf(code, "%s: %s", msg, err.Error())
+}
+
+// GrpcServerCredentials returns the credentials of the gRPC server requiring the clients to authenticate using
+// a certificate signed by the certificate authority in clientCAFile, i.e. mutual TLS. All the files must be
+// PEM-encoded.
+func GrpcServerCredentials(certFile, keyFile, clientCAFile string) (credentials.TransportCredentials, error) {
+	if certFile == "" || keyFile == "" || clientCAFile == "" {
+		return nil, fmt.Errorf("%w: the certificate, the key and the client CA must all be configured", invalidGrpcTlsConfigurationError)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate of the gRPC server: %w", err)
+	}
+
+	caPem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the client CA of the gRPC server: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("%w: no certificates found in %s", invalidGrpcTlsConfigurationError, clientCAFile)
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+// NewGrpcServer creates the gRPC server serving the TokenService using the provided credentials. The context of
+// the calls carries the logger of the server.
+func NewGrpcServer(service grpcapi.TokenServiceServer, creds credentials.TransportCredentials) *grpc.Server {
+	lg := log.Log.WithName("grpc")
+	server := grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			return handler(log.IntoContext(ctx, lg.WithValues("method", info.FullMethod)), req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			return handler(srv, &loggingServerStream{ServerStream: ss, ctx: log.IntoContext(ss.Context(), lg.WithValues("method", info.FullMethod))})
+		}),
+	)
+	grpcapi.RegisterTokenServiceServer(server, service)
+	return server
+}
+
+// loggingServerStream is the server stream with the logger in the context.
+type loggingServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggingServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// GrpcServerSubsystem returns the subsystem serving the gRPC server on all the addresses. The listeners are opened on
+// start so that the failure to bind any of the addresses fails the start. The server is stopped gracefully on stop,
+// the calls still in progress when the context is done are cancelled.
+func GrpcServerSubsystem(name string, addrs []string, server *grpc.Server) Subsystem {
+	var listeners []net.Listener
+	return Subsystem{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var err error
+			listeners, err = listenAll(ctx, addrs)
+			return err
+		},
+		Run: func(_ context.Context) error {
+			return serveAll(listeners, func(listener net.Listener) error {
+				if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+					return fmt.Errorf("the gRPC server failed: %w", err)
+				}
+				return nil
+			})
+		},
+		Stop: func(ctx context.Context) error {
+			stopped := make(chan struct{})
+			go func() {
+				server.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				server.Stop()
+				return fmt.Errorf("failed to stop the gRPC server gracefully: %w", ctx.Err())
+			}
+		},
+	}
+}
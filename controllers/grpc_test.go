@@ -0,0 +1,246 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/grpcapi"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	authz "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// startTokenService serves the TokenService using the provided client and storage over an in-memory connection and
+// returns the client of it.
+func startTokenService(t *testing.T, cl client.Client, storage tokenstorage.TokenStorage) grpcapi.TokenServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewGrpcServer(&TokenServiceServer{
+		K8sClient: cl,
+		Uploader:  &SpiTokenUploader{K8sClient: cl, Storage: storage},
+		Storage:   storage,
+	}, insecure.NewCredentials())
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return grpcapi.NewTokenServiceClient(conn)
+}
+
+func grpcTestClient(t *testing.T) client.Client {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	assert.NoError(t, authz.AddToScheme(scheme))
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+		Status: api.SPIAccessTokenStatus{
+			TokenMetadata: &api.TokenMetadata{Username: "alois", UserId: "42", Scopes: []string{"repo"}, LastRefreshTime: 1000},
+		},
+	}).Build()
+}
+
+// denyingClient is the client that doesn't allow anything in the SelfSubjectAccessReviews.
+type denyingClient struct {
+	client.Client
+}
+
+func (c denyingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authz.SelfSubjectAccessReview); ok {
+		review.Status.Allowed = false
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func authenticated() context.Context {
+	return metadata.AppendToOutgoingContext(context.TODO(), "authorization", "Bearer k8s-token")
+}
+
+func TestTokenServiceServer_UploadToken(t *testing.T) {
+	var stored *api.Token
+	svc := startTokenService(t, grpcTestClient(t), tokenstorage.TestTokenStorage{
+		StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			assert.Equal(t, "token", owner.Name)
+			stored = token
+			return nil
+		},
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		_, err := svc.UploadToken(authenticated(), &grpcapi.UploadTokenRequest{
+			Token: &grpcapi.TokenReference{Namespace: "default", Name: "token"},
+			Data:  &grpcapi.Token{Username: "alois", AccessToken: "access", Expiry: 42},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, &api.Token{Username: "alois", AccessToken: "access", Expiry: 42}, stored)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		_, err := svc.UploadToken(context.TODO(), &grpcapi.UploadTokenRequest{
+			Token: &grpcapi.TokenReference{Namespace: "default", Name: "token"},
+			Data:  &grpcapi.Token{AccessToken: "access"},
+		})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("no access token", func(t *testing.T) {
+		_, err := svc.UploadToken(authenticated(), &grpcapi.UploadTokenRequest{
+			Token: &grpcapi.TokenReference{Namespace: "default", Name: "token"},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		_, err := svc.UploadToken(authenticated(), &grpcapi.UploadTokenRequest{
+			Data: &grpcapi.Token{AccessToken: "access"},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("token not found", func(t *testing.T) {
+		_, err := svc.UploadToken(authenticated(), &grpcapi.UploadTokenRequest{
+			Token: &grpcapi.TokenReference{Namespace: "default", Name: "missing"},
+			Data:  &grpcapi.Token{AccessToken: "access"},
+		})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+func TestTokenServiceServer_UploadTokens(t *testing.T) {
+	stored := 0
+	svc := startTokenService(t, grpcTestClient(t), tokenstorage.TestTokenStorage{
+		StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			stored++
+			return nil
+		},
+	})
+
+	stream, err := svc.UploadTokens(authenticated())
+	assert.NoError(t, err)
+
+	for _, name := range []string{"token", "missing", "token"} {
+		assert.NoError(t, stream.Send(&grpcapi.UploadTokenRequest{
+			Token: &grpcapi.TokenReference{Namespace: "default", Name: name},
+			Data:  &grpcapi.Token{AccessToken: "access"},
+		}))
+	}
+	assert.NoError(t, stream.CloseSend())
+
+	var results []*grpcapi.UploadTokenResult
+	for {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		results = append(results, result)
+	}
+
+	assert.Len(t, results, 3)
+	assert.Equal(t, int32(codes.OK), results[0].Code)
+	assert.Equal(t, "missing", results[1].Token.Name)
+	assert.Equal(t, int32(codes.NotFound), results[1].Code)
+	assert.NotEmpty(t, results[1].Message)
+	assert.Equal(t, int32(codes.OK), results[2].Code)
+	assert.Equal(t, 2, stored)
+}
+
+func TestTokenServiceServer_GetTokenMetadata(t *testing.T) {
+	svc := startTokenService(t, grpcTestClient(t), tokenstorage.TestTokenStorage{})
+
+	metadata, err := svc.GetTokenMetadata(authenticated(), &grpcapi.GetTokenMetadataRequest{
+		Token: &grpcapi.TokenReference{Namespace: "default", Name: "token"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "alois", metadata.Username)
+	assert.Equal(t, "42", metadata.UserId)
+	assert.Equal(t, []string{"repo"}, metadata.Scopes)
+	assert.Equal(t, int64(1000), metadata.LastRefreshTime)
+
+	_, err = svc.GetTokenMetadata(authenticated(), &grpcapi.GetTokenMetadataRequest{
+		Token: &grpcapi.TokenReference{Namespace: "default", Name: "missing"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestTokenServiceServer_DeleteToken(t *testing.T) {
+	deleted := false
+	storage := tokenstorage.TestTokenStorage{
+		DeleteImpl: func(ctx context.Context, owner *api.SPIAccessToken) error {
+			assert.Equal(t, "token", owner.Name)
+			deleted = true
+			return nil
+		},
+	}
+	req := &grpcapi.DeleteTokenRequest{Token: &grpcapi.TokenReference{Namespace: "default", Name: "token"}}
+
+	t.Run("forbidden", func(t *testing.T) {
+		svc := startTokenService(t, denyingClient{grpcTestClient(t)}, storage)
+		_, err := svc.DeleteToken(authenticated(), req)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		assert.False(t, deleted)
+	})
+
+	t.Run("ok", func(t *testing.T) {
+		svc := startTokenService(t, allowingClient{grpcTestClient(t)}, storage)
+		_, err := svc.DeleteToken(authenticated(), req)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	})
+}
+
+func TestGrpcServerCredentials(t *testing.T) {
+	_, err := GrpcServerCredentials("", "", "")
+	assert.ErrorIs(t, err, invalidGrpcTlsConfigurationError)
+
+	_, err = GrpcServerCredentials("/nonexistent/cert.pem", "/nonexistent/key.pem", "/nonexistent/ca.pem")
+	assert.Error(t, err)
+}
+
+func TestGrpcServerSubsystem(t *testing.T) {
+	s := GrpcServerSubsystem("grpc-server", []string{"127.0.0.1:0"}, NewGrpcServer(&TokenServiceServer{}, insecure.NewCredentials()))
+
+	assert.NoError(t, s.Start(context.TODO()))
+	done := make(chan error)
+	go func() {
+		done <- s.Run(context.TODO())
+	}()
+
+	assert.NoError(t, s.Stop(context.TODO()))
+	assert.NoError(t, <-done)
+}
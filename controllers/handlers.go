@@ -14,20 +14,28 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"unicode"
 
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/kcp-dev/logicalcluster/v2"
 
 	"github.com/go-jose/go-jose/v3/json"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapio"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
 )
 
 // OkHandler is a Handler implementation that responds only with http.StatusOK.
@@ -36,11 +44,85 @@ func OkHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// CallbackSuccessHandler is a Handler implementation that responds with HTML page
-// This page is a landing page after successfully completing the OAuth flow.
-// Resource file location is prefixed with `../` to be compatible with tests running locally.
-func CallbackSuccessHandler(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "../static/callback_success.html")
+// successViewData structure is used to pass parameters during callback_success.html template processing.
+type successViewData struct {
+	NextStepUrl  string
+	NextStepText string
+}
+
+// nextStepData is the data available to the template of the next step URL shown on the success page.
+type nextStepData struct {
+	Namespace    string
+	TokenName    string
+	KcpWorkspace string
+}
+
+// CallbackSuccessHandler returns a Handler implementation that responds with HTML page
+// This page is a landing page after successfully completing the OAuth flow. If the nextStepUrl template is provided
+// and the request identifies the SPIAccessToken using the `namespace` and `name` query parameters, the page contains
+// a link to the next step of the flow that initiated the OAuth authentication. The page can only be reached with
+// the marker issued by the callback, otherwise the request is redirected to the generic landing page.
+// The page template is parsed once, on the first request.
+func CallbackSuccessHandler(nextStepUrl *texttemplate.Template, nextStepText string, jwtSigningSecret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !verifyPageMarker(w, r, jwtSigningSecret, callbackSuccessPage) {
+			return
+		}
+
+		data := successViewData{
+			NextStepText: nextStepText,
+			NextStepUrl:  renderNextStepUrl(r, nextStepUrl),
+		}
+
+		renderTemplate(r.Context(), w, http.StatusOK, successPageTemplate.get(r.Context()), callbackSuccessTemplateName, data, fallbackViewData{
+			Title:   "Login successful",
+			Message: "You may now close this tab",
+			Url:     data.NextStepUrl,
+		})
+	}
+}
+
+// renderNextStepUrl renders the next step URL template using the token coordinates from the query of the request.
+// It returns an empty string if there is no template or the request doesn't identify the token.
+func renderNextStepUrl(r *http.Request, nextStepUrl *texttemplate.Template) string {
+	if nextStepUrl == nil {
+		return ""
+	}
+
+	q := r.URL.Query()
+	data := nextStepData{
+		Namespace:    q.Get("namespace"),
+		TokenName:    q.Get("name"),
+		KcpWorkspace: q.Get("workspace"),
+	}
+
+	// the values come from the query, so let's make sure they are valid kubernetes names before we put them in a link
+	if len(validation.IsDNS1123Label(data.Namespace)) > 0 || len(validation.IsDNS1123Subdomain(data.TokenName)) > 0 ||
+		!isValidKcpWorkspace(data.KcpWorkspace) {
+		log.FromContext(r.Context()).V(logs.DebugLevel).Info("not rendering the next step URL for invalid token coordinates", "data", data)
+		return ""
+	}
+
+	buf := &strings.Builder{}
+	if err := nextStepUrl.Execute(buf, data); err != nil {
+		log.FromContext(r.Context()).Error(err, "failed to render the next step URL")
+		return ""
+	}
+
+	return buf.String()
+}
+
+// isValidKcpWorkspace checks that the workspace is either empty or a colon-separated path of DNS labels.
+func isValidKcpWorkspace(workspace string) bool {
+	if workspace == "" {
+		return true
+	}
+	for _, segment := range strings.Split(workspace, ":") {
+		if len(validation.IsDNS1123Label(segment)) > 0 {
+			return false
+		}
+	}
+	return true
 }
 
 // viewData structure is used to pass parameters during callback_error.html template processing.
@@ -49,79 +131,207 @@ type viewData struct {
 	Message string
 }
 
-// CallbackErrorHandler is a Handler implementation that responds with HTML page
-// This page is a landing page after unsuccessfully completing the OAuth flow.
-// Resource file location is prefixed with `../` to be compatible with tests running locally.
-func CallbackErrorHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	errorMsg := q.Get("error")
-	errorDescription := q.Get("error_description")
-	data := viewData{
-		Title:   errorMsg,
-		Message: errorDescription,
+const (
+	// maxProviderErrorLength is the maximum length of the error code supplied by the service provider that we display.
+	maxProviderErrorLength = 64
+	// maxProviderErrorDescriptionLength is the maximum length of the error description supplied by the service provider
+	// that we display.
+	maxProviderErrorDescriptionLength = 512
+)
+
+// CallbackErrorHandler returns a Handler implementation that handles the service provider redirecting back with
+// an error. If the `state` in the request belongs to a pending flow of the session, the flow is finished and the user
+// is redirected to the error page with the marker allowing to display the error. Otherwise, the user is redirected to
+// the generic landing page. The error is responded as JSON if the client negotiated the JSON mode, the pending flow is
+// finished in that mode, too.
+func CallbackErrorHandler(stateStorage *StateStorage, baseUrl string, jwtSigningSecret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		errorMsg := sanitizeProviderString(q.Get("error"), maxProviderErrorLength)
+		errorDescription := sanitizeProviderString(q.Get("error_description"), maxProviderErrorDescriptionLength)
+		logging.AuditLog(r.Context()).Info("OAuth authentication flow failed.", "message", errorMsg, "description", errorDescription)
+
+		// the flow is over in both modes, the callback with the state would only fail
+		_, err := stateStorage.UnveilState(r.Context(), r)
+		if err == nil {
+			stateStorage.FinishState(r.Context(), r.URL.Query().Get("state"))
+		}
+
+		if isJsonMode(r) {
+			renderCallbackErrorPage(w, r, http.StatusOK, viewData{Title: errorMsg, Message: errorDescription})
+			return
+		}
+
+		if err != nil {
+			log.FromContext(r.Context()).V(logs.DebugLevel).Info("no pending OAuth flow for the error from the service provider, redirecting to the landing page", "error", err.Error())
+			http.Redirect(w, r, strings.TrimSuffix(baseUrl, "/")+"/"+landingPage, http.StatusFound)
+			return
+		}
+
+		query := url.Values{}
+		query.Set("error", errorMsg)
+		query.Set("error_description", errorDescription)
+		signPageQuery(jwtSigningSecret, callbackErrorPage, query)
+		http.Redirect(w, r, strings.TrimSuffix(baseUrl, "/")+"/"+callbackErrorPage+"?"+query.Encode(), http.StatusFound)
+	}
+}
+
+// CallbackErrorPageHandler returns a Handler implementation that responds with HTML page
+// This page is a landing page after unsuccessfully completing the OAuth flow. The page can only be reached with
+// the marker issued by the callback, otherwise the request is redirected to the generic landing page.
+func CallbackErrorPageHandler(jwtSigningSecret []byte) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !verifyPageMarker(w, r, jwtSigningSecret, callbackErrorPage) {
+			return
+		}
+
+		q := r.URL.Query()
+		renderErrorPage(r.Context(), w, http.StatusOK, viewData{
+			Title:   sanitizeProviderString(q.Get("error"), maxProviderErrorLength),
+			Message: sanitizeProviderString(q.Get("error_description"), maxProviderErrorDescriptionLength),
+		})
 	}
-	AuditLog(r.Context()).Info("OAuth authentication flow failed.", "message", errorMsg, "description", errorDescription)
-	tmpl, _ := template.ParseFiles("../static/callback_error.html")
-
-	err := tmpl.Execute(w, data)
-	if err == nil {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		log.FromContext(r.Context()).Error(err, "failed to process template")
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(fmt.Sprintf("Error response returned to OAuth callback: %s. Message: %s ", errorMsg, errorDescription)))
+}
+
+// verifyPageMarker checks the marker of the landing page in the request. If the marker is not valid, the request is
+// redirected to the generic landing page and false is returned.
+func verifyPageMarker(w http.ResponseWriter, r *http.Request, jwtSigningSecret []byte, page string) bool {
+	if err := verifyPageQuery(jwtSigningSecret, page, r.URL.Query()); err != nil {
+		log.FromContext(r.Context()).V(logs.DebugLevel).Info("redirecting to the landing page", "page", page, "error", err.Error())
+		// the landing page lives next to the other pages. Not using http.Redirect which would make the location
+		// absolute using the path of the request which doesn't need to be the path the user sees.
+		w.Header().Set("Location", landingPage)
+		w.WriteHeader(http.StatusFound)
+		return false
+	}
+	return true
+}
+
+// LandingHandler is a Handler implementation that responds with the generic landing page. The users are sent here
+// when they reach the pages of the OAuth flow without the marker issued by the callback.
+func LandingHandler(w http.ResponseWriter, r *http.Request) {
+	data := fallbackViewData{
+		Title:   "Service Provider Integration",
+		Message: "There is no OAuth flow to show. Please start the flow from the application that requested the access.",
 	}
+	renderTemplate(r.Context(), w, http.StatusOK, fallbackTemplate, landingTemplateName, data, data)
+}
+
+// sanitizeProviderString makes the string supplied by the service provider safe for displaying and logging. It drops
+// the non-printable characters, collapses the whitespace and limits the length of the string to maxLength characters.
+// The string still needs to be HTML-escaped when rendered which is done by the templates.
+func sanitizeProviderString(s string, maxLength int) string {
+	sb := strings.Builder{}
+	length := 0
+	space := false
+	for _, r := range strings.TrimSpace(s) {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if space {
+			if length++; length > maxLength {
+				break
+			}
+			sb.WriteRune(' ')
+			space = false
+		}
+		if length++; length > maxLength {
+			break
+		}
+		sb.WriteRune(r)
+	}
+
+	if length > maxLength {
+		return strings.TrimSpace(sb.String()) + "…"
+	}
+	return sb.String()
+}
 
+// renderErrorPage responds with the HTML page describing the error that prevented the OAuth flow from finishing.
+func renderErrorPage(ctx context.Context, w http.ResponseWriter, status int, data viewData) {
+	renderTemplate(ctx, w, status, errorPageTemplate.get(ctx), callbackErrorTemplateName, data, fallbackViewData{
+		Title:   fmt.Sprintf("Error: %s", data.Title),
+		Message: data.Message,
+	})
 }
 
 // HandleUpload returns Handler implementation that is relied on provided TokenUploader to persist provided credentials
 // for some concrete SPIAccessToken.
 func HandleUpload(uploader TokenUploader) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx, err := WithAuthFromRequestIntoContext(r, r.Context())
+		vars := mux.Vars(r)
+		tokenObjectName := vars["name"]
+		tokenObjectNamespace := vars["namespace"]
+		r = r.WithContext(logging.WithTokenLogFields(r.Context(), tokenObjectNamespace, tokenObjectName))
+
+		ctx, err := auth.WithAuthFromRequestIntoContext(r, r.Context())
 		if err != nil {
-			LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed extract authorization information from headers", err)
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed extract authorization information from headers", err)
 			return
 		}
 
-		vars := mux.Vars(r)
-		tokenObjectName := vars["name"]
-		tokenObjectNamespace := vars["namespace"]
 		if tokenObjectKcpWorkspace, hasKcpWorkspace := vars["kcpWorkspace"]; hasKcpWorkspace {
 			ctx = logicalcluster.WithCluster(ctx, logicalcluster.New(tokenObjectKcpWorkspace))
 		}
 
 		if len(tokenObjectName) < 1 || len(tokenObjectNamespace) < 1 {
-			LogDebugAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "Incorrect service deployment. Token name and namespace can't be omitted or empty.")
+			logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "Incorrect service deployment. Token name and namespace can't be omitted or empty.")
 			return
 		}
 
 		data := &api.Token{}
 		if err := json.NewDecoder(r.Body).Decode(data); err != nil {
-			LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode request body as token JSON", err)
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode request body as token JSON", err)
 			return
 		}
 
 		if data.AccessToken == "" {
-			LogDebugAndWriteResponse(r.Context(), w, http.StatusBadRequest, "access token can't be omitted or empty")
+			logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusBadRequest, "access token can't be omitted or empty")
 			return
 		}
 
 		if err := uploader.Upload(ctx, tokenObjectName, tokenObjectNamespace, data); err != nil {
-			LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to upload the token", err)
+			logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "failed to upload the token", err)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-// MiddlewareHandler is a Handler that composed couple of different responsibilities.
-// Like:
-// - Request logging
-// - CORS processing
-func MiddlewareHandler(allowedOrigins []string, h http.Handler) http.Handler {
-	return handlers.LoggingHandler(&zapio.Writer{Log: zap.L(), Level: zap.DebugLevel},
-		handlers.CORS(handlers.AllowedOrigins(allowedOrigins),
-			handlers.AllowCredentials(),
-			handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Language", "Origin", "Authorization"}))(h))
+// FlowCancelHandler returns a Handler implementation that cancels the pending OAuth flow identified by the `state`
+// path variable. The state is the OAuth state the flow was started with. Once cancelled, the callback of the flow is
+// responded as if the authorization session expired. The requests need the session of the flow.
+func FlowCancelHandler(stateStorage *StateStorage, jwtSigningSecret []byte) func(http.ResponseWriter, *http.Request) {
+	codec, codecErr := oauthstate.NewCodec(jwtSigningSecret)
+	return func(w http.ResponseWriter, r *http.Request) {
+		stateString := mux.Vars(r)["state"]
+
+		if codecErr != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to instantiate OAuth stateString codec", codecErr)
+			return
+		}
+
+		state, err := codec.ParseAnonymous(stateString)
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to decode the OAuth state", err)
+			return
+		}
+		r = r.WithContext(logging.WithTokenLogFields(r.Context(), state.TokenNamespace, state.TokenName))
+
+		if err = stateStorage.CancelState(r.Context(), stateString); err != nil {
+			if errors.Is(err, stateNotFoundError) {
+				logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusNotFound, "no pending OAuth flow found for the state in the session")
+			} else {
+				logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to cancel the OAuth flow", err)
+			}
+			return
+		}
+
+		logging.AuditLogWithTokenInfo(r.Context(), "OAuth authentication flow cancelled", state.TokenNamespace, state.TokenName, "provider", string(state.ServiceProviderType))
+		w.WriteHeader(http.StatusNoContent)
+	}
 }
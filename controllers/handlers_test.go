@@ -20,10 +20,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	texttemplate "text/template"
 
+	"github.com/alexedwards/scs/v2"
 	"github.com/gorilla/mux"
 	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -74,16 +79,18 @@ func TestReadyCheckHandler(t *testing.T) {
 }
 
 func TestCallbackSuccessHandler(t *testing.T) {
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	req, err := http.NewRequest("GET", "/callback_success", nil)
+	query := url.Values{}
+	signPageQuery([]byte("secret"), callbackSuccessPage, query)
+
+	// Create a request to pass to our handler.
+	req, err := http.NewRequest("GET", "/callback_success?"+query.Encode(), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(CallbackSuccessHandler)
+	handler := http.HandlerFunc(CallbackSuccessHandler(nil, "", []byte("secret")))
 
 	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
 	// directly and pass in our Request and ResponseRecorder.
@@ -96,27 +103,167 @@ func TestCallbackSuccessHandler(t *testing.T) {
 	}
 }
 
-func TestCallbackErrorHandler(t *testing.T) {
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	req, err := http.NewRequest("GET", "/github/callback?error=foo&error_description=bar", nil)
-	if err != nil {
-		t.Fatal(err)
+func TestCallbackSuccessHandlerRequiresMarker(t *testing.T) {
+	handler := http.HandlerFunc(CallbackSuccessHandler(nil, "", []byte("secret")))
+
+	t.Run("no marker", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/callback_success?namespace=jdoe&name=umbrella", nil))
+		assert.Equal(t, http.StatusFound, rr.Code)
+		assert.Equal(t, "landing", rr.Header().Get("Location"))
+	})
+
+	t.Run("tampered query", func(t *testing.T) {
+		query := url.Values{"namespace": []string{"jdoe"}, "name": []string{"umbrella"}}
+		signPageQuery([]byte("secret"), callbackSuccessPage, query)
+		query.Set("name", "other")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/callback_success?"+query.Encode(), nil))
+		assert.Equal(t, http.StatusFound, rr.Code)
+	})
+
+	t.Run("marker of other page", func(t *testing.T) {
+		query := url.Values{}
+		signPageQuery([]byte("secret"), callbackErrorPage, query)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/callback_success?"+query.Encode(), nil))
+		assert.Equal(t, http.StatusFound, rr.Code)
+	})
+}
+
+func TestCallbackSuccessHandlerWithNextStep(t *testing.T) {
+	nextStep := texttemplate.Must(texttemplate.New("next").Parse("https://appstudio.acme.com/{{.Namespace}}/import?token={{.TokenName}}"))
+	signedQuery := func(namespace, name string) string {
+		query := url.Values{"namespace": []string{namespace}, "name": []string{name}}
+		signPageQuery([]byte("secret"), callbackSuccessPage, query)
+		return query.Encode()
 	}
 
-	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(CallbackErrorHandler)
+	t.Run("renders link", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/callback_success?"+signedQuery("jdoe", "umbrella"), nil)
+		rr := httptest.NewRecorder()
 
-	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
+		http.HandlerFunc(CallbackSuccessHandler(nextStep, "Back to import", []byte("secret"))).ServeHTTP(rr, req)
 
-	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), `<a href="https://appstudio.acme.com/jdoe/import?token=umbrella">Back to import</a>`)
+	})
+
+	t.Run("no link for invalid coordinates", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/callback_success?"+signedQuery("jdoe", `"><script>`), nil)
+		rr := httptest.NewRecorder()
+
+		http.HandlerFunc(CallbackSuccessHandler(nextStep, "Back to import", []byte("secret"))).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NotContains(t, rr.Body.String(), "Back to import")
+		assert.Contains(t, rr.Body.String(), "You may now close this tab")
+	})
+}
+
+func TestCallbackErrorHandler(t *testing.T) {
+	sessionManager := scs.New()
+	stateStorage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
+	handler := CallbackErrorHandler(stateStorage, "https://spi.acme.com/", []byte("secret"))
+
+	t.Run("redirects to error page for pending flow", func(t *testing.T) {
+		sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			veil, err := stateStorage.VeilRealState(r)
+			assert.NoError(t, err)
+
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest("GET", "/github/callback?error=foo&error_description=bar&state="+veil, nil).WithContext(r.Context()))
+
+			assert.Equal(t, http.StatusFound, rr.Code)
+			location, err := url.Parse(rr.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, "/callback_error", location.Path)
+			assert.Equal(t, "foo", location.Query().Get("error"))
+			assert.Equal(t, "bar", location.Query().Get("error_description"))
+			assert.NoError(t, verifyPageQuery([]byte("secret"), callbackErrorPage, location.Query()))
+
+			// the flow is finished
+			assert.Empty(t, sessionManager.GetString(r.Context(), veil))
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?state=statestr", nil))
+	})
+
+	t.Run("finishes pending flow in JSON mode", func(t *testing.T) {
+		sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			veil, err := stateStorage.VeilRealState(r)
+			assert.NoError(t, err)
+
+			rr := httptest.NewRecorder()
+			handler(rr, httptest.NewRequest("GET", "/github/callback?format=json&error=foo&error_description=bar&state="+veil, nil).WithContext(r.Context()))
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			// the flow cannot be replayed
+			assert.Empty(t, sessionManager.GetString(r.Context(), veil))
+			assert.Empty(t, sessionManager.GetString(r.Context(), flowSessionKey("statestr")))
+		})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?state=statestr", nil))
+	})
+
+	t.Run("redirects to landing page without pending flow", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		sessionManager.LoadAndSave(http.HandlerFunc(handler)).ServeHTTP(rr, httptest.NewRequest("GET", "/github/callback?error=foo&error_description=bar&state=unknown", nil))
+
+		assert.Equal(t, http.StatusFound, rr.Code)
+		assert.Equal(t, "https://spi.acme.com/landing", rr.Header().Get("Location"))
+	})
+}
+
+func TestCallbackErrorPageHandler(t *testing.T) {
+	handler := CallbackErrorPageHandler([]byte("secret"))
+
+	query := url.Values{"error": []string{"foo"}, "error_description": []string{"bar"}}
+	signPageQuery([]byte("secret"), callbackErrorPage, query)
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/callback_error?"+query.Encode(), nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "foo")
+
+	rr = httptest.NewRecorder()
+	handler(rr, httptest.NewRequest("GET", "/callback_error?error=foo&error_description=bar", nil))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "landing", rr.Header().Get("Location"))
+}
+
+func TestCallbackErrorPageHandlerSanitizesProviderStrings(t *testing.T) {
+	query := url.Values{
+		"error":             []string{"<script>alert(1)</script>"},
+		"error_description": []string{strings.Repeat("x", 1000) + "\n\x1bdone"},
 	}
+	signPageQuery([]byte("secret"), callbackErrorPage, query)
+	req := httptest.NewRequest("GET", "/callback_error?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+
+	CallbackErrorPageHandler([]byte("secret"))(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "<script>")
+	assert.Contains(t, rr.Body.String(), "&lt;script&gt;alert(1)&lt;/script&gt;")
+	assert.Contains(t, rr.Body.String(), strings.Repeat("x", maxProviderErrorDescriptionLength)+"…")
+	assert.NotContains(t, rr.Body.String(), strings.Repeat("x", maxProviderErrorDescriptionLength+1))
+	assert.NotContains(t, rr.Body.String(), "done")
+}
+
+func TestLandingHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	LandingHandler(rr, httptest.NewRequest("GET", "/landing", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "There is no OAuth flow to show.")
+}
+
+func TestSanitizeProviderString(t *testing.T) {
+	assert.Equal(t, "access_denied", sanitizeProviderString("access_denied", 64))
+	assert.Equal(t, "multi line description", sanitizeProviderString("  multi\n\tline \r\n description\n", 64))
+	assert.Equal(t, "no control chars", sanitizeProviderString("no\x00 control\x1b chars\u200b", 64))
+	assert.Equal(t, "Přístup odepřen", sanitizeProviderString("Přístup odepřen", 64))
+	assert.Equal(t, "Příst…", sanitizeProviderString("Přístup odepřen", 5))
+	assert.Equal(t, "abc…", sanitizeProviderString("abc def", 4))
+	assert.Equal(t, "", sanitizeProviderString("", 64))
 }
 
 func TestUploaderOk(t *testing.T) {
@@ -342,76 +489,52 @@ func TestUploader_FailIncorrectHandlerConfiguration(t *testing.T) {
 	}
 }
 
-func TestMiddlewareHandlerCorsPart(t *testing.T) {
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	req, err := http.NewRequest("GET", "/github/callback?error=foo&error_description=bar", nil)
-	req.Header.Set("Origin", "https://prod.foo.redhat.com")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-	rr := httptest.NewRecorder()
-	handler := MiddlewareHandler([]string{"https://console.dev.redhat.com", "https://prod.foo.redhat.com"}, http.HandlerFunc(OkHandler))
+func TestFlowCancelHandler(t *testing.T) {
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+	state, err := codec.Encode(&oauthstate.AnonymousOAuthState{
+		TokenName:           "mytoken",
+		TokenNamespace:      "default",
+		ServiceProviderType: "My_Special_SP",
+	})
+	assert.NoError(t, err)
 
-	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
+	sessionManager := scs.New()
+	stateStorage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
 
-	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
-	}
+	router := mux.NewRouter()
+	router.Handle("/flow/{state}/cancel", sessionManager.LoadAndSave(http.HandlerFunc(FlowCancelHandler(stateStorage, []byte("secret")))))
+	router.Handle("/authenticate", sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := stateStorage.VeilRealState(r)
+		assert.NoError(t, err)
+	})))
 
-	// Check the status code is what we expect.
-	if allowOrigin := rr.Header().Get("Access-Control-Allow-Origin"); allowOrigin != "https://prod.foo.redhat.com" {
-		t.Errorf("handler returned wrong header \"Access-Control-Allow-Origin\": got %v want %v",
-			allowOrigin, "prod.foo.redhat.com")
-	}
-
-}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/authenticate?state="+state, nil))
+	sessionCookie := rr.Result().Cookies()[0]
 
-func TestMiddlewareHandlerCors(t *testing.T) {
-	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-	// pass 'nil' as the third parameter.
-	req, err := http.NewRequest("OPTIONS", "/github/authenticate?state=eyJhbGciO", nil)
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Accept-Language", "c")
-	req.Header.Set("Access-Control-Request-Headers", "authorization")
-	req.Header.Set("Access-Control-Request-Method", "GET")
-	req.Header.Set("Cache-Control", "no-cache")
-	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Origin", "https://file-retriever-server-service-spi-system.apps.cluster-flmv6.flmv6.sandbox1324.opentlc.com")
-	req.Header.Set("Pragma", "no-cache")
-	req.Header.Set("Referer", "https://file-retriever-server-service-spi-system.apps.cluster-flmv6.flmv6.sandbox1324.opentlc.com/")
-	req.Header.Set("Sec-Fetch-Dest", "empty")
-	req.Header.Set("Sec-Fetch-Mode", "cors")
-	req.Header.Set("Sec-Fetch-Site", "same-site")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.54 Safari/537.36")
-	if err != nil {
-		t.Fatal(err)
-	}
+	t.Run("cancels pending flow", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/flow/"+state+"/cancel", nil)
+		req.AddCookie(sessionCookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
 
-	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-	rr := httptest.NewRecorder()
-	handler := MiddlewareHandler([]string{"https://file-retriever-server-service-spi-system.apps.cluster-flmv6.flmv6.sandbox1324.opentlc.com", "http:://acme.com"}, http.HandlerFunc(OkHandler))
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	})
 
-	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
+	t.Run("fails for no pending flow", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/flow/"+state+"/cancel", nil)
+		req.AddCookie(sessionCookie)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
 
-	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
-	}
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
 
-	// Check the status code is what we expect.
-	if allowOrigin := rr.Header().Get("Access-Control-Allow-Origin"); allowOrigin != "https://file-retriever-server-service-spi-system.apps.cluster-flmv6.flmv6.sandbox1324.opentlc.com" {
-		t.Errorf("handler returned wrong header \"Access-Control-Allow-Origin\": got %v want %v",
-			allowOrigin, "https://file-retriever-server-service-spi-system.apps.cluster-flmv6.flmv6.sandbox1324.opentlc.com")
-	}
+	t.Run("fails for invalid state", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/flow/invalid/cancel", nil))
 
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
 }
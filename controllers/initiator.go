@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// InitiatorHeader is the header the client applications identify themselves with when starting the OAuth flows,
+	// e.g. "appstudio-ui". The authenticate endpoints also accept the initiator query parameter because the browsers
+	// are redirected to them. The initiator claim of the OAuth state takes precedence over both. Unlike the claim,
+	// the header is an unauthenticated label declared by the client, so any client can present itself as any of
+	// the allowed initiators. It keeps the well-behaved clients apart but it is not an enforcement.
+	InitiatorHeader = "X-SPI-Initiator"
+	// CanaryInitiator is the initiator of the flows of the canary probe.
+	CanaryInitiator = "spi-canary"
+
+	initiatorParameter = "initiator"
+)
+
+var (
+	invalidInitiatorError    = spierrors.WithKind(spierrors.InvalidRequest, errors.New("invalid initiator"))
+	initiatorNotAllowedError = spierrors.WithKind(spierrors.Forbidden, errors.New("the initiator is not allowed to start OAuth flows"))
+	initiatorRequiredError   = spierrors.WithKind(spierrors.Forbidden, errors.New("the OAuth flows need to be started by an identified initiator"))
+)
+
+// initiatorPattern keeps the initiators short and safe to put into the logs.
+var initiatorPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,62}$`)
+
+// InitiatorPolicy decides which client applications, identified by the initiator, can start the OAuth flows.
+type InitiatorPolicy struct {
+	// Allowed are the initiators allowed to start the flows. Any initiator is allowed if empty.
+	Allowed []string
+	// Required rejects the flows started without an initiator.
+	Required bool
+	// limiters limit the rate of the flows started by each of the allowed initiators, see WithRateLimit. The flows of
+	// the unlisted initiators and those without one share the limiter of the empty initiator. Unlimited if nil.
+	limiters map[string]*rate.Limiter
+}
+
+// NewInitiatorPolicy creates the policy from the comma-separated list of the allowed initiators.
+func NewInitiatorPolicy(allowed string, required bool) (InitiatorPolicy, error) {
+	policy := InitiatorPolicy{Required: required}
+	for _, initiator := range strings.Split(allowed, ",") {
+		initiator = strings.TrimSpace(initiator)
+		if initiator == "" {
+			continue
+		}
+		if !initiatorPattern.MatchString(initiator) {
+			return InitiatorPolicy{}, fmt.Errorf("%w '%s' in the allowed initiators", invalidInitiatorError, initiator)
+		}
+		policy.Allowed = append(policy.Allowed, initiator)
+	}
+	return policy, nil
+}
+
+// Check returns an error if the initiator cannot start the OAuth flows. The empty initiator stands for the flows
+// started without one.
+func (p InitiatorPolicy) Check(initiator string) error {
+	if initiator == "" {
+		if p.Required {
+			return initiatorRequiredError
+		}
+		return nil
+	}
+	if !initiatorPattern.MatchString(initiator) {
+		return fmt.Errorf("%w: %q", invalidInitiatorError, initiator)
+	}
+	if len(p.Allowed) > 0 && !p.isListed(initiator) {
+		return fmt.Errorf("%w: %s", initiatorNotAllowedError, initiator)
+	}
+	return nil
+}
+
+// WithRateLimit returns the policy limiting the rate of the flows to requestsPerSecond with the given burst for each of
+// the allowed initiators, so that a misbehaving client application cannot exhaust the capacity for the others.
+// The limiters are shared by all the copies of the returned policy.
+func (p InitiatorPolicy) WithRateLimit(requestsPerSecond float64, burst int) InitiatorPolicy {
+	// the limiters are created upfront so that the clients cannot make us keep an unbounded number of them
+	p.limiters = make(map[string]*rate.Limiter, len(p.Allowed)+1)
+	p.limiters[""] = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+	for _, initiator := range p.Allowed {
+		p.limiters[initiator] = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+	}
+	return p
+}
+
+// Allow reports whether the initiator can start another OAuth flow now according to the rate limit. The initiator
+// needs to be the one resolved for the flow, so that the limit applies to the same initiator as Check.
+func (p InitiatorPolicy) Allow(initiator string) bool {
+	if p.limiters == nil {
+		return true
+	}
+	limiter, ok := p.limiters[initiator]
+	if !ok {
+		limiter = p.limiters[""]
+	}
+	return limiter.Allow()
+}
+
+func (p InitiatorPolicy) isListed(initiator string) bool {
+	for _, a := range p.Allowed {
+		if a == initiator {
+			return true
+		}
+	}
+	return false
+}
+
+// requestInitiator returns the initiator the client identified itself with in the request, if any.
+func requestInitiator(r *http.Request) string {
+	if initiator := r.Header.Get(InitiatorHeader); initiator != "" {
+		return initiator
+	}
+	return r.URL.Query().Get(initiatorParameter)
+}
+
+type initiatorContextKey struct{}
+
+// withInitiator returns a new context carrying the initiator of the OAuth flow.
+func withInitiator(ctx context.Context, initiator string) context.Context {
+	return context.WithValue(ctx, initiatorContextKey{}, initiator)
+}
+
+// initiatorFromContext returns the initiator of the OAuth flow in the context, if any.
+func initiatorFromContext(ctx context.Context) string {
+	initiator, _ := ctx.Value(initiatorContextKey{}).(string)
+	return initiator
+}
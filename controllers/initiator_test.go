@@ -0,0 +1,211 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/oauthstate"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestNewInitiatorPolicy(t *testing.T) {
+	policy, err := NewInitiatorPolicy(" appstudio-ui, spi-cli,,", true)
+	assert.NoError(t, err)
+	assert.Equal(t, InitiatorPolicy{Allowed: []string{"appstudio-ui", "spi-cli"}, Required: true}, policy)
+
+	policy, err = NewInitiatorPolicy("", false)
+	assert.NoError(t, err)
+	assert.Empty(t, policy.Allowed)
+
+	_, err = NewInitiatorPolicy("appstudio ui", false)
+	assert.ErrorIs(t, err, invalidInitiatorError)
+}
+
+func TestInitiatorPolicy_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    InitiatorPolicy
+		initiator string
+		err       error
+	}{
+		{name: "anything allowed", policy: InitiatorPolicy{}, initiator: "pipeline"},
+		{name: "no initiator allowed", policy: InitiatorPolicy{Allowed: []string{"appstudio-ui"}}},
+		{name: "listed", policy: InitiatorPolicy{Allowed: []string{"appstudio-ui", "spi-cli"}, Required: true}, initiator: "spi-cli"},
+		{name: "not listed", policy: InitiatorPolicy{Allowed: []string{"appstudio-ui"}}, initiator: "pipeline", err: initiatorNotAllowedError},
+		{name: "required", policy: InitiatorPolicy{Required: true}, err: initiatorRequiredError},
+		{name: "invalid", policy: InitiatorPolicy{}, initiator: "<script>", err: invalidInitiatorError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Check(test.initiator)
+			if test.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, test.err)
+			}
+		})
+	}
+}
+
+func TestRequestInitiator(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?initiator=spi-cli", nil)
+	assert.Equal(t, "spi-cli", requestInitiator(req))
+
+	req.Header.Set(InitiatorHeader, "appstudio-ui")
+	assert.Equal(t, "appstudio-ui", requestInitiator(req))
+
+	assert.Equal(t, "", requestInitiator(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestInitiatorPolicy_Allow(t *testing.T) {
+	assert.True(t, InitiatorPolicy{}.Allow("appstudio-ui"), "unlimited without the rate limit")
+
+	policy := InitiatorPolicy{Allowed: []string{"appstudio-ui", "spi-cli"}}.WithRateLimit(0.001, 1)
+	assert.True(t, policy.Allow("appstudio-ui"))
+	assert.False(t, policy.Allow("appstudio-ui"))
+	// the other initiators are not affected
+	assert.True(t, policy.Allow("spi-cli"))
+	// the unlisted initiators share the limit with the flows without one
+	assert.True(t, policy.Allow("pipeline"))
+	assert.False(t, policy.Allow(""))
+}
+
+func TestAuthorizationUrlInitiator(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	assert.NoError(t, authz.AddToScheme(scheme))
+	cl := allowingClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+		ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+	}).Build()}
+
+	codec, err := oauthstate.NewCodec([]byte("secret"))
+	assert.NoError(t, err)
+	newState := func(initiator string) string {
+		state, err := codec.Encode(&exchangeState{
+			AnonymousOAuthState: oauthstate.AnonymousOAuthState{
+				TokenName:           "token",
+				TokenNamespace:      "default",
+				IssuedAt:            time.Now().Unix(),
+				ServiceProviderType: CanaryServiceProviderType,
+			},
+			Initiator: initiator,
+		})
+		assert.NoError(t, err)
+		return state
+	}
+
+	sessionManager := scs.New()
+	stateStorage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
+	cfg := OAuthServiceConfiguration{
+		SharedConfiguration: config.SharedConfiguration{BaseUrl: "https://spi", SharedSecret: []byte("secret")},
+		Initiators:          InitiatorPolicy{Allowed: []string{"appstudio-ui", CanaryInitiator}, Required: true},
+	}
+	controller, err := FromConfiguration(cfg, CanaryServiceProviderConfiguration("https://spi", "client-secret"), auth.NewAuthenticator(sessionManager, cl), stateStorage, nil, nil, cl, tokenstorage.TestTokenStorage{}, nil)
+	assert.NoError(t, err)
+
+	authenticateWithToken := func(state string, initiator string, k8sToken string) (int, string) {
+		query := url.Values{"state": {state}}
+		if k8sToken != "" {
+			query.Set("k8s_token", k8sToken)
+		}
+		if initiator != "" {
+			query.Set(initiatorParameter, initiator)
+		}
+		rr := httptest.NewRecorder()
+		recorded := ""
+		sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorizationUrl, ok := controller.AuthorizationUrl(w, r, state)
+			if !ok {
+				return
+			}
+			u, err := url.Parse(authorizationUrl)
+			assert.NoError(t, err)
+			recorded = stateStorage.Initiator(r.Context(), u.Query().Get("state"))
+		})).ServeHTTP(rr, httptest.NewRequest("GET", "https://spi/canary/authenticate?"+query.Encode(), nil))
+		return rr.Code, recorded
+	}
+	authenticate := func(state string, initiator string) (int, string) {
+		return authenticateWithToken(state, initiator, "k8s-token")
+	}
+
+	t.Run("allowed initiator", func(t *testing.T) {
+		code, recorded := authenticate(newState(""), "appstudio-ui")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "appstudio-ui", recorded)
+	})
+
+	t.Run("state claim takes precedence", func(t *testing.T) {
+		code, recorded := authenticate(newState(CanaryInitiator), "pipeline")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, CanaryInitiator, recorded)
+	})
+
+	t.Run("not allowed initiator", func(t *testing.T) {
+		code, _ := authenticate(newState(""), "pipeline")
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("missing initiator", func(t *testing.T) {
+		code, _ := authenticate(newState(""), "")
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("invalid initiator", func(t *testing.T) {
+		code, _ := authenticate(newState(""), "<script>")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("rate limit of the resolved initiator", func(t *testing.T) {
+		limited := cfg
+		limited.Initiators = cfg.Initiators.WithRateLimit(0.001, 1)
+		controller, err = FromConfiguration(limited, CanaryServiceProviderConfiguration("https://spi", "client-secret"), auth.NewAuthenticator(sessionManager, cl), stateStorage, nil, nil, cl, tokenstorage.TestTokenStorage{}, nil)
+		assert.NoError(t, err)
+
+		code, _ := authenticate(newState(CanaryInitiator), "appstudio-ui")
+		assert.Equal(t, http.StatusOK, code)
+		// the claim, not the declared initiator, used up the limit
+		code, _ = authenticate(newState(CanaryInitiator), "appstudio-ui")
+		assert.Equal(t, http.StatusTooManyRequests, code)
+		code, _ = authenticate(newState(""), "appstudio-ui")
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("unauthenticated requests don't use up the rate limit", func(t *testing.T) {
+		limited := cfg
+		limited.Initiators = cfg.Initiators.WithRateLimit(0.001, 1)
+		controller, err = FromConfiguration(limited, CanaryServiceProviderConfiguration("https://spi", "client-secret"), auth.NewAuthenticator(sessionManager, cl), stateStorage, nil, nil, cl, tokenstorage.TestTokenStorage{}, nil)
+		assert.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			code, _ := authenticateWithToken(newState(""), "appstudio-ui", "")
+			assert.Equal(t, http.StatusUnauthorized, code)
+		}
+		code, _ := authenticate(newState(""), "appstudio-ui")
+		assert.Equal(t, http.StatusOK, code)
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+)
+
+// InstrumentedTokenStorage is a wrapper around TokenStorage that counts the requests to the wrapped storage and their
+// failures and observes their durations so that the health of the storage can be monitored.
+type InstrumentedTokenStorage struct {
+	// TokenStorage is the token storage to delegate the actual storage operations to.
+	TokenStorage tokenstorage.TokenStorage
+}
+
+var _ tokenstorage.TokenStorage = (*InstrumentedTokenStorage)(nil)
+
+func (s *InstrumentedTokenStorage) Store(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	start := time.Now()
+	err := s.TokenStorage.Store(ctx, owner, token)
+	observeTokenStorageRequest("store", start, err)
+	if err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return nil
+}
+
+func (s *InstrumentedTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	start := time.Now()
+	token, err := s.TokenStorage.Get(ctx, owner)
+	observeTokenStorageRequest("get", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return token, nil
+}
+
+func (s *InstrumentedTokenStorage) Delete(ctx context.Context, owner *api.SPIAccessToken) error {
+	start := time.Now()
+	err := s.TokenStorage.Delete(ctx, owner)
+	observeTokenStorageRequest("delete", start, err)
+	if err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return nil
+}
+
+// observeTokenStorageRequest records the request to the token storage that started at the given time and failed with
+// the error, if any, in the metrics.
+func observeTokenStorageRequest(operation string, start time.Time, err error) {
+	tokenStorageRequestDurationHistogram.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	tokenStorageRequestsCounter.WithLabelValues(operation, result).Inc()
+}
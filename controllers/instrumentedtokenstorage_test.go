@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedTokenStorage(t *testing.T) {
+	storageErr := errors.New("vault sealed")
+	storage := &InstrumentedTokenStorage{TokenStorage: tokenstorage.TestTokenStorage{
+		StoreImpl: func(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+			return nil
+		},
+		GetImpl: func(ctx context.Context, token *api.SPIAccessToken) (*api.Token, error) {
+			return nil, storageErr
+		},
+		DeleteImpl: func(ctx context.Context, token *api.SPIAccessToken) error {
+			return nil
+		},
+	}}
+	count := func(operation, result string) float64 {
+		return testutil.ToFloat64(tokenStorageRequestsCounter.WithLabelValues(operation, result))
+	}
+	storeSuccesses, getErrors, deleteSuccesses := count("store", "success"), count("get", "error"), count("delete", "success")
+
+	assert.NoError(t, storage.Store(context.TODO(), &api.SPIAccessToken{}, &api.Token{}))
+	_, err := storage.Get(context.TODO(), &api.SPIAccessToken{})
+	assert.ErrorIs(t, err, storageErr)
+	assert.NoError(t, storage.Delete(context.TODO(), &api.SPIAccessToken{}))
+
+	assert.Equal(t, storeSuccesses+1, count("store", "success"))
+	assert.Equal(t, getErrors+1, count("get", "error"))
+	assert.Equal(t, deleteSuccesses+1, count("delete", "success"))
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// LeaderElection configures the leader election of the managers watching the cluster, so that only one replica of
+// the service reconciles the watched objects at a time. The leader holds a Lease with the ID in the namespace.
+type LeaderElection struct {
+	Enabled bool
+	// ID is the name of the Lease. Each of the watchers needs its own.
+	ID string
+	// Namespace is the namespace of the Lease. The namespace the service runs in is used when empty.
+	Namespace string
+}
+
+// apply configures the leader election in the options of the manager.
+func (l LeaderElection) apply(options *manager.Options) {
+	options.LeaderElection = l.Enabled
+	options.LeaderElectionID = l.ID
+	options.LeaderElectionNamespace = l.Namespace
+	// the watchers stop when the service stops, so let the next leader take over right away
+	options.LeaderElectionReleaseOnCancel = l.Enabled
+}
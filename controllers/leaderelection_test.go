@@ -0,0 +1,41 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+func TestLeaderElection(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		options := manager.Options{}
+		LeaderElection{Enabled: true, ID: "spi-oauth-upload-secret", Namespace: "spi-system"}.apply(&options)
+
+		assert.True(t, options.LeaderElection)
+		assert.Equal(t, "spi-oauth-upload-secret", options.LeaderElectionID)
+		assert.Equal(t, "spi-system", options.LeaderElectionNamespace)
+		assert.True(t, options.LeaderElectionReleaseOnCancel)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		options := manager.Options{}
+		LeaderElection{ID: "spi-oauth-upload-secret"}.apply(&options)
+
+		assert.False(t, options.LeaderElection)
+		assert.False(t, options.LeaderElectionReleaseOnCancel)
+	})
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	duplicateSubsystemError   = errors.New("duplicate subsystem")
+	unknownDependencyError    = errors.New("unknown dependency")
+	dependencyCycleError      = errors.New("dependency cycle")
+	lifecycleStartedError     = errors.New("the lifecycle has already been started")
+	subsystemStartFailedError = errors.New("failed to start subsystem")
+	subsystemStopFailedError  = errors.New("failed to stop subsystem")
+	subsystemRunFailedError   = errors.New("subsystem failed")
+)
+
+// Subsystem is a part of the service with its own lifecycle, e.g. a server, a periodic background job or a watcher.
+// All the functions are optional.
+type Subsystem struct {
+	// Name identifies the subsystem in the logs and in the dependencies of the other subsystems.
+	Name string
+	// DependsOn are the names of the subsystems that must be started before this one and stopped after it.
+	DependsOn []string
+	// Start initializes the subsystem. The subsystems depending on this one are started only after Start returns.
+	// An error fails the start of the whole lifecycle.
+	Start func(ctx context.Context) error
+	// Run runs the subsystem in the background after it has been started. The context of Run is cancelled when
+	// the subsystem is being stopped, after Stop returned. Run is expected to return soon after that. An error
+	// returned before that makes the lifecycle not ready and is reported by Failed.
+	Run func(ctx context.Context) error
+	// Stop drains the subsystem, e.g. by waiting for the requests in progress to finish. It is called before
+	// the context of Run is cancelled so that Run can return on its own.
+	Stop func(ctx context.Context) error
+	// Ready checks whether the started subsystem can do its job. The lifecycle is not ready while it returns an error.
+	Ready func() error
+}
+
+// Lifecycle starts the subsystems of the service in the order of their dependencies and stops them in the reverse
+// order. It is ready once all the subsystems are started and until it is being stopped or any of them fails.
+type Lifecycle struct {
+	lock       sync.Mutex
+	subsystems []Subsystem
+	// started are the subsystems that have been started, in the order of their start
+	started []*runningSubsystem
+	ready   bool
+	// failed receives the first failure of the subsystems
+	failed chan error
+}
+
+// runningSubsystem is the bookkeeping of a started subsystem.
+type runningSubsystem struct {
+	Subsystem
+	cancel context.CancelFunc
+	// done is closed once Run returns, or right away for the subsystems without Run.
+	done chan struct{}
+	// err is the error Run failed with before the subsystem was stopped. Guarded by the lock of the lifecycle.
+	err error
+}
+
+// NewLifecycle creates a new lifecycle without any subsystems.
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{failed: make(chan error, 1)}
+}
+
+// Add registers the subsystem to be started by the lifecycle. The subsystems can be added in any order, their
+// dependencies are resolved on Start.
+func (l *Lifecycle) Add(subsystem Subsystem) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.started != nil {
+		return lifecycleStartedError
+	}
+	for _, s := range l.subsystems {
+		if s.Name == subsystem.Name {
+			return fmt.Errorf("%w '%s'", duplicateSubsystemError, subsystem.Name)
+		}
+	}
+	l.subsystems = append(l.subsystems, subsystem)
+	return nil
+}
+
+// Start starts all the subsystems in the order of their dependencies and marks the lifecycle ready. If a subsystem
+// fails to start, the already started subsystems are stopped using the provided context and the error is returned.
+// The logger in the context is passed to the subsystems with their name added.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.lock.Lock()
+	if l.started != nil {
+		l.lock.Unlock()
+		return lifecycleStartedError
+	}
+	ordered, err := l.order()
+	if err != nil {
+		l.lock.Unlock()
+		return err
+	}
+	l.started = []*runningSubsystem{}
+	l.lock.Unlock()
+
+	lg := log.FromContext(ctx)
+	for _, s := range ordered {
+		subsystemCtx := log.IntoContext(ctx, lg.WithName(s.Name))
+		lg.Info("starting subsystem", "subsystem", s.Name)
+		if s.Start != nil {
+			if err := s.Start(subsystemCtx); err != nil {
+				// the subsystems don't need to be ready to be stopped, so let's not wait for anything here
+				if stopErr := l.Stop(ctx); stopErr != nil {
+					lg.Error(stopErr, "failed to stop the started subsystems")
+				}
+				return fmt.Errorf("%w '%s': %s", subsystemStartFailedError, s.Name, err.Error())
+			}
+		}
+
+		// the run context must outlive the start context so that the subsystems are stopped only by Stop
+		runCtx, cancel := context.WithCancel(log.IntoContext(context.Background(), lg.WithName(s.Name)))
+		running := &runningSubsystem{Subsystem: s, cancel: cancel, done: make(chan struct{})}
+		if s.Run != nil {
+			go func() {
+				defer close(running.done)
+				if err := running.Run(runCtx); err != nil {
+					lg.Error(err, "subsystem failed", "subsystem", running.Name)
+					// the errors while stopping are reported by Stop
+					if runCtx.Err() == nil {
+						l.fail(running, err)
+					}
+				}
+			}()
+		} else {
+			close(running.done)
+		}
+
+		l.lock.Lock()
+		l.started = append(l.started, running)
+		l.lock.Unlock()
+	}
+
+	l.lock.Lock()
+	l.ready = true
+	l.lock.Unlock()
+	lg.Info("all subsystems started")
+	return nil
+}
+
+// Stop marks the lifecycle not ready and stops the started subsystems in the reverse order of their start. Each
+// subsystem is stopped even if stopping the previous ones failed, but the ones that don't stop before the context is
+// done are left behind. The first error is returned, all of them are logged.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.lock.Lock()
+	l.ready = false
+	started := l.started
+	l.started = []*runningSubsystem{}
+	l.lock.Unlock()
+
+	lg := log.FromContext(ctx)
+	var firstErr error
+	for i := len(started) - 1; i >= 0; i-- {
+		s := started[i]
+		lg.Info("stopping subsystem", "subsystem", s.Name)
+		var err error
+		if s.Stop != nil {
+			err = s.Stop(log.IntoContext(ctx, lg.WithName(s.Name)))
+		}
+		s.cancel()
+		if err == nil {
+			select {
+			case <-s.done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%w '%s': %s", subsystemStopFailedError, s.Name, err.Error())
+			lg.Error(err, "failed to stop the subsystem")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Failed returns the channel receiving the error of the first subsystem whose Run failed before it was stopped.
+// The service is meant to be stopped then, because it keeps running without the subsystem otherwise.
+func (l *Lifecycle) Failed() <-chan error {
+	return l.failed
+}
+
+// fail records the failure of the running subsystem.
+func (l *Lifecycle) fail(s *runningSubsystem, err error) {
+	err = fmt.Errorf("%w '%s': %s", subsystemRunFailedError, s.Name, err.Error())
+
+	l.lock.Lock()
+	s.err = err
+	l.lock.Unlock()
+
+	select {
+	case l.failed <- err:
+	default:
+		// only the first failure is reported
+	}
+}
+
+// Ready tells whether all the subsystems are started and ready, none of them failed and the lifecycle is not being
+// stopped.
+func (l *Lifecycle) Ready() bool {
+	l.lock.Lock()
+	ready, started := l.ready, l.started
+	for _, s := range started {
+		if s.err != nil {
+			ready = false
+		}
+	}
+	l.lock.Unlock()
+
+	if !ready {
+		return false
+	}
+	for _, s := range started {
+		if s.Ready != nil && s.Ready() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadyHandler responds with http.StatusOK if the lifecycle is ready and with http.StatusServiceUnavailable otherwise.
+// It is meant for the readiness probe so that no traffic is routed to the service while it is starting or draining.
+func (l *Lifecycle) ReadyHandler(w http.ResponseWriter, _ *http.Request) {
+	if l.Ready() {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// order returns the subsystems sorted such that each comes after its dependencies. The subsystems without mutual
+// dependencies keep the order in which they were added. Must be called with the lock held.
+func (l *Lifecycle) order() ([]Subsystem, error) {
+	byName := make(map[string]Subsystem, len(l.subsystems))
+	for _, s := range l.subsystems {
+		byName[s.Name] = s
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	ordered := make([]Subsystem, 0, len(l.subsystems))
+
+	var visit func(s Subsystem) error
+	visit = func(s Subsystem) error {
+		switch state[s.Name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("%w involving subsystem '%s'", dependencyCycleError, s.Name)
+		}
+		state[s.Name] = visiting
+		for _, d := range s.DependsOn {
+			dep, ok := byName[d]
+			if !ok {
+				return fmt.Errorf("%w '%s' of subsystem '%s'", unknownDependencyError, d, s.Name)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[s.Name] = visited
+		ordered = append(ordered, s)
+		return nil
+	}
+
+	for _, s := range l.subsystems {
+		if err := visit(s); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// HttpServerSubsystem returns the subsystem serving the HTTP server on all the addresses. The listeners are opened on
+// start so that the failure to bind any of the addresses fails the start. The server is shut down gracefully on stop.
+func HttpServerSubsystem(name string, server *http.Server, addrs []string) Subsystem {
+	var listeners []net.Listener
+	return Subsystem{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var err error
+			listeners, err = listenAll(ctx, addrs)
+			return err
+		},
+		Run: func(_ context.Context) error {
+			return serveAll(listeners, func(listener net.Listener) error {
+				if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					return fmt.Errorf("the HTTP server failed: %w", err)
+				}
+				return nil
+			})
+		},
+		Stop: func(ctx context.Context) error {
+			if err := server.Shutdown(ctx); err != nil {
+				return fmt.Errorf("failed to shut down the HTTP server: %w", err)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lifecycleRecorder records the calls of the functions of the subsystems.
+type lifecycleRecorder struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (r *lifecycleRecorder) record(call string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *lifecycleRecorder) subsystem(name string, dependsOn ...string) Subsystem {
+	return Subsystem{
+		Name:      name,
+		DependsOn: dependsOn,
+		Start: func(ctx context.Context) error {
+			r.record("start " + name)
+			return nil
+		},
+		Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			r.record("run " + name + " done")
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			r.record("stop " + name)
+			return nil
+		},
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	r := &lifecycleRecorder{}
+	l := NewLifecycle()
+	assert.NoError(t, l.Add(r.subsystem("canary", "server")))
+	assert.NoError(t, l.Add(r.subsystem("server", "store")))
+	assert.NoError(t, l.Add(r.subsystem("store")))
+
+	res := httptest.NewRecorder()
+	l.ReadyHandler(res, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+
+	assert.NoError(t, l.Start(context.TODO()))
+	assert.True(t, l.Ready())
+	assert.ErrorIs(t, l.Start(context.TODO()), lifecycleStartedError)
+	assert.ErrorIs(t, l.Add(r.subsystem("late")), lifecycleStartedError)
+
+	res = httptest.NewRecorder()
+	l.ReadyHandler(res, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	assert.NoError(t, l.Stop(context.TODO()))
+	assert.False(t, l.Ready())
+
+	assert.Equal(t, []string{
+		"start store", "start server", "start canary",
+		"stop canary", "run canary done",
+		"stop server", "run server done",
+		"stop store", "run store done",
+	}, r.calls)
+}
+
+func TestLifecycle_SubsystemNotReady(t *testing.T) {
+	r := &lifecycleRecorder{}
+	l := NewLifecycle()
+	var readyErr error
+	s := r.subsystem("coordination")
+	s.Ready = func() error {
+		return readyErr
+	}
+	assert.NoError(t, l.Add(s))
+	assert.NoError(t, l.Start(context.TODO()))
+	assert.True(t, l.Ready())
+
+	readyErr = errors.New("incompatible configuration")
+	assert.False(t, l.Ready())
+	res := httptest.NewRecorder()
+	l.ReadyHandler(res, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+
+	assert.NoError(t, l.Stop(context.TODO()))
+}
+
+func TestLifecycle_InvalidDependencies(t *testing.T) {
+	r := &lifecycleRecorder{}
+
+	t.Run("duplicate", func(t *testing.T) {
+		l := NewLifecycle()
+		assert.NoError(t, l.Add(r.subsystem("a")))
+		assert.ErrorIs(t, l.Add(r.subsystem("a")), duplicateSubsystemError)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		l := NewLifecycle()
+		assert.NoError(t, l.Add(r.subsystem("a", "b")))
+		assert.ErrorIs(t, l.Start(context.TODO()), unknownDependencyError)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		l := NewLifecycle()
+		assert.NoError(t, l.Add(r.subsystem("a", "b")))
+		assert.NoError(t, l.Add(r.subsystem("b", "c")))
+		assert.NoError(t, l.Add(r.subsystem("c", "a")))
+		assert.ErrorIs(t, l.Start(context.TODO()), dependencyCycleError)
+	})
+
+	assert.Empty(t, r.calls)
+}
+
+func TestLifecycle_StartFailure(t *testing.T) {
+	r := &lifecycleRecorder{}
+	l := NewLifecycle()
+	assert.NoError(t, l.Add(r.subsystem("store")))
+	failing := r.subsystem("server", "store")
+	failing.Start = func(ctx context.Context) error {
+		return errors.New("address in use")
+	}
+	assert.NoError(t, l.Add(failing))
+	assert.NoError(t, l.Add(r.subsystem("canary", "server")))
+
+	err := l.Start(context.TODO())
+	assert.ErrorIs(t, err, subsystemStartFailedError)
+	assert.Contains(t, err.Error(), "address in use")
+	assert.False(t, l.Ready())
+
+	assert.Equal(t, []string{"start store", "stop store", "run store done"}, r.calls)
+}
+
+func TestLifecycle_RunFailure(t *testing.T) {
+	r := &lifecycleRecorder{}
+	l := NewLifecycle()
+	assert.NoError(t, l.Add(r.subsystem("server")))
+	fail := make(chan struct{})
+	assert.NoError(t, l.Add(Subsystem{
+		Name: "watcher",
+		Run: func(_ context.Context) error {
+			<-fail
+			return errors.New("forbidden")
+		},
+	}))
+	assert.NoError(t, l.Start(context.TODO()))
+	assert.True(t, l.Ready())
+
+	close(fail)
+	var err error
+	select {
+	case err = <-l.Failed():
+	case <-time.After(time.Second):
+		assert.Fail(t, "the failure of the subsystem was not reported")
+	}
+	assert.ErrorIs(t, err, subsystemRunFailedError)
+	assert.Contains(t, err.Error(), "watcher")
+	assert.False(t, l.Ready())
+	res := httptest.NewRecorder()
+	l.ReadyHandler(res, httptest.NewRequest("GET", "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+
+	assert.NoError(t, l.Stop(context.TODO()))
+}
+
+func TestLifecycle_RunErrorWhileStopping(t *testing.T) {
+	l := NewLifecycle()
+	assert.NoError(t, l.Add(Subsystem{
+		Name: "watcher",
+		Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}))
+	assert.NoError(t, l.Start(context.TODO()))
+	assert.NoError(t, l.Stop(context.TODO()))
+
+	select {
+	case err := <-l.Failed():
+		assert.Fail(t, "the error of the stopped subsystem was reported as a failure", err.Error())
+	default:
+	}
+}
+
+func TestLifecycle_StopTimeout(t *testing.T) {
+	l := NewLifecycle()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	assert.NoError(t, l.Add(Subsystem{
+		Name: "stuck",
+		Run: func(_ context.Context) error {
+			<-stuck
+			return nil
+		},
+	}))
+	assert.NoError(t, l.Start(context.TODO()))
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Stop(ctx), subsystemStopFailedError)
+}
+
+func TestHttpServerSubsystem(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+	s := HttpServerSubsystem("server", server, []string{"127.0.0.1:0"})
+
+	assert.NoError(t, s.Start(context.TODO()))
+	done := make(chan error)
+	go func() {
+		done <- s.Run(context.TODO())
+	}()
+
+	assert.NoError(t, s.Stop(context.TODO()))
+	assert.NoError(t, <-done)
+
+	t.Run("listen failure", func(t *testing.T) {
+		assert.Error(t, HttpServerSubsystem("server", &http.Server{ReadHeaderTimeout: time.Second}, []string{"invalid:address:0"}).Start(context.TODO()))
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var invalidListenAddressError = errors.New("invalid listen address")
+
+// ParseListenAddresses parses the comma-separated list of the addresses to listen on. Each address is a host:port
+// pair where the host is either an IP address, a host name or empty. The port must be always specified.
+func ParseListenAddresses(addresses string) ([]string, error) {
+	var addrs []string
+	for _, addr := range strings.Split(addresses, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			return nil, fmt.Errorf("%w: %s", invalidListenAddressError, addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: no address in %q", invalidListenAddressError, addresses)
+	}
+	return addrs, nil
+}
+
+// listenNetwork returns the network to listen on the address in. The literal IP addresses, including the unspecified
+// ones like 0.0.0.0 or [::], are listened on only in their own IP stack so that the IPv4 and IPv6 addresses can be
+// configured separately. The addresses with an empty host or with a host name are listened on in both stacks.
+func listenNetwork(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// listenAll opens the listeners on all the addresses. If any of them fails, the already opened ones are closed.
+func listenAll(ctx context.Context, addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.Listen(listenNetwork(addr), addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		log.FromContext(ctx).Info("listening", "Addr", listener.Addr().String())
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// serveAll serves on all the listeners concurrently and waits until all of them are done. Returns the first error of
+// the serve function.
+func serveAll(listeners []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(listeners))
+	wg := sync.WaitGroup{}
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			errs <- serve(l)
+		}(l)
+	}
+	wg.Wait()
+	close(errs)
+
+	var firstErr error
+	for err := range errs {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddresses(t *testing.T) {
+	addrs, err := ParseListenAddresses("0.0.0.0:8000, [::]:8000,:9000")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0.0.0.0:8000", "[::]:8000", ":9000"}, addrs)
+
+	_, err = ParseListenAddresses("")
+	assert.ErrorIs(t, err, invalidListenAddressError)
+
+	_, err = ParseListenAddresses("0.0.0.0:8000,8000")
+	assert.ErrorIs(t, err, invalidListenAddressError)
+
+	_, err = ParseListenAddresses("localhost:")
+	assert.ErrorIs(t, err, invalidListenAddressError)
+}
+
+func TestListenNetwork(t *testing.T) {
+	assert.Equal(t, "tcp4", listenNetwork("0.0.0.0:8000"))
+	assert.Equal(t, "tcp4", listenNetwork("127.0.0.1:8000"))
+	assert.Equal(t, "tcp6", listenNetwork("[::]:8000"))
+	assert.Equal(t, "tcp6", listenNetwork("[::1]:8000"))
+	assert.Equal(t, "tcp", listenNetwork(":8000"))
+	assert.Equal(t, "tcp", listenNetwork("localhost:8000"))
+}
+
+func TestHttpServerSubsystemMultipleAddresses(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+	s := HttpServerSubsystem("server", server, []string{"127.0.0.1:0", "127.0.0.1:0"})
+
+	assert.NoError(t, s.Start(context.TODO()))
+	done := make(chan error)
+	go func() {
+		done <- s.Run(context.TODO())
+	}()
+
+	assert.NoError(t, s.Stop(context.TODO()))
+	assert.NoError(t, <-done)
+
+	t.Run("closes the listeners on failure", func(t *testing.T) {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer l.Close()
+
+		listeners, err := listenAll(context.TODO(), []string{"127.0.0.1:0", l.Addr().String()})
+		assert.Error(t, err)
+		assert.Nil(t, listeners)
+	})
+}
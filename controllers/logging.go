@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/go-logr/zapr"
+	"github.com/hashicorp/go-hclog"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"go.uber.org/zap"
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+	crzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// InitLogging sets up the logging of the service such that everything, i.e. our code, the controller-runtime, klog,
+// the Vault client and the global zap logger, logs using the same logger configured by the logging arguments. Our
+// code is supposed to only use the logr.Logger obtained from the context (log.FromContext) or ctrl.Log and never
+// the zap logger directly. The caller parameter controls whether the location of the log call is included in the logs.
+func InitLogging(args config.LoggingCliArgs, caller bool) error {
+	flagSet := flag.NewFlagSet("zap", flag.ContinueOnError)
+
+	opts := crzap.Options{ZapOpts: []zap.Option{zap.WithCaller(caller), zap.AddCallerSkip(-1)}}
+	opts.BindFlags(flagSet)
+
+	for name, value := range map[string]string{
+		"zap-devel":            strconv.FormatBool(args.ZapDevel),
+		"zap-encoder":          args.ZapEncoder,
+		"zap-log-level":        args.ZapLogLevel,
+		"zap-stacktrace-level": args.ZapStackTraceLevel,
+		"zap-time-encoding":    args.ZapTimeEncoding,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := flagSet.Set(name, value); err != nil {
+			return fmt.Errorf("invalid logging configuration %s=%s: %w", name, value, err)
+		}
+	}
+
+	logger := crzap.NewRaw(crzap.UseFlagOptions(&opts))
+	_ = zap.ReplaceGlobals(logger)
+	lg := zapr.NewLogger(logger).WithCallDepth(1)
+	ctrl.SetLogger(lg)
+	klog.SetLoggerWithOptions(lg, klog.ContextualLogger(true))
+	hclog.SetDefault(logs.NewHCLogAdapter(logger.WithOptions(zap.AddCallerSkip(1))))
+	return nil
+}
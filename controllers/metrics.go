@@ -0,0 +1,268 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// MetricsNamespace is the common prefix of all the metrics exposed by the OAuth service.
+	MetricsNamespace = "redhat_appstudio"
+	// MetricsSubsystem identifies the OAuth service among the other AppStudio metrics.
+	MetricsSubsystem = "spi_oauth"
+)
+
+var (
+	// templateFailuresCounter counts the failures to render the HTML pages. The pages are rendered using the built-in
+	// fallback page when this happens.
+	templateFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "template_failures_total",
+		Help:      "The number of failures to render the HTML templates, per template",
+	}, []string{"template"})
+
+	// expiredSessionsCounter counts the OAuth callbacks for which no authorization session with the OAuth state was
+	// found.
+	expiredSessionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "expired_sessions_total",
+		Help:      "The number of OAuth callbacks that could not be finished because the authorization session expired, per service provider",
+	}, []string{"sp"})
+
+	// crossPodLookupsCounter counts the OAuth states that were not found in the session and were looked up in
+	// the shared store instead. This happens when the callback doesn't hit the same replica as the authentication.
+	crossPodLookupsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "cross_pod_state_lookups_total",
+		Help:      "The number of OAuth states looked up in the shared store because they were not found in the session, per result",
+	}, []string{"result"})
+
+	// flowPhaseDurationHistogram observes the durations of the individual phases of the OAuth flow that the service
+	// performs, i.e. not including the time the user spends at the service provider.
+	flowPhaseDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "flow_phase_duration_seconds",
+		Help:      "The duration of the phases of the OAuth flow, per service provider and phase",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"sp", "phase"})
+
+	// requestsCounter counts the HTTP requests handled by the routes that use the WithMetrics middleware. It is the base
+	// of the availability SLO.
+	requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "http_requests_total",
+		Help:      "The number of HTTP requests handled, per route, method and response code",
+	}, []string{"route", "method", "code"})
+
+	// requestDurationHistogram observes the durations of the HTTP requests handled by the routes that use
+	// the WithMetrics middleware. It is the base of the latency SLO.
+	requestDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "http_request_duration_seconds",
+		Help:      "The duration of the HTTP requests, per route",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	// canarySuccessGauge is 1 if the last run of the canary OAuth flow succeeded and 0 if it failed.
+	canarySuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "canary_success",
+		Help:      "Whether the last run of the canary OAuth flow succeeded (1) or failed (0)",
+	})
+
+	// canaryLastRunGauge is the time of the last run of the canary OAuth flow so that a stuck canary can be detected.
+	canaryLastRunGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "canary_last_run_timestamp_seconds",
+		Help:      "The time of the last run of the canary OAuth flow",
+	})
+
+	// orphanedFlowsCounter counts the OAuth flows found in the flow journal that obtained the token from the service
+	// provider but never stored it, typically because the replica crashed in between.
+	orphanedFlowsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "orphaned_flows_total",
+		Help:      "The number of OAuth flows that obtained the token from the service provider but failed to store it, per service provider",
+	}, []string{"sp"})
+
+	// tokenStorageCacheLookupsCounter counts the lookups of the tokens in the cache in front of the token storage.
+	tokenStorageCacheLookupsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "token_storage_cache_lookups_total",
+		Help:      "The number of lookups of the tokens in the token storage cache, per result (hit or miss)",
+	}, []string{"result"})
+
+	// queuedRequestsGauge is the number of the requests waiting for the PriorityScheduler to handle them.
+	queuedRequestsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "queued_requests",
+		Help:      "The number of the HTTP requests waiting to be handled because the service is busy, per priority",
+	}, []string{"priority"})
+
+	// requestQueueDurationHistogram observes how long the requests waited for the PriorityScheduler to handle them.
+	requestQueueDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "request_queue_duration_seconds",
+		Help:      "The time the HTTP requests waited to be handled because the service was busy, per priority",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"priority"})
+
+	// flowsCounter counts the finished OAuth flows. It is the base of the flow success rate on the dashboard.
+	flowsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "flows_total",
+		Help:      "The number of finished OAuth flows, per service provider and result (succeeded, failed or expired)",
+	}, []string{"sp", "result"})
+
+	// tokenStorageRequestsCounter counts the requests to the token storage made through the InstrumentedTokenStorage.
+	tokenStorageRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "token_storage_requests_total",
+		Help:      "The number of requests to the token storage, per operation and result (success or error)",
+	}, []string{"operation", "result"})
+
+	// tokenStorageRequestDurationHistogram observes the durations of the requests to the token storage made through
+	// the InstrumentedTokenStorage.
+	tokenStorageRequestDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "token_storage_request_duration_seconds",
+		Help:      "The duration of the requests to the token storage, per operation",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// providerRequestsCounter counts the requests to the APIs of the service providers made through
+	// the ProviderMetricsTransport.
+	providerRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "provider_requests_total",
+		Help:      "The number of requests to the APIs of the service providers, per host and response code",
+	}, []string{"host", "code"})
+
+	// providerRateLimitRemainingGauge is the number of the requests left in the rate limit window of the service
+	// provider, as reported in the last response from it.
+	providerRateLimitRemainingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "provider_rate_limit_remaining",
+		Help:      "The number of requests remaining in the rate limit of the service provider as reported by its last response, per host",
+	}, []string{"host"})
+
+	// syntheticExpiriesCounter counts the tokens stored with the synthetic expiry because the service provider didn't
+	// report any.
+	syntheticExpiriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "synthetic_token_expiries_total",
+		Help:      "The number of tokens stored with the expiry computed from the max age policy because the service provider reported none, per service provider type",
+	}, []string{"sp"})
+
+	// signingSecretValidGauge is 1 if the JWT signing secret can be used and 0 if not.
+	signingSecretValidGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "jwt_signing_secret_valid",
+		Help:      "Whether the JWT signing secret is configured and long enough (1) or not (0)",
+	})
+
+	// signingSecretEntropyGauge is the estimated entropy of the JWT signing secret.
+	signingSecretEntropyGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "jwt_signing_secret_entropy_bits",
+		Help:      "The estimated entropy of the JWT signing secret in bits",
+	})
+
+	// signingSecretRotationDaysGauge is the number of days left until the JWT signing secret should be rotated. It is
+	// only set if the rotation schedule of the secret is configured.
+	signingSecretRotationDaysGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "jwt_signing_secret_rotation_days",
+		Help:      "The number of days left until the JWT signing secret should be rotated, negative when overdue",
+	})
+
+	// sessionStoreEvictionsCounter counts the sessions removed from the in-memory session store before they were
+	// deleted by the service, either because they expired or to keep the store within its maximum size.
+	sessionStoreEvictionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "session_store_evictions_total",
+		Help:      "The number of sessions evicted from the in-memory session store, per reason",
+	}, []string{"reason"})
+
+	// sessionStoreEntriesGauge is the number of sessions in the in-memory session store.
+	sessionStoreEntriesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: MetricsSubsystem,
+		Name:      "session_store_entries",
+		Help:      "The number of sessions kept in the in-memory session store",
+	})
+)
+
+// RegisterMetrics registers all the metrics of the OAuth service with the provided registerer. This is supposed to be
+// called once at the startup of the service, typically with the controller-runtime's metrics.Registry.
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		templateFailuresCounter,
+		expiredSessionsCounter,
+		crossPodLookupsCounter,
+		flowPhaseDurationHistogram,
+		requestsCounter,
+		requestDurationHistogram,
+		canarySuccessGauge,
+		canaryLastRunGauge,
+		orphanedFlowsCounter,
+		tokenStorageCacheLookupsCounter,
+		queuedRequestsGauge,
+		requestQueueDurationHistogram,
+		flowsCounter,
+		tokenStorageRequestsCounter,
+		tokenStorageRequestDurationHistogram,
+		providerRequestsCounter,
+		providerRateLimitRemainingGauge,
+		syntheticExpiriesCounter,
+		signingSecretValidGauge,
+		signingSecretEntropyGauge,
+		signingSecretRotationDaysGauge,
+		sessionStoreEvictionsCounter,
+		sessionStoreEntriesGauge,
+	}
+
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			return fmt.Errorf("failed to register the metrics: %w", err)
+		}
+	}
+
+	return nil
+}
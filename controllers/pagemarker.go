@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// pageMarkerQueryParameter is the query parameter carrying the marker of the landing pages of the OAuth flow.
+	pageMarkerQueryParameter = "marker"
+
+	// pageMarkerValidity is how long the landing page can be reached using the marker issued by the callback.
+	pageMarkerValidity = 5 * time.Minute
+
+	callbackSuccessPage = "callback_success"
+	callbackErrorPage   = "callback_error"
+	landingPage         = "landing"
+)
+
+var (
+	missingPageMarkerError = errors.New("no page marker")
+	invalidPageMarkerError = errors.New("invalid page marker")
+	expiredPageMarkerError = errors.New("expired page marker")
+)
+
+// signPageQuery adds the marker to the query of the landing page. The marker is a short-lived signature of the page
+// and its query so that the pages only show what the callback wants them to show.
+func signPageQuery(secret []byte, page string, query url.Values) {
+	expiry := strconv.FormatInt(time.Now().Add(pageMarkerValidity).Unix(), 10)
+	query.Set(pageMarkerQueryParameter, expiry+"."+pageMarkerSignature(secret, page, query, expiry))
+}
+
+// verifyPageQuery checks that the query of the landing page contains a valid, unexpired marker.
+func verifyPageQuery(secret []byte, page string, query url.Values) error {
+	marker := query.Get(pageMarkerQueryParameter)
+	if marker == "" {
+		return missingPageMarkerError
+	}
+
+	expiry, signature, found := strings.Cut(marker, ".")
+	if !found {
+		return invalidPageMarkerError
+	}
+	expiryUnix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s", invalidPageMarkerError, err.Error())
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(pageMarkerSignature(secret, page, query, expiry))) {
+		return invalidPageMarkerError
+	}
+	if time.Now().After(time.Unix(expiryUnix, 0)) {
+		return expiredPageMarkerError
+	}
+	return nil
+}
+
+// pageMarkerSignature computes the signature of the page, its query without the marker and the expiry of the marker.
+func pageMarkerSignature(secret []byte, page string, query url.Values, expiry string) string {
+	signed := url.Values{}
+	for k, v := range query {
+		if k != pageMarkerQueryParameter {
+			signed[k] = v
+		}
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	// the url.Values.Encode sorts the keys so the encoding is stable
+	mac.Write([]byte(page + "\n" + expiry + "\n" + signed.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageMarker(t *testing.T) {
+	secret := []byte("secret")
+
+	t.Run("valid", func(t *testing.T) {
+		query := url.Values{"name": []string{"umbrella"}}
+		signPageQuery(secret, callbackSuccessPage, query)
+		assert.NoError(t, verifyPageQuery(secret, callbackSuccessPage, query))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		err := verifyPageQuery(secret, callbackSuccessPage, url.Values{})
+		assert.True(t, errors.Is(err, missingPageMarkerError))
+	})
+
+	t.Run("different secret", func(t *testing.T) {
+		query := url.Values{}
+		signPageQuery([]byte("other"), callbackSuccessPage, query)
+		err := verifyPageQuery(secret, callbackSuccessPage, query)
+		assert.True(t, errors.Is(err, invalidPageMarkerError))
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, marker := range []string{"nodot", "notanumber.sig", "123.sig"} {
+			err := verifyPageQuery(secret, callbackSuccessPage, url.Values{pageMarkerQueryParameter: []string{marker}})
+			assert.True(t, errors.Is(err, invalidPageMarkerError), marker)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		query := url.Values{}
+		expiry := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+		query.Set(pageMarkerQueryParameter, expiry+"."+pageMarkerSignature(secret, callbackSuccessPage, query, expiry))
+		err := verifyPageQuery(secret, callbackSuccessPage, query)
+		assert.True(t, errors.Is(err, expiredPageMarkerError))
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+)
+
+// RequestPriority is the priority class of a route. When the service is busy, the waiting requests of the higher
+// priority are served first.
+type RequestPriority int
+
+const (
+	// PriorityBackground is the priority of the requests made by the automation, e.g. the token uploads or
+	// the introspection of the flows, that can wait.
+	PriorityBackground RequestPriority = iota
+	// PriorityInteractive is the priority of the requests of the OAuth flows a user is waiting for, e.g.
+	// the authentication and the callback.
+	PriorityInteractive
+
+	// priorityCount is the number of the priority classes.
+	priorityCount = int(PriorityInteractive) + 1
+)
+
+// String returns the name of the priority as used in the metrics.
+func (p RequestPriority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return "background"
+	}
+}
+
+// PriorityScheduler limits the number of the requests that are handled concurrently. The requests over the limit wait
+// until one of the handled requests finishes or until their context is done. The freed slot is given to the oldest
+// waiting request of the highest priority so that under load the users going through the OAuth flows are served
+// before the automation. The routes that need to respond even under load, like the health checks, should not use
+// the scheduler at all. A nil scheduler doesn't limit anything.
+type PriorityScheduler struct {
+	lock    sync.Mutex
+	limit   int
+	running int
+	// waiting are the queues of the waiting requests per priority. A slot is given to the waiting request by closing
+	// its channel.
+	waiting [priorityCount][]chan struct{}
+}
+
+// NewPriorityScheduler creates a new scheduler handling at most limit requests concurrently. Returns nil, i.e.
+// no limit, if the limit is not positive.
+func NewPriorityScheduler(limit int) *PriorityScheduler {
+	if limit <= 0 {
+		return nil
+	}
+	return &PriorityScheduler{limit: limit}
+}
+
+// WithPriority is a middleware that handles the requests with the given priority once the scheduler gives them a slot.
+// The requests that don't get the slot before their context is done are rejected with http.StatusServiceUnavailable,
+// so this should be applied after the WithTimeout middleware.
+func (s *PriorityScheduler) WithPriority(priority RequestPriority) Middleware {
+	return func(h http.Handler) http.Handler {
+		if s == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.acquire(r.Context(), priority) {
+				w.Header().Set("Retry-After", "1")
+				logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusServiceUnavailable, "the service is busy, please try again later", "priority", priority.String())
+				return
+			}
+			defer s.release()
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// acquire waits for a slot for the request of the given priority. Returns false if the context is done before that.
+func (s *PriorityScheduler) acquire(ctx context.Context, priority RequestPriority) bool {
+	s.lock.Lock()
+	// the waiting requests of the same or higher priority go first
+	if s.running < s.limit && !s.hasWaiting(priority) {
+		s.running++
+		s.lock.Unlock()
+		return true
+	}
+	slot := make(chan struct{})
+	s.waiting[priority] = append(s.waiting[priority], slot)
+	s.lock.Unlock()
+
+	start := time.Now()
+	queuedRequestsGauge.WithLabelValues(priority.String()).Inc()
+	defer func() {
+		queuedRequestsGauge.WithLabelValues(priority.String()).Dec()
+		requestQueueDurationHistogram.WithLabelValues(priority.String()).Observe(time.Since(start).Seconds())
+	}()
+
+	select {
+	case <-slot:
+		return true
+	case <-ctx.Done():
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i, c := range s.waiting[priority] {
+			if c == slot {
+				s.waiting[priority] = append(s.waiting[priority][:i], s.waiting[priority][i+1:]...)
+				return false
+			}
+		}
+		// the slot was given to us in the meantime, pass it on
+		s.handOver()
+		return false
+	}
+}
+
+// release frees the slot of a finished request.
+func (s *PriorityScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handOver()
+}
+
+// handOver gives the slot of the finished request to the next waiting request, if any. Must be called with the lock
+// held.
+func (s *PriorityScheduler) handOver() {
+	for p := priorityCount - 1; p >= 0; p-- {
+		if len(s.waiting[p]) > 0 {
+			next := s.waiting[p][0]
+			s.waiting[p] = s.waiting[p][1:]
+			close(next)
+			return
+		}
+	}
+	s.running--
+}
+
+// hasWaiting checks whether there are requests of the given or higher priority waiting. Must be called with the lock
+// held.
+func (s *PriorityScheduler) hasWaiting(priority RequestPriority) bool {
+	for p := int(priority); p < priorityCount; p++ {
+		if len(s.waiting[p]) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityScheduler_Nil(t *testing.T) {
+	assert.Nil(t, NewPriorityScheduler(0))
+
+	var s *PriorityScheduler
+	handler := s.WithPriority(PriorityBackground)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusNoContent, res.Code)
+}
+
+func TestPriorityScheduler_InteractiveFirst(t *testing.T) {
+	s := NewPriorityScheduler(1)
+	assert.True(t, s.acquire(context.TODO(), PriorityBackground))
+
+	lock := sync.Mutex{}
+	var order []RequestPriority
+	wg := sync.WaitGroup{}
+	wait := func(p RequestPriority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.True(t, s.acquire(context.TODO(), p))
+			lock.Lock()
+			order = append(order, p)
+			lock.Unlock()
+			s.release()
+		}()
+		// make sure the requests queue up in the order of the calls
+		assert.Eventually(t, func() bool {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			return len(s.waiting[p]) > 0
+		}, time.Second, time.Millisecond)
+	}
+
+	wait(PriorityBackground)
+	wait(PriorityInteractive)
+
+	s.release()
+	wg.Wait()
+
+	assert.Equal(t, []RequestPriority{PriorityInteractive, PriorityBackground}, order)
+	assert.Equal(t, 0, s.running)
+}
+
+func TestPriorityScheduler_Busy(t *testing.T) {
+	s := NewPriorityScheduler(1)
+	assert.True(t, s.acquire(context.TODO(), PriorityInteractive))
+	defer s.release()
+
+	handler := s.WithPriority(PriorityBackground)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Fail(t, "the handler should not be called when the service is busy")
+	}))
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Equal(t, "1", res.Header().Get("Retry-After"))
+	assert.Empty(t, s.waiting[PriorityBackground])
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// rateLimitRemainingHeader is the header in which GitHub, and the other service providers following it, report
+// the number of the requests remaining in the current rate limit window.
+const rateLimitRemainingHeader = "X-RateLimit-Remaining"
+
+// ProviderMetricsTransport is the http.RoundTripper counting the requests to the APIs of the service providers and
+// recording the remaining rate limits reported by them, so that the exhaustion of the quotas can be monitored.
+type ProviderMetricsTransport struct {
+	// Transport performs the actual requests. The http.DefaultTransport is used if nil.
+	Transport http.RoundTripper
+}
+
+var _ http.RoundTripper = (*ProviderMetricsTransport)(nil)
+
+func (t *ProviderMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		providerRequestsCounter.WithLabelValues(req.URL.Host, "error").Inc()
+		return nil, fmt.Errorf("the request to the service provider failed: %w", err)
+	}
+
+	providerRequestsCounter.WithLabelValues(req.URL.Host, strconv.Itoa(res.StatusCode)).Inc()
+	if remaining, err := strconv.ParseFloat(res.Header.Get(rateLimitRemainingHeader), 64); err == nil {
+		providerRateLimitRemainingGauge.WithLabelValues(req.URL.Host).Set(remaining)
+	}
+	return res, nil
+}
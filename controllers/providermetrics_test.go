@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderMetricsTransport(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer provider.Close()
+	host, err := url.Parse(provider.URL)
+	assert.NoError(t, err)
+
+	client := &http.Client{Transport: &ProviderMetricsTransport{Transport: provider.Client().Transport}}
+	before := testutil.ToFloat64(providerRequestsCounter.WithLabelValues(host.Host, "200"))
+
+	res, err := client.Get(provider.URL + "/repos/org/repo")
+	assert.NoError(t, err)
+	assert.NoError(t, res.Body.Close())
+
+	assert.Equal(t, before+1, testutil.ToFloat64(providerRequestsCounter.WithLabelValues(host.Host, "200")))
+	assert.Equal(t, float64(4999), testutil.ToFloat64(providerRateLimitRemainingGauge.WithLabelValues(host.Host)))
+
+	t.Run("failed request", func(t *testing.T) {
+		provider.Close()
+		before := testutil.ToFloat64(providerRequestsCounter.WithLabelValues(host.Host, "error"))
+		_, err := client.Get(provider.URL)
+		assert.Error(t, err)
+		assert.Equal(t, before+1, testutil.ToFloat64(providerRequestsCounter.WithLabelValues(host.Host, "error")))
+	})
+}
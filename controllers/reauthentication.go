@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// promptExtraKey is the key in the extra configuration of the service provider specifying the `prompt` parameter
+	// of the authorization request, e.g. "login" to force the user to log in again or "consent" to force the re-consent.
+	promptExtraKey = "prompt"
+	// maxAgeExtraKey is the key in the extra configuration of the service provider specifying the `max_age` parameter
+	// of the authorization request, i.e. the maximum number of seconds since the user last actively authenticated.
+	maxAgeExtraKey = "maxAge"
+	// reauthenticationScopesExtraKey is the key in the extra configuration of the service provider specifying
+	// the comma-separated scopes for which the prompt and max age are applied. They are applied to all the flows if
+	// not specified.
+	reauthenticationScopesExtraKey = "reauthenticationScopes"
+)
+
+var (
+	invalidPromptError = errors.New("invalid prompt")
+	invalidMaxAgeError = errors.New("invalid max age")
+
+	// validPrompts are the values of the prompt parameter defined by OpenID Connect.
+	validPrompts = map[string]bool{"none": true, "login": true, "consent": true, "select_account": true}
+)
+
+// reauthenticationPolicy describes when and how the users are forced to authenticate again or re-consent at
+// the service provider.
+type reauthenticationPolicy struct {
+	// prompt is the value of the prompt parameter. It is not sent if empty.
+	prompt string
+	// maxAge is the value of the max_age parameter. It is not sent if empty.
+	maxAge string
+	// scopes are the scopes that trigger the policy. The policy is applied to all the flows if empty.
+	scopes []string
+}
+
+// reauthenticationPolicyFromConfiguration reads the reauthentication policy from the extra configuration of
+// the service provider.
+func reauthenticationPolicyFromConfiguration(spConfig config.ServiceProviderConfiguration) (reauthenticationPolicy, error) {
+	policy := reauthenticationPolicy{}
+
+	if prompt := spConfig.Extra[promptExtraKey]; prompt != "" {
+		// the prompt is a space-separated list of values
+		for _, p := range strings.Fields(prompt) {
+			if !validPrompts[p] {
+				return policy, fmt.Errorf("%w '%s' configured for service provider %s", invalidPromptError, prompt, spConfig.ServiceProviderType)
+			}
+		}
+		policy.prompt = strings.Join(strings.Fields(prompt), " ")
+	}
+
+	if maxAge := spConfig.Extra[maxAgeExtraKey]; maxAge != "" {
+		value, err := strconv.Atoi(maxAge)
+		if err != nil || value < 0 {
+			return policy, fmt.Errorf("%w '%s' configured for service provider %s", invalidMaxAgeError, maxAge, spConfig.ServiceProviderType)
+		}
+		policy.maxAge = strconv.Itoa(value)
+	}
+
+	for _, scope := range strings.Split(spConfig.Extra[reauthenticationScopesExtraKey], ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			policy.scopes = append(policy.scopes, scope)
+		}
+	}
+
+	return policy, nil
+}
+
+// options returns the parameters of the authorization request requesting the provided scopes.
+func (p reauthenticationPolicy) options(requestedScopes []string) []oauth2.AuthCodeOption {
+	if len(p.scopes) > 0 && len(scopeDiff(requestedScopes, p.scopes)) == len(p.scopes) {
+		// none of the scopes triggering the policy is requested
+		return nil
+	}
+
+	var opts []oauth2.AuthCodeOption
+	if p.prompt != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", p.prompt))
+	}
+	if p.maxAge != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("max_age", p.maxAge))
+	}
+	return opts
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestReauthenticationPolicy(t *testing.T) {
+	policy := func(extra map[string]string) (reauthenticationPolicy, error) {
+		return reauthenticationPolicyFromConfiguration(config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub, Extra: extra})
+	}
+	authUrl := func(opts []oauth2.AuthCodeOption) url.Values {
+		u, err := url.Parse((&oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://sp/authorize"}}).AuthCodeURL("state", opts...))
+		assert.NoError(t, err)
+		return u.Query()
+	}
+
+	t.Run("nothing configured", func(t *testing.T) {
+		p, err := policy(nil)
+		assert.NoError(t, err)
+		assert.Empty(t, p.options([]string{"repo"}))
+	})
+
+	t.Run("applied to all flows", func(t *testing.T) {
+		p, err := policy(map[string]string{promptExtraKey: " login  consent ", maxAgeExtraKey: "0"})
+		assert.NoError(t, err)
+		q := authUrl(p.options([]string{"read:user"}))
+		assert.Equal(t, "login consent", q.Get("prompt"))
+		assert.Equal(t, "0", q.Get("max_age"))
+	})
+
+	t.Run("applied to configured scopes", func(t *testing.T) {
+		p, err := policy(map[string]string{promptExtraKey: "login", reauthenticationScopesExtraKey: "admin:org, delete_repo"})
+		assert.NoError(t, err)
+		assert.Empty(t, p.options([]string{"repo", "read:user"}))
+		q := authUrl(p.options([]string{"repo", "delete_repo"}))
+		assert.Equal(t, "login", q.Get("prompt"))
+		assert.False(t, q.Has("max_age"))
+	})
+
+	t.Run("invalid prompt", func(t *testing.T) {
+		_, err := policy(map[string]string{promptExtraKey: "login always"})
+		assert.True(t, errors.Is(err, invalidPromptError))
+	})
+
+	t.Run("invalid max age", func(t *testing.T) {
+		for _, maxAge := range []string{"-1", "1h"} {
+			_, err := policy(map[string]string{maxAgeExtraKey: maxAge})
+			assert.True(t, errors.Is(err, invalidMaxAgeError), maxAge)
+		}
+	})
+}
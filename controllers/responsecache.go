@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bufferedResponseWriter is the http.ResponseWriter keeping the response in memory.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.body.Write(b) //nolint:wrapcheck // writing to the buffer doesn't fail
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// cachedResponse is the response of the handler kept by WithResponseCaching.
+type cachedResponse struct {
+	header       http.Header
+	body         []byte
+	etag         string
+	lastModified time.Time
+	expires      time.Time
+}
+
+// WithResponseCaching returns a middleware that keeps the successful response of the handler in memory for the ttl
+// and serves it to the GET and HEAD requests without calling the handler. The responses carry the ETag and
+// Last-Modified headers and the conditional requests with the matching If-None-Match or If-Modified-Since headers
+// are responded with http.StatusNotModified, so that polling the endpoint costs almost nothing. The Last-Modified time
+// only changes when the response does. It is meant for the endpoints whose responses don't depend on the caller.
+// Each handler wrapped by the middleware has its own cached response, so the middleware can be shared by several routes.
+func WithResponseCaching(ttl time.Duration) Middleware {
+	return func(h http.Handler) http.Handler {
+		lock := sync.Mutex{}
+		var cached *cachedResponse
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			lock.Lock()
+			current := cached
+			lock.Unlock()
+
+			if current == nil || time.Now().After(current.expires) {
+				rec := &bufferedResponseWriter{header: http.Header{}}
+				h.ServeHTTP(rec, r.Clone(r.Context()))
+				if rec.code != http.StatusOK {
+					// the failures are not cached so that the next request tries again
+					for k, v := range rec.header {
+						w.Header()[k] = v
+					}
+					w.WriteHeader(rec.code)
+					_, _ = w.Write(rec.body.Bytes())
+					return
+				}
+				current = refreshCachedResponse(current, rec, ttl)
+
+				lock.Lock()
+				cached = current
+				lock.Unlock()
+			}
+
+			for k, v := range current.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("ETag", current.etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			// ServeContent handles the conditional requests and the HEAD requests
+			http.ServeContent(w, r, "", current.lastModified, bytes.NewReader(current.body))
+		})
+	}
+}
+
+// refreshCachedResponse creates the cached response from the recorded one, keeping the Last-Modified time of
+// the previous cached response if the body didn't change.
+func refreshCachedResponse(previous *cachedResponse, rec *bufferedResponseWriter, ttl time.Duration) *cachedResponse {
+	now := time.Now()
+	body := rec.body.Bytes()
+	digest := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(digest[:16]) + `"`
+
+	lastModified := now
+	if previous != nil && previous.etag == etag {
+		lastModified = previous.lastModified
+	}
+
+	header := rec.header.Clone()
+	header.Del("Content-Length")
+	return &cachedResponse{
+		header:       header,
+		body:         body,
+		etag:         etag,
+		lastModified: lastModified,
+		expires:      now.Add(ttl),
+	}
+}
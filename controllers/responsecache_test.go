@@ -0,0 +1,114 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithResponseCaching(t *testing.T) {
+	calls := 0
+	body := "v1"
+	code := http.StatusOK
+	handler := WithResponseCaching(time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/yaml")
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(body))
+	}))
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/slo-rules", nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("failures are not cached", func(t *testing.T) {
+		code = http.StatusInternalServerError
+		defer func() { code = http.StatusOK }()
+		assert.Equal(t, http.StatusInternalServerError, get().Code)
+		assert.Equal(t, 1, calls)
+	})
+
+	first := get()
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, "v1", first.Body.String())
+	assert.Equal(t, "application/yaml", first.Header().Get("Content-Type"))
+	etag := first.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, first.Header().Get("Last-Modified"))
+
+	body = "v2"
+	second := get()
+	assert.Equal(t, "v1", second.Body.String())
+	assert.Equal(t, 2, calls)
+
+	assert.Equal(t, http.StatusNotModified, get("If-None-Match", etag).Code)
+	assert.Equal(t, http.StatusNotModified, get("If-Modified-Since", first.Header().Get("Last-Modified")).Code)
+	assert.Equal(t, http.StatusOK, get("If-None-Match", `"other"`).Code)
+	assert.Equal(t, 2, calls)
+}
+
+func TestWithResponseCaching_Expiry(t *testing.T) {
+	body := "v1"
+	handler := WithResponseCaching(time.Nanosecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	get := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/grafana-dashboard", nil))
+		return res
+	}
+
+	first := get()
+	time.Sleep(time.Millisecond)
+	unchanged := get()
+	// the Last-Modified time only changes with the response
+	assert.Equal(t, first.Header().Get("ETag"), unchanged.Header().Get("ETag"))
+	assert.Equal(t, first.Header().Get("Last-Modified"), unchanged.Header().Get("Last-Modified"))
+
+	body = "v2"
+	time.Sleep(time.Millisecond)
+	changed := get()
+	assert.Equal(t, "v2", changed.Body.String())
+	assert.NotEqual(t, first.Header().Get("ETag"), changed.Header().Get("ETag"))
+}
+
+func TestWithResponseCaching_SharedMiddleware(t *testing.T) {
+	caching := WithResponseCaching(time.Hour)
+	handler := func(body string) http.Handler {
+		return caching(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+	first, second := handler("first"), handler("second")
+	get := func(h http.Handler) string {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+		return res.Body.String()
+	}
+
+	assert.Equal(t, "first", get(first))
+	// the second handler doesn't get the response cached by the first one
+	assert.Equal(t, "second", get(second))
+	assert.Equal(t, "first", get(first))
+}
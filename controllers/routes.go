@@ -0,0 +1,170 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var unsupportedContentTypeError = errors.New("unsupported content type of the request body")
+
+// Middleware wraps the handler with some additional behavior.
+type Middleware func(http.Handler) http.Handler
+
+// Route declares a single endpoint of the service together with the middleware that should be applied to it.
+type Route struct {
+	// Path is the path template of the route as understood by the gorilla mux.
+	Path string
+	// Methods is the list of the HTTP methods the route responds to. All methods are matched if empty.
+	Methods []string
+	// Queries is the list of key/value pairs of the query parameters the route requires, as understood by the
+	// gorilla mux.
+	Queries []string
+	// ContentTypes is the list of the media types of the request bodies the route accepts. The requests with unsafe
+	// methods and with other bodies are rejected with http.StatusUnsupportedMediaType after going through
+	// the middleware. The requests without a body are not checked. All the media types are accepted if empty.
+	ContentTypes []string
+	// Handler handles the requests to the route.
+	Handler http.Handler
+	// Middleware is the list of the middleware applied to the handler. The first middleware in the list is the
+	// outermost one, i.e. it sees the request first.
+	Middleware []Middleware
+}
+
+// RegisterRoutes registers the routes with the router in the order in which they are declared. Notice that the order
+// matters, because the router uses the first route that matches the request.
+func RegisterRoutes(router *mux.Router, routes []Route) {
+	for _, r := range routes {
+		route := router.NewRoute().Path(r.Path).Handler(r.handler())
+		if len(r.Methods) > 0 {
+			route.Methods(r.Methods...)
+		}
+		if len(r.Queries) > 0 {
+			route.Queries(r.Queries...)
+		}
+	}
+}
+
+// handler returns the handler of the route wrapped in all its middleware.
+func (r Route) handler() http.Handler {
+	h := r.Handler
+	if len(r.ContentTypes) > 0 {
+		h = withContentTypes(r.ContentTypes)(h)
+	}
+	for i := len(r.Middleware) - 1; i >= 0; i-- {
+		h = r.Middleware[i](h)
+	}
+	return h
+}
+
+// WithMetrics returns a middleware that counts the requests and observes their durations in the metrics under
+// the provided route name. It should be the outermost middleware so that it sees the responses of the other middleware
+// too.
+func WithMetrics(route string) Middleware {
+	labels := prometheus.Labels{"route": route}
+	counter := requestsCounter.MustCurryWith(labels)
+	duration := requestDurationHistogram.MustCurryWith(labels)
+	return func(h http.Handler) http.Handler {
+		return promhttp.InstrumentHandlerCounter(counter, promhttp.InstrumentHandlerDuration(duration, h))
+	}
+}
+
+// WithTimeout returns a middleware that limits the time the handler has for producing the response. The requests
+// that take longer are responded with http.StatusServiceUnavailable.
+func WithTimeout(timeout time.Duration) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.TimeoutHandler(h, timeout, "the request timed out")
+	}
+}
+
+// WithBodyLimit returns a middleware that limits the size of the request body. Reading more than maxBytes from
+// the body fails in the handler.
+func WithBodyLimit(maxBytes int64) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithRateLimit returns a middleware that limits the rate of the requests to the handler to requestsPerSecond with
+// the given burst. The requests over the limit are responded with http.StatusTooManyRequests. The limit is shared by
+// all the callers of the route.
+func WithRateLimit(requestsPerSecond float64, burst int) Middleware {
+	limiter := rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Allow() {
+				logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusTooManyRequests, "too many requests, please try again later")
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithAllowedHosts is a middleware that rejects the requests with the Host header not matching any of the allowed hosts
+// with http.StatusBadRequest. A host without a port matches any port. All the hosts are allowed if the list is empty.
+func WithAllowedHosts(allowed []string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isAllowedHost(allowed, r.Host) {
+				log.FromContext(r.Context()).V(logs.DebugLevel).Info("rejecting the request received on an unexpected host", "host", r.Host, "allowedHosts", allowed)
+				logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusBadRequest, "failed to process the request", unexpectedCallbackHostError)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withContentTypes returns a middleware that rejects the requests with unsafe methods and with a body of a media type
+// other than the allowed ones with http.StatusUnsupportedMediaType. The requests known to have no body, e.g. the login
+// with just the Authorization header, carry no media type and are let through.
+func withContentTypes(allowed []string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isSafeMethod(r.Method) && r.ContentLength != 0 {
+				mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+				if err != nil || !isAllowedContentType(allowed, mediaType) {
+					logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnsupportedMediaType, "failed to process the request", unsupportedContentTypeError)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isAllowedContentType(allowed []string, mediaType string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(a, mediaType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	var calls []string
+	recording := func(name string) Middleware {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	router := mux.NewRouter()
+	RegisterRoutes(router, []Route{
+		{
+			Path:       "/{type}/callback",
+			Queries:    []string{"error", ""},
+			Handler:    http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) }),
+			Middleware: []Middleware{recording("error")},
+		},
+		{
+			Path:       "/{type}/callback",
+			Methods:    []string{"GET"},
+			Handler:    http.HandlerFunc(OkHandler),
+			Middleware: []Middleware{recording("outer"), recording("inner")},
+		},
+	})
+
+	t.Run("applies middleware in order", func(t *testing.T) {
+		calls = nil
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/github/callback", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"outer", "inner"}, calls)
+	})
+
+	t.Run("matches queries first", func(t *testing.T) {
+		calls = nil
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/github/callback?error=foo", nil))
+
+		assert.Equal(t, http.StatusTeapot, rr.Code)
+		assert.Equal(t, []string{"error"}, calls)
+	})
+
+	t.Run("matches methods", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("POST", "/github/callback", nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	})
+}
+
+func TestWithMetrics(t *testing.T) {
+	handler := WithMetrics("/test/metrics")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(requestsCounter.WithLabelValues("/test/metrics", "get", "502")))
+}
+
+func TestWithTimeout(t *testing.T) {
+	handler := WithTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestWithBodyLimit(t *testing.T) {
+	handler := WithBodyLimit(4)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/", bytes.NewBufferString("1234")))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/", bytes.NewBufferString("12345")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestWithRateLimit(t *testing.T) {
+	handler := WithRateLimit(0.001, 2)(http.HandlerFunc(OkHandler))
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+}
+
+func TestRouteContentTypes(t *testing.T) {
+	router := mux.NewRouter()
+	RegisterRoutes(router, []Route{
+		{
+			Path:         "/token/{namespace}/{name}",
+			Methods:      []string{"GET", "POST"},
+			ContentTypes: []string{"application/json"},
+			Handler:      http.HandlerFunc(OkHandler),
+		},
+	})
+	serve := func(method, contentType string) int {
+		r := httptest.NewRequest(method, "/token/default/token", strings.NewReader("{}"))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("POST", "application/json"))
+	assert.Equal(t, http.StatusOK, serve("POST", "application/json; charset=utf-8"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, serve("POST", "text/plain"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, serve("POST", ""))
+	assert.Equal(t, http.StatusOK, serve("GET", ""))
+
+	t.Run("bearer-only login", func(t *testing.T) {
+		RegisterRoutes(router, []Route{
+			{
+				Path:         "/login",
+				Methods:      []string{"POST"},
+				ContentTypes: []string{"application/x-www-form-urlencoded", "multipart/form-data"},
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+					w.WriteHeader(http.StatusOK)
+				}),
+			},
+		})
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.Header.Set("Authorization", "Bearer token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+
+	t.Run("body of unknown length", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/token/default/token", strings.NewReader("{}"))
+		r.ContentLength = -1
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, r)
+
+		assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import "golang.org/x/oauth2"
+
+// includeGrantedScopesParameter is the parameter of the authorization request asking the service provider to include
+// the already granted scopes in the new token. See https://developers.google.com/identity/protocols/oauth2/web-server#incrementalAuth
+const includeGrantedScopesParameter = "include_granted_scopes"
+
+// scopeDiff returns the requested scopes that are not among the granted scopes, in the order they are requested.
+func scopeDiff(granted []string, requested []string) []string {
+	grantedSet := make(map[string]struct{}, len(granted))
+	for _, s := range granted {
+		grantedSet[s] = struct{}{}
+	}
+
+	diff := []string{}
+	for _, s := range requested {
+		if _, ok := grantedSet[s]; !ok {
+			diff = append(diff, s)
+			// make sure duplicates in the request are reported once
+			grantedSet[s] = struct{}{}
+		}
+	}
+	return diff
+}
+
+// scopeUnion returns the granted scopes followed by the requested scopes that are not granted yet.
+func scopeUnion(granted []string, requested []string) []string {
+	union := make([]string, 0, len(granted)+len(requested))
+	union = append(union, scopeDiff(nil, granted)...)
+	return append(union, scopeDiff(granted, requested)...)
+}
+
+// authorizationScopes returns the scopes to request from the service provider and the additional parameters of
+// the authorization request. When a token with some scopes already exists, the new token must not lose them. So either
+// the union of the scopes is requested, or, if the service provider supports the incremental authorization, only
+// the scopes that are not granted yet are requested together with the instruction to include the granted ones.
+func authorizationScopes(granted []string, requested []string, incremental bool) ([]string, []oauth2.AuthCodeOption) {
+	if len(granted) == 0 {
+		return requested, nil
+	}
+
+	if incremental {
+		newScopes := scopeDiff(granted, requested)
+		if len(newScopes) == 0 {
+			// nothing new to grant, the user is just re-approving the same access
+			return requested, nil
+		}
+		return newScopes, []oauth2.AuthCodeOption{oauth2.SetAuthURLParam(includeGrantedScopesParameter, "true")}
+	}
+
+	return scopeUnion(granted, requested), nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestScopeDiff(t *testing.T) {
+	assert.Equal(t, []string{}, scopeDiff([]string{"a", "b"}, []string{"b", "a"}))
+	assert.Equal(t, []string{"c"}, scopeDiff([]string{"a", "b"}, []string{"a", "c", "c"}))
+	assert.Equal(t, []string{"a"}, scopeDiff(nil, []string{"a"}))
+	assert.Equal(t, []string{}, scopeDiff(nil, nil))
+}
+
+func TestScopeUnion(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, scopeUnion([]string{"a", "b"}, []string{"b", "c"}))
+	assert.Equal(t, []string{"a"}, scopeUnion([]string{"a", "a"}, nil))
+	assert.Equal(t, []string{"c"}, scopeUnion(nil, []string{"c"}))
+}
+
+func TestAuthorizationScopes(t *testing.T) {
+	authUrl := func(opts []oauth2.AuthCodeOption) url.Values {
+		u, err := url.Parse((&oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://sp/authorize"}}).AuthCodeURL("state", opts...))
+		assert.NoError(t, err)
+		return u.Query()
+	}
+
+	t.Run("no token yet", func(t *testing.T) {
+		scopes, opts := authorizationScopes(nil, []string{"repo"}, true)
+		assert.Equal(t, []string{"repo"}, scopes)
+		assert.Empty(t, opts)
+	})
+
+	t.Run("union without incremental authorization", func(t *testing.T) {
+		scopes, opts := authorizationScopes([]string{"read:user"}, []string{"repo"}, false)
+		assert.Equal(t, []string{"read:user", "repo"}, scopes)
+		assert.Empty(t, opts)
+	})
+
+	t.Run("only new scopes with incremental authorization", func(t *testing.T) {
+		scopes, opts := authorizationScopes([]string{"read:user"}, []string{"read:user", "repo"}, true)
+		assert.Equal(t, []string{"repo"}, scopes)
+		assert.Equal(t, "true", authUrl(opts).Get(includeGrantedScopesParameter))
+	})
+
+	t.Run("nothing new with incremental authorization", func(t *testing.T) {
+		scopes, opts := authorizationScopes([]string{"repo"}, []string{"repo"}, true)
+		assert.Equal(t, []string{"repo"}, scopes)
+		assert.Empty(t, authUrl(opts).Get(includeGrantedScopesParameter))
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+const (
+	sessionEvictionExpired  = "expired"
+	sessionEvictionCapacity = "capacity"
+)
+
+// BoundedSessionStore is an in-memory scs.Store that keeps at most the configured number of sessions. When the store is
+// full, the least recently used session is evicted to make room for the new one, so that a flood of requests creating
+// new sessions cannot exhaust the memory of the service. Only the users whose sessions were evicted need to start over.
+type BoundedSessionStore struct {
+	maxEntries int
+
+	lock sync.Mutex
+	// entries index the elements of the lru list by the session token
+	entries map[string]*list.Element
+	// lru has the most recently used session at the front
+	lru         *list.List
+	stopCleanup chan struct{}
+}
+
+type sessionStoreEntry struct {
+	token  string
+	data   []byte
+	expiry time.Time
+}
+
+var _ scs.IterableStore = (*BoundedSessionStore)(nil)
+
+// NewBoundedSessionStore returns a new in-memory session store keeping at most maxEntries sessions, or any number of
+// them if maxEntries is zero. The expired sessions are removed every cleanupInterval unless it is zero.
+func NewBoundedSessionStore(maxEntries int, cleanupInterval time.Duration) *BoundedSessionStore {
+	s := &BoundedSessionStore{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+	if cleanupInterval > 0 {
+		s.stopCleanup = make(chan struct{})
+		go s.runCleanup(cleanupInterval)
+	}
+	return s
+}
+
+func (s *BoundedSessionStore) Find(token string) ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, ok := s.entries[token]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*sessionStoreEntry)
+	if time.Now().After(entry.expiry) {
+		s.remove(element, sessionEvictionExpired)
+		return nil, false, nil
+	}
+	s.lru.MoveToFront(element)
+	return entry.data, true, nil
+}
+
+func (s *BoundedSessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[token]; ok {
+		entry := element.Value.(*sessionStoreEntry)
+		entry.data = b
+		entry.expiry = expiry
+		s.lru.MoveToFront(element)
+		return nil
+	}
+
+	s.entries[token] = s.lru.PushFront(&sessionStoreEntry{token: token, data: b, expiry: expiry})
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back(), sessionEvictionCapacity)
+	}
+	sessionStoreEntriesGauge.Set(float64(s.lru.Len()))
+	return nil
+}
+
+func (s *BoundedSessionStore) Delete(token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, ok := s.entries[token]; ok {
+		s.remove(element, "")
+	}
+	return nil
+}
+
+func (s *BoundedSessionStore) All() (map[string][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	all := make(map[string][]byte, len(s.entries))
+	for token, element := range s.entries {
+		entry := element.Value.(*sessionStoreEntry)
+		if now.Before(entry.expiry) {
+			all[token] = entry.data
+		}
+	}
+	return all, nil
+}
+
+// Len returns the number of sessions in the store, including the expired ones that were not removed yet.
+func (s *BoundedSessionStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lru.Len()
+}
+
+// StopCleanup stops the periodic removal of the expired sessions.
+func (s *BoundedSessionStore) StopCleanup() {
+	if s.stopCleanup != nil {
+		close(s.stopCleanup)
+	}
+}
+
+func (s *BoundedSessionStore) runCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.deleteExpired()
+		case <-s.stopCleanup:
+			return
+		}
+	}
+}
+
+func (s *BoundedSessionStore) deleteExpired() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for _, element := range s.entries {
+		if now.After(element.Value.(*sessionStoreEntry).expiry) {
+			s.remove(element, sessionEvictionExpired)
+		}
+	}
+}
+
+// remove removes the session from the store, counting it as evicted for the reason, if any. The lock must be held.
+func (s *BoundedSessionStore) remove(element *list.Element, reason string) {
+	entry := s.lru.Remove(element).(*sessionStoreEntry)
+	delete(s.entries, entry.token)
+	if reason != "" {
+		sessionStoreEvictionsCounter.WithLabelValues(reason).Inc()
+	}
+	sessionStoreEntriesGauge.Set(float64(s.lru.Len()))
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoundedSessionStore(t *testing.T) {
+	expiry := time.Now().Add(time.Hour)
+
+	t.Run("evicts least recently used", func(t *testing.T) {
+		store := NewBoundedSessionStore(2, 0)
+		before := testutil.ToFloat64(sessionStoreEvictionsCounter.WithLabelValues(sessionEvictionCapacity))
+
+		assert.NoError(t, store.Commit("a", []byte("a"), expiry))
+		assert.NoError(t, store.Commit("b", []byte("b"), expiry))
+		// reading a makes b the least recently used
+		_, found, err := store.Find("a")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.NoError(t, store.Commit("c", []byte("c"), expiry))
+
+		assert.Equal(t, 2, store.Len())
+		_, found, _ = store.Find("b")
+		assert.False(t, found)
+		data, found, _ := store.Find("a")
+		assert.True(t, found)
+		assert.Equal(t, []byte("a"), data)
+		_, found, _ = store.Find("c")
+		assert.True(t, found)
+		assert.Equal(t, before+1, testutil.ToFloat64(sessionStoreEvictionsCounter.WithLabelValues(sessionEvictionCapacity)))
+	})
+
+	t.Run("updates without eviction", func(t *testing.T) {
+		store := NewBoundedSessionStore(1, 0)
+		assert.NoError(t, store.Commit("a", []byte("a"), expiry))
+		assert.NoError(t, store.Commit("a", []byte("updated"), expiry))
+
+		data, found, err := store.Find("a")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, []byte("updated"), data)
+	})
+
+	t.Run("unbounded when zero", func(t *testing.T) {
+		store := NewBoundedSessionStore(0, 0)
+		for _, token := range []string{"a", "b", "c"} {
+			assert.NoError(t, store.Commit(token, []byte(token), expiry))
+		}
+		assert.Equal(t, 3, store.Len())
+	})
+
+	t.Run("drops expired", func(t *testing.T) {
+		store := NewBoundedSessionStore(10, 0)
+		before := testutil.ToFloat64(sessionStoreEvictionsCounter.WithLabelValues(sessionEvictionExpired))
+		assert.NoError(t, store.Commit("expired", []byte("x"), time.Now().Add(-time.Second)))
+		assert.NoError(t, store.Commit("valid", []byte("v"), expiry))
+
+		all, err := store.All()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]byte{"valid": []byte("v")}, all)
+
+		_, found, err := store.Find("expired")
+		assert.NoError(t, err)
+		assert.False(t, found)
+		assert.Equal(t, 1, store.Len())
+		assert.Equal(t, before+1, testutil.ToFloat64(sessionStoreEvictionsCounter.WithLabelValues(sessionEvictionExpired)))
+	})
+
+	t.Run("delete is not an eviction", func(t *testing.T) {
+		store := NewBoundedSessionStore(10, 0)
+		before := testutil.ToFloat64(sessionStoreEvictionsCounter.WithLabelValues(sessionEvictionExpired))
+		assert.NoError(t, store.Commit("a", []byte("a"), expiry))
+		assert.NoError(t, store.Delete("a"))
+		assert.NoError(t, store.Delete("unknown"))
+
+		assert.Equal(t, 0, store.Len())
+		assert.Equal(t, before, testutil.ToFloat64(sessionStoreEvictionsCounter.WithLabelValues(sessionEvictionExpired)))
+	})
+
+	t.Run("cleans up expired periodically", func(t *testing.T) {
+		store := NewBoundedSessionStore(10, 10*time.Millisecond)
+		defer store.StopCleanup()
+		assert.NoError(t, store.Commit("expired", []byte("x"), time.Now().Add(-time.Second)))
+
+		assert.Eventually(t, func() bool { return store.Len() == 0 }, time.Second, 10*time.Millisecond)
+	})
+}
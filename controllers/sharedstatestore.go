@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+)
+
+var (
+	notVaultTokenStorageError = errors.New("the token storage is not backed by Vault")
+	corruptedSharedStateError = errors.New("corrupted shared OAuth state data in Vault")
+)
+
+// vaultLogicalClient is implemented by the Vault token storage which embeds the Vault client. It lets us share the
+// already authenticated client with the token storage.
+type vaultLogicalClient interface {
+	Logical() *vault.Logical
+}
+
+// vaultStateStore is an scs.Store that keeps the data in the Vault KV secrets engine so that it is available to all
+// replicas of the OAuth service.
+type vaultStateStore struct {
+	logical    *vault.Logical
+	pathPrefix string
+}
+
+var _ scs.IterableStore = (*vaultStateStore)(nil)
+
+// NewVaultStateStore returns an scs.Store keeping the data under the pathPrefix in Vault. It uses the Vault client of
+// the provided token storage which therefore needs to be the Vault token storage.
+func NewVaultStateStore(storage tokenstorage.TokenStorage, pathPrefix string) (scs.Store, error) {
+	client, ok := storage.(vaultLogicalClient)
+	if !ok {
+		return nil, notVaultTokenStorageError
+	}
+	return &vaultStateStore{logical: client.Logical(), pathPrefix: pathPrefix}, nil
+}
+
+func (s *vaultStateStore) path(token string) string {
+	return s.pathPrefix + "/" + token
+}
+
+// metadataPath returns the path of the metadata of the data under the path prefix. The KV secrets engine version 2
+// lists the keys and destroys all the versions of the data using the metadata path instead of the data path.
+func (s *vaultStateStore) metadataPath() string {
+	return strings.Replace(s.pathPrefix, "/data/", "/metadata/", 1)
+}
+
+func (s *vaultStateStore) Find(token string) ([]byte, bool, error) {
+	b, expiry, found, err := s.read(token)
+	if err != nil || !found || time.Now().After(expiry) {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// read reads the data kept under the token together with its expiry, regardless of whether it already expired.
+func (s *vaultStateStore) read(token string) ([]byte, time.Time, bool, error) {
+	secret, err := s.logical.Read(s.path(token))
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("error reading the shared state from Vault: %w", err)
+	}
+	if secret == nil || secret.Data == nil || secret.Data["data"] == nil {
+		return nil, time.Time{}, false, nil
+	}
+
+	data, ok := secret.Data["data"].(map[string]interface{})
+	if !ok {
+		return nil, time.Time{}, false, corruptedSharedStateError
+	}
+	value, valueOk := data["value"].(string)
+	expiryString, expiryOk := data["expiry"].(string)
+	if !valueOk || !expiryOk {
+		return nil, time.Time{}, false, corruptedSharedStateError
+	}
+
+	expiry, err := time.Parse(time.RFC3339, expiryString)
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("%w: invalid expiry: %s", corruptedSharedStateError, err.Error())
+	}
+
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("%w: invalid value: %s", corruptedSharedStateError, err.Error())
+	}
+	return b, expiry, true, nil
+}
+
+func (s *vaultStateStore) Commit(token string, b []byte, expiry time.Time) error {
+	data := map[string]interface{}{
+		"data": map[string]interface{}{
+			"value":  base64.StdEncoding.EncodeToString(b),
+			"expiry": expiry.UTC().Format(time.RFC3339),
+		},
+	}
+	if _, err := s.logical.Write(s.path(token), data); err != nil {
+		return fmt.Errorf("error writing the shared state to Vault: %w", err)
+	}
+	return nil
+}
+
+// Delete destroys the data under the token. Deleting the data path of the KV secrets engine version 2 would only mark
+// the latest version as deleted and keep the metadata and the versions forever, so the metadata is deleted instead.
+func (s *vaultStateStore) Delete(token string) error {
+	if _, err := s.logical.Delete(s.metadataPath() + "/" + token); err != nil {
+		return fmt.Errorf("error deleting the shared state from Vault: %w", err)
+	}
+	return nil
+}
+
+// All returns the data of all the tokens that haven't expired yet. The expired and the deleted ones are destroyed on
+// the way so that the keys don't pile up.
+func (s *vaultStateStore) All() (map[string][]byte, error) {
+	secret, err := s.logical.List(s.metadataPath())
+	if err != nil {
+		return nil, fmt.Errorf("error listing the shared state in Vault: %w", err)
+	}
+
+	all := map[string][]byte{}
+	if secret == nil || secret.Data == nil {
+		return all, nil
+	}
+
+	keys, ok := secret.Data["keys"].([]interface{})
+	if !ok {
+		return nil, corruptedSharedStateError
+	}
+	for _, k := range keys {
+		token, ok := k.(string)
+		if !ok {
+			return nil, corruptedSharedStateError
+		}
+		b, expiry, found, err := s.read(token)
+		if err != nil {
+			return nil, err
+		}
+		// the keys without data were soft-deleted by the previous versions of the service
+		if !found || time.Now().After(expiry) {
+			if err = s.Delete(token); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		all[token] = b
+	}
+	return all, nil
+}
+
+// SharedSessionStore is an scs.Store that keeps the sessions in the local store and also in the store shared by all
+// the replicas of the service, so that the session of the user, including their authentication, is known to all of
+// them when the sticky session breaks. The callback is then authenticated by the session cookie of the user as usual,
+// no matter which replica receives it. The sessions missing in the local store are read from the shared store.
+type SharedSessionStore struct {
+	Local  scs.Store
+	Shared scs.Store
+}
+
+var _ scs.Store = (*SharedSessionStore)(nil)
+
+// sharedSessionCleanupLease is the name of the lease the instance removing the expired sessions from the shared store
+// holds.
+const sharedSessionCleanupLease = "shared-session-cleanup"
+
+func (s *SharedSessionStore) Find(token string) ([]byte, bool, error) {
+	b, found, err := s.Local.Find(token)
+	if err != nil || found {
+		return b, found, err //nolint:wrapcheck // the local store is one of ours
+	}
+	b, found, err = s.Shared.Find(token)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to find the session in the shared store: %w", err)
+	}
+	return b, found, nil
+}
+
+func (s *SharedSessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	if err := s.Local.Commit(token, b, expiry); err != nil {
+		return err //nolint:wrapcheck // the local store is one of ours
+	}
+	if err := s.Shared.Commit(token, b, expiry); err != nil {
+		return fmt.Errorf("failed to share the session: %w", err)
+	}
+	return nil
+}
+
+func (s *SharedSessionStore) Delete(token string) error {
+	if err := s.Local.Delete(token); err != nil {
+		return err //nolint:wrapcheck // the local store is one of ours
+	}
+	if err := s.Shared.Delete(token); err != nil {
+		return fmt.Errorf("failed to delete the session from the shared store: %w", err)
+	}
+	return nil
+}
+
+// StartCleanup periodically removes the expired sessions from the shared store until the context is done, the same way
+// StateStorage.StartCleanup removes the states.
+func (s *SharedSessionStore) StartCleanup(ctx context.Context, interval time.Duration, lease Lease) {
+	cleanupSharedStore(ctx, s.Shared, "sessions", interval, lease, sharedSessionCleanupLease)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build vault
+// +build vault
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestVaultStateStore checks that the shared state store doesn't leave the deleted and the expired data in Vault.
+// Starting Vault takes a while, so this is only run with the `vault` build tag.
+func TestVaultStateStore(t *testing.T) {
+	cluster, storage := tokenstorage.CreateTestVaultTokenStorage(t)
+	defer cluster.Cleanup()
+
+	store, err := NewVaultStateStore(storage, "spi/data/oauth/states")
+	assert.NoError(t, err)
+	vaultStore := store.(*vaultStateStore)
+	keys := func() []interface{} {
+		secret, err := vaultStore.logical.List(vaultStore.metadataPath())
+		assert.NoError(t, err)
+		if secret == nil {
+			return nil
+		}
+		return secret.Data["keys"].([]interface{})
+	}
+
+	assert.NoError(t, store.Commit("deleted", []byte("a"), time.Now().Add(time.Hour)))
+	assert.NoError(t, store.Commit("expired", []byte("b"), time.Now().Add(-time.Second)))
+	assert.NoError(t, store.Commit("kept", []byte("c"), time.Now().Add(time.Hour)))
+	assert.Len(t, keys(), 3)
+
+	assert.NoError(t, store.Delete("deleted"))
+	_, found, err := store.Find("deleted")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Len(t, keys(), 2)
+
+	all, err := vaultStore.All()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"kept": []byte("c")}, all)
+	assert.Equal(t, []interface{}{"kept"}, keys())
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// MinSigningSecretLength is the least number of bytes of the JWT signing secret we accept. The OAuth states are
+	// signed using HMAC-SHA256, so the secret should be at least as long as the hash.
+	MinSigningSecretLength = 32
+	// MinSigningSecretEntropyBits is the least estimated entropy of the JWT signing secret below which the secret is
+	// reported as weak. E.g. a random 32 characters long hexadecimal string has about 120 bits by the estimate.
+	MinSigningSecretEntropyBits = 96
+)
+
+var (
+	noSigningSecretError       = errors.New("no JWT signing secret configured")
+	shortSigningSecretError    = errors.New("the JWT signing secret is too short")
+	weakSigningSecretError     = errors.New("the JWT signing secret has too little entropy")
+	signingSecretRotationError = errors.New("the JWT signing secret is due for rotation")
+)
+
+// SigningSecretHealth validates the JWT signing secret and reports its health in the metrics so that the operators
+// know when it is weak or needs to be rotated.
+type SigningSecretHealth struct {
+	// err is the reason the secret cannot be used, if any. It doesn't change while the service runs.
+	err error
+	// warning is the reason the secret should be replaced even though it can be used.
+	warning error
+	// entropyBits is the estimated entropy of the secret.
+	entropyBits float64
+	// rotateBy is the time by which the secret should be rotated. It is zero if not known.
+	rotateBy time.Time
+}
+
+// NewSigningSecretHealth validates the secret. The rotateBy is the time by which the secret should be rotated, or zero
+// if the rotation schedule of the secret is not known.
+func NewSigningSecretHealth(secret []byte, rotateBy time.Time) *SigningSecretHealth {
+	h := &SigningSecretHealth{entropyBits: estimateEntropyBits(secret), rotateBy: rotateBy}
+	switch {
+	case len(secret) == 0:
+		h.err = noSigningSecretError
+	case len(secret) < MinSigningSecretLength:
+		h.err = fmt.Errorf("%w: %d bytes but it must have at least %d", shortSigningSecretError, len(secret), MinSigningSecretLength)
+	case h.entropyBits < MinSigningSecretEntropyBits:
+		h.warning = fmt.Errorf("%w: about %.0f bits, at least %d recommended", weakSigningSecretError, h.entropyBits, MinSigningSecretEntropyBits)
+	}
+	return h
+}
+
+// Check returns an error if the secret cannot be used to sign the OAuth states. It is meant as the readiness check
+// of the service.
+func (h *SigningSecretHealth) Check() error {
+	return h.err
+}
+
+// Start logs the problems of the secret and exposes its health in the metrics. It doesn't fail on an invalid secret
+// so that it is reported by the readiness check instead of a crash loop.
+func (h *SigningSecretHealth) Start(ctx context.Context) error {
+	lg := log.FromContext(ctx)
+	if h.err != nil {
+		lg.Error(h.err, "invalid JWT signing secret, the service will not be ready")
+	} else if h.warning != nil {
+		lg.Error(h.warning, "weak JWT signing secret, consider replacing it with a longer random one")
+	}
+	if h.err == nil {
+		signingSecretValidGauge.Set(1)
+	} else {
+		signingSecretValidGauge.Set(0)
+	}
+	signingSecretEntropyGauge.Set(h.entropyBits)
+	h.updateRotation(ctx)
+	return nil
+}
+
+// Run periodically updates the time left until the rotation of the secret. Returns when the context is done.
+func (h *SigningSecretHealth) Run(ctx context.Context, interval time.Duration) {
+	if h.rotateBy.IsZero() {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.updateRotation(ctx)
+		}
+	}
+}
+
+// updateRotation updates the gauge of the days left until the rotation of the secret, if its rotation schedule is
+// known, and logs when the rotation is overdue.
+func (h *SigningSecretHealth) updateRotation(ctx context.Context) {
+	if h.rotateBy.IsZero() {
+		return
+	}
+	days := time.Until(h.rotateBy).Hours() / 24
+	signingSecretRotationDaysGauge.Set(days)
+	if days <= 0 {
+		log.FromContext(ctx).Error(signingSecretRotationError, "the JWT signing secret should be rotated", "rotateBy", h.rotateBy)
+	}
+}
+
+// estimateEntropyBits estimates the entropy of the secret from the frequencies of its bytes. This is only a rough
+// upper bound that catches the obviously weak secrets like repeated or dictionary-like strings.
+func estimateEntropyBits(secret []byte) float64 {
+	if len(secret) == 0 {
+		return 0
+	}
+	counts := map[byte]int{}
+	for _, b := range secret {
+		counts[b]++
+	}
+	perByte := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(len(secret))
+		perByte -= p * math.Log2(p)
+	}
+	return perByte * float64(len(secret))
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningSecretHealth(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		h := NewSigningSecretHealth(nil, time.Time{})
+		assert.ErrorIs(t, h.Check(), noSigningSecretError)
+		assert.NoError(t, h.Start(context.TODO()))
+		assert.Equal(t, 0.0, testutil.ToFloat64(signingSecretValidGauge))
+	})
+
+	t.Run("short", func(t *testing.T) {
+		h := NewSigningSecretHealth([]byte("yaddayadda123$@#**"), time.Time{})
+		assert.ErrorIs(t, h.Check(), shortSigningSecretError)
+	})
+
+	t.Run("weak", func(t *testing.T) {
+		h := NewSigningSecretHealth([]byte(strings.Repeat("ab", 32)), time.Time{})
+		assert.NoError(t, h.Check())
+		assert.ErrorIs(t, h.warning, weakSigningSecretError)
+		assert.NoError(t, h.Start(context.TODO()))
+		assert.Equal(t, 1.0, testutil.ToFloat64(signingSecretValidGauge))
+		assert.Equal(t, 64.0, testutil.ToFloat64(signingSecretEntropyGauge))
+	})
+
+	t.Run("strong", func(t *testing.T) {
+		h := NewSigningSecretHealth([]byte("9b1f0e8a4c7d2e6f3a5b8c0d1e2f4a6b"), time.Now().Add(36*time.Hour))
+		assert.NoError(t, h.Check())
+		assert.NoError(t, h.warning)
+		assert.NoError(t, h.Start(context.TODO()))
+		assert.InDelta(t, 1.5, testutil.ToFloat64(signingSecretRotationDaysGauge), 0.01)
+	})
+
+	t.Run("rotation overdue", func(t *testing.T) {
+		h := NewSigningSecretHealth([]byte("9b1f0e8a4c7d2e6f3a5b8c0d1e2f4a6b"), time.Now().Add(-48*time.Hour))
+		assert.NoError(t, h.Start(context.TODO()))
+		assert.InDelta(t, -2, testutil.ToFloat64(signingSecretRotationDaysGauge), 0.01)
+	})
+}
+
+func TestEstimateEntropyBits(t *testing.T) {
+	assert.Equal(t, 0.0, estimateEntropyBits(nil))
+	assert.Equal(t, 0.0, estimateEntropyBits([]byte("aaaaaaaa")))
+	assert.Equal(t, 8.0, estimateEntropyBits([]byte("abababab")))
+	assert.Greater(t, estimateEntropyBits([]byte("9b1f0e8a4c7d2e6f3a5b8c0d1e2f4a6b")), float64(MinSigningSecretEntropyBits))
+}
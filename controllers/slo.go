@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	_ "embed"
+	"net/http"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// sloRules are the Prometheus recording and alerting rules of the SLOs of the service. They are derived from
+// the metrics registered by RegisterMetrics.
+//
+//go:embed slo_rules.yaml
+var sloRules []byte
+
+// SloRulesHandler is a Handler implementation that responds with the Prometheus recording and alerting rules of the SLOs
+// of the service so that they don't have to be written by hand when setting up the monitoring.
+func SloRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(sloRules); err != nil {
+		log.FromContext(r.Context()).Error(err, "error writing the SLO rules to the response")
+	}
+}
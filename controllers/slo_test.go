@@ -0,0 +1,55 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/yaml"
+)
+
+func TestSloRulesHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	SloRulesHandler(rr, httptest.NewRequest("GET", "/slo-rules", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/yaml", rr.Header().Get("Content-Type"))
+
+	rules := struct {
+		Groups []struct {
+			Name  string
+			Rules []map[string]interface{}
+		}
+	}{}
+	assert.NoError(t, yaml.Unmarshal(rr.Body.Bytes(), &rules))
+	assert.Len(t, rules.Groups, 2)
+
+	// the rules need to refer to the metrics we actually expose
+	prefix := MetricsNamespace + "_" + MetricsSubsystem
+	for _, group := range rules.Groups {
+		assert.NotEmpty(t, group.Rules)
+		for _, rule := range group.Rules {
+			expr, ok := rule["expr"].(string)
+			assert.True(t, ok)
+			assert.True(t, strings.Contains(expr, prefix), "unexpected expression: %s", expr)
+		}
+	}
+	for _, name := range []string{"http_requests_total", "http_request_duration_seconds_bucket", "flow_phase_duration_seconds_bucket"} {
+		assert.Contains(t, rr.Body.String(), prefix+"_"+name)
+	}
+}
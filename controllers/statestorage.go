@@ -15,11 +15,13 @@ package controllers
 
 import (
 	"context"
-	"crypto/rand"
+	"encoding/json"
 	"errors"
-	"math/big"
+	"fmt"
 	"net/http"
+	"time"
 
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
@@ -28,31 +30,60 @@ import (
 
 type StateStorage struct {
 	sessionManager *scs.SessionManager
+	// sharedStore is the optional store shared by all the replicas of the service. It is consulted when the state is
+	// not found in the session, e.g. when the callback hits a different replica than the authentication.
+	sharedStore scs.Store
+	// veilEntropyBits is the number of random bits in the veils of the states.
+	veilEntropyBits int
 }
 
-var (
-	noStateError                = errors.New("request has no `state` parameter")
-	randomStringGenerationError = errors.New("not able to generate new random string")
-)
+// sharedState is the data kept for a veiled state in the shared store. Together with the state, it keeps the initiator
+// of the flow so that the flow can be finished on a replica that doesn't know the session. No credentials are kept
+// with it, because the veil travels in the authorization URL. The callback needs to be authenticated by the caller.
+type sharedState struct {
+	State     string `json:"state"`
+	Initiator string `json:"initiator,omitempty"`
+}
+
+// sharedStateCleanupLease is the name of the lease the instance removing the expired states from the shared store holds.
+const sharedStateCleanupLease = "shared-state-cleanup"
 
-const (
-	letterBytes = "abcdefghijklmnopqrstuvwxyz1234567890"
+var (
+	noStateError       = spierrors.WithKind(spierrors.InvalidRequest, errors.New("request has no `state` parameter"))
+	stateNotFoundError = spierrors.WithKind(spierrors.StateExpired, errors.New("no OAuth state found for the `state` parameter, the authorization session probably expired"))
 )
 
 func (s StateStorage) VeilRealState(req *http.Request) (string, error) {
-	log := log.FromContext(req.Context())
-	state := req.URL.Query().Get("state")
+	return s.VeilState(req.Context(), req.URL.Query().Get("state"))
+}
+
+// VeilState generates a new veil for the state and puts both to the session of the context, and to the shared store
+// if configured, so that the state can be found using the veil in the callback. The initiator of the flow in
+// the context, if any, is kept with the state.
+func (s StateStorage) VeilState(ctx context.Context, state string) (string, error) {
+	log := log.FromContext(ctx)
 	if state == "" {
 		log.Error(noStateError, "Request has no state parameter")
 		return "", noStateError
 	}
-	newState, err := randStringBytes(32)
+	newState, err := NewVeil(s.veilEntropyBits)
 	if err != nil {
 
 		return "", err
 	}
 	log.V(logs.DebugLevel).Info("State veiled", "state", state, "veil", newState)
-	s.sessionManager.Put(req.Context(), newState, state)
+	s.sessionManager.Put(ctx, newState, state)
+	s.sessionManager.Put(ctx, flowSessionKey(state), newState)
+	if initiator := initiatorFromContext(ctx); initiator != "" {
+		s.sessionManager.Put(ctx, initiatorSessionKey(newState), initiator)
+	}
+
+	if s.sharedStore != nil {
+		// the shared store is only a fallback, so the flow can continue without it
+		if err := s.storeShared(ctx, newState, state); err != nil {
+			log.Error(err, "failed to store the state to the shared store", "veil", newState)
+		}
+	}
 	return newState, nil
 }
 
@@ -63,26 +94,182 @@ func (s StateStorage) UnveilState(ctx context.Context, req *http.Request) (strin
 		log.Error(noStateError, "Request has no state parameter")
 		return "", noStateError
 	}
+	// the session also contains other data than the veiled states, which must not be reachable using the parameter
+	if !isVeil(state) {
+		log.V(logs.DebugLevel).Info("The state parameter is not a veil", "veil", state)
+		return "", stateNotFoundError
+	}
 	unveiledState := s.sessionManager.GetString(ctx, state)
+	if unveiledState == "" && s.sharedStore != nil {
+		unveiledState = s.findShared(ctx, state)
+	}
+	if unveiledState == "" {
+		log.V(logs.DebugLevel).Info("No state found for the veil", "veil", state)
+		return "", stateNotFoundError
+	}
 	log.V(logs.DebugLevel).Info("State unveiled", "veil", state, "unveiledState", unveiledState)
 	return unveiledState, nil
 }
 
-func randStringBytes(n int) (string, error) {
-	b := make([]byte, n)
-	for i := range b {
-		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letterBytes))))
-		if err != nil {
-			return "", randomStringGenerationError
+// CancelState removes the veil of the state from the session and from the shared store so that the pending OAuth flow
+// cannot be finished anymore. Returns stateNotFoundError if there's no pending flow with the state in the session.
+func (s StateStorage) CancelState(ctx context.Context, state string) error {
+	lg := log.FromContext(ctx)
 
+	veil := s.sessionManager.GetString(ctx, flowSessionKey(state))
+	if veil == "" {
+		return stateNotFoundError
+	}
+
+	s.remove(ctx, state, veil)
+	lg.V(logs.DebugLevel).Info("State cancelled", "state", state, "veil", veil)
+	return nil
+}
+
+// FinishState removes the veiled state from the session and from the shared store once the callback used it, so that
+// the finished flow cannot be replayed and its record doesn't stay in the shared store until it expires.
+func (s StateStorage) FinishState(ctx context.Context, veil string) {
+	if !isVeil(veil) {
+		return
+	}
+	state := s.sessionManager.GetString(ctx, veil)
+	s.remove(ctx, state, veil)
+	log.FromContext(ctx).V(logs.DebugLevel).Info("State finished", "veil", veil)
+}
+
+// remove removes the state with its veil from the session and from the shared store.
+func (s StateStorage) remove(ctx context.Context, state string, veil string) {
+	s.sessionManager.Remove(ctx, veil)
+	if state != "" && s.sessionManager.GetString(ctx, flowSessionKey(state)) == veil {
+		s.sessionManager.Remove(ctx, flowSessionKey(state))
+	}
+	s.sessionManager.Remove(ctx, initiatorSessionKey(veil))
+	if s.sharedStore != nil {
+		if err := s.sharedStore.Delete(veil); err != nil {
+			log.FromContext(ctx).Error(err, "failed to delete the state from the shared store", "veil", veil)
 		}
-		b[i] = letterBytes[n.Uint64()]
 	}
-	return string(b), nil
 }
 
-func NewStateStorage(sessionManager *scs.SessionManager) *StateStorage {
+// Initiator returns the initiator of the flow with the veiled state, or an empty string if the flow was started
+// without one. The veil must have been unveiled in the session of the context before.
+func (s StateStorage) Initiator(ctx context.Context, veil string) string {
+	return s.sessionManager.GetString(ctx, initiatorSessionKey(veil))
+}
+
+// FlowTimeout returns how long the veiled states are kept, i.e. how long the users have to finish the OAuth flow.
+func (s StateStorage) FlowTimeout() time.Duration {
+	if s.sessionManager.IdleTimeout != 0 {
+		return s.sessionManager.IdleTimeout
+	}
+	return s.sessionManager.Lifetime
+}
+
+// StartCleanup periodically removes the expired states from the shared store until the context is done. The shared
+// store only removes them when they are listed, and only the instance holding the lease does it. Does nothing without
+// the shared store or if it doesn't support listing.
+func (s StateStorage) StartCleanup(ctx context.Context, interval time.Duration, lease Lease) {
+	cleanupSharedStore(ctx, s.sharedStore, "states", interval, lease, sharedStateCleanupLease)
+}
+
+// cleanupSharedStore periodically lists the store, which removes the expired data from it, until the context is done.
+// Only the instance holding the lease with the name does it. Does nothing if the store doesn't support listing.
+func cleanupSharedStore(ctx context.Context, store scs.Store, data string, interval time.Duration, lease Lease, leaseName string) {
+	iterable, ok := store.(scs.IterableStore)
+	if !ok {
+		return
+	}
+	lg := log.FromContext(ctx).WithValues("data", data)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !holdsLease(ctx, lease, leaseName, 2*interval) {
+			continue
+		}
+		if all, err := iterable.All(); err != nil {
+			lg.Error(err, "failed to remove the expired data from the shared store")
+		} else {
+			lg.V(logs.DebugLevel).Info("expired data removed from the shared store", "remaining", len(all))
+		}
+	}
+}
+
+// flowSessionKey is the session key under which the veil of the state is kept so that the flow can be looked up using
+// the original state.
+func flowSessionKey(state string) string {
+	return "flow:" + state
+}
+
+// initiatorSessionKey is the session key under which the initiator of the flow with the veiled state is kept.
+func initiatorSessionKey(veil string) string {
+	return "initiator:" + veil
+}
+
+// storeShared puts the state and the initiator of the flow to the shared store under the veil. The record expires
+// together with the session.
+func (s StateStorage) storeShared(ctx context.Context, veil string, state string) error {
+	b, err := json.Marshal(sharedState{
+		State:     state,
+		Initiator: initiatorFromContext(ctx),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to serialize the shared state: %w", err)
+	}
+
+	if err = s.sharedStore.Commit(veil, b, time.Now().Add(s.FlowTimeout())); err != nil {
+		return fmt.Errorf("failed to store the state to the shared store: %w", err)
+	}
+	return nil
+}
+
+// findShared looks up the veiled state in the shared store. If found, the state and the initiator are put to the current
+// session so that the rest of the flow can use them as if the session was created by this replica. The caller still
+// needs to authenticate in this session. Returns an empty string if the state is not found or cannot be read.
+func (s StateStorage) findShared(ctx context.Context, veil string) string {
+	lg := log.FromContext(ctx)
+
+	b, found, err := s.sharedStore.Find(veil)
+	if err != nil {
+		lg.Error(err, "failed to look up the state in the shared store", "veil", veil)
+		crossPodLookupsCounter.WithLabelValues("error").Inc()
+		return ""
+	}
+	if !found {
+		crossPodLookupsCounter.WithLabelValues("not_found").Inc()
+		return ""
+	}
+
+	shared := sharedState{}
+	if err = json.Unmarshal(b, &shared); err != nil {
+		lg.Error(err, "failed to deserialize the state from the shared store", "veil", veil)
+		crossPodLookupsCounter.WithLabelValues("error").Inc()
+		return ""
+	}
+
+	lg.Info("OAuth state not found in the session but found in the shared store, the session was probably created by another replica", "veil", veil)
+	crossPodLookupsCounter.WithLabelValues("found").Inc()
+
+	s.sessionManager.Put(ctx, veil, shared.State)
+	if shared.Initiator != "" {
+		s.sessionManager.Put(ctx, initiatorSessionKey(veil), shared.Initiator)
+	}
+	return shared.State
+}
+
+// NewStateStorage creates a new state storage keeping the states in the sessions. The sharedStore is optional and
+// can be nil. If provided, the states are also kept in it and it is consulted when the state is not found in the
+// session. The veilEntropyBits is the number of random bits in the veils of the states, see NewVeil.
+func NewStateStorage(sessionManager *scs.SessionManager, sharedStore scs.Store, veilEntropyBits int) *StateStorage {
 	return &StateStorage{
-		sessionManager: sessionManager,
+		sessionManager:  sessionManager,
+		sharedStore:     sharedStore,
+		veilEntropyBits: veilEntropyBits,
 	}
 }
@@ -14,13 +14,20 @@
 package controllers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,14 +36,14 @@ func TestVeilSPIState(t *testing.T) {
 	req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&k8s_token=%s", "statestr", "token-234234"), nil)
 	res := httptest.NewRecorder()
 	sessionManager := scs.New()
-	storage := NewStateStorage(sessionManager)
+	storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
 
 	//when
 	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		newStateString, err := storage.VeilRealState(r)
 		assert.NoError(t, err)
 		assert.True(t, "statestr" != newStateString)
-		assert.Equal(t, 32, len(newStateString))
+		assert.Equal(t, 43, len(newStateString))
 		assert.Equal(t, "statestr", sessionManager.Get(r.Context(), newStateString))
 
 	})).ServeHTTP(res, req)
@@ -52,7 +59,7 @@ func Test_FailToVeilIfStateIsEmpty(t *testing.T) {
 	req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s&k8s_token=%s", "", "token-234234"), nil)
 	res := httptest.NewRecorder()
 	sessionManager := scs.New()
-	storage := StateStorage{sessionManager}
+	storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
 
 	//when
 	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -80,7 +87,7 @@ func Test_ShouldUnveilState(t *testing.T) {
 
 	req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", oAuthState), nil)
 	req.AddCookie(res.Result().Cookies()[0])
-	storage := NewStateStorage(sessionManager)
+	storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
 
 	//when
 	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -102,7 +109,7 @@ func Test_FailToUnveilStateIfStateIsEmpty(t *testing.T) {
 	req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", ""), nil)
 	res := httptest.NewRecorder()
 	sessionManager := scs.New()
-	storage := StateStorage{sessionManager}
+	storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
 
 	//when
 	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -116,3 +123,237 @@ func Test_FailToUnveilStateIfStateIsEmpty(t *testing.T) {
 	assert.Equal(t, 0, len(res.Result().Cookies()))
 
 }
+
+func Test_FailToUnveilUnknownState(t *testing.T) {
+	//given
+	req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", "unknown-veil"), nil)
+	res := httptest.NewRecorder()
+	sessionManager := scs.New()
+	storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
+
+	//when
+	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unveiledState, err := storage.UnveilState(r.Context(), r)
+		assert.True(t, errors.Is(err, stateNotFoundError))
+		assert.Empty(t, unveiledState)
+	})).ServeHTTP(res, req)
+}
+
+func Test_UnveilStateFromSharedStore(t *testing.T) {
+	//given
+	sharedStore := memstore.New()
+	authenticatingPod := scs.New()
+	var veil string
+	authenticatingPod.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticatingPod.Put(r.Context(), auth.K8sTokenSessionKey, "token-234234")
+		var err error
+		veil, err = NewStateStorage(authenticatingPod, sharedStore, DefaultVeilEntropyBits).VeilRealState(r)
+		assert.NoError(t, err)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?state=statestr", nil))
+
+	callbackPod := scs.New()
+	storage := NewStateStorage(callbackPod, sharedStore, DefaultVeilEntropyBits)
+	foundBefore := testutil.ToFloat64(crossPodLookupsCounter.WithLabelValues("found"))
+
+	//when
+	callbackPod.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unveiledState, err := storage.UnveilState(r.Context(), r)
+
+		//then
+		assert.NoError(t, err)
+		assert.Equal(t, "statestr", unveiledState)
+		assert.Equal(t, "statestr", callbackPod.GetString(r.Context(), veil))
+		// the veil travels in the authorization URL, so it must not be enough to act as the user
+		assert.Empty(t, callbackPod.GetString(r.Context(), auth.K8sTokenSessionKey))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", veil), nil))
+
+	assert.Equal(t, foundBefore+1, testutil.ToFloat64(crossPodLookupsCounter.WithLabelValues("found")))
+}
+
+func Test_UnveilStateInSharedSession(t *testing.T) {
+	//given
+	sharedStore := memstore.NewWithCleanupInterval(0)
+	sharedSessions := memstore.NewWithCleanupInterval(0)
+	authenticatingPod := scs.New()
+	authenticatingPod.Store = &SharedSessionStore{Local: memstore.NewWithCleanupInterval(0), Shared: sharedSessions}
+	var veil string
+	authenticated := httptest.NewRecorder()
+	authenticatingPod.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticatingPod.Put(r.Context(), auth.K8sTokenSessionKey, "token-234234")
+		var err error
+		veil, err = NewStateStorage(authenticatingPod, sharedStore, DefaultVeilEntropyBits).VeilRealState(r)
+		assert.NoError(t, err)
+	})).ServeHTTP(authenticated, httptest.NewRequest("GET", "/?state=statestr", nil))
+
+	callbackPod := scs.New()
+	callbackPod.Store = &SharedSessionStore{Local: memstore.NewWithCleanupInterval(0), Shared: sharedSessions}
+	storage := NewStateStorage(callbackPod, sharedStore, DefaultVeilEntropyBits)
+	req := httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", veil), nil)
+	for _, c := range authenticated.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	//when
+	callbackPod.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unveiledState, err := storage.UnveilState(r.Context(), r)
+
+		//then
+		assert.NoError(t, err)
+		assert.Equal(t, "statestr", unveiledState)
+		// the session of the user is shared, so the callback is authenticated by it on any replica
+		assert.Equal(t, "token-234234", callbackPod.GetString(r.Context(), auth.K8sTokenSessionKey))
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func Test_KeepInitiatorOfVeiledState(t *testing.T) {
+	//given
+	sharedStore := memstore.New()
+	authenticatingPod := scs.New()
+	var veil string
+	authenticatingPod.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		veil, err = NewStateStorage(authenticatingPod, sharedStore, DefaultVeilEntropyBits).VeilState(withInitiator(r.Context(), "appstudio-ui"), "statestr")
+		assert.NoError(t, err)
+		assert.Equal(t, "appstudio-ui", NewStateStorage(authenticatingPod, sharedStore, DefaultVeilEntropyBits).Initiator(r.Context(), veil))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	callbackPod := scs.New()
+	storage := NewStateStorage(callbackPod, sharedStore, DefaultVeilEntropyBits)
+
+	//when
+	callbackPod.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := storage.UnveilState(r.Context(), r)
+
+		//then
+		assert.NoError(t, err)
+		assert.Equal(t, "appstudio-ui", storage.Initiator(r.Context(), veil))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/?state=%s", veil), nil))
+}
+
+func Test_FailToUnveilStateMissingInSharedStore(t *testing.T) {
+	//given
+	sessionManager := scs.New()
+	storage := NewStateStorage(sessionManager, memstore.New(), DefaultVeilEntropyBits)
+	notFoundBefore := testutil.ToFloat64(crossPodLookupsCounter.WithLabelValues("not_found"))
+
+	//when
+	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unveiledState, err := storage.UnveilState(r.Context(), r)
+
+		//then
+		assert.True(t, errors.Is(err, stateNotFoundError))
+		assert.Empty(t, unveiledState)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?state=unknown-veil-of-the-flow", nil))
+
+	assert.Equal(t, notFoundBefore+1, testutil.ToFloat64(crossPodLookupsCounter.WithLabelValues("not_found")))
+}
+
+func Test_CancelState(t *testing.T) {
+	//given
+	sharedStore := memstore.New()
+	sessionManager := scs.New()
+	storage := NewStateStorage(sessionManager, sharedStore, DefaultVeilEntropyBits)
+
+	//when
+	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		veil, err := storage.VeilRealState(r)
+		assert.NoError(t, err)
+
+		assert.NoError(t, storage.CancelState(r.Context(), "statestr"))
+
+		//then
+		assert.Empty(t, sessionManager.GetString(r.Context(), veil))
+		_, found, err := sharedStore.Find(veil)
+		assert.NoError(t, err)
+		assert.False(t, found)
+		assert.True(t, errors.Is(storage.CancelState(r.Context(), "statestr"), stateNotFoundError))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?state=statestr", nil))
+}
+
+func Test_FinishState(t *testing.T) {
+	//given
+	sharedStore := memstore.New()
+	sessionManager := scs.New()
+	storage := NewStateStorage(sessionManager, sharedStore, DefaultVeilEntropyBits)
+
+	//when
+	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		veil, err := storage.VeilState(withInitiator(r.Context(), "appstudio-ui"), "statestr")
+		assert.NoError(t, err)
+
+		storage.FinishState(r.Context(), veil)
+
+		//then
+		assert.Empty(t, sessionManager.GetString(r.Context(), veil))
+		assert.Empty(t, sessionManager.GetString(r.Context(), flowSessionKey("statestr")))
+		assert.Empty(t, storage.Initiator(r.Context(), veil))
+		_, found, err := sharedStore.Find(veil)
+		assert.NoError(t, err)
+		assert.False(t, found)
+		req := httptest.NewRequest("GET", "/?state="+veil, nil)
+		_, err = storage.UnveilState(r.Context(), req)
+		assert.True(t, errors.Is(err, stateNotFoundError))
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func Test_ShouldNotUnveilOtherSessionData(t *testing.T) {
+	//given
+	sessionManager := scs.New()
+	storage := NewStateStorage(sessionManager, nil, DefaultVeilEntropyBits)
+
+	//when
+	sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := storage.VeilRealState(r)
+		assert.NoError(t, err)
+		sessionManager.Put(r.Context(), auth.K8sTokenSessionKey, "token-234234")
+
+		//then
+		for _, key := range []string{flowSessionKey("statestr"), auth.K8sTokenSessionKey} {
+			req := httptest.NewRequest("GET", "/?state="+url.QueryEscape(key), nil)
+			unveiledState, err := storage.UnveilState(r.Context(), req)
+			assert.True(t, errors.Is(err, stateNotFoundError), "key: %s", key)
+			assert.Empty(t, unveiledState)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?state=statestr", nil))
+}
+
+func Test_StateCleanupRemovesExpiredStates(t *testing.T) {
+	//given
+	sharedStore := memstore.NewWithCleanupInterval(0)
+	storage := NewStateStorage(scs.New(), &countingIterableStore{MemStore: sharedStore}, DefaultVeilEntropyBits)
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	//when
+	done := make(chan struct{})
+	go func() {
+		storage.StartCleanup(ctx, time.Millisecond, nil)
+		close(done)
+	}()
+
+	//then
+	assert.Eventually(t, func() bool {
+		return storage.sharedStore.(*countingIterableStore).listed() > 0
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
+
+// countingIterableStore counts how many times the data of the store was listed.
+type countingIterableStore struct {
+	*memstore.MemStore
+	lock  sync.Mutex
+	count int
+}
+
+func (s *countingIterableStore) All() (map[string][]byte, error) {
+	s.lock.Lock()
+	s.count++
+	s.lock.Unlock()
+	return s.MemStore.All()
+}
+
+func (s *countingIterableStore) listed() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.count
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// SyntheticExpiryAnnotation is the annotation of the SPIAccessToken carrying the expiry computed by the service for
+// the token that the service provider didn't report the expiry of. The value is in the RFC 3339 format.
+const SyntheticExpiryAnnotation = "spi.appstudio.redhat.com/synthetic-expiry"
+
+// tokenMaxAgeExtraKey is the key in the extra configuration of the service provider specifying the maximum age of
+// the tokens of the service provider that don't expire on their own, e.g. "720h". It overrides the global
+// `--token-max-age`. Zero disables the synthetic expiry for the service provider.
+const tokenMaxAgeExtraKey = "tokenMaxAge"
+
+var invalidTokenMaxAgeError = errors.New("invalid token max age")
+
+// otherServiceProviders is the value of the `sp` label of the metrics for the service provider URLs that don't belong
+// to any configured service provider.
+const otherServiceProviders = "other"
+
+// SyntheticExpiryPolicy determines the maximum age of the tokens that don't expire on their own.
+type SyntheticExpiryPolicy struct {
+	// DefaultMaxAge applies to the service providers without their own max age. Zero disables the synthetic expiry.
+	DefaultMaxAge time.Duration
+	// maxAges are the max ages of the configured service providers.
+	maxAges []serviceProviderMaxAge
+}
+
+// serviceProviderMaxAge is the max age of the service provider with the base URL. The max age is nil if the service
+// provider has none configured and uses the default one.
+type serviceProviderMaxAge struct {
+	baseUrl             string
+	serviceProviderType config.ServiceProviderType
+	maxAge              *time.Duration
+}
+
+// SyntheticExpiryPolicyFromConfiguration reads the max ages configured for the service providers in their extra
+// configuration.
+func SyntheticExpiryPolicyFromConfiguration(defaultMaxAge time.Duration, sps []config.ServiceProviderConfiguration) (SyntheticExpiryPolicy, error) {
+	policy := SyntheticExpiryPolicy{DefaultMaxAge: defaultMaxAge}
+	for _, sp := range sps {
+		value := sp.Extra[tokenMaxAgeExtraKey]
+		baseUrl, err := serviceProviderBaseUrl(sp)
+		if err != nil {
+			if value == "" {
+				// the service provider only needs to be recognized to have its own max age
+				continue
+			}
+			return policy, err
+		}
+		spMaxAge := serviceProviderMaxAge{baseUrl: baseUrl, serviceProviderType: sp.ServiceProviderType}
+		if value != "" {
+			maxAge, err := time.ParseDuration(value)
+			if err != nil || maxAge < 0 {
+				return policy, fmt.Errorf("%w '%s' configured for service provider %s", invalidTokenMaxAgeError, value, sp.ServiceProviderType)
+			}
+			spMaxAge.maxAge = &maxAge
+		}
+		policy.maxAges = append(policy.maxAges, spMaxAge)
+	}
+	return policy, nil
+}
+
+// maxAge returns the max age of the tokens of the service provider with the longest base URL matching the service
+// provider URL, or the default one if there's none or it has no max age of its own. The type of the matched service
+// provider is returned too so that it can be used in the metrics instead of the URL, which is given by the users.
+func (p SyntheticExpiryPolicy) maxAge(serviceProviderUrl string) (time.Duration, string) {
+	i := longestBaseUrlMatch(serviceProviderUrl, len(p.maxAges), func(i int) string { return p.maxAges[i].baseUrl })
+	if i < 0 {
+		return p.DefaultMaxAge, otherServiceProviders
+	}
+	sp := p.maxAges[i]
+	if sp.maxAge == nil {
+		return p.DefaultMaxAge, string(sp.serviceProviderType)
+	}
+	return *sp.maxAge, string(sp.serviceProviderType)
+}
+
+// SyntheticExpiryTokenStorage is a wrapper around TokenStorage that gives the tokens without the expiry reported by
+// the service provider, typically the personal access tokens, the expiry according to the policy when they are stored.
+// This way, the "non-expiring" tokens are rotated on schedule by the same means as the expiring ones. The synthetic
+// expiry is also put on the SPIAccessToken as the SyntheticExpiryAnnotation.
+type SyntheticExpiryTokenStorage struct {
+	// TokenStorage is the token storage to delegate the actual storage operations to.
+	TokenStorage tokenstorage.TokenStorage
+	// K8sClient is used to annotate the SPIAccessTokens. It must authenticate as the service, because the tokens are
+	// also stored without any identity in the context, e.g. by the watchers, or on behalf of another identity.
+	K8sClient client.Client
+	// Policy determines the max age of the tokens.
+	Policy SyntheticExpiryPolicy
+}
+
+var _ tokenstorage.TokenStorage = (*SyntheticExpiryTokenStorage)(nil)
+
+func (s *SyntheticExpiryTokenStorage) Store(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	maxAge, sp := s.Policy.maxAge(owner.Spec.ServiceProviderUrl)
+	if token.Expiry != 0 || maxAge <= 0 {
+		if err := s.TokenStorage.Store(ctx, owner, token); err != nil {
+			return fmt.Errorf("wrapped storage error: %w", err)
+		}
+		return nil
+	}
+
+	expiry := time.Now().Add(maxAge).Truncate(time.Second)
+	withExpiry := *token
+	withExpiry.Expiry = uint64(expiry.Unix())
+	if err := s.TokenStorage.Store(ctx, owner, &withExpiry); err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+
+	syntheticExpiriesCounter.WithLabelValues(sp).Inc()
+
+	// the token data carry the expiry already, the annotation only makes it visible, so it's not worth failing for
+	annotated := owner.DeepCopy()
+	if annotated.Annotations == nil {
+		annotated.Annotations = map[string]string{}
+	}
+	annotated.Annotations[SyntheticExpiryAnnotation] = expiry.UTC().Format(time.RFC3339)
+	if err := s.K8sClient.Patch(ctx, annotated, client.MergeFrom(owner)); err != nil {
+		log.FromContext(ctx).Error(err, "failed to annotate the SPIAccessToken with the synthetic expiry", "namespace", owner.Namespace, "name", owner.Name)
+	}
+	return nil
+}
+
+func (s *SyntheticExpiryTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	token, err := s.TokenStorage.Get(ctx, owner)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return token, nil
+}
+
+func (s *SyntheticExpiryTokenStorage) Delete(ctx context.Context, owner *api.SPIAccessToken) error {
+	if err := s.TokenStorage.Delete(ctx, owner); err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return nil
+}
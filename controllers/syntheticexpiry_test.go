@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSyntheticExpiryPolicyFromConfiguration(t *testing.T) {
+	policy, err := SyntheticExpiryPolicyFromConfiguration(time.Hour, []config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub, Extra: map[string]string{tokenMaxAgeExtraKey: "720h"}},
+		{ServiceProviderType: config.ServiceProviderTypeQuay, Extra: map[string]string{tokenMaxAgeExtraKey: "0"}},
+		{ServiceProviderType: config.ServiceProviderTypeGitHub, ServiceProviderBaseUrl: "https://github.example.com/"},
+	})
+	assert.NoError(t, err)
+	maxAge := func(serviceProviderUrl string) time.Duration {
+		maxAge, _ := policy.maxAge(serviceProviderUrl)
+		return maxAge
+	}
+	assert.Equal(t, 720*time.Hour, maxAge("https://github.com/org/repo"))
+	assert.Equal(t, time.Duration(0), maxAge("https://quay.io"))
+	assert.Equal(t, time.Hour, maxAge("https://github.example.com"))
+	assert.Equal(t, time.Hour, maxAge("https://github.company.com"))
+
+	_, sp := policy.maxAge("https://github.example.com/org/repo")
+	assert.Equal(t, string(config.ServiceProviderTypeGitHub), sp)
+	_, sp = policy.maxAge("https://attacker.example.com/random")
+	assert.Equal(t, otherServiceProviders, sp)
+
+	_, err = SyntheticExpiryPolicyFromConfiguration(0, []config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub, Extra: map[string]string{tokenMaxAgeExtraKey: "a month"}},
+	})
+	assert.True(t, errors.Is(err, invalidTokenMaxAgeError))
+}
+
+func TestSyntheticExpiryTokenStorage(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	policy, err := SyntheticExpiryPolicyFromConfiguration(time.Hour, []config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	})
+	assert.NoError(t, err)
+
+	owner := func() *api.SPIAccessToken {
+		return &api.SPIAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Name: "token", Namespace: "default"},
+			Spec:       api.SPIAccessTokenSpec{ServiceProviderUrl: "https://github.com"},
+		}
+	}
+	setup := func() (*SyntheticExpiryTokenStorage, client.Client, **api.Token) {
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(owner()).Build()
+		stored := new(*api.Token)
+		return &SyntheticExpiryTokenStorage{
+			TokenStorage: tokenstorage.TestTokenStorage{
+				StoreImpl: func(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+					*stored = data
+					return nil
+				},
+			},
+			K8sClient: cl,
+			Policy:    policy,
+		}, cl, stored
+	}
+
+	t.Run("without expiry", func(t *testing.T) {
+		storage, cl, stored := setup()
+		before := testutil.ToFloat64(syntheticExpiriesCounter.WithLabelValues(string(config.ServiceProviderTypeGitHub)))
+		token := &api.Token{AccessToken: "pat"}
+
+		assert.NoError(t, storage.Store(context.TODO(), owner(), token))
+
+		assert.Zero(t, token.Expiry)
+		expiry := time.Unix(int64((*stored).Expiry), 0)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expiry, time.Minute)
+		assert.Equal(t, before+1, testutil.ToFloat64(syntheticExpiriesCounter.WithLabelValues(string(config.ServiceProviderTypeGitHub))))
+
+		annotated := &api.SPIAccessToken{}
+		assert.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Name: "token", Namespace: "default"}, annotated))
+		assert.Equal(t, expiry.UTC().Format(time.RFC3339), annotated.Annotations[SyntheticExpiryAnnotation])
+	})
+
+	t.Run("with expiry", func(t *testing.T) {
+		storage, cl, stored := setup()
+		token := &api.Token{AccessToken: "oauth", Expiry: 42}
+
+		assert.NoError(t, storage.Store(context.TODO(), owner(), token))
+
+		assert.Equal(t, token, *stored)
+		annotated := &api.SPIAccessToken{}
+		assert.NoError(t, cl.Get(context.TODO(), client.ObjectKey{Name: "token", Namespace: "default"}, annotated))
+		assert.NotContains(t, annotated.Annotations, SyntheticExpiryAnnotation)
+	})
+
+	t.Run("annotation failure doesn't fail the store", func(t *testing.T) {
+		storage, _, stored := setup()
+		storage.K8sClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		assert.NoError(t, storage.Store(context.TODO(), owner(), &api.Token{AccessToken: "pat"}))
+		assert.NotZero(t, (*stored).Expiry)
+	})
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"sync"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	redirectNoticeTemplateName  = "redirect_notice"
+	callbackErrorTemplateName   = "callback_error"
+	callbackSuccessTemplateName = "callback_success"
+	landingTemplateName         = "landing"
+)
+
+var (
+	noTemplateError = errors.New("no template available")
+
+	// fallbackTemplate is the minimal page rendered when the template of a page cannot be used. It is built into
+	// the binary so that it is always available.
+	fallbackTemplate = template.Must(template.New("fallback").Funcs(pageTemplateFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8"/>
+    {{- if .Url }}
+    <meta http-equiv="refresh" content="2; url={{ .Url}}"/>
+    {{- end }}
+    <title>{{ .Title}}{{ with (theme).ProductName }} - {{ . }}{{ end }}</title>
+    <style>{{ (theme).Css }}a{color:var(--spi-primary-color,#428bca)}</style>
+</head>
+<body>
+<h1>{{ .Title}}</h1>
+<p>{{ .Message}}</p>
+{{- if .Url }}
+<p><a href="{{ .Url}}">Continue</a></p>
+{{- end }}
+</body>
+</html>
+`))
+
+	// successPageTemplate and errorPageTemplate are the templates of the pages rendered at the end of the OAuth flow.
+	// Resource file locations are prefixed with `../` to be compatible with tests running locally.
+	successPageTemplate = &fileTemplate{path: "../static/callback_success.html"}
+	errorPageTemplate   = &fileTemplate{path: "../static/callback_error.html"}
+
+	// renderBuffers pools the buffers the pages are rendered into, so that each request doesn't need to grow a new one.
+	renderBuffers = sync.Pool{
+		New: func() interface{} {
+			return &bytes.Buffer{}
+		},
+	}
+)
+
+// fileTemplate is an HTML template loaded from a file. The file is parsed only once, on the first use, and the parsed
+// template is shared by all the requests afterwards.
+type fileTemplate struct {
+	path string
+	once sync.Once
+	tmpl *template.Template
+	err  error
+}
+
+// get returns the parsed template or nil if the file could not be parsed. The parse failure is logged on each call
+// so that it is not lost in the logs of the first request.
+func (t *fileTemplate) get(ctx context.Context) *template.Template {
+	t.once.Do(func() {
+		t.tmpl, t.err = ParsePageTemplate(t.path)
+	})
+	if t.err != nil {
+		log.FromContext(ctx).Error(t.err, "failed to parse the page template", "path", t.path)
+		return nil
+	}
+	return t.tmpl
+}
+
+// fallbackViewData structure is used to pass parameters during the fallback page processing.
+type fallbackViewData struct {
+	Title   string
+	Message string
+	Url     string
+}
+
+// renderTemplate executes the template with the provided data and writes the result to the response with the given
+// status. The template is rendered into a buffer first so that a failure doesn't leave a half-written page behind.
+// If the template is not available or fails to execute, the failure is counted in the metrics and the minimal fallback
+// page is rendered using the provided fallback data instead.
+func renderTemplate(ctx context.Context, w http.ResponseWriter, status int, tmpl *template.Template, templateName string, data interface{}, fallback fallbackViewData) {
+	lg := log.FromContext(ctx)
+
+	buf := renderBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer renderBuffers.Put(buf)
+
+	err := noTemplateError
+	if tmpl != nil {
+		err = tmpl.Execute(buf, data)
+	}
+
+	if err != nil {
+		lg.Error(err, "failed to process template, using the fallback page", "template", templateName)
+		templateFailuresCounter.WithLabelValues(templateName).Inc()
+
+		buf.Reset()
+		if err = fallbackTemplate.Execute(buf, fallback); err != nil {
+			logging.LogErrorAndWriteResponse(ctx, w, http.StatusInternalServerError, "failed to process the fallback template", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err = buf.WriteTo(w); err != nil {
+		lg.Error(err, "error writing the page to the response", "template", templateName)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	t.Run("renders template", func(t *testing.T) {
+		tmpl := template.Must(template.New("test").Parse("<p>{{ .}}</p>"))
+		rr := httptest.NewRecorder()
+
+		renderTemplate(context.TODO(), rr, http.StatusOK, tmpl, "test_ok", "hello", fallbackViewData{Title: "fallback"})
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "<p>hello</p>", rr.Body.String())
+		assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+		assert.Equal(t, float64(0), testutil.ToFloat64(templateFailuresCounter.WithLabelValues("test_ok")))
+	})
+
+	t.Run("falls back on execution failure", func(t *testing.T) {
+		tmpl := template.Must(template.New("test").Parse("<p>{{ .Missing}}</p>"))
+		rr := httptest.NewRecorder()
+
+		renderTemplate(context.TODO(), rr, http.StatusOK, tmpl, "test_exec", "hello", fallbackViewData{Title: "Fallback title", Url: "https://sp/login"})
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, strings.HasPrefix(rr.Body.String(), "<!DOCTYPE html>"))
+		assert.Contains(t, rr.Body.String(), "<h1>Fallback title</h1>")
+		assert.Contains(t, rr.Body.String(), `<a href="https://sp/login">Continue</a>`)
+		assert.Equal(t, float64(1), testutil.ToFloat64(templateFailuresCounter.WithLabelValues("test_exec")))
+	})
+
+	t.Run("falls back on missing template", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+
+		renderTemplate(context.TODO(), rr, http.StatusUnauthorized, nil, "test_missing", nil, fallbackViewData{Title: "Fallback title", Message: "<script>"})
+
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+		assert.Contains(t, rr.Body.String(), "<p>&lt;script&gt;</p>")
+		assert.Equal(t, float64(1), testutil.ToFloat64(templateFailuresCounter.WithLabelValues("test_missing")))
+	})
+}
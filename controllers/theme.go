@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	invalidThemeColorError   = errors.New("invalid theme color")
+	invalidThemeLogoUrlError = errors.New("invalid theme logo URL")
+
+	// themeColorRegexp matches the hexadecimal CSS colors. Only those are allowed so that the colors can be put into
+	// the pages as CSS without escaping.
+	themeColorRegexp = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+	// pageTheme is the Theme of the rendered pages.
+	pageTheme atomic.Value
+
+	// pageTemplateFuncs are the functions available to all the page templates.
+	pageTemplateFuncs = template.FuncMap{
+		"theme": CurrentPageTheme,
+	}
+)
+
+// Theme is the deployment-level branding of the pages rendered by the service. It allows the downstream distributions
+// to rebrand the pages without maintaining their own templates. The empty fields keep the default look.
+type Theme struct {
+	// ProductName is shown in the titles of the pages and as the alternative text of the logo.
+	ProductName string
+	// LogoUrl is the URL of the logo image shown in the header of the pages instead of the default one.
+	LogoUrl string
+	// PrimaryColor is the hexadecimal CSS color of the links and headings.
+	PrimaryColor string
+	// SecondaryColor is the hexadecimal CSS color of the header background. It replaces the default header image.
+	SecondaryColor string
+}
+
+// NewTheme validates the theme configuration and returns the theme.
+func NewTheme(productName, logoUrl, primaryColor, secondaryColor string) (Theme, error) {
+	for _, color := range []string{primaryColor, secondaryColor} {
+		if color != "" && !themeColorRegexp.MatchString(color) {
+			return Theme{}, fmt.Errorf("%w '%s', it must be a hexadecimal color like #0066cc", invalidThemeColorError, color)
+		}
+	}
+	if logoUrl != "" {
+		if u, err := url.Parse(logoUrl); err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return Theme{}, fmt.Errorf("%w '%s'", invalidThemeLogoUrlError, logoUrl)
+		}
+	}
+	return Theme{
+		ProductName:    strings.TrimSpace(productName),
+		LogoUrl:        logoUrl,
+		PrimaryColor:   primaryColor,
+		SecondaryColor: secondaryColor,
+	}, nil
+}
+
+// Css returns the CSS variables of the theme. The pages use the variables with their default look as the fallback.
+// The colors that are not hexadecimal are left out, because the theme does not have to come from NewTheme.
+func (t Theme) Css() template.CSS {
+	css := strings.Builder{}
+	css.WriteString(":root{")
+	if themeColorRegexp.MatchString(t.PrimaryColor) {
+		css.WriteString("--spi-primary-color:" + t.PrimaryColor + ";")
+	}
+	if themeColorRegexp.MatchString(t.SecondaryColor) {
+		css.WriteString("--spi-secondary-color:" + t.SecondaryColor + ";--spi-masthead-image:none;")
+	}
+	css.WriteString("}")
+	return template.CSS(css.String()) //nolint:gosec // the colors are checked to be hexadecimal above
+}
+
+// SetPageTheme sets the theme of all the rendered pages. It is meant to be called once at the startup of the service.
+func SetPageTheme(theme Theme) {
+	pageTheme.Store(theme)
+}
+
+// CurrentPageTheme returns the theme of the rendered pages. It is available in the page templates as the `theme`
+// function, e.g. `{{ (theme).ProductName }}`.
+func CurrentPageTheme() Theme {
+	theme, _ := pageTheme.Load().(Theme)
+	return theme
+}
+
+// ParsePageTemplate parses the template of a page from the file. The page templates can use the `theme` function to
+// access the theme of the pages.
+func ParsePageTemplate(path string) (*template.Template, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(pageTemplateFuncs).ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the page template %s: %w", path, err)
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTheme(t *testing.T) {
+	theme, err := NewTheme(" RHTAP ", "https://example.com/logo.svg", "#0066cc", "#fff")
+	assert.NoError(t, err)
+	assert.Equal(t, "RHTAP", theme.ProductName)
+	assert.Equal(t, ":root{--spi-primary-color:#0066cc;--spi-secondary-color:#fff;--spi-masthead-image:none;}", string(theme.Css()))
+
+	theme, err = NewTheme("", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, ":root{}", string(theme.Css()))
+
+	for _, color := range []string{"red", "#12345", "#fff;}body{display:none"} {
+		_, err = NewTheme("", "", color, "")
+		assert.True(t, errors.Is(err, invalidThemeColorError), color)
+	}
+	for _, logoUrl := range []string{"javascript:alert(1)", "/logo.svg"} {
+		_, err = NewTheme("", logoUrl, "", "")
+		assert.True(t, errors.Is(err, invalidThemeLogoUrlError), logoUrl)
+	}
+
+	theme = Theme{PrimaryColor: "#fff;}body{display:none", SecondaryColor: "#fff"}
+	assert.Equal(t, ":root{--spi-secondary-color:#fff;--spi-masthead-image:none;}", string(theme.Css()))
+}
+
+func TestPageTheme(t *testing.T) {
+	defer SetPageTheme(Theme{})
+
+	render := func(path string, data interface{}) string {
+		tmpl, err := ParsePageTemplate(path)
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		renderTemplate(context.TODO(), rr, http.StatusOK, tmpl, "test_theme", data, fallbackViewData{})
+		return rr.Body.String()
+	}
+
+	page := render("../static/callback_success.html", nil)
+	assert.Contains(t, page, "<title>Login successful</title>")
+	assert.Contains(t, page, `<a href="https://www.redhat.com" class="logo">`)
+
+	theme, err := NewTheme("RHTAP", "https://example.com/logo.svg", "#0066cc", "")
+	assert.NoError(t, err)
+	SetPageTheme(theme)
+
+	for _, path := range []string{"../static/callback_success.html", "../static/callback_error.html", "../static/redirect_notice.html", "../static/flow_history.html"} {
+		page = render(path, nil)
+		assert.Contains(t, page, " - RHTAP</title>", path)
+		assert.Contains(t, page, `<img class="rh-logo" src="https://example.com/logo.svg" alt="RHTAP"/>`, path)
+		assert.Contains(t, page, "--spi-primary-color:#0066cc;", path)
+		assert.NotContains(t, page, `<a href="https://www.redhat.com" class="logo">`, path)
+	}
+
+	rr := httptest.NewRecorder()
+	renderTemplate(context.TODO(), rr, http.StatusOK, fallbackTemplate, "test_theme", fallbackViewData{Title: "Landing"}, fallbackViewData{})
+	assert.Contains(t, rr.Body.String(), "<title>Landing - RHTAP</title>")
+}
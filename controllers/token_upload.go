@@ -15,13 +15,27 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
 	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	authn "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+var (
+	unauthenticatedIdentityError = spierrors.WithKind(spierrors.NotAuthenticated, errors.New("the token was not authenticated by the cluster"))
+	noServiceTokenError          = errors.New("the configuration of the service has no bearer token to review")
+)
+
 // TokenUploader is used to permanently persist credentials for the given token.
 type TokenUploader interface {
 	Upload(ctx context.Context, tokenObjectName string, tokenObjectNamespace string, data *api.Token) error
@@ -29,7 +43,8 @@ type TokenUploader interface {
 
 // UploadFunc used to provide anonymous implementation of TokenUploader.
 // Example:
-//  uploader := UploadFunc(func(ctx context.Context, tokenObjectName string, tokenObjectNamespace string, data *api.Token) error {
+//
+//	uploader := UploadFunc(func(ctx context.Context, tokenObjectName string, tokenObjectNamespace string, data *api.Token) error {
 //		return fmt.Errorf("failed to store the token data into storage")
 //	})
 type UploadFunc func(ctx context.Context, tokenObjectName string, tokenObjectNamespace string, data *api.Token) error
@@ -41,21 +56,116 @@ func (u UploadFunc) Upload(ctx context.Context, tokenObjectName string, tokenObj
 // This variable is a guard to ensure that UploadFunc actually satisfies the TokenUploader interface
 var _ TokenUploader = (UploadFunc)(nil)
 
+// UploadOnBehalfVerb is the verb on the spiaccesstokendataupdates resource that allows an identity, typically
+// the service account of an automation, to upload the token data into a namespace in which it cannot create
+// the SPIAccessTokenDataUpdates itself. The upload is then performed with the credentials of the service.
+const UploadOnBehalfVerb = "impersonate"
+
 type SpiTokenUploader struct {
 	K8sClient client.Client
 	Storage   tokenstorage.TokenStorage
+	// OnBehalf is used for the uploads of the identities granted the UploadOnBehalfVerb. The uploads on behalf of
+	// other identities are not supported if nil.
+	OnBehalf *UploadOnBehalf
+}
+
+// UploadOnBehalf are the client and the storage with the credentials of the service used to upload the token data on
+// behalf of the identities granted the UploadOnBehalfVerb. The client also reviews the tokens of the uploading
+// identities, so the service needs to be able to create the TokenReviews.
+type UploadOnBehalf struct {
+	K8sClient client.Client
+	Storage   tokenstorage.TokenStorage
+	// Identity is the username of the service the uploads are performed as, see ServiceIdentity. It is recorded as
+	// performedAs in the audit events.
+	Identity string
 }
 
 func (u *SpiTokenUploader) Upload(ctx context.Context, tokenObjectName string, tokenObjectNamespace string, data *api.Token) error {
-	AuditLogWithTokenInfo(ctx, "manual token upload initiated", tokenObjectNamespace, tokenObjectName)
+	cl, storage := u.K8sClient, u.Storage
+	var auditFields []interface{}
+	onBehalf, err := u.uploadsOnBehalf(ctx, tokenObjectNamespace)
+	if err != nil {
+		return err
+	}
+	var actingIdentity string
+	if onBehalf {
+		cl, storage = u.OnBehalf.K8sClient, u.OnBehalf.Storage
+		if actingIdentity, err = reviewIdentity(ctx, cl, auth.BearerTokenFromContext(ctx)); err != nil {
+			return err
+		}
+	}
+
 	token := &api.SPIAccessToken{}
-	if err := u.K8sClient.Get(ctx, client.ObjectKey{Name: tokenObjectName, Namespace: tokenObjectNamespace}, token); err != nil {
+	if err := cl.Get(ctx, client.ObjectKey{Name: tokenObjectName, Namespace: tokenObjectNamespace}, token); err != nil {
 		return fmt.Errorf("failed to get SPIAccessToken object %s/%s: %w", tokenObjectNamespace, tokenObjectName, err)
 	}
+	if onBehalf {
+		auditFields = []interface{}{"onBehalf", true, "actingIdentity", actingIdentity, "targetIdentity", tokenOwner(token), "targetNamespace", tokenObjectNamespace, "performedAs", u.OnBehalf.Identity}
+	}
 
-	if err := u.Storage.Store(ctx, token, data); err != nil {
-		return fmt.Errorf("failed to store the token data into storage: %w", err)
+	logging.AuditLogWithTokenInfo(ctx, "manual token upload initiated", tokenObjectNamespace, tokenObjectName, auditFields...)
+
+	if err := storage.Store(ctx, token, data); err != nil {
+		return fmt.Errorf("failed to store the token data into storage: %w", spierrors.WithKind(spierrors.StorageUnavailable, err))
 	}
-	AuditLogWithTokenInfo(ctx, "manual token upload done", tokenObjectNamespace, tokenObjectName)
+	logging.AuditLogWithTokenInfo(ctx, "manual token upload done", tokenObjectNamespace, tokenObjectName, auditFields...)
 	return nil
 }
+
+// tokenOwner returns the identity the token data of the SPIAccessToken belongs to, which is the controller owner of
+// the SPIAccessToken, e.g. the SPIAccessTokenBinding it was created for, or its namespace if it has none.
+func tokenOwner(token *api.SPIAccessToken) string {
+	if owner := metav1.GetControllerOf(token); owner != nil {
+		return owner.Kind + "/" + owner.Name
+	}
+	return token.Namespace
+}
+
+// uploadsOnBehalf checks whether the identity authenticated in the context needs to upload the token data on behalf
+// of another identity and is allowed to. The identities that can create the SPIAccessTokenDataUpdates in the namespace
+// upload the data themselves.
+func (u *SpiTokenUploader) uploadsOnBehalf(ctx context.Context, namespace string) (bool, error) {
+	if u.OnBehalf == nil {
+		return false, nil
+	}
+	direct, err := hasTokenDataUpdateAccess(ctx, u.K8sClient, namespace)
+	if err != nil || direct {
+		return false, err
+	}
+	onBehalf, err := hasTokenDataUpdateVerbAccess(ctx, u.K8sClient, namespace, UploadOnBehalfVerb)
+	if err != nil {
+		return false, err
+	}
+	return onBehalf, nil
+}
+
+// ServiceIdentity returns the username of the identity the configuration of the service authenticates as, reviewed by
+// the cluster using the client. Only the configurations with a bearer token, e.g. the token of the service account of
+// the pod, are supported.
+func ServiceIdentity(ctx context.Context, cl client.Client, cfg *rest.Config) (string, error) {
+	token := cfg.BearerToken
+	if token == "" && cfg.BearerTokenFile != "" {
+		b, err := os.ReadFile(cfg.BearerTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the bearer token of the service: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return "", noServiceTokenError
+	}
+	return reviewIdentity(ctx, cl, token)
+}
+
+// reviewIdentity returns the username of the identity the token authenticates, as reviewed by the cluster. The client
+// needs to be able to create the TokenReviews.
+func reviewIdentity(ctx context.Context, cl client.Client, token string) (string, error) {
+	review := &authn.TokenReview{Spec: authn.TokenReviewSpec{Token: token}}
+	if err := cl.Create(ctx, review); err != nil {
+		return "", fmt.Errorf("failed to review the token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return "", unauthenticatedIdentityError
+	}
+	return review.Status.User.Username, nil
+}
@@ -16,16 +16,29 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/go-logr/logr/funcr"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
 	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
 	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
 	"github.com/stretchr/testify/assert"
+	authn "k8s.io/api/authentication/v1"
+	authz "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 func TestTokenUploader_ShouldUploadWithNoError(t *testing.T) {
@@ -144,3 +157,153 @@ func TestTokenUploader_ShouldFailOnStorage(t *testing.T) {
 	var expectedErrorMsg = "failed to store the token data into storage: wrapped storage error: storage disconnected"
 	assert.EqualErrorf(t, err, expectedErrorMsg, "Error should be: %v, got: %v", expectedErrorMsg, err)
 }
+
+// verbClient is a fake client that allows the access reviews of the given verbs only.
+type verbClient struct {
+	client.Client
+	verbs map[string]bool
+}
+
+func (c verbClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authz.SelfSubjectAccessReview); ok {
+		review.Status.Allowed = c.verbs[review.Spec.ResourceAttributes.Verb]
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// reviewClient is a fake client that authenticates the given tokens in the token reviews.
+type reviewClient struct {
+	client.Client
+	users map[string]string
+}
+
+func (c reviewClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authn.TokenReview); ok {
+		review.Status.User.Username, review.Status.Authenticated = c.users[review.Spec.Token]
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestTokenOwner(t *testing.T) {
+	token := &v1beta1.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "token-123", Namespace: "ns-1"}}
+	assert.Equal(t, "ns-1", tokenOwner(token))
+
+	token.OwnerReferences = []metav1.OwnerReference{{Kind: "SPIAccessTokenBinding", Name: "binding-123"}}
+	assert.Equal(t, "ns-1", tokenOwner(token), "only the controller owns the token")
+
+	token.OwnerReferences[0].Controller = pointer.Bool(true)
+	assert.Equal(t, "SPIAccessTokenBinding/binding-123", tokenOwner(token))
+}
+
+func TestTokenUploader_UploadOnBehalf(t *testing.T) {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+	tokenData := &api.Token{AccessToken: "2345-2345-2345-234-46456"}
+	serviceClient := reviewClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&v1beta1.SPIAccessToken{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "token-123",
+				Namespace:       "ns-1",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "SPIAccessTokenBinding", Name: "binding-123", Controller: pointer.Bool(true)}},
+			},
+		},
+	).Build(), users: map[string]string{"uploader-token": "system:serviceaccount:ci:uploader"}}
+	// the user client doesn't see the token, so only the uploads on behalf can succeed
+	userClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+	var auditLogs []string
+	ctx := log.IntoContext(auth.WithAuthIntoContext("uploader-token", context.TODO()), funcr.New(func(prefix, args string) {
+		if strings.Contains(args, `"audit"="true"`) {
+			auditLogs = append(auditLogs, args)
+		}
+	}, funcr.Options{}))
+
+	upload := func(ctx context.Context, verbs ...string) (bool, error) {
+		allowed := map[string]bool{}
+		for _, v := range verbs {
+			allowed[v] = true
+		}
+		storedOnBehalf := false
+		uploader := SpiTokenUploader{
+			K8sClient: verbClient{Client: userClient, verbs: allowed},
+			Storage:   tokenstorage.TestTokenStorage{},
+			OnBehalf: &UploadOnBehalf{
+				Identity:  "system:serviceaccount:spi:spi-oauth",
+				K8sClient: serviceClient,
+				Storage: tokenstorage.TestTokenStorage{
+					StoreImpl: func(ctx context.Context, token *v1beta1.SPIAccessToken, data *v1beta1.Token) error {
+						storedOnBehalf = true
+						return nil
+					},
+				},
+			},
+		}
+		err := uploader.Upload(ctx, "token-123", "ns-1", tokenData)
+		return storedOnBehalf, err
+	}
+
+	t.Run("granted", func(t *testing.T) {
+		auditLogs = nil
+		onBehalf, err := upload(ctx, UploadOnBehalfVerb)
+		assert.NoError(t, err)
+		assert.True(t, onBehalf)
+
+		// both the initiation and the completion record the reviewed identities
+		assert.Len(t, auditLogs, 2)
+		for _, l := range auditLogs {
+			assert.Contains(t, l, `"actingIdentity"="system:serviceaccount:ci:uploader"`)
+			assert.Contains(t, l, `"targetIdentity"="SPIAccessTokenBinding/binding-123"`)
+			assert.Contains(t, l, `"targetNamespace"="ns-1"`)
+			assert.Contains(t, l, `"performedAs"="system:serviceaccount:spi:spi-oauth"`)
+		}
+	})
+
+	t.Run("not granted", func(t *testing.T) {
+		onBehalf, err := upload(ctx)
+		assert.True(t, errors.IsNotFound(err))
+		assert.False(t, onBehalf)
+	})
+
+	t.Run("direct access takes precedence", func(t *testing.T) {
+		onBehalf, err := upload(ctx, "create", UploadOnBehalfVerb)
+		assert.True(t, errors.IsNotFound(err))
+		assert.False(t, onBehalf)
+	})
+
+	t.Run("unauthenticated acting identity", func(t *testing.T) {
+		// e.g. an opaque token the cluster doesn't know
+		onBehalf, err := upload(auth.WithAuthIntoContext("opaque", ctx), UploadOnBehalfVerb)
+		assert.ErrorIs(t, err, spierrors.NotAuthenticated)
+		assert.False(t, onBehalf)
+	})
+}
+
+func TestServiceIdentity(t *testing.T) {
+	cl := reviewClient{Client: fake.NewClientBuilder().Build(), users: map[string]string{"service-token": "system:serviceaccount:spi:spi-oauth"}}
+
+	t.Run("bearer token", func(t *testing.T) {
+		identity, err := ServiceIdentity(context.TODO(), cl, &rest.Config{BearerToken: "service-token"})
+		assert.NoError(t, err)
+		assert.Equal(t, "system:serviceaccount:spi:spi-oauth", identity)
+	})
+
+	t.Run("bearer token file", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		assert.NoError(t, os.WriteFile(tokenFile, []byte("service-token\n"), 0600))
+		identity, err := ServiceIdentity(context.TODO(), cl, &rest.Config{BearerTokenFile: tokenFile})
+		assert.NoError(t, err)
+		assert.Equal(t, "system:serviceaccount:spi:spi-oauth", identity)
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		_, err := ServiceIdentity(context.TODO(), cl, &rest.Config{BearerToken: "other"})
+		assert.ErrorIs(t, err, unauthenticatedIdentityError)
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		_, err := ServiceIdentity(context.TODO(), cl, &rest.Config{})
+		assert.ErrorIs(t, err, noServiceTokenError)
+	})
+}
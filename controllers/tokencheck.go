@@ -0,0 +1,296 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kcp-dev/logicalcluster/v2"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	noRepositoryUrlError            = spierrors.WithKind(spierrors.InvalidRequest, errors.New("no `repoUrl` query parameter"))
+	invalidRepositoryUrlError       = spierrors.WithKind(spierrors.InvalidRequest, errors.New("invalid repository URL"))
+	foreignRepositoryError          = spierrors.WithKind(spierrors.InvalidRequest, errors.New("the repository doesn't belong to the service provider of the token"))
+	unsupportedCapabilityCheckError = spierrors.WithKind(spierrors.InvalidRequest, errors.New("checking the repository access is not supported for the service provider of the token"))
+	unexpectedProviderResponseError = errors.New("unexpected response of the service provider")
+)
+
+// TokenCapabilities is the response of the token check endpoint describing what the token allows to do with
+// the repository.
+type TokenCapabilities struct {
+	// RepoUrl is the checked repository.
+	RepoUrl string `json:"repoUrl"`
+	// TokenValid tells whether the service provider accepted the token at all.
+	TokenValid bool `json:"tokenValid"`
+	// Accessible tells whether the repository is visible with the token.
+	Accessible bool `json:"accessible"`
+	// Clone tells whether the token allows reading the contents of the repository, i.e. cloning or pulling it.
+	Clone bool `json:"clone"`
+	// Push tells whether the token allows writing to the repository.
+	Push bool `json:"push"`
+	// Admin tells whether the token allows administering the repository.
+	Admin bool `json:"admin"`
+}
+
+// RepositoryAccessChecker asks the service provider what the token data allows to do with the repository.
+type RepositoryAccessChecker interface {
+	// CheckRepository checks the access of the token data to the repository at the service provider with
+	// the serviceProviderUrl. The repository must belong to that service provider.
+	CheckRepository(ctx context.Context, serviceProviderUrl string, repoUrl string, data *api.Token) (TokenCapabilities, error)
+}
+
+// ProviderRepositoryAccessChecker is the RepositoryAccessChecker using the REST APIs of GitHub and Quay.
+type ProviderRepositoryAccessChecker struct {
+	client    *http.Client
+	providers []repositoryApi
+}
+
+var _ RepositoryAccessChecker = (*ProviderRepositoryAccessChecker)(nil)
+
+// repositoryApi is the REST API of the service provider with the base URL.
+type repositoryApi struct {
+	baseUrl             string
+	apiUrl              string
+	serviceProviderType config.ServiceProviderType
+}
+
+// NewProviderRepositoryAccessChecker creates the checker for the configured GitHub and Quay service providers.
+// The other service providers have no REST API to ask about the access to the repositories.
+func NewProviderRepositoryAccessChecker(serviceProviders []config.ServiceProviderConfiguration, client *http.Client) (*ProviderRepositoryAccessChecker, error) {
+	checker := &ProviderRepositoryAccessChecker{client: client}
+	for _, sp := range serviceProviders {
+		if sp.ServiceProviderType != config.ServiceProviderTypeGitHub && sp.ServiceProviderType != config.ServiceProviderTypeQuay {
+			continue
+		}
+		baseUrl, err := serviceProviderBaseUrl(sp)
+		if err != nil {
+			return nil, err
+		}
+		checker.providers = append(checker.providers, repositoryApi{
+			baseUrl:             baseUrl,
+			apiUrl:              repositoryApiUrl(sp.ServiceProviderType, baseUrl),
+			serviceProviderType: sp.ServiceProviderType,
+		})
+	}
+	return checker, nil
+}
+
+// repositoryApiUrl returns the URL of the REST API of the service provider with the base URL. The GitHub Enterprise
+// and the self-hosted Quay instances have the API on the same host.
+func repositoryApiUrl(serviceProviderType config.ServiceProviderType, baseUrl string) string {
+	switch {
+	case serviceProviderType == config.ServiceProviderTypeGitHub && baseUrl == "https://github.com":
+		return "https://api.github.com"
+	case serviceProviderType == config.ServiceProviderTypeGitHub:
+		return baseUrl + "/api/v3"
+	default:
+		return baseUrl + "/api/v1"
+	}
+}
+
+// CheckRepository implements RepositoryAccessChecker. The failures of the service provider are returned as
+// the spierrors.ProviderError, the rejected token or the inaccessible repository are a part of the result.
+func (c *ProviderRepositoryAccessChecker) CheckRepository(ctx context.Context, serviceProviderUrl string, repoUrl string, data *api.Token) (TokenCapabilities, error) {
+	provider := c.providerFor(serviceProviderUrl)
+	if provider == nil {
+		return TokenCapabilities{}, fmt.Errorf("%w: %s", unsupportedCapabilityCheckError, serviceProviderUrl)
+	}
+
+	owner, repo, err := repositoryPath(provider.baseUrl, repoUrl)
+	if err != nil {
+		return TokenCapabilities{}, err
+	}
+
+	capabilities := TokenCapabilities{RepoUrl: repoUrl}
+	switch provider.serviceProviderType {
+	case config.ServiceProviderTypeGitHub:
+		repository := struct {
+			Permissions struct {
+				Admin bool `json:"admin"`
+				Push  bool `json:"push"`
+				Pull  bool `json:"pull"`
+			} `json:"permissions"`
+		}{}
+		if capabilities.TokenValid, capabilities.Accessible, err = c.getRepository(ctx, provider.apiUrl+"/repos/"+owner+"/"+repo, data, &repository); err != nil {
+			return TokenCapabilities{}, err
+		}
+		capabilities.Clone = repository.Permissions.Pull
+		capabilities.Push = repository.Permissions.Push
+		capabilities.Admin = repository.Permissions.Admin
+	default:
+		repository := struct {
+			CanWrite bool `json:"can_write"`
+			CanAdmin bool `json:"can_admin"`
+		}{}
+		if capabilities.TokenValid, capabilities.Accessible, err = c.getRepository(ctx, provider.apiUrl+"/repository/"+owner+"/"+repo, data, &repository); err != nil {
+			return TokenCapabilities{}, err
+		}
+		// quay shows only the repositories the token can pull from
+		capabilities.Clone = capabilities.Accessible
+		capabilities.Push = repository.CanWrite
+		capabilities.Admin = repository.CanAdmin
+	}
+	return capabilities, nil
+}
+
+// getRepository reads the repository from the REST API of the service provider using the token data. Returns whether
+// the token is valid and whether the repository is accessible with it. The service providers respond to the requests
+// for the inaccessible repositories as if the repositories didn't exist, so that is not an error.
+func (c *ProviderRepositoryAccessChecker) getRepository(ctx context.Context, repositoryUrl string, data *api.Token, repository interface{}) (bool, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", repositoryUrl, nil)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to create the repository request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+data.AccessToken)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return false, false, &spierrors.ProviderError{Err: err}
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(res.Body).Decode(repository); err != nil {
+			return false, false, &spierrors.ProviderError{Code: res.StatusCode, Err: fmt.Errorf("failed to decode the repository: %w", err)}
+		}
+		return true, true, nil
+	case http.StatusUnauthorized:
+		return false, false, nil
+	case http.StatusForbidden, http.StatusNotFound:
+		return true, false, nil
+	default:
+		// the body is read so that the connection can be reused
+		_, _ = io.Copy(io.Discard, res.Body)
+		return false, false, &spierrors.ProviderError{Code: res.StatusCode, Err: fmt.Errorf("%w to %s", unexpectedProviderResponseError, repositoryUrl)}
+	}
+}
+
+// providerFor returns the API of the service provider with the longest base URL the serviceProviderUrl belongs to.
+func (c *ProviderRepositoryAccessChecker) providerFor(serviceProviderUrl string) *repositoryApi {
+	i := longestBaseUrlMatch(serviceProviderUrl, len(c.providers), func(i int) string { return c.providers[i].baseUrl })
+	if i < 0 {
+		return nil
+	}
+	return &c.providers[i]
+}
+
+// repositoryPath returns the owner and the name of the repository with the URL at the service provider with the base
+// URL. The scheme of the repository URL is optional and the .git suffix is ignored, so that the URLs users clone
+// the repositories with are accepted, e.g. github.com/org/repo.git.
+func repositoryPath(baseUrl string, repoUrl string) (string, string, error) {
+	normalized := repoUrl
+	if !strings.Contains(normalized, "://") {
+		normalized = "https://" + normalized
+	}
+	u, err := url.Parse(normalized)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("%w: %s", invalidRepositoryUrlError, repoUrl)
+	}
+	base, err := url.Parse(baseUrl)
+	if err != nil || !strings.EqualFold(u.Host, base.Host) || !strings.HasPrefix(u.Path, base.Path+"/") {
+		return "", "", fmt.Errorf("%w: %s", foreignRepositoryError, repoUrl)
+	}
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(u.Path, base.Path), "/"), "/")
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return "", "", fmt.Errorf("%w: %s", invalidRepositoryUrlError, repoUrl)
+	}
+	return url.PathEscape(segments[0]), url.PathEscape(strings.TrimSuffix(segments[1], ".git")), nil
+}
+
+// TokenCheckHandler returns a Handler implementation that responds with the TokenCapabilities of the token data of
+// the SPIAccessToken for the repository in the `repoUrl` query parameter. The requests need to carry the bearer token
+// of a user that can read the SPIAccessToken. The token data itself is never returned.
+func TokenCheckHandler(k8sClient auth.AuthenticatingClient, storage tokenstorage.TokenStorage, checker RepositoryAccessChecker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		repoUrl := r.URL.Query().Get("repoUrl")
+		if repoUrl == "" {
+			logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(noRepositoryUrlError), "failed to check the token", noRepositoryUrlError)
+			return
+		}
+
+		r, token, data, ok := readTokenData(w, r, k8sClient, storage)
+		if !ok {
+			return
+		}
+
+		capabilities, err := checker.CheckRepository(r.Context(), token.Spec.ServiceProviderUrl, repoUrl, data)
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "failed to check the token", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(capabilities); err != nil {
+			log.FromContext(r.Context()).Error(err, "error recording the token capabilities")
+		}
+	}
+}
+
+// readTokenData reads the SPIAccessToken identified by the route variables of the request, using the bearer token of
+// the request, and its token data. It returns the request with the logging fields of the token. If the token or its
+// data cannot be read, the response is written and false is returned.
+func readTokenData(w http.ResponseWriter, r *http.Request, k8sClient auth.AuthenticatingClient, storage tokenstorage.TokenStorage) (*http.Request, *api.SPIAccessToken, *api.Token, bool) {
+	vars := mux.Vars(r)
+	tokenObjectName := vars["name"]
+	tokenObjectNamespace := vars["namespace"]
+	r = r.WithContext(logging.WithTokenLogFields(r.Context(), tokenObjectNamespace, tokenObjectName))
+
+	ctx, err := auth.WithAuthFromRequestIntoContext(r, r.Context())
+	if err != nil {
+		logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed extract authorization information from headers", err)
+		return r, nil, nil, false
+	}
+
+	if tokenObjectKcpWorkspace, hasKcpWorkspace := vars["kcpWorkspace"]; hasKcpWorkspace {
+		ctx = logicalcluster.WithCluster(ctx, logicalcluster.New(tokenObjectKcpWorkspace))
+	}
+
+	token := &api.SPIAccessToken{}
+	if err = k8sClient.Get(ctx, client.ObjectKey{Name: tokenObjectName, Namespace: tokenObjectNamespace}, token); err != nil {
+		logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "failed to get the SPIAccessToken object", err)
+		return r, nil, nil, false
+	}
+
+	data, err := storage.Get(ctx, token)
+	if err != nil {
+		err = spierrors.WithKind(spierrors.StorageUnavailable, err)
+		logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "failed to read the token data", err)
+		return r, nil, nil, false
+	}
+	if data == nil {
+		logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusNotFound, "the SPIAccessToken has no token data yet")
+		return r, nil, nil, false
+	}
+	return r, token, data, true
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kcp-dev/logicalcluster/v2"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRepositoryPath(t *testing.T) {
+	test := func(baseUrl, repoUrl, expectedOwner, expectedRepo string, expectedErr error) {
+		t.Run(repoUrl, func(t *testing.T) {
+			owner, repo, err := repositoryPath(baseUrl, repoUrl)
+			if expectedErr != nil {
+				assert.ErrorIs(t, err, expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, expectedOwner, owner)
+			assert.Equal(t, expectedRepo, repo)
+		})
+	}
+
+	test("https://github.com", "https://github.com/org/repo", "org", "repo", nil)
+	test("https://github.com", "https://github.com/org/repo.git", "org", "repo", nil)
+	test("https://github.com", "github.com/org/repo/tree/main", "org", "repo", nil)
+	test("https://ghe.acme.com/git", "https://ghe.acme.com/git/org/repo", "org", "repo", nil)
+	test("https://github.com", "https://gitlab.com/org/repo", "", "", foreignRepositoryError)
+	test("https://ghe.acme.com/git", "https://ghe.acme.com/org/repo", "", "", foreignRepositoryError)
+	test("https://github.com", "https://github.com/org", "", "", invalidRepositoryUrlError)
+}
+
+func TestRepositoryApiUrl(t *testing.T) {
+	assert.Equal(t, "https://api.github.com", repositoryApiUrl(config.ServiceProviderTypeGitHub, "https://github.com"))
+	assert.Equal(t, "https://ghe.acme.com/api/v3", repositoryApiUrl(config.ServiceProviderTypeGitHub, "https://ghe.acme.com"))
+	assert.Equal(t, "https://quay.io/api/v1", repositoryApiUrl(config.ServiceProviderTypeQuay, "https://quay.io"))
+}
+
+func TestProviderRepositoryAccessChecker(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v3/repos/org/writable":
+			_, _ = w.Write([]byte(`{"permissions": {"admin": false, "push": true, "pull": true}}`))
+		case "/api/v3/repos/org/readable":
+			_, _ = w.Write([]byte(`{"permissions": {"admin": false, "push": false, "pull": true}}`))
+		case "/api/v3/repos/org/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/quay/api/v1/repository/org/image":
+			_, _ = w.Write([]byte(`{"can_write": true, "can_admin": true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer provider.Close()
+
+	checker, err := NewProviderRepositoryAccessChecker([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub, ServiceProviderBaseUrl: provider.URL},
+		{ServiceProviderType: config.ServiceProviderTypeQuay, ServiceProviderBaseUrl: provider.URL + "/quay"},
+	}, provider.Client())
+	assert.NoError(t, err)
+
+	check := func(serviceProviderUrl, repoUrl, token string) (TokenCapabilities, error) {
+		return checker.CheckRepository(context.TODO(), serviceProviderUrl, repoUrl, &api.Token{AccessToken: token})
+	}
+
+	t.Run("push access", func(t *testing.T) {
+		capabilities, err := check(provider.URL, provider.URL+"/org/writable.git", "valid")
+		assert.NoError(t, err)
+		assert.Equal(t, TokenCapabilities{RepoUrl: provider.URL + "/org/writable.git", TokenValid: true, Accessible: true, Clone: true, Push: true}, capabilities)
+	})
+
+	t.Run("read access", func(t *testing.T) {
+		capabilities, err := check(provider.URL, provider.URL+"/org/readable", "valid")
+		assert.NoError(t, err)
+		assert.True(t, capabilities.Clone)
+		assert.False(t, capabilities.Push)
+	})
+
+	t.Run("inaccessible repository", func(t *testing.T) {
+		capabilities, err := check(provider.URL, provider.URL+"/org/secret", "valid")
+		assert.NoError(t, err)
+		assert.True(t, capabilities.TokenValid)
+		assert.False(t, capabilities.Accessible)
+		assert.False(t, capabilities.Clone)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		capabilities, err := check(provider.URL, provider.URL+"/org/writable", "revoked")
+		assert.NoError(t, err)
+		assert.False(t, capabilities.TokenValid)
+		assert.False(t, capabilities.Push)
+	})
+
+	t.Run("provider failure", func(t *testing.T) {
+		_, err := check(provider.URL, provider.URL+"/org/broken", "valid")
+		var providerErr *spierrors.ProviderError
+		assert.True(t, errors.As(err, &providerErr))
+		assert.Equal(t, http.StatusInternalServerError, providerErr.Code)
+		assert.Equal(t, http.StatusBadGateway, spierrors.HttpStatus(err))
+	})
+
+	t.Run("quay", func(t *testing.T) {
+		capabilities, err := check(provider.URL+"/quay", provider.URL+"/quay/org/image", "valid")
+		assert.NoError(t, err)
+		assert.Equal(t, TokenCapabilities{RepoUrl: provider.URL + "/quay/org/image", TokenValid: true, Accessible: true, Clone: true, Push: true, Admin: true}, capabilities)
+	})
+
+	t.Run("unsupported service provider", func(t *testing.T) {
+		_, err := check("https://gitlab.com", "https://gitlab.com/org/repo", "valid")
+		assert.ErrorIs(t, err, unsupportedCapabilityCheckError)
+	})
+}
+
+type repositoryAccessCheckerFunc func(ctx context.Context, serviceProviderUrl string, repoUrl string, data *api.Token) (TokenCapabilities, error)
+
+func (f repositoryAccessCheckerFunc) CheckRepository(ctx context.Context, serviceProviderUrl string, repoUrl string, data *api.Token) (TokenCapabilities, error) {
+	return f(ctx, serviceProviderUrl, repoUrl, data)
+}
+
+func TestTokenCheckHandler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "linked", Namespace: "default"}, Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: "https://github.com"}},
+		&api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "unlinked", Namespace: "default"}, Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: "https://github.com"}},
+	).Build()
+	var storageWorkspace logicalcluster.Name
+	storage := tokenstorage.TestTokenStorage{
+		GetImpl: func(ctx context.Context, token *api.SPIAccessToken) (*api.Token, error) {
+			storageWorkspace, _ = logicalcluster.ClusterFromContext(ctx)
+			if token.Name == "linked" {
+				return &api.Token{AccessToken: "secret"}, nil
+			}
+			return nil, nil
+		},
+	}
+	checker := repositoryAccessCheckerFunc(func(ctx context.Context, serviceProviderUrl string, repoUrl string, data *api.Token) (TokenCapabilities, error) {
+		assert.Equal(t, "https://github.com", serviceProviderUrl)
+		assert.Equal(t, "secret", data.AccessToken)
+		if repoUrl == "https://gitlab.com/org/repo" {
+			return TokenCapabilities{}, foreignRepositoryError
+		}
+		return TokenCapabilities{RepoUrl: repoUrl, TokenValid: true, Accessible: true, Clone: true}, nil
+	})
+
+	router := mux.NewRouter()
+	for _, path := range []string{"/token/{namespace}/{name}/check", "/token/{kcpWorkspace}/{namespace}/{name}/check"} {
+		router.HandleFunc(path, TokenCheckHandler(cl, storage, checker))
+	}
+	check := func(name, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/token/default/"+name+"/check"+query, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("capabilities", func(t *testing.T) {
+		rr := check("linked", "?repoUrl=https://github.com/org/repo")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		capabilities := TokenCapabilities{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &capabilities))
+		assert.Equal(t, TokenCapabilities{RepoUrl: "https://github.com/org/repo", TokenValid: true, Accessible: true, Clone: true}, capabilities)
+		assert.NotContains(t, rr.Body.String(), "secret")
+	})
+
+	t.Run("no repository", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, check("linked", "").Code)
+	})
+
+	t.Run("foreign repository", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, check("linked", "?repoUrl=https://gitlab.com/org/repo").Code)
+	})
+
+	t.Run("no token data", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, check("unlinked", "?repoUrl=https://github.com/org/repo").Code)
+	})
+
+	t.Run("no SPIAccessToken", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, check("missing", "?repoUrl=https://github.com/org/repo").Code)
+	})
+
+	t.Run("kcp workspace", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/token/workspace/default/linked/check?repoUrl=https://github.com/org/repo", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, logicalcluster.New("workspace"), storageWorkspace)
+	})
+}
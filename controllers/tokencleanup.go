@@ -0,0 +1,324 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// TokenCleanupFinalizer is the finalizer the service puts on the SPIAccessTokens so that it can revoke their token
+	// data at the service provider and remove them from the token storage before the SPIAccessTokens disappear.
+	TokenCleanupFinalizer = "spi.appstudio.redhat.com/oauth-token-cleanup"
+
+	// revocationUrlExtraKey is the key in the extra configuration of the service provider specifying the URL of its
+	// RFC 7009 token revocation endpoint. The tokens are not revoked at the service providers without it.
+	revocationUrlExtraKey = "revocationUrl"
+	// tokenCleanupEventSource is the component the events of the token cleanup watcher are reported as.
+	tokenCleanupEventSource = "spi-oauth-token-cleanup"
+	// revocationMaxBodySize limits how much of the responses of the revocation endpoints is read.
+	revocationMaxBodySize = 64 * 1024
+)
+
+var (
+	invalidRevocationUrlError   = errors.New("invalid revocation URL")
+	tokenRevocationFailedError  = errors.New("token revocation failed")
+	unknownProviderBaseUrlError = errors.New("unknown base URL of the service provider")
+)
+
+// TokenRevoker revokes the token data at the service provider of the SPIAccessToken.
+type TokenRevoker interface {
+	Revoke(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error
+}
+
+// revocationEndpoint is the RFC 7009 token revocation endpoint of a service provider.
+type revocationEndpoint struct {
+	baseUrl      string
+	url          string
+	clientId     string
+	clientSecret string
+}
+
+// ProviderTokenRevoker revokes the tokens at the RFC 7009 revocation endpoints of the service providers configured
+// with the revocationUrl extra key. The service provider of the token is the one with the base URL matching
+// the service provider URL of the SPIAccessToken.
+type ProviderTokenRevoker struct {
+	endpoints []revocationEndpoint
+	client    *http.Client
+}
+
+var _ TokenRevoker = (*ProviderTokenRevoker)(nil)
+
+// NewProviderTokenRevoker creates the revoker of the tokens of the service providers that have the revocation endpoint
+// configured. The revocation requests are made using the client.
+func NewProviderTokenRevoker(serviceProviders []config.ServiceProviderConfiguration, client *http.Client) (*ProviderTokenRevoker, error) {
+	revoker := &ProviderTokenRevoker{client: client}
+	for _, sp := range serviceProviders {
+		revocationUrl, err := revocationUrlFromConfiguration(sp)
+		if err != nil {
+			return nil, err
+		}
+		if revocationUrl == "" {
+			continue
+		}
+		baseUrl, err := serviceProviderBaseUrl(sp)
+		if err != nil {
+			return nil, err
+		}
+		revoker.endpoints = append(revoker.endpoints, revocationEndpoint{
+			baseUrl:      baseUrl,
+			url:          revocationUrl,
+			clientId:     sp.ClientId,
+			clientSecret: sp.ClientSecret,
+		})
+	}
+	return revoker, nil
+}
+
+// revocationUrlFromConfiguration reads the URL of the revocation endpoint from the extra configuration of the service
+// provider. Returns an empty string if the service provider doesn't have it configured.
+func revocationUrlFromConfiguration(spConfig config.ServiceProviderConfiguration) (string, error) {
+	value := spConfig.Extra[revocationUrlExtraKey]
+	if value == "" {
+		return "", nil
+	}
+	if u, err := url.Parse(value); err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("%w '%s' configured for service provider %s", invalidRevocationUrlError, value, spConfig.ServiceProviderType)
+	}
+	return value, nil
+}
+
+// serviceProviderBaseUrl returns the base URL of the service provider, using the well-known one if it is not
+// configured.
+func serviceProviderBaseUrl(spConfig config.ServiceProviderConfiguration) (string, error) {
+	if spConfig.ServiceProviderBaseUrl != "" {
+		return strings.TrimSuffix(spConfig.ServiceProviderBaseUrl, "/"), nil
+	}
+	switch spConfig.ServiceProviderType {
+	case config.ServiceProviderTypeGitHub:
+		return "https://github.com", nil
+	case config.ServiceProviderTypeQuay:
+		return "https://quay.io", nil
+	default:
+		return "", fmt.Errorf("%w %s, configure it explicitly", unknownProviderBaseUrlError, spConfig.ServiceProviderType)
+	}
+}
+
+// longestBaseUrlMatch returns the index of the longest of the n base URLs, as returned by baseUrl, the service provider
+// URL belongs to, i.e. which is equal to it or its path prefix. Returns -1 if the URL belongs to none of them.
+func longestBaseUrlMatch(serviceProviderUrl string, n int, baseUrl func(i int) string) int {
+	match, matchLen := -1, 0
+	for i := 0; i < n; i++ {
+		b := baseUrl(i)
+		if (serviceProviderUrl == b || strings.HasPrefix(serviceProviderUrl, b+"/")) && (match < 0 || len(b) > matchLen) {
+			match, matchLen = i, len(b)
+		}
+	}
+	return match
+}
+
+// Revoke revokes the refresh token, or the access token if there's no refresh token, at the service provider of
+// the SPIAccessToken. Does nothing if the service provider doesn't have the revocation endpoint configured.
+func (r *ProviderTokenRevoker) Revoke(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+	endpoint := r.endpointFor(token.Spec.ServiceProviderUrl)
+	if endpoint == nil {
+		log.FromContext(ctx).V(logs.DebugLevel).Info("no revocation endpoint for the service provider", "serviceProviderUrl", token.Spec.ServiceProviderUrl)
+		return nil
+	}
+
+	form := url.Values{"token": {data.AccessToken}, "token_type_hint": {"access_token"}}
+	// revoking the refresh token also revokes the access tokens issued with it, see RFC 7009
+	if data.RefreshToken != "" {
+		form = url.Values{"token": {data.RefreshToken}, "token_type_hint": {"refresh_token"}}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create the revocation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(endpoint.clientId), url.QueryEscape(endpoint.clientSecret))
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", tokenRevocationFailedError, err.Error())
+	}
+	defer res.Body.Close()
+	// the body is read so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, revocationMaxBodySize))
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: the revocation endpoint responded with %d", tokenRevocationFailedError, res.StatusCode)
+	}
+	return nil
+}
+
+// endpointFor returns the revocation endpoint of the service provider with the longest base URL matching
+// the service provider URL, or nil if there's none.
+func (r *ProviderTokenRevoker) endpointFor(serviceProviderUrl string) *revocationEndpoint {
+	i := longestBaseUrlMatch(serviceProviderUrl, len(r.endpoints), func(i int) string { return r.endpoints[i].baseUrl })
+	if i < 0 {
+		return nil
+	}
+	return &r.endpoints[i]
+}
+
+// TokenCleanupReconciler makes sure that the token data of the deleted SPIAccessTokens don't stay in the token
+// storage. It puts the TokenCleanupFinalizer on the SPIAccessTokens and, once they are being deleted, revokes their
+// token data at the service provider, removes it from the token storage and lets the SPIAccessTokens go. This
+// cooperates with the finalizers of the operator, which doesn't revoke the tokens. The failure to revoke the token is
+// reported as an event of the SPIAccessToken but doesn't block its deletion.
+type TokenCleanupReconciler struct {
+	K8sClient    client.Client
+	TokenStorage tokenstorage.TokenStorage
+	Revoker      TokenRevoker
+	Recorder     record.EventRecorder
+}
+
+var _ reconcile.Reconciler = (*TokenCleanupReconciler)(nil)
+
+// NewTokenCleanupWatcher creates the manager running the TokenCleanupReconciler. Like the upload secret watcher, it
+// acts with the credentials of the service itself and needs to be able to watch and update the SPIAccessTokens and
+// create events. The SPIAccessTokens are watched in the provided namespaces or in all namespaces if none are provided.
+// With the leader election enabled, only one replica of the service cleans up the tokens, the others wait for the lease.
+func NewTokenCleanupWatcher(cfg *rest.Config, storage tokenstorage.TokenStorage, revoker TokenRevoker, namespaces []string, leaderElection LeaderElection) (manager.Manager, error) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to add corev1 to scheme: %w", err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to add api to the scheme: %w", err)
+	}
+
+	options := manager.Options{
+		Scheme: scheme,
+		// the service has its own metrics server
+		MetricsBindAddress: "0",
+	}
+	leaderElection.apply(&options)
+
+	mgr, err := ctrl.NewManager(cfg, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the manager of the token cleanup watcher: %w", err)
+	}
+
+	reconciler := &TokenCleanupReconciler{
+		K8sClient:    mgr.GetClient(),
+		TokenStorage: storage,
+		Revoker:      revoker,
+		Recorder:     mgr.GetEventRecorderFor(tokenCleanupEventSource),
+	}
+
+	inNamespaces := map[string]bool{}
+	for _, ns := range namespaces {
+		inNamespaces[ns] = true
+	}
+
+	err = ctrl.NewControllerManagedBy(mgr).
+		Named("token-cleanup").
+		For(&api.SPIAccessToken{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return len(inNamespaces) == 0 || inNamespaces[o.GetNamespace()]
+		}))).
+		Complete(reconciler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the token cleanup controller: %w", err)
+	}
+
+	return mgr, nil
+}
+
+// Reconcile adds the finalizer to the SPIAccessToken or, if it is being deleted, cleans up its token data and removes
+// the finalizer.
+func (r *TokenCleanupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx = logging.WithTokenLogFields(ctx, req.Namespace, req.Name)
+
+	token := &api.SPIAccessToken{}
+	if err := r.K8sClient.Get(ctx, req.NamespacedName, token); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err) //nolint:wrapcheck // the error is just passed to the controller-runtime
+	}
+
+	if token.DeletionTimestamp.IsZero() {
+		if controllerutil.AddFinalizer(token, TokenCleanupFinalizer) {
+			if err := r.K8sClient.Update(ctx, token); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to add the token cleanup finalizer: %w", err)
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(token, TokenCleanupFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.cleanup(ctx, token); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	controllerutil.RemoveFinalizer(token, TokenCleanupFinalizer)
+	if err := r.K8sClient.Update(ctx, token); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to remove the token cleanup finalizer: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// cleanup revokes the token data of the SPIAccessToken and removes them from the token storage.
+func (r *TokenCleanupReconciler) cleanup(ctx context.Context, token *api.SPIAccessToken) error {
+	data, err := r.TokenStorage.Get(ctx, token)
+	if err != nil {
+		return fmt.Errorf("failed to read the token data of the deleted SPIAccessToken: %w", err)
+	}
+	if data == nil {
+		log.FromContext(ctx).V(logs.DebugLevel).Info("no token data to clean up")
+		return nil
+	}
+
+	if err := r.Revoker.Revoke(ctx, token, data); err != nil {
+		// the token can expire or be revoked by the user, but it can't be deleted from the storage later
+		log.FromContext(ctx).Error(err, "failed to revoke the token of the deleted SPIAccessToken")
+		r.Recorder.Eventf(token, corev1.EventTypeWarning, "RevocationFailed", "failed to revoke the token at the service provider: %s", err.Error())
+	} else {
+		logging.AuditLogWithTokenInfo(ctx, "token of the deleted SPIAccessToken revoked", token.Namespace, token.Name)
+	}
+
+	if err := r.TokenStorage.Delete(ctx, token); err != nil {
+		return fmt.Errorf("failed to delete the token data of the deleted SPIAccessToken: %w", err)
+	}
+	logging.AuditLogWithTokenInfo(ctx, "token data of the deleted SPIAccessToken removed", token.Namespace, token.Name)
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// revokerFunc is the TokenRevoker implemented by a function.
+type revokerFunc func(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error
+
+func (f revokerFunc) Revoke(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+	return f(ctx, token, data)
+}
+
+func TestTokenCleanupReconciler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, api.AddToScheme(scheme))
+	key := client.ObjectKey{Name: "my-token", Namespace: "default"}
+
+	reconcile := func(t *testing.T, cl client.Client, storage tokenstorage.TokenStorage, revoker TokenRevoker) (*record.FakeRecorder, error) {
+		recorder := record.NewFakeRecorder(10)
+		reconciler := &TokenCleanupReconciler{K8sClient: cl, TokenStorage: storage, Revoker: revoker, Recorder: recorder}
+		_, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: key})
+		return recorder, err
+	}
+	// deletedToken returns the client with the SPIAccessToken that is being deleted.
+	deletedToken := func(t *testing.T) client.Client {
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, Finalizers: []string{TokenCleanupFinalizer}},
+		}).Build()
+		assert.NoError(t, cl.Delete(context.TODO(), &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}))
+		return cl
+	}
+	tokenGone := func(t *testing.T, cl client.Client) bool {
+		err := cl.Get(context.TODO(), key, &api.SPIAccessToken{})
+		if err != nil {
+			assert.True(t, apierrors.IsNotFound(err))
+		}
+		return err != nil
+	}
+	noRevocation := revokerFunc(func(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+		assert.Fail(t, "nothing should be revoked")
+		return nil
+	})
+
+	t.Run("adds the finalizer", func(t *testing.T) {
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&api.SPIAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+		}).Build()
+
+		_, err := reconcile(t, cl, tokenstorage.TestTokenStorage{}, noRevocation)
+		assert.NoError(t, err)
+
+		token := &api.SPIAccessToken{}
+		assert.NoError(t, cl.Get(context.TODO(), key, token))
+		assert.Contains(t, token.Finalizers, TokenCleanupFinalizer)
+	})
+
+	t.Run("revokes and deletes the token data of the deleted token", func(t *testing.T) {
+		cl := deletedToken(t)
+		revoked, deleted := false, false
+		storage := tokenstorage.TestTokenStorage{
+			GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+				return &api.Token{AccessToken: "access-token"}, nil
+			},
+			DeleteImpl: func(ctx context.Context, owner *api.SPIAccessToken) error {
+				assert.Equal(t, key.Name, owner.Name)
+				deleted = true
+				return nil
+			},
+		}
+
+		_, err := reconcile(t, cl, storage, revokerFunc(func(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+			assert.Equal(t, "access-token", data.AccessToken)
+			revoked = true
+			return nil
+		}))
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+		assert.True(t, deleted)
+		assert.True(t, tokenGone(t, cl))
+	})
+
+	t.Run("failed revocation doesn't block the deletion", func(t *testing.T) {
+		cl := deletedToken(t)
+		deleted := false
+		storage := tokenstorage.TestTokenStorage{
+			GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+				return &api.Token{AccessToken: "access-token"}, nil
+			},
+			DeleteImpl: func(ctx context.Context, owner *api.SPIAccessToken) error {
+				deleted = true
+				return nil
+			},
+		}
+
+		recorder, err := reconcile(t, cl, storage, revokerFunc(func(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+			return errors.New("provider down")
+		}))
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+		assert.True(t, tokenGone(t, cl))
+		assert.Contains(t, <-recorder.Events, "RevocationFailed")
+	})
+
+	t.Run("failed deletion from the storage is retried", func(t *testing.T) {
+		cl := deletedToken(t)
+		storage := tokenstorage.TestTokenStorage{
+			GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+				return &api.Token{AccessToken: "access-token"}, nil
+			},
+			DeleteImpl: func(ctx context.Context, owner *api.SPIAccessToken) error {
+				return errors.New("vault down")
+			},
+		}
+
+		_, err := reconcile(t, cl, storage, revokerFunc(func(ctx context.Context, token *api.SPIAccessToken, data *api.Token) error {
+			return nil
+		}))
+		assert.Error(t, err)
+		assert.False(t, tokenGone(t, cl))
+	})
+
+	t.Run("lets the token without data go", func(t *testing.T) {
+		cl := deletedToken(t)
+		storage := tokenstorage.TestTokenStorage{
+			GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+				return nil, nil
+			},
+		}
+
+		_, err := reconcile(t, cl, storage, noRevocation)
+		assert.NoError(t, err)
+		assert.True(t, tokenGone(t, cl))
+	})
+}
+
+func TestProviderTokenRevoker(t *testing.T) {
+	var form map[string]string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		user, password, _ := r.BasicAuth()
+		form = map[string]string{"token": r.PostForm.Get("token"), "hint": r.PostForm.Get("token_type_hint"), "user": user, "password": password}
+		if r.PostForm.Get("token") == "invalid" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer provider.Close()
+
+	revoker, err := NewProviderTokenRevoker([]config.ServiceProviderConfiguration{
+		{
+			ServiceProviderType:    config.ServiceProviderTypeQuay,
+			ServiceProviderBaseUrl: "https://quay.example.com",
+			ClientId:               "client-id",
+			ClientSecret:           "client-secret",
+			Extra:                  map[string]string{revocationUrlExtraKey: provider.URL + "/revoke"},
+		},
+		{ServiceProviderType: config.ServiceProviderTypeGitHub},
+	}, provider.Client())
+	assert.NoError(t, err)
+
+	token := &api.SPIAccessToken{Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: "https://quay.example.com/org/repo"}}
+
+	t.Run("revokes the refresh token", func(t *testing.T) {
+		assert.NoError(t, revoker.Revoke(context.TODO(), token, &api.Token{AccessToken: "access", RefreshToken: "refresh"}))
+		assert.Equal(t, map[string]string{"token": "refresh", "hint": "refresh_token", "user": "client-id", "password": "client-secret"}, form)
+	})
+
+	t.Run("revokes the access token", func(t *testing.T) {
+		assert.NoError(t, revoker.Revoke(context.TODO(), token, &api.Token{AccessToken: "access"}))
+		assert.Equal(t, "access", form["token"])
+		assert.Equal(t, "access_token", form["hint"])
+	})
+
+	t.Run("reports failure", func(t *testing.T) {
+		assert.ErrorIs(t, revoker.Revoke(context.TODO(), token, &api.Token{AccessToken: "invalid"}), tokenRevocationFailedError)
+	})
+
+	t.Run("ignores providers without revocation endpoint", func(t *testing.T) {
+		form = nil
+		other := &api.SPIAccessToken{Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: "https://github.com"}}
+		assert.NoError(t, revoker.Revoke(context.TODO(), other, &api.Token{AccessToken: "access"}))
+		// the base URL must match whole path segments
+		other.Spec.ServiceProviderUrl = "https://quay.example.com.evil.com"
+		assert.NoError(t, revoker.Revoke(context.TODO(), other, &api.Token{AccessToken: "access"}))
+		assert.Nil(t, form)
+	})
+
+	t.Run("rejects invalid revocation URL", func(t *testing.T) {
+		_, err := NewProviderTokenRevoker([]config.ServiceProviderConfiguration{{
+			ServiceProviderType: config.ServiceProviderTypeGitHub,
+			Extra:               map[string]string{revocationUrlExtraKey: "not a url"},
+		}}, http.DefaultClient)
+		assert.ErrorIs(t, err, invalidRevocationUrlError)
+	})
+}
+
+func TestLongestBaseUrlMatch(t *testing.T) {
+	baseUrls := []string{"https://github.com", "https://gitlab.com", "https://github.com/enterprises/acme"}
+	match := func(serviceProviderUrl string) int {
+		return longestBaseUrlMatch(serviceProviderUrl, len(baseUrls), func(i int) string { return baseUrls[i] })
+	}
+
+	assert.Equal(t, 0, match("https://github.com"))
+	assert.Equal(t, 0, match("https://github.com/org/repo"))
+	assert.Equal(t, 1, match("https://gitlab.com/group"))
+	assert.Equal(t, 2, match("https://github.com/enterprises/acme/repo"))
+	// only the whole path segments match
+	assert.Equal(t, 0, match("https://github.com/enterprises/acme-corp"))
+	assert.Equal(t, -1, match("https://github.company.com"))
+	assert.Equal(t, -1, match("https://quay.io"))
+}
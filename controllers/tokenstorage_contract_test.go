@@ -0,0 +1,249 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The token storage contract is the behavior every TokenStorage implementation needs to have so that the service
+// works the same regardless of the storage it is configured with. The contract is run against the in-memory storages
+// by default. The storages needing a real backend are run with the build tag of the backend, e.g.:
+//
+//	go test -tags vault ./controllers -run TokenStorageContract
+
+func TestTokenStorageContract(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testTokenStorageContract(t, newMemoryTokenStorage())
+	})
+
+	t.Run("caching", func(t *testing.T) {
+		testTokenStorageContract(t, NewCachingTokenStorage(newMemoryTokenStorage(), time.Minute))
+	})
+}
+
+// contractNamespaces makes the namespaces of the tokens used by the contract unique so that the checks can share
+// the storage and leave the data behind.
+var contractNamespaces uint64
+
+// testTokenStorageContract checks that the storage behaves as the TokenStorage contract requires. The storage doesn't
+// need to be empty, each check uses its own tokens.
+func testTokenStorageContract(t *testing.T, storage tokenstorage.TokenStorage) {
+	t.Helper()
+
+	newOwner := func(name string) *api.SPIAccessToken {
+		namespace := fmt.Sprintf("contract-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&contractNamespaces, 1))
+		return &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, UID: "uid"}}
+	}
+	token := func(accessToken string) *api.Token {
+		return &api.Token{
+			Username:     "jdoe",
+			AccessToken:  accessToken,
+			TokenType:    "bearer",
+			RefreshToken: "refresh-" + accessToken,
+			Expiry:       1234567890,
+		}
+	}
+	ctx := context.TODO()
+
+	t.Run("returns nil for unknown token", func(t *testing.T) {
+		stored, err := storage.Get(ctx, newOwner("unknown"))
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+
+	t.Run("stores and gets the token", func(t *testing.T) {
+		owner := newOwner("token")
+		assert.NoError(t, storage.Store(ctx, owner, token("access")))
+
+		stored, err := storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.Equal(t, token("access"), stored)
+	})
+
+	t.Run("overwrites the token", func(t *testing.T) {
+		owner := newOwner("token")
+		assert.NoError(t, storage.Store(ctx, owner, token("first")))
+		_, err := storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.NoError(t, storage.Store(ctx, owner, token("second")))
+
+		stored, err := storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.Equal(t, token("second"), stored)
+	})
+
+	t.Run("deletes the token", func(t *testing.T) {
+		owner := newOwner("token")
+		assert.NoError(t, storage.Store(ctx, owner, token("access")))
+		_, err := storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.NoError(t, storage.Delete(ctx, owner))
+
+		stored, err := storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+
+	t.Run("deletes unknown token", func(t *testing.T) {
+		assert.NoError(t, storage.Delete(ctx, newOwner("unknown")))
+	})
+
+	t.Run("keeps the tokens of different owners apart", func(t *testing.T) {
+		owner := newOwner("token")
+		otherName := owner.DeepCopy()
+		otherName.Name = "other"
+		otherNamespace := newOwner("token")
+		workspace := logicalcluster.WithCluster(ctx, logicalcluster.New("contract-workspace"))
+
+		assert.NoError(t, storage.Store(ctx, owner, token("access")))
+		_, err := storage.Get(ctx, owner)
+		assert.NoError(t, err)
+
+		for name, get := range map[string]func() (*api.Token, error){
+			"name":      func() (*api.Token, error) { return storage.Get(ctx, otherName) },
+			"namespace": func() (*api.Token, error) { return storage.Get(ctx, otherNamespace) },
+			"workspace": func() (*api.Token, error) { return storage.Get(workspace, owner) },
+		} {
+			stored, err := get()
+			assert.NoError(t, err, "other %s", name)
+			assert.Nil(t, stored, "other %s", name)
+		}
+
+		assert.NoError(t, storage.Store(workspace, owner, token("workspace")))
+		stored, err := storage.Get(workspace, owner)
+		assert.NoError(t, err)
+		assert.Equal(t, token("workspace"), stored)
+		stored, err = storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.Equal(t, token("access"), stored)
+	})
+
+	t.Run("doesn't share the token with the caller", func(t *testing.T) {
+		owner := newOwner("token")
+		original := token("access")
+		assert.NoError(t, storage.Store(ctx, owner, original))
+		original.AccessToken = "modified"
+
+		stored, err := storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.Equal(t, token("access"), stored)
+
+		stored.AccessToken = "modified"
+		stored, err = storage.Get(ctx, owner)
+		assert.NoError(t, err)
+		assert.Equal(t, token("access"), stored)
+	})
+
+	t.Run("is safe for concurrent use", func(t *testing.T) {
+		const writers = 8
+		const rounds = 10
+
+		owners := make([]*api.SPIAccessToken, writers)
+		for i := range owners {
+			owners[i] = newOwner(fmt.Sprintf("token-%d", i))
+		}
+
+		done := make(chan struct{})
+		readers := sync.WaitGroup{}
+		// the readers keep reading the tokens while they are written to so that a storage keeping any state between
+		// the calls has a chance to get it wrong
+		for i := 0; i < writers; i++ {
+			readers.Add(1)
+			go func(owner *api.SPIAccessToken) {
+				defer readers.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						_, err := storage.Get(ctx, owner)
+						assert.NoError(t, err)
+					}
+				}
+			}(owners[i])
+		}
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(owner *api.SPIAccessToken) {
+				defer wg.Done()
+				for r := 0; r < rounds; r++ {
+					expected := token(fmt.Sprintf("%s-%d", owner.Name, r))
+					assert.NoError(t, storage.Store(ctx, owner, expected))
+					stored, err := storage.Get(ctx, owner)
+					assert.NoError(t, err)
+					assert.Equal(t, expected, stored)
+
+					assert.NoError(t, storage.Delete(ctx, owner))
+					stored, err = storage.Get(ctx, owner)
+					assert.NoError(t, err)
+					assert.Nil(t, stored)
+				}
+			}(owners[i])
+		}
+		wg.Wait()
+		close(done)
+		readers.Wait()
+	})
+}
+
+// memoryTokenStorage is the reference TokenStorage implementation keeping the tokens in memory.
+type memoryTokenStorage struct {
+	lock   sync.Mutex
+	tokens map[string]*api.Token
+}
+
+var _ tokenstorage.TokenStorage = (*memoryTokenStorage)(nil)
+
+func newMemoryTokenStorage() *memoryTokenStorage {
+	return &memoryTokenStorage{tokens: map[string]*api.Token{}}
+}
+
+func (m *memoryTokenStorage) key(ctx context.Context, owner *api.SPIAccessToken) string {
+	cluster, _ := logicalcluster.ClusterFromContext(ctx)
+	return cluster.String() + "/" + owner.Namespace + "/" + owner.Name
+}
+
+func (m *memoryTokenStorage) Store(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.tokens[m.key(ctx, owner)] = token.DeepCopy()
+	return nil
+}
+
+func (m *memoryTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.tokens[m.key(ctx, owner)].DeepCopy(), nil
+}
+
+func (m *memoryTokenStorage) Delete(ctx context.Context, owner *api.SPIAccessToken) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.tokens, m.key(ctx, owner))
+	return nil
+}
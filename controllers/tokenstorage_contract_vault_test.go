@@ -0,0 +1,39 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build vault
+// +build vault
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+)
+
+// TestVaultTokenStorageContract runs the token storage contract against a Vault server started in the test process.
+// Starting Vault takes a while, so this is only run with the `vault` build tag.
+func TestVaultTokenStorageContract(t *testing.T) {
+	cluster, storage := tokenstorage.CreateTestVaultTokenStorage(t)
+	defer cluster.Cleanup()
+
+	t.Run("vault", func(t *testing.T) {
+		testTokenStorageContract(t, storage)
+	})
+
+	t.Run("caching vault", func(t *testing.T) {
+		testTokenStorageContract(t, NewCachingTokenStorage(storage, time.Minute))
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+)
+
+// tokenTransformersExtraKey is the key in the extra configuration of the service provider specifying
+// the comma-separated chain of the transformers applied to the tokens obtained from the service provider before they
+// are stored. Each transformer is specified by its name optionally followed by `=` and its argument, e.g.
+// "stripRefreshToken,username=x-access-token,maxLifetime=8h". The transformers are applied in the order given.
+const tokenTransformersExtraKey = "tokenTransformers"
+
+var (
+	unknownTokenTransformerError = errors.New("unknown token transformer")
+	invalidTokenTransformerError = errors.New("invalid token transformer argument")
+)
+
+// TokenTransformer modifies the token obtained from the service provider before it is stored, e.g. to enforce
+// a policy or to adapt the token to the format expected by its consumers.
+type TokenTransformer interface {
+	Transform(ctx context.Context, token *v1beta1.Token) error
+}
+
+// TokenTransformerFunc is a function implementing the TokenTransformer interface.
+type TokenTransformerFunc func(ctx context.Context, token *v1beta1.Token) error
+
+func (f TokenTransformerFunc) Transform(ctx context.Context, token *v1beta1.Token) error {
+	return f(ctx, token)
+}
+
+// TokenTransformerFactory creates the transformer from the argument given in the configuration. The argument is empty
+// if none is given.
+type TokenTransformerFactory func(arg string) (TokenTransformer, error)
+
+// TokenTransformerFactories are the transformers that can be used in the configuration of the service providers by
+// their names. New transformers are made available by adding them here.
+var TokenTransformerFactories = map[string]TokenTransformerFactory{
+	// stripRefreshToken drops the refresh token so that only the short-lived access token is kept.
+	"stripRefreshToken": func(arg string) (TokenTransformer, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("%w: stripRefreshToken takes no argument", invalidTokenTransformerError)
+		}
+		return TokenTransformerFunc(func(_ context.Context, token *v1beta1.Token) error {
+			token.RefreshToken = ""
+			return nil
+		}), nil
+	},
+	// username sets the username used with the token, e.g. "x-access-token" expected by GitHub in the Git credentials.
+	"username": func(arg string) (TokenTransformer, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("%w: username requires the username", invalidTokenTransformerError)
+		}
+		return TokenTransformerFunc(func(_ context.Context, token *v1beta1.Token) error {
+			token.Username = arg
+			return nil
+		}), nil
+	},
+	// tokenType overrides the token type reported by the service provider, e.g. to normalize its case.
+	"tokenType": func(arg string) (TokenTransformer, error) {
+		if arg == "" {
+			return nil, fmt.Errorf("%w: tokenType requires the token type", invalidTokenTransformerError)
+		}
+		return TokenTransformerFunc(func(_ context.Context, token *v1beta1.Token) error {
+			token.TokenType = arg
+			return nil
+		}), nil
+	},
+	// maxLifetime shortens the expiry of the token to at most the given duration from now. The tokens that don't
+	// expire get the expiry too.
+	"maxLifetime": func(arg string) (TokenTransformer, error) {
+		lifetime, err := time.ParseDuration(arg)
+		if err != nil || lifetime <= 0 {
+			return nil, fmt.Errorf("%w: maxLifetime requires a positive duration, got '%s'", invalidTokenTransformerError, arg)
+		}
+		return TokenTransformerFunc(func(_ context.Context, token *v1beta1.Token) error {
+			maxExpiry := uint64(time.Now().Add(lifetime).Unix())
+			if token.Expiry == 0 || token.Expiry > maxExpiry {
+				token.Expiry = maxExpiry
+			}
+			return nil
+		}), nil
+	},
+}
+
+// tokenTransformerChain applies the transformers one after another.
+type tokenTransformerChain []TokenTransformer
+
+func (c tokenTransformerChain) Transform(ctx context.Context, token *v1beta1.Token) error {
+	for _, t := range c {
+		if err := t.Transform(ctx, token); err != nil {
+			return fmt.Errorf("failed to transform the token: %w", err)
+		}
+	}
+	return nil
+}
+
+// tokenTransformersFromConfiguration reads the chain of the token transformers from the extra configuration of
+// the service provider.
+func tokenTransformersFromConfiguration(spConfig config.ServiceProviderConfiguration) (tokenTransformerChain, error) {
+	var chain tokenTransformerChain
+	for _, spec := range strings.Split(spConfig.Extra[tokenTransformersExtraKey], ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(spec, "=")
+		factory, ok := TokenTransformerFactories[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("%w '%s' configured for service provider %s", unknownTokenTransformerError, name, spConfig.ServiceProviderType)
+		}
+		transformer, err := factory(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, fmt.Errorf("invalid token transformer configured for service provider %s: %w", spConfig.ServiceProviderType, err)
+		}
+		chain = append(chain, transformer)
+	}
+	return chain, nil
+}
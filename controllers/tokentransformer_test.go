@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenTransformers(t *testing.T) {
+	chain := func(spec string) (tokenTransformerChain, error) {
+		return tokenTransformersFromConfiguration(config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub, Extra: map[string]string{tokenTransformersExtraKey: spec}})
+	}
+	farExpiry := uint64(time.Now().Add(24 * time.Hour).Unix())
+	token := func() *v1beta1.Token {
+		return &v1beta1.Token{AccessToken: "access", RefreshToken: "refresh", TokenType: "bearer", Expiry: farExpiry}
+	}
+
+	t.Run("nothing configured", func(t *testing.T) {
+		c, err := chain("")
+		assert.NoError(t, err)
+		tkn := token()
+		assert.NoError(t, c.Transform(context.TODO(), tkn))
+		assert.Equal(t, token(), tkn)
+	})
+
+	t.Run("applied in order", func(t *testing.T) {
+		c, err := chain(" stripRefreshToken, username=x-access-token ,tokenType=Bearer,maxLifetime=1h")
+		assert.NoError(t, err)
+		tkn := token()
+		assert.NoError(t, c.Transform(context.TODO(), tkn))
+		assert.Equal(t, "access", tkn.AccessToken)
+		assert.Empty(t, tkn.RefreshToken)
+		assert.Equal(t, "x-access-token", tkn.Username)
+		assert.Equal(t, "Bearer", tkn.TokenType)
+		assert.Less(t, tkn.Expiry, farExpiry)
+		assert.Greater(t, tkn.Expiry, uint64(time.Now().Unix()))
+	})
+
+	t.Run("max lifetime keeps shorter expiry", func(t *testing.T) {
+		c, err := chain("maxLifetime=48h")
+		assert.NoError(t, err)
+		tkn := token()
+		assert.NoError(t, c.Transform(context.TODO(), tkn))
+		assert.Equal(t, farExpiry, tkn.Expiry)
+	})
+
+	t.Run("unknown transformer", func(t *testing.T) {
+		_, err := chain("stripRefreshToken,encrypt")
+		assert.True(t, errors.Is(err, unknownTokenTransformerError))
+	})
+
+	t.Run("invalid argument", func(t *testing.T) {
+		for _, spec := range []string{"stripRefreshToken=yes", "username", "tokenType=", "maxLifetime=-1h", "maxLifetime=soon"} {
+			_, err := chain(spec)
+			assert.True(t, errors.Is(err, invalidTokenTransformerError), spec)
+		}
+	})
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// UploadSecretLabel is the label marking the Secrets the data of which are uploaded as the token data of
+	// an SPIAccessToken. The value of the label must be "token".
+	UploadSecretLabel = "spi.appstudio.redhat.com/upload-secret"
+	// UploadSecretTokenNameLabel is the label of the upload Secret with the name of the SPIAccessToken in the namespace
+	// of the Secret that the token data are uploaded to.
+	UploadSecretTokenNameLabel = "spi.appstudio.redhat.com/token-name"
+	// UploadSecretNamespaceLabel is the label of the namespaces opted in to the uploads from the Secrets. The value of
+	// the label must be "true". The watcher uploads with the credentials of the service, so without the opt-in, anyone
+	// able to create Secrets in a namespace could write the token data there.
+	UploadSecretNamespaceLabel = "spi.appstudio.redhat.com/upload-secrets"
+
+	uploadSecretLabelValue          = "token"
+	uploadSecretNamespaceLabelValue = "true"
+	// uploadSecretTokenDataKey is the key in the data of the upload Secret with the access token.
+	uploadSecretTokenDataKey = "tokenData"
+	// uploadSecretEventSource is the component the events of the upload Secret watcher are reported as.
+	uploadSecretEventSource = "spi-oauth-upload-secret"
+)
+
+// UploadSecretReconciler uploads the data of the labeled Secrets as the token data of the SPIAccessTokens. This is
+// an alternative to the upload endpoint for the GitOps-driven provisioning of the credentials. Only the Secrets in
+// the namespaces labeled with UploadSecretNamespaceLabel are uploaded. The Secrets are deleted once the token data are
+// uploaded so that the credentials are only kept in the token storage. The problems are reported as events of
+// the Secrets.
+type UploadSecretReconciler struct {
+	K8sClient    client.Client
+	TokenStorage tokenstorage.TokenStorage
+	Recorder     record.EventRecorder
+}
+
+var _ reconcile.Reconciler = (*UploadSecretReconciler)(nil)
+
+// NewUploadSecretWatcher creates the manager running the UploadSecretReconciler. The manager uses the provided
+// configuration as is, i.e. it acts with the credentials of the service itself and not of the users, and needs to be
+// able to watch and delete the Secrets, read the Namespaces and the SPIAccessTokens and create
+// the SPIAccessTokenDataUpdates and events.
+// The Secrets are watched in the provided namespaces or in all namespaces if none are provided. With the leader election
+// enabled, only one replica of the service uploads the Secrets, the others wait for the lease.
+func NewUploadSecretWatcher(cfg *rest.Config, storage tokenstorage.TokenStorage, namespaces []string, leaderElection LeaderElection) (manager.Manager, error) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to add corev1 to scheme: %w", err)
+	}
+	if err := api.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to add api to the scheme: %w", err)
+	}
+
+	options := manager.Options{
+		Scheme: scheme,
+		// the service has its own metrics server
+		MetricsBindAddress: "0",
+		// only the upload Secrets are cached, not all the Secrets in the cluster
+		NewCache: cache.BuilderWithOptions(cache.Options{SelectorsByObject: cache.SelectorsByObject{
+			&corev1.Secret{}: {Label: labels.SelectorFromSet(labels.Set{UploadSecretLabel: uploadSecretLabelValue})},
+		}}),
+	}
+	leaderElection.apply(&options)
+
+	mgr, err := ctrl.NewManager(cfg, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the manager of the upload secret watcher: %w", err)
+	}
+
+	reconciler := &UploadSecretReconciler{
+		// the SPIAccessTokens are read directly so that we don't need to cache all of them
+		K8sClient: apiReaderClient{Client: mgr.GetClient(), reader: mgr.GetAPIReader()},
+		TokenStorage: &tokenstorage.NotifyingTokenStorage{
+			Client:       mgr.GetClient(),
+			TokenStorage: storage,
+		},
+		Recorder: mgr.GetEventRecorderFor(uploadSecretEventSource),
+	}
+
+	inNamespaces := map[string]bool{}
+	for _, ns := range namespaces {
+		inNamespaces[ns] = true
+	}
+
+	err = ctrl.NewControllerManagedBy(mgr).
+		Named("upload-secret").
+		For(&corev1.Secret{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return len(inNamespaces) == 0 || inNamespaces[o.GetNamespace()]
+		}))).
+		Complete(reconciler)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the upload secret controller: %w", err)
+	}
+
+	return mgr, nil
+}
+
+// Reconcile uploads the data of the upload Secret to the token storage and deletes the Secret.
+func (r *UploadSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	lg := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	if err := r.K8sClient.Get(ctx, req.NamespacedName, secret); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err) //nolint:wrapcheck // the error is just passed to the controller-runtime
+	}
+	if secret.Labels[UploadSecretLabel] != uploadSecretLabelValue || !secret.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// there's no point in retrying the invalid Secrets, they're reconciled again once they're fixed
+	tokenName := secret.Labels[UploadSecretTokenNameLabel]
+	if tokenName == "" {
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, "InvalidUploadSecret", "the %s label with the name of the SPIAccessToken is missing", UploadSecretTokenNameLabel)
+		return ctrl.Result{}, nil
+	}
+	tokenData := secret.Data[uploadSecretTokenDataKey]
+	if len(tokenData) == 0 {
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, "InvalidUploadSecret", "the %s key with the token data is missing", uploadSecretTokenDataKey)
+		return ctrl.Result{}, nil
+	}
+
+	// the Secret is only uploaded once the namespace is opted in, the Secrets are reconciled again on the periodic resync
+	namespace := &corev1.Namespace{}
+	if err := r.K8sClient.Get(ctx, client.ObjectKey{Name: secret.Namespace}, namespace); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get the namespace %s of the upload secret: %w", secret.Namespace, err)
+	}
+	if namespace.Labels[UploadSecretNamespaceLabel] != uploadSecretNamespaceLabelValue {
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, "UploadSecretsNotEnabled", "the uploads from the Secrets are not enabled in the namespace, it needs the %s=%s label", UploadSecretNamespaceLabel, uploadSecretNamespaceLabelValue)
+		return ctrl.Result{}, nil
+	}
+
+	ctx = logging.WithTokenLogFields(ctx, secret.Namespace, tokenName)
+	accessToken := &api.SPIAccessToken{}
+	if err := r.K8sClient.Get(ctx, client.ObjectKey{Name: tokenName, Namespace: secret.Namespace}, accessToken); err != nil {
+		// the SPIAccessToken might be created later, so let's retry
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, "TokenNotFound", "failed to get the SPIAccessToken %s: %s", tokenName, err.Error())
+		return ctrl.Result{}, fmt.Errorf("failed to get the SPIAccessToken object %s/%s: %w", secret.Namespace, tokenName, err)
+	}
+
+	if err := r.TokenStorage.Store(ctx, accessToken, &api.Token{AccessToken: string(tokenData)}); err != nil {
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, "UploadFailed", "failed to upload the token data: %s", err.Error())
+		return ctrl.Result{}, fmt.Errorf("failed to persist the token to storage: %w", err)
+	}
+	logging.AuditLogWithTokenInfo(ctx, "token data uploaded from secret", secret.Namespace, tokenName, "secret", secret.Name)
+	r.Recorder.Eventf(accessToken, corev1.EventTypeNormal, "TokenUploaded", "the token data was uploaded from the Secret %s", secret.Name)
+
+	if err := r.K8sClient.Delete(ctx, secret); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to delete the uploaded secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	lg.V(logs.DebugLevel).Info("upload secret processed", "secret", secret.Name)
+
+	return ctrl.Result{}, nil
+}
+
+// apiReaderClient is a client.Client that reads everything except the Secrets directly from the API server instead of
+// the cache of the manager.
+type apiReaderClient struct {
+	client.Client
+	reader client.Reader
+}
+
+func (c apiReaderClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		return c.Client.Get(ctx, key, obj) //nolint:wrapcheck // we're just a transparent wrapper here
+	}
+	return c.reader.Get(ctx, key, obj) //nolint:wrapcheck // we're just a transparent wrapper here
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUploadSecretReconciler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, api.AddToScheme(scheme))
+
+	uploadSecret := func(labels map[string]string, data map[string][]byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "upload", Namespace: "default", Labels: labels},
+			Data:       data,
+		}
+	}
+	validLabels := map[string]string{UploadSecretLabel: "token", UploadSecretTokenNameLabel: "my-token"}
+	validData := map[string][]byte{"tokenData": []byte("access-token")}
+
+	optedIn := map[string]string{UploadSecretNamespaceLabel: "true"}
+
+	reconcileIn := func(t *testing.T, namespaceLabels map[string]string, secret *corev1.Secret, storage tokenstorage.TokenStorage) (client.Client, *record.FakeRecorder, error) {
+		cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret, &api.SPIAccessToken{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-token", Namespace: "default"},
+		}, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: namespaceLabels},
+		}).Build()
+		recorder := record.NewFakeRecorder(10)
+		reconciler := &UploadSecretReconciler{K8sClient: cl, TokenStorage: storage, Recorder: recorder}
+		_, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(secret)})
+		return cl, recorder, err
+	}
+	reconcile := func(t *testing.T, secret *corev1.Secret, storage tokenstorage.TokenStorage) (client.Client, *record.FakeRecorder, error) {
+		return reconcileIn(t, optedIn, secret, storage)
+	}
+	secretExists := func(t *testing.T, cl client.Client) bool {
+		err := cl.Get(context.TODO(), client.ObjectKey{Name: "upload", Namespace: "default"}, &corev1.Secret{})
+		if err != nil {
+			assert.True(t, apierrors.IsNotFound(err))
+		}
+		return err == nil
+	}
+
+	t.Run("uploads the token data and deletes the secret", func(t *testing.T) {
+		var stored *api.Token
+		storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			assert.Equal(t, "my-token", owner.Name)
+			stored = token
+			return nil
+		}}
+
+		cl, recorder, err := reconcile(t, uploadSecret(validLabels, validData), storage)
+		assert.NoError(t, err)
+		if assert.NotNil(t, stored) {
+			assert.Equal(t, "access-token", stored.AccessToken)
+		}
+		assert.False(t, secretExists(t, cl))
+		assert.Contains(t, <-recorder.Events, "TokenUploaded")
+	})
+
+	t.Run("ignores secrets without the upload label", func(t *testing.T) {
+		storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			t.Fatal("unexpected upload")
+			return nil
+		}}
+
+		cl, _, err := reconcile(t, uploadSecret(map[string]string{UploadSecretTokenNameLabel: "my-token"}, validData), storage)
+		assert.NoError(t, err)
+		assert.True(t, secretExists(t, cl))
+	})
+
+	t.Run("reports invalid secrets without retrying", func(t *testing.T) {
+		for _, secret := range []*corev1.Secret{
+			uploadSecret(map[string]string{UploadSecretLabel: "token"}, validData),
+			uploadSecret(validLabels, map[string][]byte{"password": []byte("access-token")}),
+		} {
+			cl, recorder, err := reconcile(t, secret, tokenstorage.TestTokenStorage{})
+			assert.NoError(t, err)
+			assert.True(t, secretExists(t, cl))
+			assert.Contains(t, <-recorder.Events, "InvalidUploadSecret")
+		}
+	})
+
+	t.Run("doesn't upload in the namespaces not opted in", func(t *testing.T) {
+		storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			t.Fatal("unexpected upload")
+			return nil
+		}}
+
+		for _, labels := range []map[string]string{nil, {UploadSecretNamespaceLabel: "false"}} {
+			cl, recorder, err := reconcileIn(t, labels, uploadSecret(validLabels, validData), storage)
+			assert.NoError(t, err)
+			assert.True(t, secretExists(t, cl))
+			assert.Contains(t, <-recorder.Events, "UploadSecretsNotEnabled")
+		}
+	})
+
+	t.Run("retries when the token doesn't exist", func(t *testing.T) {
+		labels := map[string]string{UploadSecretLabel: "token", UploadSecretTokenNameLabel: "other-token"}
+		cl, recorder, err := reconcile(t, uploadSecret(labels, validData), tokenstorage.TestTokenStorage{})
+		assert.Error(t, err)
+		assert.True(t, secretExists(t, cl))
+		assert.Contains(t, <-recorder.Events, "TokenNotFound")
+	})
+
+	t.Run("retries when the upload fails", func(t *testing.T) {
+		storage := tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			return errors.New("vault sealed")
+		}}
+
+		cl, recorder, err := reconcile(t, uploadSecret(validLabels, validData), storage)
+		assert.Error(t, err)
+		assert.True(t, secretExists(t, cl))
+		assert.Contains(t, <-recorder.Events, "UploadFailed")
+	})
+}
@@ -0,0 +1,343 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// userInfoUrlExtraKey is the key in the extra configuration of the service provider with the template of the URL of
+	// the endpoint describing the user the token belongs to. The template can refer to {{.BaseUrl}} of the service
+	// provider and to {{.ApiUrl}} of its REST API, e.g. "{{.BaseUrl}}/protocol/openid-connect/userinfo". GitHub and Quay
+	// have the endpoint configured by default.
+	userInfoUrlExtraKey = "userInfoUrl"
+	// userInfoAuthStyleExtraKey is the key in the extra configuration of the service provider specifying how the token
+	// is sent to the user info endpoint: "bearer" (the default), "token" for the "Authorization: token" header, or
+	// "query" for the access_token query parameter.
+	userInfoAuthStyleExtraKey = "userInfoAuthStyle"
+	// userInfoUsernameFieldExtraKey and userInfoIdFieldExtraKey are the keys in the extra configuration of the service
+	// provider with the fields of the user info response holding the username and the id of the user. Nested fields
+	// are separated by dots, e.g. "user.login". They default to the "preferred_username" and "sub" OpenID Connect
+	// claims for the service providers other than GitHub and Quay.
+	userInfoUsernameFieldExtraKey = "userInfoUsernameField"
+	userInfoIdFieldExtraKey       = "userInfoIdField"
+
+	userInfoAuthStyleBearer = "bearer"
+	userInfoAuthStyleToken  = "token"
+	userInfoAuthStyleQuery  = "query"
+)
+
+var (
+	invalidUserInfoUrlError       = errors.New("invalid user info URL")
+	invalidUserInfoAuthStyleError = errors.New("invalid user info auth style")
+	unsupportedUserInfoError      = spierrors.WithKind(spierrors.InvalidRequest, errors.New("looking up the user is not supported for the service provider of the token"))
+)
+
+// UserInfo describes the user of the service provider the token belongs to.
+type UserInfo struct {
+	// TokenValid tells whether the service provider accepted the token at all. The rest is empty if it didn't.
+	TokenValid bool `json:"tokenValid"`
+	// Username is the login of the user at the service provider.
+	Username string `json:"username,omitempty"`
+	// UserId is the id of the user at the service provider.
+	UserId string `json:"userId,omitempty"`
+}
+
+// UserInfoLookup asks the service provider about the user the token data belongs to.
+type UserInfoLookup interface {
+	// LookupUser looks up the user of the token data at the service provider with the serviceProviderUrl.
+	LookupUser(ctx context.Context, serviceProviderUrl string, data *api.Token) (UserInfo, error)
+}
+
+// ProviderUserInfoLookup is the UserInfoLookup using the user info endpoints of the service providers as configured
+// in their extra configuration.
+type ProviderUserInfoLookup struct {
+	client    *http.Client
+	endpoints []userInfoEndpoint
+}
+
+var _ UserInfoLookup = (*ProviderUserInfoLookup)(nil)
+
+// userInfoEndpoint is the user info endpoint of the service provider with the base URL.
+type userInfoEndpoint struct {
+	baseUrl       string
+	url           string
+	authStyle     string
+	usernameField string
+	idField       string
+}
+
+// NewProviderUserInfoLookup creates the lookup for the configured service providers that have the user info endpoint,
+// either by default or in their extra configuration.
+func NewProviderUserInfoLookup(serviceProviders []config.ServiceProviderConfiguration, client *http.Client) (*ProviderUserInfoLookup, error) {
+	lookup := &ProviderUserInfoLookup{client: client}
+	for _, sp := range serviceProviders {
+		endpoint, err := userInfoEndpointFromConfiguration(sp)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint != nil {
+			lookup.endpoints = append(lookup.endpoints, *endpoint)
+		}
+	}
+	return lookup, nil
+}
+
+// userInfoEndpointFromConfiguration reads the user info endpoint of the service provider from its extra configuration,
+// falling back to the defaults of the service provider type. Returns nil if the service provider has none.
+func userInfoEndpointFromConfiguration(spConfig config.ServiceProviderConfiguration) (*userInfoEndpoint, error) {
+	endpoint := &userInfoEndpoint{
+		authStyle:     userInfoAuthStyleBearer,
+		usernameField: "preferred_username",
+		idField:       "sub",
+	}
+	urlTemplate := ""
+	switch spConfig.ServiceProviderType {
+	case config.ServiceProviderTypeGitHub:
+		urlTemplate, endpoint.usernameField, endpoint.idField = "{{.ApiUrl}}/user", "login", "id"
+	case config.ServiceProviderTypeQuay:
+		urlTemplate, endpoint.usernameField, endpoint.idField = "{{.ApiUrl}}/user/", "username", ""
+	}
+	if value := spConfig.Extra[userInfoUrlExtraKey]; value != "" {
+		urlTemplate = value
+	}
+	if urlTemplate == "" {
+		return nil, nil
+	}
+
+	baseUrl, err := serviceProviderBaseUrl(spConfig)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.baseUrl = baseUrl
+	if endpoint.url, err = userInfoUrl(urlTemplate, spConfig.ServiceProviderType, baseUrl); err != nil {
+		return nil, fmt.Errorf("%w '%s' configured for service provider %s: %s", invalidUserInfoUrlError, urlTemplate, spConfig.ServiceProviderType, err.Error())
+	}
+
+	switch style := spConfig.Extra[userInfoAuthStyleExtraKey]; style {
+	case "":
+	case userInfoAuthStyleBearer, userInfoAuthStyleToken, userInfoAuthStyleQuery:
+		endpoint.authStyle = style
+	default:
+		return nil, fmt.Errorf("%w '%s' configured for service provider %s", invalidUserInfoAuthStyleError, style, spConfig.ServiceProviderType)
+	}
+	if field, ok := spConfig.Extra[userInfoUsernameFieldExtraKey]; ok {
+		endpoint.usernameField = field
+	}
+	if field, ok := spConfig.Extra[userInfoIdFieldExtraKey]; ok {
+		endpoint.idField = field
+	}
+	return endpoint, nil
+}
+
+// userInfoUrl renders the template of the user info URL for the service provider with the base URL.
+func userInfoUrl(urlTemplate string, serviceProviderType config.ServiceProviderType, baseUrl string) (string, error) {
+	tmpl, err := template.New("userInfoUrl").Option("missingkey=error").Parse(urlTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the template: %w", err)
+	}
+	sb := strings.Builder{}
+	if err = tmpl.Execute(&sb, map[string]string{"BaseUrl": baseUrl, "ApiUrl": repositoryApiUrl(serviceProviderType, baseUrl)}); err != nil {
+		return "", fmt.Errorf("failed to render the template: %w", err)
+	}
+	u, err := url.Parse(sb.String())
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("%w: not an absolute http(s) URL: %s", invalidUserInfoUrlError, sb.String())
+	}
+	return u.String(), nil
+}
+
+// LookupUser implements UserInfoLookup. The failures of the service provider are returned as
+// the spierrors.ProviderError, the rejected token is a part of the result.
+func (l *ProviderUserInfoLookup) LookupUser(ctx context.Context, serviceProviderUrl string, data *api.Token) (UserInfo, error) {
+	endpoint := l.endpointFor(serviceProviderUrl)
+	if endpoint == nil {
+		return UserInfo{}, fmt.Errorf("%w: %s", unsupportedUserInfoError, serviceProviderUrl)
+	}
+
+	req, err := endpoint.request(ctx, data.AccessToken)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	res, err := l.client.Do(req)
+	if err != nil {
+		return UserInfo{}, &spierrors.ProviderError{Err: err}
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		response := map[string]interface{}{}
+		decoder := json.NewDecoder(res.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&response); err != nil {
+			return UserInfo{}, &spierrors.ProviderError{Code: res.StatusCode, Err: fmt.Errorf("failed to decode the user info: %w", err)}
+		}
+		return UserInfo{
+			TokenValid: true,
+			Username:   userInfoField(response, endpoint.usernameField),
+			UserId:     userInfoField(response, endpoint.idField),
+		}, nil
+	case http.StatusUnauthorized:
+		return UserInfo{}, nil
+	default:
+		// the body is read so that the connection can be reused
+		_, _ = io.Copy(io.Discard, res.Body)
+		return UserInfo{}, &spierrors.ProviderError{Code: res.StatusCode, Err: fmt.Errorf("%w to %s", unexpectedProviderResponseError, endpoint.url)}
+	}
+}
+
+// request creates the request to the user info endpoint carrying the access token in the configured way.
+func (e *userInfoEndpoint) request(ctx context.Context, accessToken string) (*http.Request, error) {
+	requestUrl := e.url
+	if e.authStyle == userInfoAuthStyleQuery {
+		u, _ := url.Parse(e.url) // validated in the configuration
+		query := u.Query()
+		query.Set("access_token", accessToken)
+		u.RawQuery = query.Encode()
+		requestUrl = u.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", requestUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the user info request: %w", err)
+	}
+	switch e.authStyle {
+	case userInfoAuthStyleBearer:
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	case userInfoAuthStyleToken:
+		req.Header.Set("Authorization", "token "+accessToken)
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// endpointFor returns the user info endpoint of the service provider with the longest base URL
+// the serviceProviderUrl belongs to.
+func (l *ProviderUserInfoLookup) endpointFor(serviceProviderUrl string) *userInfoEndpoint {
+	i := longestBaseUrlMatch(serviceProviderUrl, len(l.endpoints), func(i int) string { return l.endpoints[i].baseUrl })
+	if i < 0 {
+		return nil
+	}
+	return &l.endpoints[i]
+}
+
+// userInfoField returns the value of the field with the dot-separated path in the user info response as a string.
+// The value is empty if the path is empty, if the field is missing or if it is not a string or a number.
+func userInfoField(response map[string]interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+	var value interface{} = response
+	for _, segment := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[segment]
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return ""
+	}
+}
+
+// TokenUserHandler returns a Handler implementation that validates the token data of the SPIAccessToken by looking up
+// its user at the service provider and responds with the UserInfo. The requests need to carry the bearer token of
+// a user that can read the SPIAccessToken. The token data itself is never returned.
+func TokenUserHandler(k8sClient auth.AuthenticatingClient, storage tokenstorage.TokenStorage, lookup UserInfoLookup) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, token, data, ok := readTokenData(w, r, k8sClient, storage)
+		if !ok {
+			return
+		}
+
+		info, err := lookup.LookupUser(r.Context(), token.Spec.ServiceProviderUrl, data)
+		if err != nil {
+			logging.LogErrorAndWriteResponse(r.Context(), w, spierrors.HttpStatus(err), "failed to look up the user of the token", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(info); err != nil {
+			log.FromContext(r.Context()).Error(err, "error recording the user info")
+		}
+	}
+}
+
+// UserInfoTokenStorage is a wrapper around TokenStorage that fills in the username of the tokens stored without it
+// using the user info endpoint of their service provider. The token is stored as is if the lookup fails.
+type UserInfoTokenStorage struct {
+	// TokenStorage is the token storage to delegate the actual storage operations to.
+	TokenStorage tokenstorage.TokenStorage
+	// Lookup looks up the users of the tokens.
+	Lookup UserInfoLookup
+}
+
+var _ tokenstorage.TokenStorage = (*UserInfoTokenStorage)(nil)
+
+func (s *UserInfoTokenStorage) Store(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+	if token.Username == "" {
+		info, err := s.Lookup.LookupUser(ctx, owner.Spec.ServiceProviderUrl, token)
+		switch {
+		case errors.Is(err, unsupportedUserInfoError):
+		case err != nil:
+			log.FromContext(ctx).Error(err, "failed to look up the user of the token", "namespace", owner.Namespace, "name", owner.Name)
+		case info.Username != "":
+			withUsername := *token
+			withUsername.Username = info.Username
+			token = &withUsername
+		}
+	}
+
+	if err := s.TokenStorage.Store(ctx, owner, token); err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return nil
+}
+
+func (s *UserInfoTokenStorage) Get(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+	token, err := s.TokenStorage.Get(ctx, owner)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return token, nil
+}
+
+func (s *UserInfoTokenStorage) Delete(ctx context.Context, owner *api.SPIAccessToken) error {
+	if err := s.TokenStorage.Delete(ctx, owner); err != nil {
+		return fmt.Errorf("wrapped storage error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kcp-dev/logicalcluster/v2"
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUserInfoEndpointFromConfiguration(t *testing.T) {
+	tests := []struct {
+		name     string
+		spConfig config.ServiceProviderConfiguration
+		expected *userInfoEndpoint
+		err      error
+	}{
+		{
+			name:     "github default",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub},
+			expected: &userInfoEndpoint{baseUrl: "https://github.com", url: "https://api.github.com/user", authStyle: "bearer", usernameField: "login", idField: "id"},
+		},
+		{
+			name:     "github enterprise",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub, ServiceProviderBaseUrl: "https://ghe.corp"},
+			expected: &userInfoEndpoint{baseUrl: "https://ghe.corp", url: "https://ghe.corp/api/v3/user", authStyle: "bearer", usernameField: "login", idField: "id"},
+		},
+		{
+			name:     "quay default",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeQuay},
+			expected: &userInfoEndpoint{baseUrl: "https://quay.io", url: "https://quay.io/api/v1/user/", authStyle: "bearer", usernameField: "username"},
+		},
+		{
+			name: "generic provider",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: "Keycloak", ServiceProviderBaseUrl: "https://sso.corp/realms/r", Extra: map[string]string{
+				userInfoUrlExtraKey: "{{.BaseUrl}}/protocol/openid-connect/userinfo",
+			}},
+			expected: &userInfoEndpoint{baseUrl: "https://sso.corp/realms/r", url: "https://sso.corp/realms/r/protocol/openid-connect/userinfo", authStyle: "bearer", usernameField: "preferred_username", idField: "sub"},
+		},
+		{
+			name: "overridden mapping",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub, Extra: map[string]string{
+				userInfoAuthStyleExtraKey:     "token",
+				userInfoUsernameFieldExtraKey: "user.name",
+				userInfoIdFieldExtraKey:       "",
+			}},
+			expected: &userInfoEndpoint{baseUrl: "https://github.com", url: "https://api.github.com/user", authStyle: "token", usernameField: "user.name"},
+		},
+		{
+			name:     "generic provider without endpoint",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: "Keycloak", ServiceProviderBaseUrl: "https://sso.corp"},
+		},
+		{
+			name: "invalid template",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: "Keycloak", ServiceProviderBaseUrl: "https://sso.corp", Extra: map[string]string{
+				userInfoUrlExtraKey: "{{.Unknown}}/userinfo",
+			}},
+			err: invalidUserInfoUrlError,
+		},
+		{
+			name: "relative URL",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: "Keycloak", ServiceProviderBaseUrl: "https://sso.corp", Extra: map[string]string{
+				userInfoUrlExtraKey: "/userinfo",
+			}},
+			err: invalidUserInfoUrlError,
+		},
+		{
+			name: "invalid auth style",
+			spConfig: config.ServiceProviderConfiguration{ServiceProviderType: config.ServiceProviderTypeGitHub, Extra: map[string]string{
+				userInfoAuthStyleExtraKey: "basic",
+			}},
+			err: invalidUserInfoAuthStyleError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoint, err := userInfoEndpointFromConfiguration(test.spConfig)
+			if test.err != nil {
+				assert.ErrorIs(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, endpoint)
+		})
+	}
+}
+
+func TestProviderUserInfoLookup(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized := r.Header.Get("Authorization") == "Bearer valid" || r.Header.Get("Authorization") == "token valid" || r.URL.Query().Get("access_token") == "valid"
+		if !authorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v3/user":
+			_, _ = w.Write([]byte(`{"login": "octocat", "id": 583231}`))
+		case "/oidc/userinfo":
+			_, _ = w.Write([]byte(`{"sub": "f1d2", "preferred_username": "jdoe", "profile": {"nick": "jd"}}`))
+		case "/broken/userinfo":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer provider.Close()
+
+	lookup, err := NewProviderUserInfoLookup([]config.ServiceProviderConfiguration{
+		{ServiceProviderType: config.ServiceProviderTypeGitHub, ServiceProviderBaseUrl: provider.URL},
+		{ServiceProviderType: "OIDC", ServiceProviderBaseUrl: provider.URL + "/oidc", Extra: map[string]string{
+			userInfoUrlExtraKey: "{{.BaseUrl}}/userinfo",
+		}},
+		{ServiceProviderType: "OIDC", ServiceProviderBaseUrl: provider.URL + "/oidc/nick", Extra: map[string]string{
+			userInfoUrlExtraKey:           provider.URL + "/oidc/userinfo",
+			userInfoAuthStyleExtraKey:     "query",
+			userInfoUsernameFieldExtraKey: "profile.nick",
+		}},
+		{ServiceProviderType: "OIDC", ServiceProviderBaseUrl: provider.URL + "/broken", Extra: map[string]string{
+			userInfoUrlExtraKey: "{{.BaseUrl}}/userinfo",
+		}},
+	}, provider.Client())
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		serviceProviderUrl string
+		token              string
+		expected           UserInfo
+		providerStatus     int
+		err                error
+	}{
+		{
+			name:               "github",
+			serviceProviderUrl: provider.URL,
+			token:              "valid",
+			expected:           UserInfo{TokenValid: true, Username: "octocat", UserId: "583231"},
+		},
+		{
+			name:               "oidc",
+			serviceProviderUrl: provider.URL + "/oidc",
+			token:              "valid",
+			expected:           UserInfo{TokenValid: true, Username: "jdoe", UserId: "f1d2"},
+		},
+		{
+			name:               "nested field with query auth",
+			serviceProviderUrl: provider.URL + "/oidc/nick",
+			token:              "valid",
+			expected:           UserInfo{TokenValid: true, Username: "jd", UserId: "f1d2"},
+		},
+		{
+			name:               "invalid token",
+			serviceProviderUrl: provider.URL + "/oidc",
+			token:              "revoked",
+			expected:           UserInfo{},
+		},
+		{
+			name:               "provider failure",
+			serviceProviderUrl: provider.URL + "/broken",
+			token:              "valid",
+			providerStatus:     http.StatusInternalServerError,
+		},
+		{
+			name:               "unsupported service provider",
+			serviceProviderUrl: "https://gitlab.com",
+			token:              "valid",
+			err:                unsupportedUserInfoError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := lookup.LookupUser(context.TODO(), test.serviceProviderUrl, &api.Token{AccessToken: test.token})
+			switch {
+			case test.err != nil:
+				assert.ErrorIs(t, err, test.err)
+			case test.providerStatus != 0:
+				var providerErr *spierrors.ProviderError
+				if assert.True(t, errors.As(err, &providerErr)) {
+					assert.Equal(t, test.providerStatus, providerErr.Code)
+				}
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, test.expected, info)
+			}
+		})
+	}
+}
+
+type userInfoLookupFunc func(ctx context.Context, serviceProviderUrl string, data *api.Token) (UserInfo, error)
+
+func (f userInfoLookupFunc) LookupUser(ctx context.Context, serviceProviderUrl string, data *api.Token) (UserInfo, error) {
+	return f(ctx, serviceProviderUrl, data)
+}
+
+func TestUserInfoTokenStorage(t *testing.T) {
+	var stored *api.Token
+	lookups := 0
+	storage := &UserInfoTokenStorage{
+		TokenStorage: tokenstorage.TestTokenStorage{StoreImpl: func(ctx context.Context, owner *api.SPIAccessToken, token *api.Token) error {
+			stored = token
+			return nil
+		}},
+		Lookup: userInfoLookupFunc(func(ctx context.Context, serviceProviderUrl string, data *api.Token) (UserInfo, error) {
+			lookups++
+			switch serviceProviderUrl {
+			case "https://github.com":
+				return UserInfo{TokenValid: true, Username: "octocat"}, nil
+			case "https://broken.com":
+				return UserInfo{}, &spierrors.ProviderError{Code: http.StatusInternalServerError, Err: errors.New("broken")}
+			default:
+				return UserInfo{}, unsupportedUserInfoError
+			}
+		}),
+	}
+	store := func(serviceProviderUrl string, token *api.Token) {
+		owner := &api.SPIAccessToken{Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: serviceProviderUrl}}
+		assert.NoError(t, storage.Store(context.TODO(), owner, token))
+	}
+
+	t.Run("fills in the username", func(t *testing.T) {
+		token := &api.Token{AccessToken: "token"}
+		store("https://github.com", token)
+		assert.Equal(t, "octocat", stored.Username)
+		assert.Equal(t, "", token.Username, "the provided token must not be modified")
+	})
+
+	t.Run("keeps the username", func(t *testing.T) {
+		before := lookups
+		store("https://github.com", &api.Token{AccessToken: "token", Username: "x-access-token"})
+		assert.Equal(t, "x-access-token", stored.Username)
+		assert.Equal(t, before, lookups)
+	})
+
+	t.Run("stores on lookup failure", func(t *testing.T) {
+		store("https://broken.com", &api.Token{AccessToken: "token"})
+		assert.Equal(t, "", stored.Username)
+	})
+
+	t.Run("stores for unsupported provider", func(t *testing.T) {
+		store("https://gitlab.com", &api.Token{AccessToken: "token"})
+		assert.Equal(t, "", stored.Username)
+	})
+}
+
+func TestTokenUserHandler(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, api.AddToScheme(scheme))
+	cl := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "linked", Namespace: "default"}, Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: "https://github.com"}},
+		&api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "unsupported", Namespace: "default"}, Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: "https://gitlab.com"}},
+		&api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: "unlinked", Namespace: "default"}, Spec: api.SPIAccessTokenSpec{ServiceProviderUrl: "https://github.com"}},
+	).Build()
+	var storageWorkspace logicalcluster.Name
+	storage := tokenstorage.TestTokenStorage{
+		GetImpl: func(ctx context.Context, token *api.SPIAccessToken) (*api.Token, error) {
+			storageWorkspace, _ = logicalcluster.ClusterFromContext(ctx)
+			if token.Name == "unlinked" {
+				return nil, nil
+			}
+			return &api.Token{AccessToken: "secret"}, nil
+		},
+	}
+	lookup := userInfoLookupFunc(func(ctx context.Context, serviceProviderUrl string, data *api.Token) (UserInfo, error) {
+		assert.Equal(t, "secret", data.AccessToken)
+		if serviceProviderUrl != "https://github.com" {
+			return UserInfo{}, unsupportedUserInfoError
+		}
+		return UserInfo{TokenValid: true, Username: "octocat", UserId: "1"}, nil
+	})
+
+	router := mux.NewRouter()
+	for _, path := range []string{"/token/{namespace}/{name}/user", "/token/{kcpWorkspace}/{namespace}/{name}/user"} {
+		router.HandleFunc(path, TokenUserHandler(cl, storage, lookup))
+	}
+	user := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/token/default/"+name+"/user", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("user info", func(t *testing.T) {
+		rr := user("linked")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		info := UserInfo{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+		assert.Equal(t, UserInfo{TokenValid: true, Username: "octocat", UserId: "1"}, info)
+		assert.NotContains(t, rr.Body.String(), "secret")
+	})
+
+	t.Run("unsupported service provider", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, user("unsupported").Code)
+	})
+
+	t.Run("no token data", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, user("unlinked").Code)
+	})
+
+	t.Run("no SPIAccessToken", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, user("missing").Code)
+	})
+
+	t.Run("kcp workspace", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/token/workspace/default/linked/user", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, logicalcluster.New("workspace"), storageWorkspace)
+	})
+}
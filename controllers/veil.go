@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+const (
+	// DefaultVeilEntropyBits is the default amount of randomness in the veils of the OAuth states.
+	DefaultVeilEntropyBits = 256
+	// MinVeilEntropyBits is the least amount of randomness we allow in the veils of the OAuth states.
+	MinVeilEntropyBits = 128
+)
+
+var (
+	invalidVeilEntropyError     = errors.New("invalid veil entropy")
+	randomStringGenerationError = errors.New("not able to generate new random string")
+)
+
+// NewVeil generates a new random string with the given number of bits of entropy, encoded using the URL-safe base64
+// alphabet without padding so that it can be safely used in URLs. The entropy must be a multiple of 8 and at least
+// MinVeilEntropyBits.
+func NewVeil(entropyBits int) (string, error) {
+	if err := ValidateVeilEntropy(entropyBits); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, entropyBits/8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("%w: %s", randomStringGenerationError, err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ValidateVeilEntropy checks that the entropy can be used to generate the veils.
+func ValidateVeilEntropy(entropyBits int) error {
+	if entropyBits < MinVeilEntropyBits || entropyBits%8 != 0 {
+		return fmt.Errorf("%w: %d bits requested but it must be a multiple of 8 and at least %d", invalidVeilEntropyError, entropyBits, MinVeilEntropyBits)
+	}
+	return nil
+}
+
+// isVeil checks that the string has the format of the veils generated by NewVeil with at least MinVeilEntropyBits of
+// entropy. This is used to tell the veils apart from the other keys kept in the session.
+func isVeil(s string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil && len(b)*8 >= MinVeilEntropyBits
+}
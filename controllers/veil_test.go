@@ -0,0 +1,76 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVeil(t *testing.T) {
+	t.Run("has the requested entropy", func(t *testing.T) {
+		veil, err := NewVeil(DefaultVeilEntropyBits)
+		assert.NoError(t, err)
+		assert.Equal(t, 43, len(veil))
+
+		decoded, err := base64.RawURLEncoding.DecodeString(veil)
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultVeilEntropyBits/8, len(decoded))
+	})
+
+	t.Run("is URL safe", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			veil, err := NewVeil(MinVeilEntropyBits)
+			assert.NoError(t, err)
+			assert.NotContains(t, veil, "+")
+			assert.NotContains(t, veil, "/")
+			assert.NotContains(t, veil, "=")
+		}
+	})
+
+	t.Run("is random", func(t *testing.T) {
+		veils := map[string]bool{}
+		for i := 0; i < 1000; i++ {
+			veil, err := NewVeil(DefaultVeilEntropyBits)
+			assert.NoError(t, err)
+			veils[veil] = true
+		}
+		assert.Equal(t, 1000, len(veils))
+	})
+
+	t.Run("rejects invalid entropy", func(t *testing.T) {
+		for _, bits := range []int{0, 64, MinVeilEntropyBits - 8, MinVeilEntropyBits + 1} {
+			veil, err := NewVeil(bits)
+			assert.True(t, errors.Is(err, invalidVeilEntropyError), "bits: %d", bits)
+			assert.Empty(t, veil)
+		}
+	})
+}
+
+func BenchmarkNewVeil(b *testing.B) {
+	for _, bits := range []int{MinVeilEntropyBits, DefaultVeilEntropyBits, 512} {
+		b.Run(fmt.Sprintf("%d bits", bits), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := NewVeil(bits); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
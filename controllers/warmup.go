@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// warmUpTokenName is the name and namespace of the SPIAccessToken read from the token storage during the warm-up.
+	// It doesn't need to exist, the read is only there to establish the connection.
+	warmUpTokenName = "spi-oauth-warm-up"
+	// warmUpMaxBodySize limits how much of the responses of the token endpoints is read during the warm-up.
+	warmUpMaxBodySize = 64 * 1024
+)
+
+var warmUpFailedError = errors.New("warm-up failed")
+
+// WarmUp pre-establishes the connections to the token storage and to the token endpoints of the service providers so
+// that the first OAuth flows after the start of the service don't pay for the DNS lookups, TCP and TLS handshakes.
+// The token endpoints are contacted using http.DefaultClient, which is the client the OAuth exchange uses, so that
+// the established connections are kept in its pool and reused by the exchange. Note that the pooled connections are
+// closed after being idle for a while (90 seconds in http.DefaultTransport).
+//
+// The warm-up is best-effort. All the targets are tried in parallel until the context is done and the returned error
+// only reports how many of them failed. The details are logged.
+func WarmUp(ctx context.Context, storage tokenstorage.TokenStorage, serviceProviders []config.ServiceProviderConfiguration) error {
+	lg := log.FromContext(ctx)
+
+	targets := map[string]func(context.Context) error{
+		"tokenStorage": func(ctx context.Context) error {
+			_, err := storage.Get(ctx, &api.SPIAccessToken{ObjectMeta: metav1.ObjectMeta{Name: warmUpTokenName, Namespace: warmUpTokenName}})
+			if err != nil {
+				return fmt.Errorf("failed to read from the token storage: %w", err)
+			}
+			return nil
+		},
+	}
+	for _, sp := range serviceProviders {
+		// the canary provider is served by this service which is not listening yet
+		if sp.ServiceProviderType == CanaryServiceProviderType {
+			continue
+		}
+		endpoint, err := endpointFromConfiguration(sp)
+		if err != nil {
+			continue
+		}
+		tokenUrl := endpoint.TokenURL
+		targets[string(sp.ServiceProviderType)] = func(ctx context.Context) error {
+			return warmUpEndpoint(ctx, http.DefaultClient, tokenUrl)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	failed := 0
+	for name, warmUp := range targets {
+		wg.Add(1)
+		go func(name string, warmUp func(context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := warmUp(ctx)
+			if err != nil {
+				lg.Error(err, "failed to warm up the connection", "target", name, "duration", time.Since(start))
+				lock.Lock()
+				failed++
+				lock.Unlock()
+				return
+			}
+			lg.Info("connection warmed up", "target", name, "duration", time.Since(start))
+		}(name, warmUp)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d targets failed", warmUpFailedError, failed, len(targets))
+	}
+	return nil
+}
+
+// warmUpEndpoint makes a HEAD request to the URL using the client. The status of the response doesn't matter,
+// the point is to leave an established connection in the pool of the client.
+func warmUpEndpoint(ctx context.Context, client *http.Client, endpointUrl string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpointUrl, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create the warm-up request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform the warm-up request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// the connection is only returned to the pool once the body is read
+	if _, err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, warmUpMaxBodySize)); err != nil {
+		return fmt.Errorf("failed to read the warm-up response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	api "github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmUp(t *testing.T) {
+	t.Run("reads from the token storage", func(t *testing.T) {
+		reads := 0
+		storage := tokenstorage.TestTokenStorage{GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+			reads++
+			return nil, nil
+		}}
+
+		assert.NoError(t, WarmUp(context.TODO(), storage, []config.ServiceProviderConfiguration{CanaryServiceProviderConfiguration("http://localhost:1", "secret")}))
+		assert.Equal(t, 1, reads)
+	})
+
+	t.Run("reports failures", func(t *testing.T) {
+		storage := tokenstorage.TestTokenStorage{GetImpl: func(ctx context.Context, owner *api.SPIAccessToken) (*api.Token, error) {
+			return nil, errors.New("vault sealed")
+		}}
+
+		err := WarmUp(context.TODO(), storage, nil)
+		assert.True(t, errors.Is(err, warmUpFailedError))
+	})
+}
+
+func TestWarmUpEndpoint(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	assert.NoError(t, warmUpEndpoint(context.TODO(), client, server.URL+"/token"))
+
+	// the subsequent request reuses the connection established by the warm-up
+	resp, err := client.Post(server.URL+"/token", "application/x-www-form-urlencoded", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, resp.Body.Close())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The grafana-dashboard command prints the JSON model of the Grafana dashboard of the service. It is used by
+// `make grafana_dashboard` to regenerate the dashboard shipped in the dashboards directory.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+)
+
+func main() {
+	dashboard, err := controllers.GrafanaDashboardJson()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := os.Stdout.Write(dashboard); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
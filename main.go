@@ -16,44 +16,67 @@ package main
 import (
 	"context"
 	"fmt"
-	"html/template"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"time"
 
-	"go.uber.org/zap"
-
 	"github.com/alexedwards/scs/v2"
-	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
 
-	"github.com/alexedwards/scs/v2/memstore"
 	"github.com/alexflint/go-arg"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redhat-appstudio/service-provider-integration-oauth/controllers"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/auth"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/middleware"
 	"github.com/redhat-appstudio/service-provider-integration-operator/api/v1beta1"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/config"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/tokenstorage"
+	authn "k8s.io/api/authentication/v1"
 	authz "k8s.io/api/authorization/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	certutil "k8s.io/client-go/util/cert"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// defaultRouteTimeout is the time the routes have to produce the response unless they need more.
+	defaultRouteTimeout = 10 * time.Second
+	// callbackRouteTimeout is the time the OAuth callbacks have to finish the exchange and store the token.
+	callbackRouteTimeout = 14 * time.Second
+	// maxUploadBodySize is the maximum size of the token data that can be uploaded.
+	maxUploadBodySize = 64 * 1024
+	// maxFlowBodySize is the maximum size of the request starting the OAuth flow using the flows API.
+	maxFlowBodySize = 16 * 1024
+	// loginRateLimit and loginRateBurst limit the number of the login requests per second to protect the cluster.
+	loginRateLimit = 20
+	loginRateBurst = 50
+	// canaryRateLimit and canaryRateBurst limit the number of the requests per second to the canary service provider,
+	// which only serves the canary flows run every few minutes.
+	canaryRateLimit = 1
+	canaryRateBurst = 5
 )
 
+// version is the version of the service. It is set during the build using -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
 	args := controllers.OAuthServiceCliArgs{}
 	arg.MustParse(&args)
 
-	logs.InitLoggers(args.ZapDevel, args.ZapEncoder, args.ZapLogLevel, args.ZapStackTraceLevel, args.ZapTimeEncoding)
+	if err := controllers.InitLogging(args.LoggingCliArgs, args.LogCaller); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	setupLog := ctrl.Log.WithName("setup")
-	setupLog.Info("Starting OAuth service with environment", "env", os.Environ(), "configuration", &args)
+	setupLog.Info("Starting OAuth service with environment", "version", version, "env", os.Environ(), "configuration", &args)
 
 	cfg, err := controllers.LoadOAuthServiceConfiguration(args)
 	if err != nil {
@@ -67,22 +90,28 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err = controllers.RegisterMetrics(metrics.Registry); err != nil {
+		setupLog.Error(err, "failed to register the metrics")
+		os.Exit(1)
+	}
+
 	router := mux.NewRouter()
 
-	// insecure mode only allowed when the trusted root certificate is not specified...
-	if args.KubeInsecureTLS && kubeConfig.TLSClientConfig.CAFile == "" {
-		kubeConfig.Insecure = true
-	}
+	configureKubeClient(kubeConfig, &args)
 
 	// we can't use the default dynamic rest mapper, because we don't have a token that would enable us to connect
 	// to the cluster just yet. Therefore, we need to list all the resources that we are ever going to query using our
 	// client here thus making the mapper not reach out to the target cluster at all.
 	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{})
 	mapper.Add(authz.SchemeGroupVersion.WithKind("SelfSubjectAccessReview"), meta.RESTScopeRoot)
-	//	mapper.Add(auth.SchemeGroupVersion.WithKind("TokenReview"), meta.RESTScopeRoot)
+	mapper.Add(authn.SchemeGroupVersion.WithKind("TokenReview"), meta.RESTScopeRoot)
 	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessToken"), meta.RESTScopeNamespace)
 	mapper.Add(v1beta1.GroupVersion.WithKind("SPIAccessTokenDataUpdate"), meta.RESTScopeNamespace)
 
+	// the client of the service authenticates the requests with the tokens of the users, the configuration is modified
+	// by CreateClient so let's keep a copy with the credentials of the service
+	serviceKubeConfig := rest.CopyConfig(kubeConfig)
+
 	cl, err := controllers.CreateClient(kubeConfig, client.Options{
 		Mapper: mapper,
 	})
@@ -92,6 +121,36 @@ func main() {
 		return
 	}
 
+	if args.ClustersConfigFile != "" {
+		clustersCfg, err := controllers.LoadClustersConfiguration(args.ClustersConfigFile)
+		if err != nil {
+			setupLog.Error(err, "failed to load the member clusters configuration")
+			return
+		}
+
+		members := make([]controllers.MemberCluster, 0, len(clustersCfg.Clusters))
+		for _, c := range clustersCfg.Clusters {
+			memberConfig, err := controllers.ApiServerConfig(c.ApiServer, c.CAPath)
+			if err != nil {
+				setupLog.Error(err, "failed to create the configuration of the member cluster", "cluster", c.Name)
+				return
+			}
+			configureKubeClient(memberConfig, &args)
+
+			memberClient, err := controllers.CreateClient(memberConfig, client.Options{
+				Mapper: mapper,
+			})
+			if err != nil {
+				setupLog.Error(err, "failed to create the client of the member cluster", "cluster", c.Name)
+				return
+			}
+
+			setupLog.Info("using member cluster", "cluster", c.Name, "apiServer", c.ApiServer, "namespaces", c.Namespaces)
+			members = append(members, controllers.MemberCluster{Name: c.Name, Namespaces: c.Namespaces, Client: memberClient})
+		}
+		cl = controllers.NewClusterRoutingClient(cl, members)
+	}
+
 	strg, err := tokenstorage.NewVaultStorage(&tokenstorage.VaultStorageConfig{
 		Host:                        args.VaultHost,
 		AuthType:                    args.VaultAuthMethod,
@@ -106,92 +165,553 @@ func main() {
 		return
 	}
 
+	tokenStorage := tokenstorage.TokenStorage(&controllers.InstrumentedTokenStorage{TokenStorage: strg})
+	if args.TokenStorageCacheTTL > 0 {
+		tokenStorage = controllers.NewCachingTokenStorage(tokenStorage, args.TokenStorageCacheTTL)
+	}
+	// the requests to the APIs of the service providers are counted so that their quotas can be monitored
+	providerClient := &http.Client{Transport: &controllers.ProviderMetricsTransport{}}
+	userInfoLookup, err := controllers.NewProviderUserInfoLookup(cfg.ServiceProviders, providerClient)
+	if err != nil {
+		setupLog.Error(err, "invalid configuration of the user info endpoints")
+		return
+	}
+	if args.UserInfoEnrichment {
+		tokenStorage = &controllers.UserInfoTokenStorage{TokenStorage: tokenStorage, Lookup: userInfoLookup}
+	}
+	// the client of the service is used where the token of the user is not available or not to be used
+	serviceClient, err := controllers.CreateServiceClient(rest.CopyConfig(serviceKubeConfig), client.Options{
+		Mapper: mapper,
+	})
+	if err != nil {
+		setupLog.Error(err, "failed to create the kubernetes client of the service")
+		return
+	}
+	expiryPolicy, err := controllers.SyntheticExpiryPolicyFromConfiguration(args.TokenMaxAge, cfg.ServiceProviders)
+	if err != nil {
+		setupLog.Error(err, "invalid configuration of the token max age")
+		return
+	}
+	// the tokens are also stored by the watchers and on behalf of others, so the annotation is put by the service
+	tokenStorage = &controllers.SyntheticExpiryTokenStorage{TokenStorage: tokenStorage, K8sClient: serviceClient, Policy: expiryPolicy}
+
+	var uploadSecretWatcher manager.Manager
+	if args.UploadSecrets {
+		var namespaces []string
+		if args.UploadSecretNamespaces != "" {
+			namespaces = strings.Split(args.UploadSecretNamespaces, ",")
+		}
+		if uploadSecretWatcher, err = controllers.NewUploadSecretWatcher(serviceKubeConfig, tokenStorage, namespaces, controllers.LeaderElection{
+			Enabled:   args.LeaderElection,
+			ID:        args.UploadSecretLeaderElectionID,
+			Namespace: args.LeaderElectionNamespace,
+		}); err != nil {
+			setupLog.Error(err, "failed to create the upload secret watcher")
+			return
+		}
+	}
+
+	var tokenCleanupWatcher manager.Manager
+	if args.TokenCleanup {
+		var namespaces []string
+		if args.TokenCleanupNamespaces != "" {
+			namespaces = strings.Split(args.TokenCleanupNamespaces, ",")
+		}
+		revoker, err := controllers.NewProviderTokenRevoker(cfg.ServiceProviders, providerClient)
+		if err != nil {
+			setupLog.Error(err, "invalid configuration of the token revocation")
+			return
+		}
+		if tokenCleanupWatcher, err = controllers.NewTokenCleanupWatcher(serviceKubeConfig, tokenStorage, revoker, namespaces, controllers.LeaderElection{
+			Enabled:   args.LeaderElection,
+			ID:        args.TokenCleanupLeaderElectionID,
+			Namespace: args.LeaderElectionNamespace,
+		}); err != nil {
+			setupLog.Error(err, "failed to create the token cleanup watcher")
+			return
+		}
+	}
+
 	tokenUploader := controllers.SpiTokenUploader{
 		K8sClient: cl,
 		Storage: tokenstorage.NotifyingTokenStorage{
 			Client:       cl,
-			TokenStorage: strg,
+			TokenStorage: tokenStorage,
 		},
 	}
 
+	if args.UploadOnBehalf {
+		// the audit events of the uploads on behalf record the identity of the service performing them
+		identityCtx, cancelIdentity := context.WithTimeout(context.Background(), defaultRouteTimeout)
+		serviceIdentity, err := controllers.ServiceIdentity(identityCtx, serviceClient, serviceKubeConfig)
+		cancelIdentity()
+		if err != nil {
+			setupLog.Error(err, "failed to determine the identity of the service uploading the tokens on behalf of others")
+			return
+		}
+		tokenUploader.OnBehalf = &controllers.UploadOnBehalf{
+			Identity:  serviceIdentity,
+			K8sClient: serviceClient,
+			Storage: tokenstorage.NotifyingTokenStorage{
+				Client:       serviceClient,
+				TokenStorage: tokenStorage,
+			},
+		}
+	}
+
 	// the session has 15 minutes timeout and stale sessions are cleaned every 5 minutes
 	sessionManager := scs.New()
-	sessionManager.Store = memstore.NewWithCleanupInterval(5 * time.Minute)
+	sessionStore := controllers.NewBoundedSessionStore(args.SessionStoreMaxEntries, 5*time.Minute)
+	sessionManager.Store = sessionStore
 	sessionManager.IdleTimeout = 15 * time.Minute
 	sessionManager.Cookie.Name = "appstudio_spi_session"
 	sessionManager.Cookie.SameSite = http.SameSiteNoneMode
 	sessionManager.Cookie.Secure = true
-	authenticator := controllers.NewAuthenticator(sessionManager, cl)
-	stateStorage := controllers.NewStateStorage(sessionManager)
-	//static routes first
-	router.HandleFunc("/health", controllers.OkHandler).Methods("GET")
-	router.HandleFunc("/ready", controllers.OkHandler).Methods("GET")
-	router.HandleFunc("/callback_success", controllers.CallbackSuccessHandler).Methods("GET")
-	router.HandleFunc("/login", authenticator.Login).Methods("POST")
-	router.NewRoute().Path("/{type}/callback").Queries("error", "", "error_description", "").HandlerFunc(controllers.CallbackErrorHandler)
-	router.NewRoute().Path("/token/{namespace}/{name}").HandlerFunc(controllers.HandleUpload(&tokenUploader)).Methods("POST")
-	router.NewRoute().Path("/token/{kcpWorkspace}/{namespace}/{name}").HandlerFunc(controllers.HandleUpload(&tokenUploader)).Methods("POST")
-
-	redirectTpl, err := template.ParseFiles("static/redirect_notice.html")
+	authenticator := auth.NewAuthenticator(sessionManager, cl)
+
+	var sharedStateStore scs.Store
+	var sharedSessionStore *controllers.SharedSessionStore
+	var flowJournal *controllers.FlowJournal
+	var coordinator *controllers.Coordinator
+	if args.SharedStateStore {
+		if sharedStateStore, err = controllers.NewVaultStateStore(strg, args.SharedStateStoreVaultPath); err != nil {
+			setupLog.Error(err, "failed to create the shared state store")
+			return
+		}
+		// the callback needs the session of the user, including their authentication, on any replica
+		sharedSessions, err := controllers.NewVaultStateStore(strg, args.SharedSessionStoreVaultPath)
+		if err != nil {
+			setupLog.Error(err, "failed to create the shared session store")
+			return
+		}
+		sharedSessionStore = &controllers.SharedSessionStore{Local: sessionStore, Shared: sharedSessions}
+		sessionManager.Store = sharedSessionStore
+		journalStore, err := controllers.NewVaultStateStore(strg, args.FlowJournalVaultPath)
+		if err != nil {
+			setupLog.Error(err, "failed to create the flow journal store")
+			return
+		}
+		flowJournal = controllers.NewFlowJournal(journalStore)
+		coordinationStore, err := controllers.NewVaultStateStore(strg, args.CoordinationVaultPath)
+		if err != nil {
+			setupLog.Error(err, "failed to create the coordination store")
+			return
+		}
+		identity, err := controllers.NewInstanceIdentity()
+		if err != nil {
+			setupLog.Error(err, "failed to determine the identity of the instance")
+			return
+		}
+		setupLog.Info("joining the deployment", "instanceId", identity.Id)
+		coordinator = controllers.NewCoordinator(coordinationStore, identity, cfg.BaseUrl, []byte(cfg.SharedSecret), args.CoordinationTTL)
+		coordinator.Takeover = args.CoordinationTakeover
+	}
+	stateStorage := controllers.NewStateStorage(sessionManager, sharedStateStore, cfg.StateEntropyBits)
+	flowHistory := controllers.NewFlowHistory(args.FlowHistorySize, serviceClient)
+	controllers.SetPageTheme(cfg.Theme)
+	redirectTpl, err := controllers.ParsePageTemplate("static/redirect_notice.html")
 	if err != nil {
 		setupLog.Error(err, "failed to parse the redirect notice HTML template")
 		return
 	}
 
+	// under load, the users going through the OAuth flows are served before the automation
+	scheduler := controllers.NewPriorityScheduler(args.MaxConcurrentRequests)
+
+	// the subsystems are started in the order of their dependencies and stopped in the reverse order, the service is
+	// ready only once all of them are started
+	lifecycle := controllers.NewLifecycle()
+
+	// the state-mutating requests authenticated by the session cookie need an anti-CSRF token or a trusted origin
+	csrfProtection := controllers.WithCsrfProtection(strings.Split(args.AllowedOrigins, ","))
+
+	//static routes first
+	routes := []controllers.Route{
+		{Path: "/health", Methods: []string{"GET"}, Handler: http.HandlerFunc(controllers.OkHandler)},
+		{Path: "/ready", Methods: []string{"GET"}, Handler: http.HandlerFunc(lifecycle.ReadyHandler)},
+		{Path: "/callback_success", Methods: []string{"GET"}, Handler: http.HandlerFunc(controllers.CallbackSuccessHandler(cfg.SuccessNextStepUrl, cfg.SuccessNextStepText, cfg.SharedSecret))},
+		{Path: "/callback_error", Methods: []string{"GET"}, Handler: http.HandlerFunc(controllers.CallbackErrorPageHandler(cfg.SharedSecret))},
+		{Path: "/landing", Methods: []string{"GET"}, Handler: http.HandlerFunc(controllers.LandingHandler)},
+		{
+			Path:         "/login",
+			Methods:      []string{"POST"},
+			ContentTypes: []string{"application/x-www-form-urlencoded", "multipart/form-data"},
+			Handler:      http.HandlerFunc(authenticator.Login),
+			Middleware:   []controllers.Middleware{controllers.WithMetrics("/login"), controllers.WithRateLimit(loginRateLimit, loginRateBurst), csrfProtection, controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive), sessionManager.LoadAndSave},
+		},
+		{
+			Path:       "/flow/{state}/cancel",
+			Methods:    []string{"POST"},
+			Handler:    http.HandlerFunc(controllers.FlowCancelHandler(stateStorage, cfg.SharedSecret)),
+			Middleware: []controllers.Middleware{controllers.WithMetrics("/flow/{state}/cancel"), csrfProtection, controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive), sessionManager.LoadAndSave},
+		},
+		{
+			Path:       "/flow/history",
+			Methods:    []string{"GET"},
+			Handler:    http.HandlerFunc(controllers.FlowHistoryHandler(flowHistory, authenticator)),
+			Middleware: []controllers.Middleware{controllers.WithMetrics("/flow/history"), csrfProtection, controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive), sessionManager.LoadAndSave},
+		},
+		{
+			Path:       "/flow/preview",
+			Methods:    []string{"GET"},
+			Handler:    http.HandlerFunc(controllers.FlowPreviewHandler(cl, cfg.SharedSecret)),
+			Middleware: []controllers.Middleware{controllers.WithMetrics("/flow/preview"), auth.RequireBearerToken, controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityBackground)},
+		},
+	}
+
+	repositoryAccessChecker, err := controllers.NewProviderRepositoryAccessChecker(cfg.ServiceProviders, providerClient)
+	if err != nil {
+		setupLog.Error(err, "invalid configuration of the token capability check")
+		return
+	}
+	for _, path := range []string{"/token/{namespace}/{name}/check", "/token/{kcpWorkspace}/{namespace}/{name}/check"} {
+		routes = append(routes, controllers.Route{
+			Path:       path,
+			Methods:    []string{"GET"},
+			Handler:    http.HandlerFunc(controllers.TokenCheckHandler(cl, tokenStorage, repositoryAccessChecker)),
+			Middleware: []controllers.Middleware{controllers.WithMetrics(path), auth.RequireBearerToken, controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityBackground)},
+		})
+	}
+
+	for _, path := range []string{"/token/{namespace}/{name}/user", "/token/{kcpWorkspace}/{namespace}/{name}/user"} {
+		routes = append(routes, controllers.Route{
+			Path:       path,
+			Methods:    []string{"GET"},
+			Handler:    http.HandlerFunc(controllers.TokenUserHandler(cl, tokenStorage, userInfoLookup)),
+			Middleware: []controllers.Middleware{controllers.WithMetrics(path), auth.RequireBearerToken, controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityBackground)},
+		})
+	}
+
+	for _, path := range []string{"/token/{namespace}/{name}", "/token/{kcpWorkspace}/{namespace}/{name}"} {
+		routes = append(routes, controllers.Route{
+			Path:         path,
+			Methods:      []string{"POST"},
+			ContentTypes: []string{"application/json"},
+			Handler:      http.HandlerFunc(controllers.HandleUpload(&tokenUploader)),
+			Middleware:   []controllers.Middleware{controllers.WithMetrics(path), csrfProtection, auth.RequireBearerToken, controllers.WithBodyLimit(maxUploadBodySize), controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityBackground)},
+		})
+	}
+
+	if args.CanaryInterval > 0 {
+		canaryClientSecret, err := controllers.NewVeil(controllers.DefaultVeilEntropyBits)
+		if err != nil {
+			setupLog.Error(err, "failed to generate the client secret of the canary service provider")
+			return
+		}
+		cfg.ServiceProviders = append(cfg.ServiceProviders, controllers.CanaryServiceProviderConfiguration(args.CanaryServiceUrl, canaryClientSecret))
+		// the canary service provider is public and mints the codes, so it's limited the same way as the login. It stands
+		// in for the external service providers in the canary flows, so it's served with the same priority as the flows.
+		routes = append(routes, controllers.Route{
+			Path:       controllers.CanaryProviderPath + "/authorize",
+			Methods:    []string{"GET"},
+			Handler:    http.HandlerFunc(controllers.CanaryAuthorizeHandler(cfg.BaseUrl, args.CanaryServiceUrl)),
+			Middleware: []controllers.Middleware{controllers.WithMetrics(controllers.CanaryProviderPath + "/authorize"), controllers.WithRateLimit(canaryRateLimit, canaryRateBurst), controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive)},
+		}, controllers.Route{
+			Path:       controllers.CanaryProviderPath + "/token",
+			Methods:    []string{"POST"},
+			Handler:    http.HandlerFunc(controllers.CanaryTokenHandler(canaryClientSecret)),
+			Middleware: []controllers.Middleware{controllers.WithMetrics(controllers.CanaryProviderPath + "/token"), controllers.WithRateLimit(canaryRateLimit, canaryRateBurst), controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive)},
+		})
+	}
+
+	// the errors from the service providers are received by the callback route shared by all of them, so it
+	// needs to accept the callback hosts of all of them, including the canary one
+	callbackHosts, err := controllers.CallbackHosts(cfg.BaseUrl, config.ServiceProviderConfiguration{})
+	if err != nil {
+		setupLog.Error(err, "invalid configuration of the callback hosts")
+		return
+	}
+	for _, sp := range cfg.ServiceProviders {
+		hosts, err := controllers.CallbackHosts(cfg.BaseUrl, sp)
+		if err != nil {
+			setupLog.Error(err, "invalid configuration of the callback hosts")
+			return
+		}
+		callbackHosts = append(callbackHosts, hosts...)
+	}
+
+	// the error callback needs to be registered before the callbacks of the service providers to take precedence
+	routes = append(routes, controllers.Route{
+		Path:       "/{type}/callback",
+		Queries:    []string{"error", "", "error_description", ""},
+		Handler:    http.HandlerFunc(controllers.CallbackErrorHandler(stateStorage, cfg.BaseUrl, cfg.SharedSecret)),
+		Middleware: []controllers.Middleware{controllers.WithAllowedHosts(callbackHosts), controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive), sessionManager.LoadAndSave},
+	})
+
+	flowControllers := map[config.ServiceProviderType]controllers.Controller{}
 	for _, sp := range cfg.ServiceProviders {
 		setupLog.V(1).Info("initializing service provider controller", "type", sp.ServiceProviderType, "url", sp.ServiceProviderBaseUrl)
 
-		controller, err := controllers.FromConfiguration(cfg, sp, authenticator, stateStorage, cl, strg, redirectTpl)
+		controller, err := controllers.FromConfiguration(cfg, sp, authenticator, stateStorage, flowJournal, flowHistory, cl, tokenStorage, redirectTpl)
 		if err != nil {
 			setupLog.Error(err, "failed to initialize controller")
+			return
 		}
 
+		flowControllers[sp.ServiceProviderType] = controller
 		prefix := strings.ToLower(string(sp.ServiceProviderType))
 
-		router.Handle(fmt.Sprintf("/%s/authenticate", prefix), http.HandlerFunc(controller.Authenticate)).Methods("GET", "POST")
-		router.Handle(fmt.Sprintf("/%s/callback", prefix), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			controller.Callback(r.Context(), w, r)
-		})).Methods("GET")
+		authenticatePath := fmt.Sprintf("/%s/authenticate", prefix)
+		callbackPath := fmt.Sprintf("/%s/callback", prefix)
+		routes = append(routes, controllers.Route{
+			Path:       authenticatePath,
+			Methods:    []string{"GET", "POST"},
+			Handler:    http.HandlerFunc(controller.Authenticate),
+			Middleware: []controllers.Middleware{controllers.WithMetrics(authenticatePath), csrfProtection, controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive), sessionManager.LoadAndSave},
+		}, controllers.Route{
+			Path:    callbackPath,
+			Methods: []string{"GET"},
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				controller.Callback(r.Context(), w, r)
+			}),
+			// the callback talks to the service provider, the cluster and the token storage, so let's give it more time
+			Middleware: []controllers.Middleware{controllers.WithMetrics(callbackPath), controllers.WithTimeout(callbackRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive), sessionManager.LoadAndSave},
+		})
+	}
+
+	// the state of the flow started by a backend is kept in the session of the backend, so the callback authenticated
+	// by the session of the user can only find it in the shared state store
+	if sharedStateStore != nil {
+		routes = append(routes, controllers.Route{
+			Path:         "/flows",
+			Methods:      []string{"POST"},
+			ContentTypes: []string{"application/json"},
+			Handler:      http.HandlerFunc(controllers.FlowsHandler(flowControllers, stateStorage, cl, cfg.SharedSecret)),
+			Middleware:   []controllers.Middleware{controllers.WithMetrics("/flows"), csrfProtection, auth.RequireBearerToken, controllers.WithBodyLimit(maxFlowBodySize), controllers.WithTimeout(defaultRouteTimeout), scheduler.WithPriority(controllers.PriorityInteractive), sessionManager.LoadAndSave},
+		})
+	} else {
+		setupLog.Info("the flows API is disabled because the OAuth states are not shared among the replicas, see the --shared-state-store argument")
+	}
+
+	controllers.RegisterRoutes(router, routes)
+
+	subsystems := []controllers.Subsystem{
+		{
+			Name: "session-store",
+			Stop: func(_ context.Context) error {
+				sessionStore.StopCleanup()
+				return nil
+			},
+		},
+	}
+	serverDependencies := []string{"session-store"}
+	// the service cannot verify the OAuth states without the signing secret, so it is not ready to serve without it
+	signingSecretHealth := controllers.NewSigningSecretHealth(cfg.SharedSecret, cfg.SigningSecretRotateBy)
+	subsystems = append(subsystems, controllers.Subsystem{
+		Name:  "jwt-signing-secret",
+		Start: signingSecretHealth.Start,
+		Run: func(ctx context.Context) error {
+			signingSecretHealth.Run(ctx, time.Hour)
+			return nil
+		},
+		Ready: signingSecretHealth.Check,
+	})
+	if coordinator != nil {
+		// the replicas with incompatible configurations would fail each other's OAuth flows, so let's not serve any
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name:  "coordination",
+			Start: coordinator.Join,
+			Run: func(ctx context.Context) error {
+				coordinator.Start(ctx)
+				return nil
+			},
+			Ready: coordinator.Ready,
+		})
+		serverDependencies = append(serverDependencies, "coordination")
+	}
+	if args.WarmUp {
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name: "warm-up",
+			Start: func(ctx context.Context) error {
+				warmUpCtx, cancelWarmUp := context.WithTimeout(ctx, args.WarmUpTimeout)
+				defer cancelWarmUp()
+				// the warm-up is best-effort, the service works without it, only the first flows are slower
+				if err := controllers.WarmUp(warmUpCtx, strg, cfg.ServiceProviders); err != nil {
+					setupLog.Error(err, "failed to warm up the connections")
+				}
+				return nil
+			},
+		})
+		serverDependencies = append(serverDependencies, "warm-up")
+	}
+
+	serviceAddrs, err := controllers.ParseListenAddresses(args.ServiceAddr)
+	if err != nil {
+		setupLog.Error(err, "invalid service address")
+		return
+	}
+	metricsAddrs, err := controllers.ParseListenAddresses(args.MetricsAddr)
+	if err != nil {
+		setupLog.Error(err, "invalid metrics address")
+		return
 	}
-	setupLog.Info("Starting the server", "Addr", args.ServiceAddr)
+
 	server := &http.Server{
-		Addr: args.ServiceAddr,
 		// Good practice to set timeouts to avoid Slowloris attacks.
 		WriteTimeout:      time.Second * 15,
 		ReadTimeout:       time.Second * 15,
 		ReadHeaderTimeout: time.Second * 15,
 		IdleTimeout:       time.Second * 60,
-		Handler:           sessionManager.LoadAndSave(controllers.MiddlewareHandler(strings.Split(args.AllowedOrigins, ","), router)),
+		Handler:           middleware.MiddlewareHandler(strings.Split(args.AllowedOrigins, ","), router),
+	}
+	serverSubsystem := controllers.HttpServerSubsystem("server", server, serviceAddrs)
+	serverSubsystem.DependsOn = serverDependencies
+	subsystems = append(subsystems, serverSubsystem)
+
+	metricsRouter := http.NewServeMux()
+	metricsRouter.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	// the generated documents don't change while the service runs, so let the pollers only check they're up-to-date
+	metricsRouter.Handle("/slo-rules", controllers.WithResponseCaching(time.Hour)(http.HandlerFunc(controllers.SloRulesHandler)))
+	metricsRouter.Handle("/grafana-dashboard", controllers.WithResponseCaching(time.Hour)(http.HandlerFunc(controllers.GrafanaDashboardHandler)))
+	metricsServer := &http.Server{
+		Handler:           metricsRouter,
+		ReadHeaderTimeout: time.Second * 15,
+	}
+	subsystems = append(subsystems, controllers.HttpServerSubsystem("metrics-server", metricsServer, metricsAddrs))
+
+	if args.GrpcAddr != "" {
+		grpcAddrs, err := controllers.ParseListenAddresses(args.GrpcAddr)
+		if err != nil {
+			setupLog.Error(err, "invalid gRPC address")
+			return
+		}
+		creds, err := controllers.GrpcServerCredentials(args.GrpcCertFile, args.GrpcKeyFile, args.GrpcClientCAFile)
+		if err != nil {
+			setupLog.Error(err, "failed to configure the TLS of the gRPC server")
+			return
+		}
+		grpcServer := controllers.NewGrpcServer(&controllers.TokenServiceServer{
+			K8sClient: cl,
+			Uploader:  &tokenUploader,
+			Storage:   tokenUploader.Storage,
+		}, creds)
+		grpcSubsystem := controllers.GrpcServerSubsystem("grpc-server", grpcAddrs, grpcServer)
+		grpcSubsystem.DependsOn = serverDependencies
+		subsystems = append(subsystems, grpcSubsystem)
 	}
 
-	// Run our server in a goroutine so that it doesn't block.
-	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			setupLog.Error(err, "failed to start the HTTP server")
+	if args.CanaryInterval > 0 {
+		probe := &controllers.CanaryProbe{
+			ServiceUrl:       args.CanaryServiceUrl,
+			TokenNamespace:   args.CanaryTokenNamespace,
+			TokenName:        args.CanaryTokenName,
+			K8sTokenFilePath: args.CanaryK8sTokenFilePath,
+			JwtSigningSecret: cfg.SharedSecret,
 		}
-	}()
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name: "canary",
+			// the canary goes through the HTTP endpoints of the service
+			DependsOn: []string{"server"},
+			Run: func(ctx context.Context) error {
+				probe.Start(ctx, args.CanaryInterval)
+				return nil
+			},
+		})
+	}
+	if uploadSecretWatcher != nil {
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name: "upload-secret",
+			Run: func(ctx context.Context) error {
+				if err := uploadSecretWatcher.Start(ctx); err != nil {
+					return fmt.Errorf("the upload secret watcher failed: %w", err)
+				}
+				return nil
+			},
+		})
+	}
+	if tokenCleanupWatcher != nil {
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name: "token-cleanup",
+			Run: func(ctx context.Context) error {
+				if err := tokenCleanupWatcher.Start(ctx); err != nil {
+					return fmt.Errorf("the token cleanup watcher failed: %w", err)
+				}
+				return nil
+			},
+		})
+	}
+	if sharedStateStore != nil {
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name:      "shared-state-cleanup",
+			DependsOn: []string{"coordination"},
+			Run: func(ctx context.Context) error {
+				// the states of the abandoned flows are not needed once the flows time out
+				stateStorage.StartCleanup(ctx, stateStorage.FlowTimeout(), coordinator)
+				return nil
+			},
+		})
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name:      "shared-session-cleanup",
+			DependsOn: []string{"coordination"},
+			Run: func(ctx context.Context) error {
+				sharedSessionStore.StartCleanup(ctx, stateStorage.FlowTimeout(), coordinator)
+				return nil
+			},
+		})
+	}
+	if flowJournal != nil && args.FlowJournalRecoveryInterval > 0 {
+		subsystems = append(subsystems, controllers.Subsystem{
+			Name: "flow-journal",
+			// the journal is kept with the shared state store, and so is the coordinator, which lets only one replica
+			// run the recovery
+			DependsOn: []string{"coordination"},
+			Run: func(ctx context.Context) error {
+				flowJournal.Start(ctx, args.FlowJournalRecoveryInterval, coordinator)
+				return nil
+			},
+		})
+	}
+
+	for _, s := range subsystems {
+		if err := lifecycle.Add(s); err != nil {
+			setupLog.Error(err, "failed to register the subsystem")
+			return
+		}
+	}
+
+	setupLog.Info("Starting the server", "Addr", args.ServiceAddr, "metricsAddr", args.MetricsAddr)
+	if err := lifecycle.Start(ctrl.LoggerInto(context.Background(), ctrl.Log)); err != nil {
+		setupLog.Error(err, "failed to start the service")
+		os.Exit(1)
+	}
 	setupLog.Info("Server is up and running")
 	// Setting up signal capturing
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
-	// Waiting for SIGINT (kill -2)
-	<-stop
-	setupLog.Info("Server got interrupt signal, going to gracefully shutdown the server", zap.Any("signal", stop))
+	// Waiting for SIGINT (kill -2) or for a failure of any of the subsystems, without which the service would keep
+	// running without the functionality of the failed subsystem
+	exitCode := 0
+	select {
+	case sig := <-stop:
+		setupLog.Info("Server got interrupt signal, going to gracefully shutdown the server", "signal", sig.String())
+	case err := <-lifecycle.Failed():
+		setupLog.Error(err, "a subsystem failed, going to gracefully shutdown the server")
+		exitCode = 1
+	}
 	// Create a deadline to wait for.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctrl.LoggerInto(context.Background(), ctrl.Log), 5*time.Second)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	if err := server.Shutdown(ctx); err != nil {
+	if err := lifecycle.Stop(ctx); err != nil {
 		setupLog.Error(err, "OAuth server shutdown failed")
 		os.Exit(1)
 	}
-	// Optionally, you could run srv.Shutdown in a goroutine and block on
-	// <-ctx.Done() if your application should wait for other services
-	// to finalize based on context cancellation.
 	setupLog.Info("OAuth server exited properly")
-	os.Exit(0)
+	os.Exit(exitCode)
+}
+
+// configureKubeClient applies the client settings from the command line to the configuration of the Kubernetes client.
+func configureKubeClient(kubeConfig *rest.Config, args *controllers.OAuthServiceCliArgs) {
+	kubeConfig.QPS = args.KubeClientQPS
+	kubeConfig.Burst = args.KubeClientBurst
+	kubeConfig.UserAgent = controllers.UserAgent(version)
+
+	// insecure mode only allowed when the trusted root certificate is not specified...
+	if args.KubeInsecureTLS && kubeConfig.TLSClientConfig.CAFile == "" {
+		kubeConfig.Insecure = true
+	}
 }
 
 func kubernetesConfig(args *controllers.OAuthServiceCliArgs) (*rest.Config, error) {
@@ -203,33 +723,11 @@ func kubernetesConfig(args *controllers.OAuthServiceCliArgs) (*rest.Config, erro
 
 		return cfg, nil
 	} else if args.ApiServer != "" {
-		// here we're essentially replicating what is done in rest.InClusterConfig() but we're using our own
-		// configuration - this is to support going through an alternative API server to the one we're running with...
-		// Note that we're NOT adding the Token or the TokenFile to the configuration here. This is supposed to be
-		// handled on per-request basis...
-		cfg := rest.Config{}
-
-		apiServerUrl, err := url.Parse(args.ApiServer)
+		cfg, err := controllers.ApiServerConfig(args.ApiServer, args.ApiServerCAPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse the API server URL: %w", err)
+			return nil, fmt.Errorf("failed to create the API server configuration: %w", err)
 		}
-
-		cfg.Host = "https://" + net.JoinHostPort(apiServerUrl.Hostname(), apiServerUrl.Port())
-
-		tlsConfig := rest.TLSClientConfig{}
-
-		if args.ApiServerCAPath != "" {
-			// rest.InClusterConfig is doing this most possibly only for early error handling so let's do the same
-			if _, err := certutil.NewPool(args.ApiServerCAPath); err != nil {
-				return nil, fmt.Errorf("expected to load root CA config from %s, but got err: %w", args.ApiServerCAPath, err)
-			} else {
-				tlsConfig.CAFile = args.ApiServerCAPath
-			}
-		}
-
-		cfg.TLSClientConfig = tlsConfig
-
-		return &cfg, nil
+		return cfg, nil
 	} else {
 		cfg, err := rest.InClusterConfig()
 		if err != nil {
@@ -11,7 +11,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package controllers
+package auth
 
 import (
 	"context"
@@ -19,6 +19,8 @@ import (
 	"net/http"
 	"strings"
 
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
 	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/spi-shared/httptransport"
 
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -29,7 +31,7 @@ import (
 const authPluginName = "spi.appstudio.redhat.com/auth-from-request"
 
 var (
-	noBearerTokenError = errors.New("no bearer token found")
+	noBearerTokenError = spierrors.WithKind(spierrors.NotAuthenticated, errors.New("no bearer token found"))
 )
 
 func init() {
@@ -38,6 +40,10 @@ func init() {
 	}))
 }
 
+// bearerTokenContextKey is the key of the bearer token in the context. The token is kept in the context under our own
+// key too so that it can be read back using the BearerTokenFromContext function.
+type bearerTokenContextKey struct{}
+
 // fromContextAuthProvider is the implementation of the rest.AuthProvider interface that looks for the bearer tokens
 // in the context.
 type fromContextAuthProvider struct{}
@@ -80,9 +86,27 @@ func WithAuthFromRequestIntoContext(r *http.Request, ctx context.Context) (conte
 // context.
 // If used with a client constructed from configuration augmented using the AugmentConfiguration function, the requests
 // to the Kubernetes API will be authenticated using this token.
-//
 func WithAuthIntoContext(bearerToken string, ctx context.Context) context.Context {
-	return httptransport.WithBearerToken(ctx, bearerToken)
+	return httptransport.WithBearerToken(context.WithValue(ctx, bearerTokenContextKey{}, bearerToken), bearerToken)
+}
+
+// BearerTokenFromContext returns the bearer token stored in the context using the WithAuthFromRequestIntoContext or
+// WithAuthIntoContext functions or an empty string if there is none.
+func BearerTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(bearerTokenContextKey{}).(string)
+	return token
+}
+
+// RequireBearerToken is a middleware that rejects the requests that don't carry a bearer token in the Authorization
+// header with http.StatusUnauthorized.
+func RequireBearerToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization")) == "" {
+			logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed extract authorization information from headers", noBearerTokenError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 func (f fromContextAuthProvider) WrapTransport(tripper http.RoundTripper) http.RoundTripper {
@@ -11,10 +11,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package controllers
+package auth
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -26,6 +28,13 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// fakeRoundTrip casts a function into a http.RoundTripper
+type fakeRoundTrip func(r *http.Request) (*http.Response, error)
+
+func (f fakeRoundTrip) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
 func TestAugmentConfiguration(t *testing.T) {
 	cfg := rest.Config{}
 	AugmentConfiguration(&cfg)
@@ -82,4 +91,24 @@ func TestWithAuthFromRequest(t *testing.T) {
 	obj := corev1.ConfigMap{}
 	_ = cl.Get(ctx, client.ObjectKey{Name: "name", Namespace: "ns"}, &obj)
 	assert.True(t, requestPerformed)
+	assert.Equal(t, "kachny", BearerTokenFromContext(ctx))
+}
+
+func TestBearerTokenFromContext(t *testing.T) {
+	assert.Equal(t, "kachny", BearerTokenFromContext(WithAuthIntoContext("kachny", context.TODO())))
+	assert.Empty(t, BearerTokenFromContext(context.TODO()))
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	handler := RequireBearerToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer kachny")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
 }
@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth contains the authentication of the users of the SPI services using their Kubernetes tokens and
+// the helpers to make the requests to the Kubernetes API on behalf of the authenticated users.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	spierrors "github.com/redhat-appstudio/service-provider-integration-oauth/pkg/errors"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	authz "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+// AuthenticatingClient is just a typedef that advertises that it is safe to use the WithAuthIntoContext or
+// WithAuthFromRequestIntoContext functions with clients having this type.
+type AuthenticatingClient client.Client
+
+// Authenticator authenticates the users using their Kubernetes tokens and remembers the tokens in the session so that
+// the subsequent requests of the user in the session are authenticated, too.
+type Authenticator struct {
+	K8sClient      AuthenticatingClient
+	SessionManager *scs.SessionManager
+}
+
+// K8sTokenSessionKey is the key of the Kubernetes token of the user in the session.
+const K8sTokenSessionKey = "k8s_token"
+
+var (
+	noTokenFoundError = spierrors.WithKind(spierrors.NotAuthenticated, errors.New("no token associated with the given session or provided as a `k8s_token` query parameter"))
+)
+
+// tokenReview checks that the cluster authenticates the token. The users are usually not allowed to create
+// the TokenReviews, so the token is reviewed by creating a SelfSubjectAccessReview with it instead. Any authenticated
+// user can create one, while the cluster rejects the tokens it doesn't authenticate as unauthorized.
+func (a Authenticator) tokenReview(token string, req *http.Request) (bool, error) {
+	review := &authz.SelfSubjectAccessReview{
+		Spec: authz.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authz.ResourceAttributes{
+				Group:    authz.GroupName,
+				Resource: "selfsubjectaccessreviews",
+				Verb:     "create",
+			},
+		},
+	}
+	if err := a.K8sClient.Create(WithAuthIntoContext(token, req.Context()), review); err != nil {
+		if apierrors.IsUnauthorized(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to review the token: %w", err)
+	}
+	return true, nil
+}
+
+// GetToken returns the Kubernetes token of the user from the `k8s_token` query parameter or from the session. The token
+// from the query parameter is remembered in the session.
+func (a *Authenticator) GetToken(r *http.Request) (string, error) {
+	lg := log.FromContext(r.Context())
+	defer logs.TimeTrack(lg, time.Now(), "/GetToken")
+
+	token := r.URL.Query().Get("k8s_token")
+	if token == "" {
+		token = a.SessionManager.GetString(r.Context(), K8sTokenSessionKey)
+	} else {
+		lg.V(logs.DebugLevel).Info("persisting token that was provided by `k8_token` query parameter to the session")
+		a.SessionManager.Put(r.Context(), K8sTokenSessionKey, token)
+	}
+
+	if token == "" {
+		return "", noTokenFoundError
+	}
+	return token, nil
+}
+
+// Login is a handler authenticating the user with the Kubernetes token from the `k8s_token` form parameter or from
+// the Authorization header. The token is remembered in the session on success.
+func (a Authenticator) Login(w http.ResponseWriter, r *http.Request) {
+	lg := log.FromContext(r.Context())
+	defer logs.TimeTrack(lg, time.Now(), "/Login")
+
+	token := r.FormValue("k8s_token")
+
+	if token == "" {
+		token = ExtractTokenFromAuthorizationHeader(r.Header.Get("Authorization"))
+	}
+
+	if token == "" {
+		logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed extract authorization info either from headers or form parameters")
+		return
+	}
+	hasAccess, err := a.tokenReview(token, r)
+	if err != nil {
+		logging.LogErrorAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "failed to determine if the authenticated user has access", err)
+		lg.Error(err, "The token is incorrect or the SPI OAuth service is not configured properly "+
+			"and the API_SERVER environment variable points it to the incorrect Kubernetes API server. "+
+			"If SPI is running with Devsandbox Proxy or KCP, make sure this env var points to the Kubernetes API proxy,"+
+			" otherwise unset this variable. See more https://github.com/redhat-appstudio/infra-deployments/pull/264")
+		return
+	}
+
+	if !hasAccess {
+		logging.LogDebugAndWriteResponse(r.Context(), w, http.StatusUnauthorized, "authenticating the request in Kubernetes unsuccessful")
+		logging.AuditLog(r.Context()).Info("unsuccessful authentication with Kubernetes token occurred")
+		return
+	}
+
+	a.SessionManager.Put(r.Context(), K8sTokenSessionKey, token)
+	logging.AuditLog(r.Context()).Info("successful authentication with Kubernetes token")
+	w.WriteHeader(http.StatusOK)
+}
+
+// NewAuthenticator creates a new Authenticator keeping the tokens in the sessions of the provided session manager.
+func NewAuthenticator(sessionManager *scs.SessionManager, cl AuthenticatingClient) *Authenticator {
+	return &Authenticator{
+		K8sClient:      cl,
+		SessionManager: sessionManager,
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/stretchr/testify/assert"
+	authz "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reviewingClient authenticates only the valid token in the SelfSubjectAccessReviews the same way as the cluster.
+type reviewingClient struct {
+	client.Client
+	validToken string
+	err        error
+}
+
+func (c reviewingClient) Create(ctx context.Context, obj client.Object, _ ...client.CreateOption) error {
+	if _, ok := obj.(*authz.SelfSubjectAccessReview); !ok {
+		return errors.New("unexpected object")
+	}
+	if c.err != nil {
+		return c.err
+	}
+	if BearerTokenFromContext(ctx) != c.validToken {
+		return apierrors.NewUnauthorized("Unauthorized")
+	}
+	return nil
+}
+
+func TestAuthenticator_Login(t *testing.T) {
+	login := func(cl reviewingClient, token string) (int, string) {
+		sessionManager := scs.New()
+		authenticator := NewAuthenticator(sessionManager, cl)
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		remembered := ""
+		sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authenticator.Login(w, r)
+			remembered = sessionManager.GetString(r.Context(), K8sTokenSessionKey)
+		})).ServeHTTP(rr, req)
+		return rr.Code, remembered
+	}
+
+	t.Run("authenticated token", func(t *testing.T) {
+		code, remembered := login(reviewingClient{validToken: "k8s-token"}, "k8s-token")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "k8s-token", remembered)
+	})
+
+	t.Run("unauthenticated token", func(t *testing.T) {
+		code, remembered := login(reviewingClient{validToken: "k8s-token"}, "forged-token")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		assert.Empty(t, remembered)
+	})
+
+	t.Run("review failure", func(t *testing.T) {
+		code, remembered := login(reviewingClient{validToken: "k8s-token", err: errors.New("connection refused")}, "k8s-token")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		assert.Empty(t, remembered)
+	})
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package errors contains the errors shared by the SPI services and their mapping to the HTTP statuses. The errors
+// returned from the functions of the services are either these errors themselves, errors wrapping them or errors
+// marked with them using WithKind, so that the handlers can choose the response using HttpStatus instead of deciding
+// on the status at each call site.
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var (
+	// NotAuthenticated is the error of the requests the user of which can't be determined.
+	NotAuthenticated = errors.New("not authenticated")
+	// Forbidden is the error of the requests of the users that lack the permissions for them.
+	Forbidden = errors.New("forbidden")
+	// InvalidRequest is the error of the malformed requests.
+	InvalidRequest = errors.New("invalid request")
+	// StateExpired is the error of the OAuth callbacks the state of which is no longer known, e.g. because
+	// the authorization session expired.
+	StateExpired = errors.New("the OAuth state expired")
+	// StorageUnavailable is the error of the operations that failed to read or write the token storage.
+	StorageUnavailable = errors.New("the token storage is unavailable")
+)
+
+// ProviderError is the failure of the request to the service provider.
+type ProviderError struct {
+	// Code is the HTTP status code the service provider responded with, zero if there was no response.
+	Code int
+	// Err is the cause of the failure.
+	Err error
+}
+
+var _ error = (*ProviderError)(nil)
+
+func (e *ProviderError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("the service provider request failed: %s", e.Err.Error())
+	}
+	return fmt.Sprintf("the service provider responded with %d: %s", e.Code, e.Err.Error())
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// kindError marks the error with the kind, i.e. one of the errors of this package, without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind //nolint:errorlint // the kinds are the sentinel errors compared by identity
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// WithKind returns the error that has the same message as err and that both errors.Is the kind and wraps err. This is
+// useful when the error already wraps its cause, which means it can't wrap the kind, too. Returns nil if err is nil.
+func WithKind(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// HttpStatus returns the HTTP status to respond with when handling the request failed with the error. The errors of
+// the Kubernetes API are mapped according to their reason. The failures of the service providers that rejected
+// the request are the failures of the request, the others mean the service provider is not available. All the
+// unknown errors are internal server errors.
+func HttpStatus(err error) int {
+	var providerErr *ProviderError
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, NotAuthenticated), errors.Is(err, StateExpired), apierrors.IsUnauthorized(err):
+		return http.StatusUnauthorized
+	case errors.Is(err, Forbidden), apierrors.IsForbidden(err):
+		return http.StatusForbidden
+	case errors.Is(err, InvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, StorageUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &providerErr):
+		if providerErr.Code >= 400 && providerErr.Code < 500 {
+			return http.StatusBadRequest
+		}
+		return http.StatusBadGateway
+	case apierrors.IsNotFound(err):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Kind returns the stable name of the kind of the error that can be given to the clients instead of the message of
+// the error, which may contain internal details. The names follow the mapping of HttpStatus, the unknown errors are
+// "internal".
+func Kind(err error) string {
+	var providerErr *ProviderError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, NotAuthenticated), apierrors.IsUnauthorized(err):
+		return "not_authenticated"
+	case errors.Is(err, StateExpired):
+		return "state_expired"
+	case errors.Is(err, Forbidden), apierrors.IsForbidden(err):
+		return "forbidden"
+	case errors.Is(err, InvalidRequest):
+		return "invalid_request"
+	case errors.Is(err, StorageUnavailable):
+		return "storage_unavailable"
+	case errors.As(err, &providerErr):
+		return "provider_error"
+	case apierrors.IsNotFound(err):
+		return "not_found"
+	default:
+		return "internal"
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestWithKind(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := WithKind(StorageUnavailable, cause)
+
+	assert.Equal(t, "connection refused", err.Error())
+	assert.True(t, errors.Is(err, StorageUnavailable))
+	assert.True(t, errors.Is(err, cause))
+	assert.False(t, errors.Is(err, NotAuthenticated))
+	assert.True(t, errors.Is(fmt.Errorf("failed to store: %w", err), StorageUnavailable))
+	assert.NoError(t, WithKind(StorageUnavailable, nil))
+}
+
+func TestProviderError(t *testing.T) {
+	cause := errors.New("bad verification code")
+	err := fmt.Errorf("failed to finish the OAuth exchange: %w", &ProviderError{Code: 401, Err: cause})
+
+	assert.Equal(t, "failed to finish the OAuth exchange: the service provider responded with 401: bad verification code", err.Error())
+	assert.True(t, errors.Is(err, cause))
+
+	var providerErr *ProviderError
+	assert.True(t, errors.As(err, &providerErr))
+	assert.Equal(t, 401, providerErr.Code)
+}
+
+func TestHttpStatus(t *testing.T) {
+	assert.Equal(t, http.StatusOK, HttpStatus(nil))
+
+	resource := schema.GroupResource{Group: "appstudio.redhat.com", Resource: "spiaccesstokens"}
+	test := func(name string, err error, expected int) {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, expected, HttpStatus(err))
+			assert.Equal(t, expected, HttpStatus(fmt.Errorf("wrapped: %w", err)))
+		})
+	}
+
+	test("not authenticated", WithKind(NotAuthenticated, errors.New("no token")), http.StatusUnauthorized)
+	test("state expired", StateExpired, http.StatusUnauthorized)
+	test("forbidden", Forbidden, http.StatusForbidden)
+	test("invalid request", InvalidRequest, http.StatusBadRequest)
+	test("storage unavailable", WithKind(StorageUnavailable, errors.New("vault sealed")), http.StatusServiceUnavailable)
+	test("provider rejected", &ProviderError{Code: 400, Err: errors.New("bad code")}, http.StatusBadRequest)
+	test("provider failed", &ProviderError{Code: 500, Err: errors.New("oops")}, http.StatusBadGateway)
+	test("provider unreachable", &ProviderError{Err: errors.New("timeout")}, http.StatusBadGateway)
+	test("k8s not found", apierrors.NewNotFound(resource, "token"), http.StatusNotFound)
+	test("k8s forbidden", apierrors.NewForbidden(resource, "token", errors.New("no")), http.StatusForbidden)
+	test("k8s unauthorized", apierrors.NewUnauthorized("no"), http.StatusUnauthorized)
+	test("unknown", errors.New("unknown"), http.StatusInternalServerError)
+}
+
+func TestKind(t *testing.T) {
+	assert.Equal(t, "", Kind(nil))
+	assert.Equal(t, "not_authenticated", Kind(fmt.Errorf("wrapped: %w", WithKind(NotAuthenticated, errors.New("no token")))))
+	assert.Equal(t, "state_expired", Kind(StateExpired))
+	assert.Equal(t, "forbidden", Kind(Forbidden))
+	assert.Equal(t, "invalid_request", Kind(InvalidRequest))
+	assert.Equal(t, "storage_unavailable", Kind(WithKind(StorageUnavailable, errors.New("vault sealed"))))
+	assert.Equal(t, "provider_error", Kind(&ProviderError{Code: 400, Err: errors.New("bad code")}))
+	assert.Equal(t, "not_found", Kind(apierrors.NewNotFound(schema.GroupResource{Resource: "spiaccesstokens"}, "token")))
+	assert.Equal(t, "internal", Kind(errors.New("oops")))
+}
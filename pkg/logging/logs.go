@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging contains the HTTP middlewares and helpers that make the logs of the requests consistent across
+// the SPI services. All the logs go through the logger in the request context (log.FromContext) so that they carry
+// the request ID assigned by WithRequestId.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/go-logr/logr"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// RequestIdHeader is the header carrying the ID of the request. It is taken from the incoming request if present so
+// that the requests can be correlated with the logs of the proxies in front of the service.
+const RequestIdHeader = "X-Request-Id"
+
+// requestIdBytes is the number of the random bytes in the generated request IDs.
+const requestIdBytes = 16
+
+// requestIdContextKey is the key of the request ID in the context.
+type requestIdContextKey struct{}
+
+// validRequestId limits what we accept as the request ID from the clients so that it is safe to put into the logs and
+// response headers.
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// WithRequestId is a middleware that assigns an ID to the request. The ID is put into the context together with
+// a logger carrying it, so that all the logs emitted using log.FromContext during the request have it. It is also
+// returned in the X-Request-Id response header.
+func WithRequestId(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			var err error
+			if requestId, err = newRequestId(); err != nil {
+				LogErrorAndWriteResponse(r.Context(), w, http.StatusInternalServerError, "failed to generate the request ID", err)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), requestIdContextKey{}, requestId)
+		ctx = log.IntoContext(ctx, log.FromContext(ctx).WithValues("requestId", requestId))
+		w.Header().Set(RequestIdHeader, requestId)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newRequestId generates a random request ID.
+func newRequestId() (string, error) {
+	b := make([]byte, requestIdBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// RequestIdFromContext returns the ID of the request assigned by the WithRequestId middleware or an empty string.
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey{}).(string)
+	return requestId
+}
+
+// WithTokenLogFields returns a context with the logger carrying the coordinates of the SPIAccessToken the request is
+// about, so that they don't need to be repeated in every log call.
+func WithTokenLogFields(ctx context.Context, namespace string, name string) context.Context {
+	return log.IntoContext(ctx, log.FromContext(ctx).WithValues("tokenNamespace", namespace, "tokenName", name))
+}
+
+// LogErrorAndWriteResponse logs the error using the logger from the context, i.e. with the request ID and the other
+// fields of the request, and responds with the status and the message describing the error.
+func LogErrorAndWriteResponse(ctx context.Context, w http.ResponseWriter, status int, msg string, err error) {
+	log := log.FromContext(ctx)
+	log.Error(err, msg, "status", status)
+	writeResponse(ctx, w, status, fmt.Sprintf("%s: %s", msg, err.Error()))
+}
+
+// LogDebugAndWriteResponse logs the message on the debug level using the logger from the context, i.e. with
+// the request ID and the other fields of the request, and responds with the status and the message.
+func LogDebugAndWriteResponse(ctx context.Context, w http.ResponseWriter, status int, msg string, keysAndValues ...interface{}) {
+	log := log.FromContext(ctx)
+	log.V(logs.DebugLevel).Info(msg, append(keysAndValues, "status", status)...)
+	writeResponse(ctx, w, status, msg)
+}
+
+// writeResponse writes the plain text response with the status.
+func writeResponse(ctx context.Context, w http.ResponseWriter, status int, body string) {
+	// the headers need to be set before the status is written, otherwise they're ignored
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := fmt.Fprint(w, body); err != nil {
+		log.FromContext(ctx).Error(err, "error recording response error message")
+	}
+}
+
+// AuditLogWithTokenInfo logs message related to particular SPIAccessToken into audit logger
+func AuditLogWithTokenInfo(ctx context.Context, msg string, namespace string, token string, keysAndValues ...interface{}) {
+	keysAndValues = append(keysAndValues, "namespace", namespace, "token", token)
+	AuditLog(ctx).Info(msg, keysAndValues...)
+}
+
+// AuditLog returns logger prepared with audit markers
+func AuditLog(ctx context.Context) logr.Logger {
+	return log.FromContext(ctx, "audit", "true")
+}
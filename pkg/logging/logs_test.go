@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestWithRequestId(t *testing.T) {
+	var logged []string
+	logger := funcr.New(func(prefix, args string) {
+		logged = append(logged, args)
+	}, funcr.Options{})
+
+	var requestId string
+	handler := WithRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId = RequestIdFromContext(r.Context())
+		ctx := WithTokenLogFields(r.Context(), "default", "mytoken")
+		LogErrorAndWriteResponse(ctx, w, http.StatusBadRequest, "failed", errors.New("bad things"))
+	}))
+
+	t.Run("generates request ID", func(t *testing.T) {
+		logged = nil
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil).WithContext(log.IntoContext(context.TODO(), logger)))
+
+		assert.Len(t, requestId, 22)
+		assert.Equal(t, requestId, rr.Header().Get(RequestIdHeader))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+		assert.Equal(t, "failed: bad things", rr.Body.String())
+		if assert.Len(t, logged, 1) {
+			assert.Contains(t, logged[0], `"requestId"="`+requestId+`"`)
+			assert.Contains(t, logged[0], `"tokenNamespace"="default" "tokenName"="mytoken"`)
+			assert.Contains(t, logged[0], `"status"=400`)
+		}
+	})
+
+	t.Run("uses incoming request ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIdHeader, "abc-123")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, "abc-123", requestId)
+		assert.Equal(t, "abc-123", rr.Header().Get(RequestIdHeader))
+	})
+
+	t.Run("ignores invalid incoming request ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIdHeader, "abc 123\n")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		assert.NotEqual(t, "abc 123\n", requestId)
+		assert.Len(t, requestId, 22)
+	})
+}
+
+func TestLogDebugAndWriteResponse(t *testing.T) {
+	rr := httptest.NewRecorder()
+	LogDebugAndWriteResponse(context.TODO(), rr, http.StatusNotFound, "not here")
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "not here", rr.Body.String())
+	assert.Empty(t, RequestIdFromContext(context.TODO()))
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/redhat-appstudio/service-provider-integration-operator/pkg/logs"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// statusRecordingResponseWriter remembers the status and the size of the response for the request log.
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecordingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err //nolint:wrapcheck // we're just a transparent wrapper here
+}
+
+// WithRequestLogging is a middleware logging the handled requests on the debug level using the logger from the request
+// context. The query of the request is not logged because it can contain the OAuth state or the Kubernetes token.
+func WithRequestLogging(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &statusRecordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rw, r)
+
+		log.FromContext(r.Context()).V(logs.DebugLevel).Info("request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.status,
+			"size", rw.size,
+			"duration", time.Since(start),
+			"remoteAddr", r.RemoteAddr,
+			"userAgent", r.UserAgent())
+	})
+}
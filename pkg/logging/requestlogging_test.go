@@ -0,0 +1,51 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func TestWithRequestLogging(t *testing.T) {
+	var logged []string
+	logger := funcr.New(func(prefix, args string) {
+		logged = append(logged, args)
+	}, funcr.Options{Verbosity: 10})
+
+	handler := WithRequestLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	}))
+
+	req := httptest.NewRequest("GET", "/github/authenticate?k8s_token=secret", nil)
+	req = req.WithContext(log.IntoContext(context.TODO(), logger))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTeapot, rr.Code)
+	if assert.Len(t, logged, 1) {
+		assert.Contains(t, logged[0], `"path"="/github/authenticate"`)
+		assert.Contains(t, logged[0], `"status"=418`)
+		assert.Contains(t, logged[0], `"size"=15`)
+		assert.False(t, strings.Contains(logged[0], "secret"))
+	}
+}
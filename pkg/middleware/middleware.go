@@ -0,0 +1,39 @@
+// Copyright (c) 2021 Red Hat, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package middleware contains the middleware applied to all the requests of the SPI services.
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/handlers"
+	"github.com/redhat-appstudio/service-provider-integration-oauth/pkg/logging"
+)
+
+// CsrfHeaderName is the header carrying the anti-CSRF token of the SPI services. The UIs on the allowed origins need
+// to both read it from the responses and send it with the requests.
+const CsrfHeaderName = "X-CSRF-Token"
+
+// MiddlewareHandler is a Handler that composed couple of different responsibilities.
+// Like:
+// - Request ID assignment
+// - Request logging
+// - CORS processing
+func MiddlewareHandler(allowedOrigins []string, h http.Handler) http.Handler {
+	return logging.WithRequestId(logging.WithRequestLogging(
+		handlers.CORS(handlers.AllowedOrigins(allowedOrigins),
+			handlers.AllowCredentials(),
+			handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Language", "Content-Type", "Origin", "Authorization", logging.RequestIdHeader, CsrfHeaderName}),
+			handlers.ExposedHeaders([]string{logging.RequestIdHeader, CsrfHeaderName}))(h)))
+}